@@ -15,6 +15,8 @@
 package bootstrap
 
 import (
+	"fmt"
+	"io/ioutil"
 	"strings"
 
 	"istio.io/istio/pilot/pkg/leaderelection"
@@ -35,6 +37,19 @@ var (
 		"Name of validatingwebhookconfiguration to patch. Empty will skip using cluster admin to patch.")
 
 	validationEnabled = env.RegisterBoolVar("VALIDATION_ENABLED", true, "Enable config validation handler.")
+
+	webhookTLSMinVersion = env.RegisterStringVar("WEBHOOK_TLS_MIN_VERSION", "",
+		"Minimum TLS version accepted by the secure webhook server, one of 1.0, 1.1, 1.2 or 1.3. It applies to "+
+			"all the webhooks served by Istiod, including sidecar injection, but is only read if VALIDATION_ENABLED is set.")
+
+	webhookTLSCipherSuites = env.RegisterStringVar("WEBHOOK_TLS_CIPHER_SUITES", "",
+		"Comma separated names of the TLS cipher suites allowed by the secure webhook server. It applies to "+
+			"all the webhooks served by Istiod, including sidecar injection, but is only read if VALIDATION_ENABLED is set.")
+
+	validationClientCAFile = env.RegisterStringVar("VALIDATION_WEBHOOK_CLIENT_CA_FILE", "",
+		"Path of the PEM encoded CA bundle the client certificates of validation requests are verified against, "+
+			"typically the one of the Kubernetes API server. If set, validation requests without a valid client "+
+			"certificate are rejected. The other webhooks served by Istiod do not require client certificates.")
 )
 
 func (s *Server) initConfigValidation(args *PilotArgs) error {
@@ -52,11 +67,34 @@ func (s *Server) initConfigValidation(args *PilotArgs) error {
 		Schemas:      collections.Istio,
 		DomainSuffix: args.RegistryOptions.KubeOptions.DomainSuffix,
 		Mux:          s.httpsMux,
+
+		TLSMinVersion: webhookTLSMinVersion.Get(),
+	}
+	if suites := webhookTLSCipherSuites.Get(); suites != "" {
+		params.TLSCipherSuites = strings.Split(suites, ",")
+	}
+	// Client certificates are only available if TLS is terminated by the secure webhook server.
+	if caFile := validationClientCAFile.Get(); caFile != "" && s.httpsServer != nil {
+		bundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read validation webhook client CA bundle: %v", err)
+		}
+		params.ClientCABundle = bundle
 	}
 	whServer, err := server.New(params)
 	if err != nil {
 		return err
 	}
+	// The validation webhook shares the secure webhook server, so the TLS version and cipher settings apply to
+	// all of it, while client certificates are only verified by the validation handlers. Without it, TLS is
+	// handled in front of Istiod.
+	if s.httpsServer != nil {
+		if err := params.ApplyTLSConfig(s.httpsServer.TLSConfig); err != nil {
+			return err
+		}
+	} else if params.TLSMinVersion != "" || len(params.TLSCipherSuites) > 0 || validationClientCAFile.Get() != "" {
+		log.Warn("ignoring webhook TLS settings, the secure webhook server is disabled")
+	}
 
 	s.addStartFunc(func(stop <-chan struct{}) error {
 		whServer.Run(stop)
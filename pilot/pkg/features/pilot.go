@@ -15,13 +15,21 @@
 package features
 
 import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/duration"
 
+	networking "istio.io/api/networking/v1alpha3"
+
 	"istio.io/istio/pkg/jwt"
+	"istio.io/istio/pkg/util/gogoprotomarshal"
 	"istio.io/pkg/env"
+	"istio.io/pkg/log"
 )
 
 var (
@@ -76,6 +84,13 @@ var (
 			" EDS pushes may be delayed, but there will be fewer pushes. By default this is enabled",
 	)
 
+	EndpointStreamDebounce = env.RegisterDurationVar(
+		"PILOT_ENDPOINT_STREAM_DEBOUNCE",
+		100*time.Millisecond,
+		"The window in which endpoint snapshots sent to an endpoint update stream are merged. Only the "+
+			"latest snapshot of each window is applied, so each stream triggers at most one push per window.",
+	).Get()
+
 	// HTTP10 will add "accept_http_10" to http outbound listeners. Can also be set only for specific sidecars via meta.
 	//
 	// Alpha in 1.1, may become the default or be turned into a Sidecar API or mesh setting. Only applies to namespaces
@@ -347,6 +362,386 @@ var (
 	XDSCacheMaxSize = env.RegisterIntVar("PILOT_XDS_CACHE_SIZE", 20000,
 		"The maximum number of cache entries for the XDS cache. If the size is <= 0, the cache will have no upper bound.").Get()
 
+	SkipUnchangedEDSPushes = env.RegisterBoolVar("PILOT_SKIP_UNCHANGED_EDS_PUSHES", false,
+		"If true, Pilot will not send an incremental EDS push to a proxy when the generated endpoints are "+
+			"identical to the last ones sent on that connection. EDS is always sent on full pushes, as Envoy "+
+			"needs it to finish warming updated clusters.").Get()
+
+	EDSMaxResponseBytes = env.RegisterIntVar("PILOT_EDS_MAX_RESPONSE_BYTES", 0,
+		"If > 0, EDS pushes whose resources exceed this size, in bytes, are split across several responses of "+
+			"the same version, each within the size unless it holds a single larger resource. This keeps pushes of "+
+			"many clusters below the gRPC message size limit. If <= 0, all resources are sent in a single response.").Get()
+
+	TopServicesByEndpoints = env.RegisterIntVar("PILOT_TOP_SERVICES_BY_ENDPOINTS", 0,
+		"If > 0, Pilot will periodically log and report metrics for this number of services with the most "+
+			"endpoints, to spot services which have grown unexpectedly.").Get()
+
+	TopServicesByEndpointsInterval = env.RegisterDurationVar("PILOT_TOP_SERVICES_BY_ENDPOINTS_INTERVAL", 5*time.Minute,
+		"The interval at which the services with the most endpoints are reported, if "+
+			"PILOT_TOP_SERVICES_BY_ENDPOINTS is enabled.").Get()
+
+	LocalityLBMaxFailoverDepth = env.RegisterIntVar("PILOT_LOCALITY_LB_MAX_FAILOVER_DEPTH", 0,
+		"The maximum number of priority levels locality failover may fall back to, beyond the proxy's own "+
+			"locality. Localities with a lower priority are excluded. If <= 0, all priority levels are kept.").Get()
+
+	LocalityLBFailoverScope = env.RegisterStringVar("PILOT_LOCALITY_LB_FAILOVER_SCOPE", "",
+		"The scope locality failover is confined to. If set to 'region', the endpoints of other regions than the "+
+			"proxy's are excluded, so failover happens across zones and subzones, but never leaves the region. "+
+			"If empty, failover is not confined.").Get()
+
+	LocalityLabelDelimiter = env.RegisterStringVar("PILOT_LOCALITY_LABEL_DELIMITER", "/",
+		"The delimiter separating region, zone and subzone in endpoint locality labels. Only needed for "+
+			"registries which encode locality with a separator other than '/'.").Get()
+
+	FlakyEndpointWindow = env.RegisterDurationVar("PILOT_FLAKY_ENDPOINT_WINDOW", 0,
+		"If set, endpoints which became ready or not ready at least PILOT_FLAKY_ENDPOINT_FLIPS times within "+
+			"this window are considered flaky and get a reduced load balancing weight. The load assignments are "+
+			"not cached while enabled, as flaky endpoints recover over time. Disabled by default.").Get()
+
+	FlakyEndpointFlips = env.RegisterIntVar("PILOT_FLAKY_ENDPOINT_FLIPS", 3,
+		"The number of readiness flips within PILOT_FLAKY_ENDPOINT_WINDOW after which an endpoint is flaky.").Get()
+
+	FlakyEndpointWeightFactor = env.RegisterIntVar("PILOT_FLAKY_ENDPOINT_WEIGHT_FACTOR", 10,
+		"The factor by which the load balancing weight of flaky endpoints is divided, down to 1. Endpoints "+
+			"with a weight of 1, the default unless PILOT_DEFAULT_ENDPOINT_WEIGHT is set, cannot be "+
+			"deprioritized. Only used if PILOT_FLAKY_ENDPOINT_WINDOW is set.").Get()
+
+	PreferredLocality = env.RegisterStringVar("PILOT_PREFERRED_LOCALITY", "",
+		"The locality, in region/zone/subzone form, whose endpoints receive more traffic by the "+
+			"PILOT_PREFERRED_LOCALITY_WEIGHT_MULTIPLIER. Zone and subzone may be omitted or '*' to match any.").Get()
+
+	PreferredLocalityWeightMultiplier = env.RegisterFloatVar("PILOT_PREFERRED_LOCALITY_WEIGHT_MULTIPLIER", 1.0,
+		"The multiplier applied to the load balancing weight of endpoints in the PILOT_PREFERRED_LOCALITY. "+
+			"It only applies to clusters with locality weighted load balancing, which is enabled for clusters "+
+			"with outlier detection and locality load balancing, or with zone weights.").Get()
+
+	EndpointTransportSocketMatchLabels = func() []string {
+		v := env.RegisterStringVar("PILOT_ENDPOINT_TRANSPORT_SOCKET_MATCH_LABELS", "",
+			"Comma separated list of endpoint label keys. The values of these labels are added to the "+
+				"envoy.transport_socket_match metadata of each endpoint, alongside tlsMode, so that custom "+
+				"transport socket matches can select endpoints by them.").Get()
+		var keys []string
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}()
+
+	EndpointFilterMetadataLabelPrefixes = func() map[string]string {
+		v := env.RegisterStringVar("PILOT_ENDPOINT_FILTER_METADATA_LABEL_PREFIXES", "",
+			"Comma separated list of label prefix to filter metadata namespace mappings, such as "+
+				"'envoy.filter.foo/=foo'. Endpoint labels starting with a prefix are added, without the "+
+				"prefix, to the filter metadata of the endpoint under the mapped namespace.").Get()
+		prefixes := map[string]string{}
+		for _, m := range strings.Split(v, ",") {
+			parts := strings.SplitN(m, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			prefix, namespace := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			if prefix != "" && namespace != "" {
+				prefixes[prefix] = namespace
+			}
+		}
+		return prefixes
+	}()
+
+	EndpointConnectionPoolLabelPrefix = env.RegisterStringVar("PILOT_ENDPOINT_CONNECTION_POOL_LABEL_PREFIX", "",
+		"Advanced: if set, such as 'connectionpool.example.com/', endpoint labels starting with this prefix are "+
+			"added, without the prefix, to the istio.connection_pool filter metadata of the endpoint. Istio does "+
+			"not apply them: they are per-endpoint connection pool hints for custom Envoy configuration, such as "+
+			"an EnvoyFilter, to consume.").Get()
+
+	EndpointCanaryWeightLabel = env.RegisterStringVar("PILOT_ENDPOINT_CANARY_WEIGHT_LABEL", "",
+		"Advanced: if set, such as 'rollout.example.com/canary-weight', the value of this endpoint label, a percentage "+
+			"between 0 and 100, is added as a number under the weight key of the istio.canary filter metadata of the "+
+			"endpoint. Istio does not use it and it does not change the load balancing weight: it is meant for "+
+			"progressive delivery controllers reading the canary endpoints over xDS.").Get()
+
+	EDSGenerationWorkers = env.RegisterIntVar("PILOT_EDS_GENERATION_WORKERS", 1,
+		"The number of workers generating the endpoints of the clusters of a single connection in parallel. "+
+			"Only used for pushes of at least 100 clusters. If <= 1, endpoints are generated serially.").Get()
+
+	EDSCaptureDir = env.RegisterStringVar("PILOT_EDS_CAPTURE_DIR", "",
+		"If set, the inputs and result of generating the endpoints of the PILOT_EDS_CAPTURE_CLUSTERS are "+
+			"written to this directory, so they can be replayed in tests. Only meant for debugging.").Get()
+
+	EnableEndpointOverrides = env.RegisterBoolVar("PILOT_ENABLE_ENDPOINT_OVERRIDES", false,
+		"If enabled, the /debug/endpoint_overridez debug API can temporarily replace the endpoints of a cluster "+
+			"sent to a single proxy, for testing failure scenarios. Only meant for testing.").Get()
+
+	EDSCaptureClusters = func() []string {
+		v := env.RegisterStringVar("PILOT_EDS_CAPTURE_CLUSTERS", "",
+			"Comma separated list of cluster names whose endpoints are captured to PILOT_EDS_CAPTURE_DIR.").Get()
+		var clusters []string
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				clusters = append(clusters, c)
+			}
+		}
+		return clusters
+	}()
+
+	MaxShardsPerService = env.RegisterIntVar("PILOT_MAX_SHARDS_PER_SERVICE", 0,
+		"The maximum number of shards (clusters) tracked for the endpoints of a service. Once exceeded, the "+
+			"least recently updated shard is evicted. If <= 0, the number of shards is not limited.").Get()
+
+	EndpointShardDeletionGracePeriod = env.RegisterDurationVar("PILOT_ENDPOINT_SHARD_DELETION_GRACE_PERIOD", 0,
+		"If set, the endpoint shard of a cluster whose endpoints of a service dropped to zero is retained empty for "+
+			"this period before it is deleted, so services briefly scaling to zero reuse it. Expired shards are "+
+			"deleted on the next update of the service.").Get()
+
+	ServiceAccountFullPushWindow = env.RegisterDurationVar("PILOT_SERVICE_ACCOUNT_FULL_PUSH_WINDOW", 0,
+		"If set, the full pushes triggered by changes of the service accounts of a service are limited to one per "+
+			"window. Later changes within the window are coalesced into a single full push at the end of the "+
+			"window, avoiding full push storms during rollouts changing identities. Disabled by default.").Get()
+
+	EDSPushLoopThreshold = env.RegisterIntVar("PILOT_EDS_PUSH_LOOP_THRESHOLD", 0,
+		"If set, a service pushed by endpoint updates more than this many times in a PILOT_EDS_PUSH_LOOP_WINDOW is "+
+			"considered to be in a push loop, e.g. because of a misconfiguration where pushes trigger endpoint "+
+			"updates. Its pushes are then held back for a window, doubling up to 32 windows while the rate stays "+
+			"high, and a single push is sent at the end of each backoff. Disabled by default.").Get()
+
+	EDSPushLoopWindow = env.RegisterDurationVar("PILOT_EDS_PUSH_LOOP_WINDOW", 10*time.Second,
+		"The window over which the pushes of a service are counted to detect push loops, see "+
+			"PILOT_EDS_PUSH_LOOP_THRESHOLD.").Get()
+
+	EDSSkipTrace = env.RegisterBoolVar("PILOT_EDS_SKIP_TRACE", false,
+		"If enabled, every cluster whose endpoints are not sent in an EDS push is logged, with the reason why. "+
+			"This is very verbose, and meant for debugging proxies not getting endpoints.").Get()
+
+	EDSMinShards = env.RegisterIntVar("PILOT_EDS_MIN_SHARDS", 0,
+		"If set, endpoints of a service are only sent once this minimum number of clusters have reported "+
+			"endpoints for it at once, so multi-cluster services are not balanced to the first cluster reporting. "+
+			"Once reached, endpoints keep being sent if clusters go away. Until then, proxies keep the endpoints they have, and new proxies get none: their clusters only warm "+
+			"up once the threshold is met, or after the initial fetch timeout. Services deployed to fewer clusters "+
+			"never get endpoints, so this should not exceed the number of clusters of any service.").Get()
+
+	EDSPreload = env.RegisterBoolVar("PILOT_EDS_PRELOAD", false,
+		"If enabled, the endpoints of the clusters of all services are precomputed in the background after each full "+
+			"push, for each distinct profile of the connected proxies, so the first EDS push of a new connection is "+
+			"mostly served from the EDS cache. This requires PILOT_ENABLE_XDS_CACHE, and trades CPU and memory for "+
+			"a faster connection establishment.").Get()
+
+	EndpointShardCompactionInterval = env.RegisterDurationVar("PILOT_ENDPOINT_SHARD_COMPACTION_INTERVAL", 0,
+		"If set, the endpoint shards of services are compacted at this interval: the services without any shard "+
+			"left which no longer exist are removed, reclaiming memory after churn. Disabled by default.").Get()
+
+	MinEndpointsPerService = func() map[string]int {
+		v := env.RegisterStringVar("PILOT_MIN_ENDPOINTS_PER_SERVICE", "",
+			"Comma separated list of hostname=count pairs. Endpoint updates which would reduce the endpoints of "+
+				"the service below the count are rejected, and the previous endpoints are kept, as a safeguard "+
+				"against registries wrongly dropping endpoints. Deleting the service is not affected.").Get()
+		minimums := map[string]int{}
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			kv := strings.SplitN(entry, "=", 2)
+			if len(kv) != 2 {
+				log.Errorf("ignoring invalid entry %q of PILOT_MIN_ENDPOINTS_PER_SERVICE", entry)
+				continue
+			}
+			count, err := strconv.Atoi(kv[1])
+			if err != nil || count < 1 {
+				log.Errorf("ignoring invalid count of entry %q of PILOT_MIN_ENDPOINTS_PER_SERVICE", entry)
+				continue
+			}
+			minimums[kv[0]] = count
+		}
+		return minimums
+	}()
+
+	SortedEDSOutput = env.RegisterBoolVar("PILOT_SORTED_EDS_OUTPUT", false,
+		"If enabled, the localities of each ClusterLoadAssignment are sent by ascending priority, and the endpoints "+
+			"of each locality by descending weight. This has no effect on load balancing, but makes config dumps "+
+			"easier to read.").Get()
+
+	EndpointTLSModeCompatibility = env.RegisterStringVar("PILOT_ENDPOINT_TLS_MODE_COMPATIBILITY", "",
+		"How endpoints accepting Istio mutual TLS are sent to proxies which cannot originate it, as declared by "+
+			"their DISABLE_MTLS metadata. If 'downgrade', their tlsMode metadata is set to disabled, so plaintext is "+
+			"used. If 'exclude', they are not sent. By default, their metadata is sent unchanged.").Get()
+
+	ZoneAwareEndpointWeights = env.RegisterBoolVar("PILOT_ZONE_AWARE_ENDPOINT_WEIGHTS", false,
+		"If enabled, locality weights are precomputed by Pilot for the clusters of proxyless gRPC clients without "+
+			"locality failover or distribution, so they keep as much traffic as possible in their zone, like the zone "+
+			"aware routing of Envoy.").Get()
+
+	GRPCFlattenLocalityPriorities = env.RegisterBoolVar("PILOT_GRPC_FLATTEN_LOCALITY_PRIORITIES", false,
+		"If enabled, the locality priorities of the endpoints sent to proxyless gRPC clients are flattened into "+
+			"endpoint and locality weights, so a weighted random picker approximates the locality preference: "+
+			"each priority receives a hundredth of the traffic of the priority above.").Get()
+
+	LocalityLoadFeedbackTTL = env.RegisterDurationVar("PILOT_LOCALITY_LOAD_FEEDBACK_TTL", 0,
+		"If set, the weight of each locality is scaled inversely to the load last reported for it through the "+
+			"locality load feedback API, for adaptive load balancing. Reports older than this are ignored, and "+
+			"endpoints are pushed again once they expire. Disabled by default.").Get()
+
+	ProxyEndpointOrdering = env.RegisterBoolVar("PILOT_PROXY_ENDPOINT_ORDERING", false,
+		"If enabled, the endpoints of each locality are sent in an order specific to the proxy, which is stable "+
+			"across pushes. This improves connection reuse, but the endpoints are no longer shared between proxies "+
+			"in the EDS cache.").Get()
+
+	EndpointAuditLog = env.RegisterBoolVar("PILOT_ENDPOINT_AUDIT_LOG", false,
+		"If enabled, changes of the endpoint membership of services are logged as JSON audit records, with "+
+			"the addresses of the added and removed endpoints, to the endpointaudit log scope.").Get()
+
+	DefaultEndpointWeight = func() uint32 {
+		v := env.RegisterIntVar("PILOT_DEFAULT_ENDPOINT_WEIGHT", 1,
+			"The load balancing weight of endpoints without an explicit weight. Values lower than 1 are ignored.").Get()
+		if v < 1 {
+			return 1
+		}
+		if v > math.MaxUint32 {
+			return math.MaxUint32
+		}
+		return uint32(v)
+	}()
+
+	MeshDefaultTrafficPolicy = func() *networking.TrafficPolicy {
+		v := env.RegisterStringVar("PILOT_MESH_DEFAULT_TRAFFIC_POLICY", "",
+			"A traffic policy in JSON, applied to the clusters and endpoints of services without a DestinationRule "+
+				"as if a DestinationRule set it.").Get()
+		if v == "" {
+			return nil
+		}
+		policy := &networking.TrafficPolicy{}
+		if err := gogoprotomarshal.ApplyJSON(v, policy); err != nil {
+			log.Errorf("ignoring invalid PILOT_MESH_DEFAULT_TRAFFIC_POLICY: %v", err)
+			return nil
+		}
+		return policy
+	}()
+
+	NamespaceLocalityLbSettings = func() map[string]*networking.LocalityLoadBalancerSetting {
+		v := env.RegisterStringVar("PILOT_NAMESPACE_LOCALITY_LB_SETTINGS", "",
+			"A JSON object of locality load balancing settings keyed by namespace. The setting of a namespace "+
+				"applies to its services instead of the mesh config setting, and is overridden by DestinationRules.").Get()
+		if v == "" {
+			return nil
+		}
+		raw := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(v), &raw); err != nil {
+			log.Errorf("ignoring invalid PILOT_NAMESPACE_LOCALITY_LB_SETTINGS: %v", err)
+			return nil
+		}
+		settings := make(map[string]*networking.LocalityLoadBalancerSetting, len(raw))
+		for ns, setting := range raw {
+			lb := &networking.LocalityLoadBalancerSetting{}
+			if err := gogoprotomarshal.ApplyJSON(string(setting), lb); err != nil {
+				log.Errorf("ignoring invalid setting of namespace %s in PILOT_NAMESPACE_LOCALITY_LB_SETTINGS: %v", ns, err)
+				continue
+			}
+			settings[ns] = lb
+		}
+		return settings
+	}()
+
+	EDSOriginalDstMetadata = env.RegisterBoolVar("PILOT_EDS_ORIGINAL_DST_METADATA", false,
+		"If enabled, the endpoints of the passthrough clusters of gateways carry their address in the "+
+			"envoy.filters.listener.original_dst filter metadata, so original destination load balancing "+
+			"configured with this metadata key routes to them.").Get()
+
+	NetworkFilterExemptClusters = func() map[string]struct{} {
+		v := env.RegisterStringVar("PILOT_NETWORK_FILTER_EXEMPT_CLUSTERS", "",
+			"Comma separated list of cluster names whose endpoints are not filtered by network. The proxies see "+
+				"all the endpoints of these clusters regardless of their network, for example for services "+
+				"reachable from all networks through an anycast address.").Get()
+		clusters := map[string]struct{}{}
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				clusters[c] = struct{}{}
+			}
+		}
+		return clusters
+	}()
+
+	SelfEndpointClusters = func() map[string]struct{} {
+		v := env.RegisterStringVar("PILOT_SELF_ENDPOINT_CLUSTERS", "",
+			"Comma separated list of cluster names for which a synthetic endpoint pointing at the proxy itself is "+
+				"added to the endpoints sent to the proxy. The endpoint is marked with the 'synthetic' field "+
+				"of the istio filter metadata.").Get()
+		clusters := map[string]struct{}{}
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				clusters[c] = struct{}{}
+			}
+		}
+		return clusters
+	}()
+
+	ClusterLocalNamespaces = func() map[string]struct{} {
+		v := env.RegisterStringVar("PILOT_CLUSTER_LOCAL_NAMESPACES", "",
+			"Comma separated list of namespaces whose services are cluster-local, in addition to the cluster-local "+
+				"hosts of the mesh config. Proxies only get the endpoints of these services in their own cluster.").Get()
+		namespaces := map[string]struct{}{}
+		for _, ns := range strings.Split(v, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces[ns] = struct{}{}
+			}
+		}
+		return namespaces
+	}()
+
+	ClusterLocalLabels = func() map[string]string {
+		v := env.RegisterStringVar("PILOT_CLUSTER_LOCAL_LABELS", "",
+			"Comma separated list of key=value labels. Endpoints with all of these labels are cluster-local: "+
+				"proxies only get them if they are in the same cluster. If empty, no endpoint is selected.").Get()
+		selector := map[string]string{}
+		for _, l := range strings.Split(v, ",") {
+			if l = strings.TrimSpace(l); l == "" {
+				continue
+			}
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				log.Errorf("ignoring invalid label %q of PILOT_CLUSTER_LOCAL_LABELS", l)
+				continue
+			}
+			selector[kv[0]] = kv[1]
+		}
+		return selector
+	}()
+
+	EndpointTierLabel = env.RegisterStringVar("PILOT_ENDPOINT_TIER_LABEL", "",
+		"If set, endpoints are prioritized by the value of this label, e.g. istio.io/tier, instead of their "+
+			"locality: tier 0 is served first, higher tiers are used for failover. Endpoints without the label are "+
+			"in tier 0, endpoints with a value which is not a non-negative integer are excluded.").Get()
+
+	EndpointSpotInstanceLabel = env.RegisterStringVar("PILOT_ENDPOINT_SPOT_INSTANCE_LABEL", "",
+		"Advanced: if set, such as 'node.example.com/spot', endpoints with this label set to \"true\" are on spot or "+
+			"preemptible nodes. All endpoints then carry a spot key, \"true\" or \"false\", in their envoy.lb filter "+
+			"metadata, so subset load balancing can route critical requests to stable nodes.").Get()
+
+	EndpointOutlierExemptLabel = env.RegisterStringVar("PILOT_ENDPOINT_OUTLIER_EXEMPT_LABEL", "",
+		"Advanced: if set, such as 'example.com/outlier-exempt', endpoints with this label set to \"true\" carry an "+
+			"exempt key set to true in their istio.outlier_detection filter metadata, so outlier detection "+
+			"extensions do not eject them, e.g. a canary being monitored. The outlier detection built into Envoy "+
+			"has no per endpoint exemption, and ignores this metadata.").Get()
+
+	DeprioritizeSpotEndpoints = env.RegisterBoolVar("PILOT_DEPRIORITIZE_SPOT_ENDPOINTS", false,
+		"If enabled along with PILOT_ENDPOINT_SPOT_INSTANCE_LABEL, the endpoints on spot nodes are given a lower "+
+			"priority than the other endpoints of their tier, and only used for failover. Like endpoint tiers, "+
+			"this replaces the prioritization of endpoints by locality.").Get()
+
+	DrainingNodeEndpointLabel = env.RegisterStringVar("PILOT_DRAINING_NODE_ENDPOINT_LABEL", "",
+		"If set, endpoints with this label set to \"true\", e.g. by a controller labeling the pods of cordoned "+
+			"nodes, are sent with the DRAINING health status, so new traffic prefers the endpoints of other nodes.").Get()
+
+	EmptySubsetMatchesNone = env.RegisterBoolVar("PILOT_EMPTY_SUBSET_MATCHES_NONE", false,
+		"If enabled, a DestinationRule subset without labels selects no endpoints, instead of all the endpoints "+
+			"of the service, so subsets missing their labels by mistake do not silently receive all traffic.").Get()
+
+	EmptyServicePortNameFallback = env.RegisterBoolVar("PILOT_EMPTY_SERVICE_PORT_NAME_FALLBACK", false,
+		"If enabled, endpoints without a service port name are matched to the port of services that have a single "+
+			"port, with a warning logged once per service, instead of being left out of the cluster. Services with "+
+			"several ports always require the port name to match.").Get()
+
+	FlatEndpointLocality = env.RegisterBoolVar("PILOT_FLAT_EDS_LOCALITY", false,
+		"If enabled, the endpoints of clusters without locality load balancing are sent in a single group with "+
+			"an empty locality, which reduces the size of the EDS config.").Get()
+
 	AllowMetadataCertsInMutualTLS = env.RegisterBoolVar("PILOT_ALLOW_METADATA_CERTS_DR_MUTUAL_TLS", false,
 		"If true, Pilot will allow certs specified in Metadata to override DR certs in MUTUAL TLS mode. "+
 			"This is only enabled for migration and will be removed soon.").Get()
@@ -495,6 +495,14 @@ type NodeMetadata struct {
 	// ProxyXDSViaAgent indicates that xds data is being proxied via the agent
 	ProxyXDSViaAgent string `json:"PROXY_XDS_VIA_AGENT,omitempty"`
 
+	// DisableMTLS indicates the proxy cannot originate Istio mutual TLS, for example because it has no
+	// workload certificate.
+	DisableMTLS StringBool `json:"DISABLE_MTLS,omitempty"`
+
+	// IPFamilyPreference is the address family, IPv4 or IPv6, preferred by the proxy for the endpoints of
+	// dual-stack workloads. Workloads with addresses in a single family are not affected.
+	IPFamilyPreference string `json:"IP_FAMILY_PREFERENCE,omitempty"`
+
 	// Contains a copy of the raw metadata. This is needed to lookup arbitrary values.
 	// If a value is known ahead of time it should be added to the struct rather than reading from here,
 	Raw map[string]interface{} `json:"-"`
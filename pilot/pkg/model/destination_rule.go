@@ -22,6 +22,11 @@ import (
 	"istio.io/istio/pkg/config/visibility"
 )
 
+// DisableNetworkFilterAnnotation is the name of the annotation which, when set to "true" on a DestinationRule,
+// exempts the clusters of its host from the network filtering of endpoints: proxies see all the endpoints
+// regardless of their network.
+const DisableNetworkFilterAnnotation = "networking.istio.io/disableNetworkFilter"
+
 // This function merges one or more destination rules for a given host string
 // into a single destination rule. Note that it does not perform inheritance style merging.
 // IOW, given three dest rules (*.foo.com, *.foo.com, *.com), calling this function for
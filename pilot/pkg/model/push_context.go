@@ -267,6 +267,14 @@ type XDSUpdater interface {
 	ProxyUpdate(clusterID, ip string)
 }
 
+// NamespaceUpdater is optionally implemented by an XDSUpdater which tracks the phase of namespaces.
+// Registries supporting namespaces notify it when a namespace starts or stops terminating.
+type NamespaceUpdater interface {
+	// NamespaceUpdate is called when a namespace of the cluster is added, updated or deleted. Terminating
+	// is true while the namespace is being deleted.
+	NamespaceUpdate(clusterID, namespace string, terminating bool)
+}
+
 // PushRequest defines a request to push to proxies
 // It is used to send updates to the config update debouncer and pass to the PushQueue.
 type PushRequest struct {
@@ -299,6 +307,11 @@ type PushRequest struct {
 	// There should only be multiple reasons if the push request is the result of two distinct triggers, rather than
 	// classifying a single trigger as having multiple reasons.
 	Reason []TriggerReason
+
+	// ForceEds pushes the endpoints of all the clusters watched by the proxies on incremental pushes, and even
+	// if they did not change since the last push. Otherwise, incremental pushes only push the endpoints of the
+	// services in ConfigsUpdated.
+	ForceEds bool
 }
 
 type TriggerReason string
@@ -343,6 +356,9 @@ func (first *PushRequest) Merge(other *PushRequest) *PushRequest {
 
 		// Merge the two reasons. Note that we shouldn't deduplicate here, or we would under count
 		Reason: append(first.Reason, other.Reason...),
+
+		// A forced push must not be lost by merging it
+		ForceEds: first.ForceEds || other.ForceEds,
 	}
 
 	// Do not merge when any one is empty
@@ -459,6 +475,18 @@ var (
 		"Number of clusters without instances.",
 	)
 
+	// ProxyStatusClusterExcludedEndpoints tracks clusters with endpoints excluded by the EndpointExcludeLabel.
+	ProxyStatusClusterExcludedEndpoints = monitoring.NewGauge(
+		"pilot_eds_excluded_endpoints",
+		"Number of clusters with endpoints excluded from load balancing.",
+	)
+
+	// ProxyStatusClusterUnknownSubset tracks subset clusters whose subset is not defined by the DestinationRule.
+	ProxyStatusClusterUnknownSubset = monitoring.NewGauge(
+		"pilot_eds_unknown_subsets",
+		"Number of subset clusters whose subset is not defined by the DestinationRule of the service.",
+	)
+
 	// DuplicatedDomains tracks rejected VirtualServices due to duplicated hostname.
 	DuplicatedDomains = monitoring.NewGauge(
 		"pilot_vservice_dup_domain",
@@ -495,6 +523,8 @@ var (
 		ProxyStatusConflictInboundListener,
 		DuplicatedClusters,
 		ProxyStatusClusterNoInstances,
+		ProxyStatusClusterExcludedEndpoints,
+		ProxyStatusClusterUnknownSubset,
 		DuplicatedDomains,
 		DuplicatedSubsets,
 	}
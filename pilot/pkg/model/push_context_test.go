@@ -98,6 +98,12 @@ func TestMergeUpdateRequest(t *testing.T) {
 				Kind: config.GroupVersionKind{Kind: "cfg2"}}: {}}},
 			PushRequest{Full: true, ConfigsUpdated: nil},
 		},
+		{
+			"forced eds push",
+			&PushRequest{Full: false, ForceEds: true},
+			&PushRequest{Full: false},
+			PushRequest{Full: false, ForceEds: true},
+		},
 	}
 
 	for _, tt := range cases {
@@ -160,6 +160,14 @@ const (
 
 	// IstioCanonicalServiceRevisionLabelName is the name of label for the Istio Canonical Service revision for a workload instance.
 	IstioCanonicalServiceRevisionLabelName = "service.istio.io/canonical-revision"
+
+	// EndpointExcludeLabel is the name of the label which, when set to "true", takes a workload instance out of
+	// rotation. The endpoint is not sent to any proxy, for example while the workload is under maintenance.
+	EndpointExcludeLabel = "istio.io/exclude"
+
+	// EndpointHealthCheckPortLabel is the name of the label setting an alternative port on which Envoy health
+	// checks a workload instance, for workloads serving health checks apart from their traffic.
+	EndpointHealthCheckPortLabel = "networking.istio.io/healthCheckPort"
 )
 
 // Port represents a network port where a service is listening for
@@ -294,6 +302,9 @@ func WorkloadInstancesEqual(first, second *WorkloadInstance) bool {
 	if first.Endpoint.UID != second.Endpoint.UID {
 		return false
 	}
+	if first.Endpoint.PendingEviction != second.Endpoint.PendingEviction {
+		return false
+	}
 	if first.Namespace != second.Namespace {
 		return false
 	}
@@ -335,9 +346,16 @@ func GetLocalityLabelOrDefault(label, defaultLabel string) string {
 
 // Locality information for an IstioEndpoint
 type Locality struct {
-	// Label for locality on the endpoint. This is a "/" separated string.
+	// Label for locality on the endpoint. This is a "/" separated string, unless a different
+	// delimiter is configured with PILOT_LOCALITY_LABEL_DELIMITER.
 	Label string
 
+	// Region, Zone and SubZone of the endpoint, for registries providing them as separate fields. If any of
+	// them is set, they are used as is instead of parsing Label, so they may even contain the delimiter.
+	Region  string
+	Zone    string
+	SubZone string
+
 	// ClusterID where the endpoint is located
 	ClusterID string
 }
@@ -396,6 +414,10 @@ type IstioEndpoint struct {
 
 	// TLSMode endpoint is injected with istio sidecar and ready to configure Istio mTLS
 	TLSMode string
+
+	// PendingEviction is set when the workload is about to be evicted for a voluntary disruption, such as one
+	// allowed by a pod disruption budget. Such endpoints are drained, so they get no new traffic.
+	PendingEviction bool
 }
 
 // ServiceAttributes represents a group of custom attributes of the service.
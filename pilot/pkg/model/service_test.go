@@ -188,6 +188,8 @@ func TestWorkloadInstanceEqual(t *testing.T) {
 	differingLbWeight.Endpoint.LbWeight = 0
 	differingUID := exampleInstance.DeepCopy()
 	differingUID.Endpoint.UID = "UID-TWO"
+	differingPendingEviction := exampleInstance.DeepCopy()
+	differingPendingEviction.Endpoint.PendingEviction = true
 
 	cases := []struct {
 		comparer *WorkloadInstance
@@ -255,6 +257,12 @@ func TestWorkloadInstanceEqual(t *testing.T) {
 			shouldEq: false,
 			name:     "different UID",
 		},
+		{
+			comparer: exampleInstance.DeepCopy(),
+			comparee: differingPendingEviction.DeepCopy(),
+			shouldEq: false,
+			name:     "different PendingEviction",
+		},
 	}
 
 	for _, testCase := range cases {
@@ -29,6 +29,7 @@ import (
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/validation"
 	"istio.io/istio/pkg/util/gogo"
 )
 
@@ -58,13 +59,14 @@ func (cb *ClusterBuilder) applyDestinationRule(c *cluster.Cluster, clusterMode C
 	destinationRule := castDestinationRuleOrDefault(destRule)
 
 	opts := buildClusterOpts{
-		mesh:        cb.push.Mesh,
-		cluster:     c,
-		policy:      destinationRule.TrafficPolicy,
-		port:        port,
-		clusterMode: clusterMode,
-		direction:   model.TrafficDirectionOutbound,
-		proxy:       cb.proxy,
+		mesh:             cb.push.Mesh,
+		cluster:          c,
+		policy:           DestinationRuleTrafficPolicy(castDestinationRule(destRule)),
+		port:             port,
+		clusterMode:      clusterMode,
+		direction:        model.TrafficDirectionOutbound,
+		proxy:            cb.proxy,
+		serviceNamespace: service.Attributes.Namespace,
 	}
 
 	if clusterMode == DefaultClusterMode {
@@ -83,6 +85,7 @@ func (cb *ClusterBuilder) applyDestinationRule(c *cluster.Cluster, clusterMode C
 	// Apply EdsConfig if needed. This should be called after traffic policy is applied because, traffic policy might change
 	// discovery type.
 	maybeApplyEdsConfig(c)
+	applyZoneWeights(c, destRule)
 
 	var clusterMetadata *core.Metadata
 	if destRule != nil {
@@ -132,6 +135,7 @@ func (cb *ClusterBuilder) applyDestinationRule(c *cluster.Cluster, clusterMode C
 		applyTrafficPolicy(opts)
 
 		maybeApplyEdsConfig(subsetCluster)
+		applyZoneWeights(subsetCluster, destRule)
 
 		subsetCluster.Metadata = util.AddSubsetToMetadata(clusterMetadata, subset.Name)
 		subsetClusters = append(subsetClusters, subsetCluster)
@@ -412,6 +416,23 @@ func (cb *ClusterBuilder) defaultTrafficPolicy(discoveryType cluster.Cluster_Dis
 	}
 }
 
+// DestinationRuleTrafficPolicy returns the top-level traffic policy of the DestinationRule, or the mesh default
+// traffic policy set in PILOT_MESH_DEFAULT_TRAFFIC_POLICY for services without a DestinationRule.
+func DestinationRuleTrafficPolicy(destinationRule *networking.DestinationRule) *networking.TrafficPolicy {
+	if destinationRule == nil {
+		return features.MeshDefaultTrafficPolicy
+	}
+	return destinationRule.TrafficPolicy
+}
+
+// castDestinationRule returns the destination rule enclosed by the config, or nil if there is none.
+func castDestinationRule(config *config.Config) *networking.DestinationRule {
+	if config == nil {
+		return nil
+	}
+	return config.Spec.(*networking.DestinationRule)
+}
+
 // castDestinationRuleOrDefault returns the destination rule enclosed by the config, if not null.
 // Otherwise, return default (empty) DR.
 func castDestinationRuleOrDefault(config *config.Config) *networking.DestinationRule {
@@ -422,6 +443,23 @@ func castDestinationRuleOrDefault(config *config.Config) *networking.Destination
 	return &defaultDestinationRule
 }
 
+// applyZoneWeights enables locality weighted load balancing on EDS clusters of DestinationRules setting the
+// percentage of each zone, as EDS turns the percentages into locality weights.
+func applyZoneWeights(c *cluster.Cluster, destRule *config.Config) {
+	if destRule == nil || c.GetType() != cluster.Cluster_EDS {
+		return
+	}
+	if _, f := destRule.Annotations[validation.ZoneWeightsAnnotation]; !f {
+		return
+	}
+	if c.CommonLbConfig == nil {
+		c.CommonLbConfig = &cluster.Cluster_CommonLbConfig{}
+	}
+	c.CommonLbConfig.LocalityConfigSpecifier = &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+		LocalityWeightedLbConfig: &cluster.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+	}
+}
+
 // maybeApplyEdsConfig applies EdsClusterConfig on the passed in cluster if it is an EDS type of cluster.
 func maybeApplyEdsConfig(c *cluster.Cluster) {
 	switch v := c.ClusterDiscoveryType.(type) {
@@ -39,6 +39,7 @@ import (
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/config/validation"
 )
 
 func TestApplyDestinationRule(t *testing.T) {
@@ -584,6 +585,48 @@ func TestApplyEdsConfig(t *testing.T) {
 	}
 }
 
+func TestApplyZoneWeights(t *testing.T) {
+	zoneWeights := &config.Config{Meta: config.Meta{
+		Annotations: map[string]string{validation.ZoneWeightsAnnotation: "region1/zone1=100"},
+	}}
+	cases := []struct {
+		name     string
+		cluster  *cluster.Cluster
+		destRule *config.Config
+		weighted bool
+	}{
+		{
+			name:     "eds cluster with zone weights",
+			cluster:  &cluster.Cluster{Name: "foo", ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS}},
+			destRule: zoneWeights,
+			weighted: true,
+		},
+		{
+			name:     "eds cluster without zone weights",
+			cluster:  &cluster.Cluster{Name: "foo", ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS}},
+			destRule: &config.Config{},
+		},
+		{
+			name:    "eds cluster without destination rule",
+			cluster: &cluster.Cluster{Name: "foo", ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS}},
+		},
+		{
+			name:     "non eds type of cluster",
+			cluster:  &cluster.Cluster{Name: "foo", ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_STRICT_DNS}},
+			destRule: zoneWeights,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			applyZoneWeights(tt.cluster, tt.destRule)
+			if weighted := tt.cluster.GetCommonLbConfig().GetLocalityWeightedLbConfig() != nil; weighted != tt.weighted {
+				t.Errorf("Unexpected locality weighted lb config in cluster. want %v, got %v", tt.weighted, weighted)
+			}
+		})
+	}
+}
+
 func TestBuildDefaultCluster(t *testing.T) {
 	servicePort := &model.Port{
 		Name:     "default",
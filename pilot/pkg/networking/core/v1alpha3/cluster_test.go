@@ -1232,6 +1232,69 @@ func TestLocalityLBDestinationRuleOverride(t *testing.T) {
 	}
 }
 
+func TestMeshDefaultTrafficPolicyCluster(t *testing.T) {
+	g := NewWithT(t)
+	defer func(old *networking.TrafficPolicy) { features.MeshDefaultTrafficPolicy = old }(features.MeshDefaultTrafficPolicy)
+	features.MeshDefaultTrafficPolicy = &networking.TrafficPolicy{
+		OutlierDetection: &networking.OutlierDetection{
+			MinHealthPercent: 10,
+		},
+	}
+	testMesh.LocalityLbSetting = &networking.LocalityLoadBalancerSetting{}
+
+	build := func(destRule proto.Message) *cluster.Cluster {
+		return xdstest.ExtractCluster("outbound|8080||*.example.org",
+			buildTestClusters(clusterTest{t: t, serviceHostname: "*.example.org", serviceResolution: model.DNSLB, nodeType: model.SidecarProxy,
+				locality: &core.Locality{
+					Region:  "region1",
+					Zone:    "zone1",
+					SubZone: "subzone1",
+				}, mesh: testMesh, destRule: destRule}))
+	}
+
+	// Without a DestinationRule, the mesh default applies.
+	c := build(nil)
+	g.Expect(c.OutlierDetection).NotTo(BeNil())
+	g.Expect(c.CommonLbConfig.GetLocalityWeightedLbConfig()).NotTo(BeNil())
+	g.Expect(c.CommonLbConfig.HealthyPanicThreshold.GetValue()).To(Equal(float64(10)))
+
+	// A DestinationRule replaces the mesh default.
+	c = build(&networking.DestinationRule{
+		Host:          "*.example.org",
+		TrafficPolicy: &networking.TrafficPolicy{},
+	})
+	g.Expect(c.OutlierDetection).To(BeNil())
+	g.Expect(c.CommonLbConfig.GetLocalityWeightedLbConfig()).To(BeNil())
+}
+
+func TestNamespaceLocalityLB(t *testing.T) {
+	g := NewWithT(t)
+	defer func(old map[string]*networking.LocalityLoadBalancerSetting) {
+		features.NamespaceLocalityLbSettings = old
+	}(features.NamespaceLocalityLbSettings)
+	features.NamespaceLocalityLbSettings = map[string]*networking.LocalityLoadBalancerSetting{
+		TestServiceNamespace: {},
+	}
+	testMesh.LocalityLbSetting = nil
+
+	c := xdstest.ExtractCluster("outbound|8080||*.example.org",
+		buildTestClusters(clusterTest{t: t, serviceHostname: "*.example.org", serviceResolution: model.ClientSideLB, nodeType: model.SidecarProxy,
+			locality: &core.Locality{
+				Region:  "region1",
+				Zone:    "zone1",
+				SubZone: "subzone1",
+			}, mesh: testMesh,
+			destRule: &networking.DestinationRule{
+				Host: "*.example.org",
+				TrafficPolicy: &networking.TrafficPolicy{
+					OutlierDetection: &networking.OutlierDetection{
+						MinHealthPercent: 10,
+					},
+				},
+			}}))
+	g.Expect(c.CommonLbConfig.GetLocalityWeightedLbConfig()).NotTo(BeNil())
+}
+
 func TestGatewayLocalityLB(t *testing.T) {
 	g := NewWithT(t)
 	// Distribute locality loadbalancing setting
@@ -1794,7 +1857,7 @@ func TestApplyLoadBalancer(t *testing.T) {
 				defer func() { features.EnableRedisFilter = defaultValue }()
 			}
 
-			applyLoadBalancer(cluster, test.lbSettings, test.port, &proxy, &meshconfig.MeshConfig{})
+			applyLoadBalancer(cluster, test.lbSettings, test.port, "", &proxy, &meshconfig.MeshConfig{})
 
 			if cluster.LbPolicy != test.expectedLbPolicy {
 				t.Errorf("cluster LbPolicy %s != expected %s", cluster.LbPolicy, test.expectedLbPolicy)
@@ -24,13 +24,21 @@ import (
 	"github.com/golang/protobuf/ptypes/wrappers"
 
 	"istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/networking/util"
 )
 
+// GetLocalityLbSetting returns the locality load balancing setting of a service in the namespace, if enabled. The
+// setting of the DestinationRule takes precedence over the one of the namespace, set in
+// PILOT_NAMESPACE_LOCALITY_LB_SETTINGS, which takes precedence over the one of the mesh config.
 func GetLocalityLbSetting(
 	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	namespace string,
 	destrule *v1alpha3.LocalityLoadBalancerSetting,
 ) *v1alpha3.LocalityLoadBalancerSetting {
+	if ns, f := features.NamespaceLocalityLbSettings[namespace]; f {
+		mesh = ns
+	}
 	var enabled bool
 	// Locality lb is enabled if its not explicitly disabled in mesh global config
 	if mesh != nil && (mesh.Enabled == nil || mesh.Enabled.Value) {
@@ -66,23 +74,78 @@ func ApplyLocalityLBSetting(
 		return
 	}
 
-	// one of Distribute or Failover settings can be applied.
-	if localityLB.GetDistribute() != nil {
-		applyLocalityWeight(locality, loadAssignment, localityLB.GetDistribute())
-		// Failover needs outlier detection, otherwise Envoy will never drop down to a lower priority.
-		// Do not apply default failover when locality LB is disabled.
-	} else if enableFailover && (localityLB.Enabled == nil || localityLB.Enabled.Value) {
+	// Failover needs outlier detection, otherwise Envoy will never drop down to a lower priority.
+	// Do not apply default failover when locality LB is disabled.
+	failover := enableFailover && (localityLB.Enabled == nil || localityLB.Enabled.Value)
+	switch {
+	case localityLB.GetDistribute() != nil && failover && len(localityLB.GetFailover()) > 0:
+		// distribute governs the weights within priority 0, failover orders the rest.
+		applyLocalityWeightWithFailover(locality, loadAssignment, localityLB)
+	case localityLB.GetDistribute() != nil:
+		applyLocalityWeight(locality, loadAssignment, localityLB.GetDistribute(), true)
+	case failover:
 		applyLocalityFailover(locality, loadAssignment, localityLB.GetFailover())
 	}
 }
 
+// applyLocalityWeightWithFailover combines distribute and failover settings.
+// The localities the matching distribute rule sends traffic to are weighted as
+// configured and kept at priority 0. Instead of being dropped, all other
+// localities are ranked by the failover settings and placed behind them.
+// Without a distribute rule for the proxy locality, only failover applies.
+func applyLocalityWeightWithFailover(
+	locality *core.Locality,
+	loadAssignment *endpoint.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting) {
+	misMatched := applyLocalityWeight(locality, loadAssignment, localityLB.GetDistribute(), false)
+	if misMatched == nil {
+		applyLocalityFailover(locality, loadAssignment, localityLB.GetFailover())
+		return
+	}
+
+	fallback := &endpoint.ClusterLoadAssignment{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		if _, exist := misMatched[i]; exist {
+			fallback.Endpoints = append(fallback.Endpoints, localityEndpoint)
+		} else {
+			localityEndpoint.Priority = 0
+		}
+	}
+	applyLocalityFailover(locality, fallback, localityLB.GetFailover())
+
+	// failover may have excluded some localities; keep the survivors one priority below the distributed ones.
+	maxDepth := features.LocalityLBMaxFailoverDepth
+	kept := make(map[*endpoint.LocalityLbEndpoints]struct{}, len(fallback.Endpoints))
+	for _, localityEndpoint := range fallback.Endpoints {
+		localityEndpoint.Priority++
+		if maxDepth > 0 && localityEndpoint.Priority > uint32(maxDepth) {
+			continue
+		}
+		kept[localityEndpoint] = struct{}{}
+	}
+	endpoints := make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints))
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		if _, exist := misMatched[i]; exist {
+			if _, ok := kept[localityEndpoint]; !ok {
+				continue
+			}
+		}
+		endpoints = append(endpoints, localityEndpoint)
+	}
+	loadAssignment.Endpoints = endpoints
+}
+
 // set locality loadbalancing weight
+// It returns the indexes of the LocalityLbEndpoints the matching distribute rule
+// sends no traffic to, or nil if no rule matches the proxy locality. Those are
+// emptied when dropMisMatched is set.
 func applyLocalityWeight(
 	locality *core.Locality,
 	loadAssignment *endpoint.ClusterLoadAssignment,
-	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute) {
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+	dropMisMatched bool) map[int]struct{} {
 	if distribute == nil {
-		return
+		return nil
 	}
 
 	// Support Locality weighted load balancing
@@ -127,19 +190,36 @@ func applyLocalityWeight(
 			}
 
 			// remove groups of endpoints in a locality that miss matched
-			for i := range misMatched {
-				loadAssignment.Endpoints[i].LbEndpoints = nil
+			if dropMisMatched {
+				for i := range misMatched {
+					loadAssignment.Endpoints[i].LbEndpoints = nil
+				}
 			}
-			break
+			return misMatched
 		}
 	}
+	return nil
 }
 
 // set locality loadbalancing priority
+// regionFailoverScope confines locality failover to the region of the proxy.
+const regionFailoverScope = "region"
+
 func applyLocalityFailover(
 	locality *core.Locality,
 	loadAssignment *endpoint.ClusterLoadAssignment,
 	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover) {
+	// 0. exclude the LocalityLbEndpoints of other regions, if failover is confined to the region
+	if features.LocalityLBFailoverScope == regionFailoverScope && locality.GetRegion() != "" {
+		endpoints := make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints))
+		for _, localityEndpoint := range loadAssignment.Endpoints {
+			if localityEndpoint.Locality.GetRegion() == locality.GetRegion() {
+				endpoints = append(endpoints, localityEndpoint)
+			}
+		}
+		loadAssignment.Endpoints = endpoints
+	}
+
 	// key is priority, value is the index of the LocalityLbEndpoints in ClusterLoadAssignment
 	priorityMap := map[int][]int{}
 
@@ -185,4 +265,15 @@ func applyLocalityFailover(
 		}
 	}
 
+	// 3. exclude the LocalityLbEndpoints beyond the max failover depth, if configured
+	maxDepth := features.LocalityLBMaxFailoverDepth
+	if maxDepth > 0 && len(priorities) > maxDepth+1 {
+		endpoints := make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints))
+		for _, localityEndpoint := range loadAssignment.Endpoints {
+			if localityEndpoint.Priority <= uint32(maxDepth) {
+				endpoints = append(endpoints, localityEndpoint)
+			}
+		}
+		loadAssignment.Endpoints = endpoints
+	}
 }
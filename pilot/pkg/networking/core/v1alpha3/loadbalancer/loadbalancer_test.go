@@ -15,6 +15,7 @@
 package loadbalancer
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -27,6 +28,7 @@ import (
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	memregistry "istio.io/istio/pilot/pkg/serviceregistry/memory"
 	"istio.io/istio/pkg/config"
@@ -169,6 +171,111 @@ func TestApplyLocalitySetting(t *testing.T) {
 			g.Expect(localityEndpoint.Priority).To(Equal(uint32(0)))
 		}
 	})
+
+	t.Run("Distribute and Failover", func(t *testing.T) {
+		lbsetting := func(from string) *networking.LocalityLoadBalancerSetting {
+			return &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: from,
+						To: map[string]uint32{
+							"region1/zone1/subzone1": 80,
+							"region1/zone1/subzone2": 20,
+						},
+					},
+				},
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region2",
+					},
+				},
+			}
+		}
+		weightsAndPriorities := func(cluster *cluster.Cluster) ([]int, []int) {
+			weights := make([]int, 0)
+			priorities := make([]int, 0)
+			for _, localityEndpoint := range cluster.LoadAssignment.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+				priorities = append(priorities, int(localityEndpoint.Priority))
+			}
+			return weights, priorities
+		}
+
+		t.Run("distribute weights priority 0, failover orders the rest", func(t *testing.T) {
+			g := NewWithT(t)
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSetting(locality, cluster.LoadAssignment, lbsetting("region1/zone1/subzone1"), true)
+			weights, priorities := weightsAndPriorities(cluster)
+			g.Expect(weights).To(Equal([]int{40, 40, 20, 0, 0, 0, 0}))
+			g.Expect(priorities).To(Equal([]int{0, 0, 0, 1, 2, 3, 4}))
+		})
+
+		t.Run("no distribute rule for the proxy locality", func(t *testing.T) {
+			g := NewWithT(t)
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSetting(locality, cluster.LoadAssignment, lbsetting("region9/zone9/subzone9"), true)
+			weights, priorities := weightsAndPriorities(cluster)
+			g.Expect(weights).To(Equal([]int{0, 0, 0, 0, 0, 0, 0}))
+			g.Expect(priorities).To(Equal([]int{0, 0, 1, 1, 2, 3, 4}))
+		})
+
+		t.Run("failover disabled", func(t *testing.T) {
+			g := NewWithT(t)
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSetting(locality, cluster.LoadAssignment, lbsetting("region1/zone1/subzone1"), false)
+			weights, priorities := weightsAndPriorities(cluster)
+			g.Expect(weights).To(Equal([]int{40, 40, 20, 0, 0, 0, 0}))
+			g.Expect(priorities).To(Equal([]int{0, 0, 0, 0, 0, 0, 0}))
+			for _, localityEndpoint := range cluster.LoadAssignment.Endpoints[3:] {
+				g.Expect(localityEndpoint.LbEndpoints).To(BeNil())
+			}
+		})
+
+		t.Run("max failover depth", func(t *testing.T) {
+			g := NewWithT(t)
+			defaultDepth := features.LocalityLBMaxFailoverDepth
+			features.LocalityLBMaxFailoverDepth = 2
+			defer func() { features.LocalityLBMaxFailoverDepth = defaultDepth }()
+
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSetting(locality, cluster.LoadAssignment, lbsetting("region1/zone1/subzone1"), true)
+			weights, priorities := weightsAndPriorities(cluster)
+			g.Expect(weights).To(Equal([]int{40, 40, 20, 0, 0}))
+			g.Expect(priorities).To(Equal([]int{0, 0, 0, 1, 2}))
+		})
+	})
+
+	t.Run("Failover: max failover depth", func(t *testing.T) {
+		for _, tt := range []struct {
+			maxDepth   int
+			priorities int
+		}{
+			{maxDepth: 0, priorities: 5},
+			{maxDepth: 1, priorities: 2},
+			{maxDepth: 3, priorities: 4},
+			{maxDepth: 10, priorities: 5},
+		} {
+			t.Run(fmt.Sprint(tt.maxDepth), func(t *testing.T) {
+				g := NewWithT(t)
+				defaultDepth := features.LocalityLBMaxFailoverDepth
+				features.LocalityLBMaxFailoverDepth = tt.maxDepth
+				defer func() { features.LocalityLBMaxFailoverDepth = defaultDepth }()
+
+				env := buildEnvForClustersWithFailover()
+				cluster := buildFakeCluster()
+				ApplyLocalityLBSetting(locality, cluster.LoadAssignment, env.Mesh().LocalityLbSetting, true)
+				priorities := map[uint32]struct{}{}
+				for _, localityEndpoint := range cluster.LoadAssignment.Endpoints {
+					priorities[localityEndpoint.Priority] = struct{}{}
+				}
+				g.Expect(priorities).To(HaveLen(tt.priorities))
+				for priority := range priorities {
+					g.Expect(priority).To(BeNumerically("<", tt.priorities))
+				}
+			})
+		}
+	})
 }
 
 func TestGetLocalityLbSetting(t *testing.T) {
@@ -223,7 +330,7 @@ func TestGetLocalityLbSetting(t *testing.T) {
 	}
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetLocalityLbSetting(tt.mesh, tt.dr)
+			got := GetLocalityLbSetting(tt.mesh, "", tt.dr)
 			if !reflect.DeepEqual(tt.expected, got) {
 				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
 			}
@@ -458,3 +565,54 @@ func buildSmallClusterWithNilLocalities() *cluster.Cluster {
 		},
 	}
 }
+
+func TestGetLocalityLbSettingNamespace(t *testing.T) {
+	defer func(old map[string]*networking.LocalityLoadBalancerSetting) {
+		features.NamespaceLocalityLbSettings = old
+	}(features.NamespaceLocalityLbSettings)
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{nil}
+	features.NamespaceLocalityLbSettings = map[string]*networking.LocalityLoadBalancerSetting{
+		"enabled":  {Failover: failover},
+		"disabled": {Enabled: &types.BoolValue{Value: false}},
+	}
+	cases := []struct {
+		name      string
+		mesh      *networking.LocalityLoadBalancerSetting
+		namespace string
+		dr        *networking.LocalityLoadBalancerSetting
+		expected  *networking.LocalityLoadBalancerSetting
+	}{
+		{"namespace overrides mesh disabled",
+			nil,
+			"enabled",
+			nil,
+			&networking.LocalityLoadBalancerSetting{Failover: failover},
+		},
+		{"namespace disables mesh",
+			&networking.LocalityLoadBalancerSetting{},
+			"disabled",
+			nil,
+			nil,
+		},
+		{"dr overrides namespace",
+			nil,
+			"disabled",
+			&networking.LocalityLoadBalancerSetting{},
+			&networking.LocalityLoadBalancerSetting{},
+		},
+		{"other namespace",
+			&networking.LocalityLoadBalancerSetting{},
+			"other",
+			nil,
+			&networking.LocalityLoadBalancerSetting{},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetLocalityLbSetting(tt.mesh, tt.namespace, tt.dr)
+			if !reflect.DeepEqual(tt.expected, got) {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -80,6 +80,26 @@ const (
 	// which determines the endpoint level transport socket configuration.
 	EnvoyTransportSocketMetadataKey = "envoy.transport_socket_match"
 
+	// ConnectionPoolMetadataKey is the key under which the connection pool hints of an endpoint are added
+	// to its metadata, for custom Envoy configuration to consume.
+	ConnectionPoolMetadataKey = "istio.connection_pool"
+
+	// CanaryMetadataKey is the key under which the canary weight of an endpoint is added to its metadata,
+	// for progressive delivery controllers to consume.
+	CanaryMetadataKey = "istio.canary"
+
+	// OutlierDetectionMetadataKey is the key under which endpoints exempt from outlier detection are marked in
+	// their metadata, for outlier detection extensions to consume.
+	OutlierDetectionMetadataKey = "istio.outlier_detection"
+
+	// EnvoyLbMetadataKey is the key under which the metadata of an endpoint is matched by the subset load
+	// balancing of Envoy.
+	EnvoyLbMetadataKey = "envoy.lb"
+
+	// OriginalDstMetadataKey is the key under which the address of an endpoint is added to its metadata, in
+	// the local field, for original destination load balancing configured with this metadata key.
+	OriginalDstMetadataKey = "envoy.filters.listener.original_dst"
+
 	// EnvoyRawBufferSocketName matched with hardcoded built-in Envoy transport name which determines
 	// endpoint level plantext transport socket configuration
 	EnvoyRawBufferSocketName = wellknown.TransportSocketRawBuffer
@@ -279,11 +299,16 @@ func IsProtocolSniffingEnabledForOutboundPort(port *model.Port) bool {
 
 // ConvertLocality converts '/' separated locality string to Locality struct.
 func ConvertLocality(locality string) *core.Locality {
+	return ConvertLocalityWithDelimiter(locality, "/")
+}
+
+// ConvertLocalityWithDelimiter converts a locality string separated by the given delimiter to Locality struct.
+func ConvertLocalityWithDelimiter(locality, delimiter string) *core.Locality {
 	if locality == "" {
 		return &core.Locality{}
 	}
 
-	region, zone, subzone := SplitLocality(locality)
+	region, zone, subzone := splitLocality(locality, delimiter)
 	return &core.Locality{
 		Region:  region,
 		Zone:    zone,
@@ -291,6 +316,19 @@ func ConvertLocality(locality string) *core.Locality {
 	}
 }
 
+// ConvertEndpointLocality converts the locality of an endpoint to Locality struct. The region, zone and
+// subzone are used as is if any of them is set, otherwise the label is parsed with the given delimiter.
+func ConvertEndpointLocality(locality model.Locality, delimiter string) *core.Locality {
+	if locality.Region == "" && locality.Zone == "" && locality.SubZone == "" {
+		return ConvertLocalityWithDelimiter(locality.Label, delimiter)
+	}
+	return &core.Locality{
+		Region:  locality.Region,
+		Zone:    locality.Zone,
+		SubZone: locality.SubZone,
+	}
+}
+
 // ConvertLocality converts '/' separated locality string to Locality struct.
 func LocalityToString(l *core.Locality) string {
 	if l == nil {
@@ -329,7 +367,17 @@ func LocalityMatch(proxyLocality *core.Locality, ruleLocality string) bool {
 }
 
 func SplitLocality(locality string) (region, zone, subzone string) {
-	items := strings.Split(locality, "/")
+	return splitLocality(locality, "/")
+}
+
+// splitLocality splits the locality into its region, zone and subzone. Whitespace around them is trimmed, so
+// a region only locality such as "region/ " has empty zone and subzone, rather than a distinct " " zone which
+// would not match the one of other proxies and endpoints in the region for locality load balancing.
+func splitLocality(locality, delimiter string) (region, zone, subzone string) {
+	items := strings.Split(locality, delimiter)
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
 	switch len(items) {
 	case 1:
 		return items[0], "", ""
@@ -525,6 +573,125 @@ func BuildLbEndpointMetadata(network string, tlsMode string) *core.Metadata {
 	return metadata
 }
 
+// BuildGrpcLbEndpointMetadata returns the metadata of an endpoint sent to proxyless gRPC clients. gRPC does
+// not support transport socket matches, so unlike BuildLbEndpointMetadata, all values are set as fields of
+// the istio filter metadata.
+func BuildGrpcLbEndpointMetadata(network string, tlsMode string) *core.Metadata {
+	fields := map[string]*pstruct.Value{}
+	if network != "" {
+		fields["network"] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: network}}
+	}
+	if tlsMode != "" {
+		fields[model.TLSModeLabelShortname] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: tlsMode}}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &core.Metadata{
+		FilterMetadata: map[string]*pstruct.Struct{
+			IstioMetadataKey: {Fields: fields},
+		},
+	}
+}
+
+// AddLabelFilterMetadata adds the endpoint labels starting with one of the prefixes to the filter metadata
+// namespace mapped to the prefix, with the prefix removed from the key. Existing values, such as the ones
+// set by Istio, are never overridden. The metadata is returned, and allocated if nil and needed.
+func AddLabelFilterMetadata(metadata *core.Metadata, labels map[string]string, prefixes map[string]string) *core.Metadata {
+	for key, value := range labels {
+		for prefix, namespace := range prefixes {
+			if !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+				continue
+			}
+			if metadata == nil {
+				metadata = &core.Metadata{}
+			}
+			if metadata.FilterMetadata == nil {
+				metadata.FilterMetadata = map[string]*pstruct.Struct{}
+			}
+			ns := metadata.FilterMetadata[namespace]
+			if ns == nil {
+				ns = &pstruct.Struct{Fields: map[string]*pstruct.Value{}}
+				metadata.FilterMetadata[namespace] = ns
+			}
+			field := strings.TrimPrefix(key, prefix)
+			if _, f := ns.Fields[field]; !f {
+				ns.Fields[field] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: value}}
+			}
+		}
+	}
+	return metadata
+}
+
+// AddCanaryWeightMetadata adds the canary weight, as a number, under the weight key of the canary filter
+// metadata. The metadata is returned, and allocated if nil.
+func AddCanaryWeightMetadata(metadata *core.Metadata, weight float64) *core.Metadata {
+	if metadata == nil {
+		metadata = &core.Metadata{}
+	}
+	if metadata.FilterMetadata == nil {
+		metadata.FilterMetadata = map[string]*pstruct.Struct{}
+	}
+	metadata.FilterMetadata[CanaryMetadataKey] = &pstruct.Struct{
+		Fields: map[string]*pstruct.Value{
+			"weight": {Kind: &pstruct.Value_NumberValue{NumberValue: weight}},
+		},
+	}
+	return metadata
+}
+
+// AddOutlierExemptMetadata sets the exempt key of the outlier detection filter metadata to true. The metadata
+// is returned, and allocated if nil.
+func AddOutlierExemptMetadata(metadata *core.Metadata) *core.Metadata {
+	if metadata == nil {
+		metadata = &core.Metadata{}
+	}
+	if metadata.FilterMetadata == nil {
+		metadata.FilterMetadata = map[string]*pstruct.Struct{}
+	}
+	metadata.FilterMetadata[OutlierDetectionMetadataKey] = &pstruct.Struct{
+		Fields: map[string]*pstruct.Value{
+			"exempt": {Kind: &pstruct.Value_BoolValue{BoolValue: true}},
+		},
+	}
+	return metadata
+}
+
+// AddSpotInstanceMetadata sets the spot key of the envoy.lb filter metadata to "true" or "false", whether the
+// endpoint is on a spot instance. The metadata is returned, and allocated if nil.
+func AddSpotInstanceMetadata(metadata *core.Metadata, spot bool) *core.Metadata {
+	if metadata == nil {
+		metadata = &core.Metadata{}
+	}
+	if metadata.FilterMetadata == nil {
+		metadata.FilterMetadata = map[string]*pstruct.Struct{}
+	}
+	lb := metadata.FilterMetadata[EnvoyLbMetadataKey]
+	if lb == nil {
+		lb = &pstruct.Struct{Fields: map[string]*pstruct.Value{}}
+		metadata.FilterMetadata[EnvoyLbMetadataKey] = lb
+	}
+	lb.Fields["spot"] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: strconv.FormatBool(spot)}}
+	return metadata
+}
+
+// AddOriginalDstMetadata adds the address, in host:port form, under the local key of the original destination
+// filter metadata. The metadata is returned, and allocated if nil.
+func AddOriginalDstMetadata(metadata *core.Metadata, address string) *core.Metadata {
+	if metadata == nil {
+		metadata = &core.Metadata{}
+	}
+	if metadata.FilterMetadata == nil {
+		metadata.FilterMetadata = map[string]*pstruct.Struct{}
+	}
+	metadata.FilterMetadata[OriginalDstMetadataKey] = &pstruct.Struct{
+		Fields: map[string]*pstruct.Value{
+			"local": {Kind: &pstruct.Value_StringValue{StringValue: address}},
+		},
+	}
+	return metadata
+}
+
 // IsAllowAnyOutbound checks if allow_any is enabled for outbound traffic
 func IsAllowAnyOutbound(node *model.Proxy) bool {
 	return node.SidecarScope != nil &&
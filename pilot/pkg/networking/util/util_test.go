@@ -212,6 +212,138 @@ func TestConvertLocality(t *testing.T) {
 	}
 }
 
+func TestConvertLocalityRegionOnly(t *testing.T) {
+	want := &core.Locality{Region: "region"}
+	for _, locality := range []string{"region", "region/", "region//", "region/ / ", " region "} {
+		t.Run(locality, func(t *testing.T) {
+			got := ConvertLocality(locality)
+			if got.Zone != "" || got.SubZone != "" {
+				t.Fatalf("expected no zone and subzone, got %q and %q", got.Zone, got.SubZone)
+			}
+			if !proto.Equal(got, want) {
+				t.Fatalf("expected locality %v, got %v", want, got)
+			}
+			// The locality matches the one of a proxy in the region at all levels.
+			if p := LbPriority(want, got); p != 0 {
+				t.Fatalf("expected region only localities to match, got priority %d", p)
+			}
+			if s := LocalityToString(got); s != "region" {
+				t.Fatalf("expected locality string region, got %q", s)
+			}
+		})
+	}
+}
+
+func TestConvertLocalityWithDelimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		locality  string
+		delimiter string
+		want      *core.Locality
+	}{
+		{
+			name:      "custom delimiter",
+			locality:  "region.zone.subzone",
+			delimiter: ".",
+			want: &core.Locality{
+				Region:  "region",
+				Zone:    "zone",
+				SubZone: "subzone",
+			},
+		},
+		{
+			name:      "multi character delimiter",
+			locality:  "region::zone",
+			delimiter: "::",
+			want: &core.Locality{
+				Region: "region",
+				Zone:   "zone",
+			},
+		},
+		{
+			name:      "default delimiter is not split",
+			locality:  "region/zone",
+			delimiter: ".",
+			want: &core.Locality{
+				Region: "region/zone",
+			},
+		},
+		{
+			name:      "empty locality",
+			locality:  "",
+			delimiter: ".",
+			want:      &core.Locality{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertLocalityWithDelimiter(tt.locality, tt.delimiter)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected locality %#v, but got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConvertEndpointLocality(t *testing.T) {
+	tests := []struct {
+		name       string
+		structured model.Locality
+		label      string
+		want       *core.Locality
+	}{
+		{
+			name:       "region only",
+			structured: model.Locality{Region: "region"},
+			label:      "region",
+			want:       &core.Locality{Region: "region"},
+		},
+		{
+			name:       "region and zone",
+			structured: model.Locality{Region: "region", Zone: "zone"},
+			label:      "region/zone",
+			want:       &core.Locality{Region: "region", Zone: "zone"},
+		},
+		{
+			name:       "region zone and subzone",
+			structured: model.Locality{Region: "region", Zone: "zone", SubZone: "subzone"},
+			label:      "region/zone/subzone",
+			want:       &core.Locality{Region: "region", Zone: "zone", SubZone: "subzone"},
+		},
+		{
+			name:       "structured fields take precedence over the label",
+			structured: model.Locality{Label: "other/label", Region: "region", Zone: "zone"},
+			label:      "region/zone",
+			want:       &core.Locality{Region: "region", Zone: "zone"},
+		},
+		{
+			name:       "empty",
+			structured: model.Locality{},
+			label:      "",
+			want:       &core.Locality{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertEndpointLocality(tt.structured, "/")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected locality %#v, but got %#v", tt.want, got)
+			}
+			if parsed := ConvertEndpointLocality(model.Locality{Label: tt.label}, "/"); !reflect.DeepEqual(got, parsed) {
+				t.Errorf("Expected locality %#v to be equivalent to the parsed label %#v", got, parsed)
+			}
+		})
+	}
+
+	// Structured fields are not split, unlike a label containing the delimiter.
+	got := ConvertEndpointLocality(model.Locality{Region: "region", Zone: "zone/a"}, "/")
+	if want := (&core.Locality{Region: "region", Zone: "zone/a"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected locality %#v, but got %#v", want, got)
+	}
+}
+
 func TestLocalityMatch(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -386,6 +518,57 @@ func TestBuildConfigInfoMetadata(t *testing.T) {
 	}
 }
 
+func TestAddLabelFilterMetadata(t *testing.T) {
+	str := func(s string) *structpb.Value {
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+	}
+	prefixes := map[string]string{"envoy.filter.foo/": "foo", "envoy.filter.bar/": "bar"}
+	cases := []struct {
+		name   string
+		in     *core.Metadata
+		labels map[string]string
+		want   *core.Metadata
+	}{
+		{
+			"labels mapped to namespaces",
+			BuildLbEndpointMetadata("", model.IstioMutualTLSModeLabel),
+			map[string]string{"envoy.filter.foo/tier": "gold", "envoy.filter.foo/zone": "a", "envoy.filter.bar/team": "x", "app": "foo"},
+			&core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					EnvoyTransportSocketMetadataKey: {Fields: map[string]*structpb.Value{model.TLSModeLabelShortname: str(model.IstioMutualTLSModeLabel)}},
+					"foo":                           {Fields: map[string]*structpb.Value{"tier": str("gold"), "zone": str("a")}},
+					"bar":                           {Fields: map[string]*structpb.Value{"team": str("x")}},
+				},
+			},
+		},
+		{
+			"no metadata",
+			nil,
+			map[string]string{"envoy.filter.bar/team": "x"},
+			&core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					"bar": {Fields: map[string]*structpb.Value{"team": str("x")}},
+				},
+			},
+		},
+		{
+			"no matching labels",
+			nil,
+			map[string]string{"app": "foo", "envoy.filter.foo/": "empty"},
+			nil,
+		},
+	}
+
+	for _, v := range cases {
+		t.Run(v.name, func(tt *testing.T) {
+			got := AddLabelFilterMetadata(v.in, v.labels, prefixes)
+			if diff := cmp.Diff(got, v.want, protocmp.Transform()); diff != "" {
+				tt.Errorf("AddLabelFilterMetadata(%v) produced incorrect result:\ngot: %v\nwant: %v\nDiff: %s", v.labels, got, v.want, diff)
+			}
+		})
+	}
+}
+
 func TestAddSubsetToMetadata(t *testing.T) {
 	cases := []struct {
 		name   string
@@ -181,6 +181,9 @@ type Controller struct {
 	nodeInformer cache.SharedIndexInformer
 	nodeLister   listerv1.NodeLister
 
+	// Used to pass the phase of namespaces to the xdsUpdater, if it implements model.NamespaceUpdater.
+	namespaceInformer cache.SharedIndexInformer
+
 	pods *PodCache
 
 	metrics         model.Metrics
@@ -274,6 +277,11 @@ func NewController(kubeClient kubelib.Client, options Options) *Controller {
 	})
 	registerHandlers(c.pods.informer, c.queue, "Pods", c.pods.onEvent, nil)
 
+	if _, ok := c.xdsUpdater.(model.NamespaceUpdater); ok {
+		c.namespaceInformer = kubeClient.KubeInformer().Core().V1().Namespaces().Informer()
+		registerHandlers(c.namespaceInformer, c.queue, "Namespaces", c.onNamespaceEvent, nil)
+	}
+
 	return c
 }
 
@@ -421,6 +429,25 @@ func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
 	return nil
 }
 
+func (c *Controller) onNamespaceEvent(obj interface{}, event model.Event) error {
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			log.Errorf("couldn't get object from tombstone %+v", obj)
+			return nil
+		}
+		ns, ok = tombstone.Obj.(*v1.Namespace)
+		if !ok {
+			log.Errorf("tombstone contained object that is not a namespace %#v", obj)
+			return nil
+		}
+	}
+	terminating := event != model.EventDelete && ns.Status.Phase == v1.NamespaceTerminating
+	c.xdsUpdater.(model.NamespaceUpdater).NamespaceUpdate(c.clusterID, ns.Name, terminating)
+	return nil
+}
+
 // Filter func for filtering out objects during update callback
 type FilterOutFunc func(old, cur interface{}) bool
 
@@ -494,7 +521,8 @@ func (c *Controller) HasSynced() bool {
 	if !c.serviceInformer.HasSynced() ||
 		!c.endpoints.HasSynced() ||
 		!c.pods.informer.HasSynced() ||
-		!c.nodeInformer.HasSynced() {
+		!c.nodeInformer.HasSynced() ||
+		(c.namespaceInformer != nil && !c.namespaceInformer.HasSynced()) {
 		return false
 	}
 
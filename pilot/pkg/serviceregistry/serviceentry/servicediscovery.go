@@ -693,9 +693,28 @@ func (s *ServiceEntryStore) deleteExistingInstances(ckey configKey, instances []
 func deleteInstances(key configKey, instances []*model.ServiceInstance, instanceMap map[instancesKey]map[configKey][]*model.ServiceInstance,
 	ip2instance map[string][]*model.ServiceInstance) {
 	for _, i := range instances {
-		delete(instanceMap[makeInstanceKey(i)], key)
-		delete(ip2instance, i.Endpoint.Address)
+		ikey := makeInstanceKey(i)
+		// Only drop the instances owned by this config from the ip index. Other configs,
+		// for example another STATIC ServiceEntry, may define endpoints with the same address.
+		for _, old := range instanceMap[ikey][key] {
+			ip2instance[old.Endpoint.Address] = removeInstance(ip2instance[old.Endpoint.Address], old)
+			if len(ip2instance[old.Endpoint.Address]) == 0 {
+				delete(ip2instance, old.Endpoint.Address)
+			}
+		}
+		delete(instanceMap[ikey], key)
+	}
+}
+
+// removeInstance returns the instances without the given one.
+func removeInstance(instances []*model.ServiceInstance, instance *model.ServiceInstance) []*model.ServiceInstance {
+	out := instances[:0]
+	for _, i := range instances {
+		if i != instance {
+			out = append(out, i)
+		}
 	}
+	return out
 }
 
 // updateExistingInstances updates the indexes (by host, byip maps) for the passed in instances.
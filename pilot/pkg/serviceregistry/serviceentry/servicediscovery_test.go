@@ -902,6 +902,53 @@ func TestServiceDiscoveryGetProxyServiceInstances(t *testing.T) {
 	}, "2.2.2.2")
 }
 
+func TestServiceDiscoveryOverlappingStaticAddresses(t *testing.T) {
+	store, sd, events, stopFn := initServiceDiscovery()
+	defer stopFn()
+
+	// httpStatic and tcpStatic are STATIC ServiceEntries for different hosts, which both have an endpoint at 2.2.2.2.
+	createConfigs([]*config.Config{httpStatic, tcpStatic}, store, t)
+	httpInstances := []*model.ServiceInstance{
+		makeInstance(httpStatic, "2.2.2.2", 7080, httpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+		makeInstance(httpStatic, "2.2.2.2", 18080, httpStatic.Spec.(*networking.ServiceEntry).Ports[1], nil, MTLS),
+		makeInstance(httpStatic, "3.3.3.3", 1080, httpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+		makeInstance(httpStatic, "3.3.3.3", 8080, httpStatic.Spec.(*networking.ServiceEntry).Ports[1], nil, MTLS),
+		makeInstance(httpStatic, "4.4.4.4", 1080, httpStatic.Spec.(*networking.ServiceEntry).Ports[0], map[string]string{"foo": "bar"}, PlainText),
+		makeInstance(httpStatic, "4.4.4.4", 8080, httpStatic.Spec.(*networking.ServiceEntry).Ports[1], map[string]string{"foo": "bar"}, PlainText),
+	}
+	expectServiceInstances(t, sd, httpStatic, 0, httpInstances)
+	expectServiceInstances(t, sd, tcpStatic, 0, []*model.ServiceInstance{
+		makeInstance(tcpStatic, "1.1.1.1", 444, tcpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+		makeInstance(tcpStatic, "2.2.2.2", 444, tcpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+	})
+	// Drain the events for the initial creation
+	expectEvents(t, events,
+		Event{kind: "svcupdate", host: "*.google.com", namespace: httpStatic.Namespace},
+		Event{kind: "xds"},
+		Event{kind: "svcupdate", host: "tcpstatic.com", namespace: tcpStatic.Namespace},
+		Event{kind: "xds"})
+
+	// Only change the endpoints of tcpStatic, the instances of httpStatic at the same address must not be affected.
+	tcpStaticUpdated := func() *config.Config {
+		c := tcpStatic.DeepCopy()
+		se := c.Spec.(*networking.ServiceEntry)
+		se.Endpoints = se.Endpoints[1:]
+		return &c
+	}()
+	createConfigs([]*config.Config{tcpStaticUpdated}, store, t)
+	expectServiceInstances(t, sd, tcpStaticUpdated, 0, []*model.ServiceInstance{
+		makeInstance(tcpStatic, "2.2.2.2", 444, tcpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+	})
+	expectServiceInstances(t, sd, httpStatic, 0, httpInstances)
+	expectEvents(t, events, Event{kind: "eds", host: "tcpstatic.com", namespace: tcpStatic.Namespace, endpoints: 1})
+	expectProxyInstances(t, sd, []*model.ServiceInstance{
+		makeInstance(httpStatic, "2.2.2.2", 7080, httpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+		makeInstance(httpStatic, "2.2.2.2", 18080, httpStatic.Spec.(*networking.ServiceEntry).Ports[1], nil, MTLS),
+		makeInstance(tcpStatic, "2.2.2.2", 444, tcpStatic.Spec.(*networking.ServiceEntry).Ports[0], nil, MTLS),
+	}, "2.2.2.2")
+	expectProxyInstances(t, sd, []*model.ServiceInstance{}, "1.1.1.1")
+}
+
 // Keeping this test for legacy - but it never happens in real life.
 func TestServiceDiscoveryInstances(t *testing.T) {
 	store, sd, _, stopFn := initServiceDiscovery()
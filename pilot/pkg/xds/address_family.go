@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"net"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	addressFamilyIPv4 = "IPv4"
+	addressFamilyIPv6 = "IPv6"
+)
+
+// addressFamilyPreference returns the address family preferred by the proxy, or an empty string if it has no
+// valid preference.
+func addressFamilyPreference(proxy *model.Proxy) string {
+	if proxy.Metadata == nil {
+		return ""
+	}
+	switch strings.ToLower(proxy.Metadata.IPFamilyPreference) {
+	case "ipv4":
+		return addressFamilyIPv4
+	case "ipv6":
+		return addressFamilyIPv6
+	}
+	return ""
+}
+
+// addressFamily returns the family of the address, or an empty string if it is not an IP address.
+func addressFamily(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return addressFamilyIPv4
+	}
+	return addressFamilyIPv6
+}
+
+func workloadPortKey(ep *model.IstioEndpoint) string {
+	return ep.UID + "/" + ep.ServicePortName
+}
+
+// preferredFamilyWorkloads returns the workload ports which have an endpoint in the given family, keyed by
+// workloadPortKey. Endpoints without a workload UID cannot be matched with their other family and are ignored.
+// Must be called with the mutex of the shards held.
+func preferredFamilyWorkloads(shards *EndpointShards, family string) map[string]struct{} {
+	preferred := map[string]struct{}{}
+	for _, endpoints := range shards.Shards {
+		for _, ep := range endpoints {
+			if ep.UID != "" && addressFamily(ep.Address) == family {
+				preferred[workloadPortKey(ep)] = struct{}{}
+			}
+		}
+	}
+	return preferred
+}
+
+// otherFamilyDuplicate returns true if the endpoint is the address of a dual-stack workload in the family
+// which is not preferred, so only the address in the preferred family is sent. Workloads available in a single
+// family keep their endpoints whatever the preference.
+func otherFamilyDuplicate(ep *model.IstioEndpoint, family string, preferred map[string]struct{}) bool {
+	if ep.UID == "" {
+		return false
+	}
+	if f := addressFamily(ep.Address); f == "" || f == family {
+		return false
+	}
+	_, dualStack := preferred[workloadPortKey(ep)]
+	return dualStack
+}
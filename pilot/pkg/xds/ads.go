@@ -82,6 +82,13 @@ type Connection struct {
 	// Original node metadata, to avoid unmarshal/marshal.
 	// This is included in internal events.
 	node *core.Node
+
+	// edsHash is the content hash of the last EDS response sent on this connection. Pushes
+	// generating the same content are skipped. Only accessed from the connection's main loop.
+	edsHash uint64
+
+	// edsStats tracks the EDS pushes sent on this connection, for debugging.
+	edsStats edsConnStats
 }
 
 // Event represents a config or registry event that results in a push.
@@ -178,6 +185,11 @@ func (s *DiscoveryServer) processRequest(req *discovery.DiscoveryRequest, con *C
 
 	push := s.globalPushContext()
 
+	// Requests from the proxy must always be answered, even if the content is unchanged.
+	if req.TypeUrl == v3.EndpointType {
+		con.edsHash = 0
+	}
+
 	return s.pushXds(con, push, versionInfo(), con.Watched(req.TypeUrl), &model.PushRequest{Full: true})
 }
 
@@ -559,6 +571,10 @@ func (s *DiscoveryServer) pushConnection(con *Connection, pushEv *Event) error {
 		}
 	}
 
+	if pushRequest.ForceEds {
+		con.edsHash = 0
+	}
+
 	if !ProxyNeedsPush(con.proxy, pushEv) {
 		adsLog.Debugf("Skipping push to %v, no updates required", con.ConID)
 		if pushRequest.Full {
@@ -29,6 +29,7 @@ import (
 
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/istio/pilot/pkg/config/kube/crd"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
@@ -265,13 +266,101 @@ func BenchmarkEndpointGeneration(b *testing.B) {
 					l := s.Discovery.generateEndpoints(NewEndpointBuilder(fmt.Sprintf("outbound|80||foo-%d.com", svc), proxy, push))
 					loadAssignments = append(loadAssignments, util.MessageToAny(l))
 				}
-				response = endpointDiscoveryResponse(loadAssignments, version, push.Version)
+				response = s.Discovery.endpointDiscoveryResponse(loadAssignments, version, push.Version)
 			}
 			logDebug(b, response.GetResources())
 		})
 	}
 }
 
+// BenchmarkEndpointGenerationManyClusters benchmarks the endpoint generation of a single connection watching
+// a large number of clusters, with and without the parallel worker pool.
+func BenchmarkEndpointGenerationManyClusters(b *testing.B) {
+	disableLogging()
+	const services = 10000
+	s := NewFakeDiscoveryServer(b, FakeOptions{
+		Configs: createEndpoints(1, services),
+	})
+	proxy := &model.Proxy{
+		Type:            model.SidecarProxy,
+		IPAddresses:     []string{"10.3.3.3"},
+		ID:              "random",
+		ConfigNamespace: "default",
+		Metadata:        &model.NodeMetadata{},
+	}
+	push := s.Discovery.globalPushContext()
+	proxy.SetSidecarScope(push)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType}
+	for svc := 0; svc < services; svc++ {
+		w.ResourceNames = append(w.ResourceNames, fmt.Sprintf("outbound|80||foo-%d.com", svc))
+	}
+	gen := s.Discovery.Generators[v3.EndpointType]
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			defer func(old int) { features.EDSGenerationWorkers = old }(features.EDSGenerationWorkers)
+			features.EDSGenerationWorkers = workers
+			var resources model.Resources
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				// Drop the cached endpoints so every iteration generates them.
+				s.Discovery.Cache.ClearAll()
+				resources = gen.Generate(proxy, push, w, &model.PushRequest{Full: true})
+			}
+			logDebug(b, resources)
+		})
+	}
+}
+
+// BenchmarkEDSFirstPush benchmarks the first EDS push of a new connection watching a large number of clusters,
+// with and without the endpoints preloaded for the profile of an already connected proxy.
+func BenchmarkEDSFirstPush(b *testing.B) {
+	disableLogging()
+	const services = 1000
+	s := NewFakeDiscoveryServer(b, FakeOptions{
+		Configs: createEndpoints(10, services),
+	})
+	newProxy := func(id string) *model.Proxy {
+		proxy := &model.Proxy{
+			Type:            model.SidecarProxy,
+			IPAddresses:     []string{"10.3.3.3"},
+			ID:              id,
+			ConfigNamespace: "default",
+			Metadata:        &model.NodeMetadata{},
+		}
+		proxy.SetSidecarScope(s.Discovery.globalPushContext())
+		return proxy
+	}
+	con, _ := newRecordingConnection(s, newProxy("connected"))
+	con.proxy.WatchedResources[v3.EndpointType] = &model.WatchedResource{TypeUrl: v3.EndpointType}
+	s.Discovery.addCon(con.ConID, con)
+
+	push := s.Discovery.globalPushContext()
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType}
+	for svc := 0; svc < services; svc++ {
+		w.ResourceNames = append(w.ResourceNames, fmt.Sprintf("outbound|80||foo-%d.com", svc))
+	}
+	gen := s.Discovery.Generators[v3.EndpointType]
+
+	for _, preload := range []bool{false, true} {
+		b.Run(fmt.Sprintf("preload-%v", preload), func(b *testing.B) {
+			var resources model.Resources
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				s.Discovery.Cache.ClearAll()
+				if preload {
+					s.Discovery.preloadEndpoints(push, nil)
+				}
+				proxy := newProxy(fmt.Sprintf("new-%d", n))
+				b.StartTimer()
+				resources = gen.Generate(proxy, push, w, &model.PushRequest{Full: true})
+			}
+			logDebug(b, resources)
+		})
+	}
+}
+
 // Setup test builds a mock test environment. Note: push context is not initialized, to be able to benchmark separately
 // most should just call setupAndInitializeTest
 func setupTest(t testing.TB, config ConfigInput) (*FakeDiscoveryServer, *model.Proxy) {
@@ -0,0 +1,130 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// ClusterConsistency reports the mismatches between the EDS clusters sent to a proxy over CDS and the
+// clusters it watches over EDS. Clusters sent over CDS without endpoints do not warm, while endpoints
+// watched for clusters CDS did not send are computed for nothing, for example after the resolution of a
+// service changed from STATIC to DNS.
+type ClusterConsistency struct {
+	ProxyID string `json:"proxyID"`
+	// EdsWithoutCds holds the clusters watched over EDS which are not EDS clusters sent over CDS.
+	EdsWithoutCds []string `json:"edsWithoutCds,omitempty"`
+	// CdsWithoutEds holds the EDS clusters sent over CDS which are not watched over EDS.
+	CdsWithoutEds []string `json:"cdsWithoutEds,omitempty"`
+}
+
+// Consistent returns true if there are no mismatches.
+func (c ClusterConsistency) Consistent() bool {
+	return len(c.EdsWithoutCds) == 0 && len(c.CdsWithoutEds) == 0
+}
+
+// checkClusterConsistency compares the names of the EDS clusters sent over CDS with the names of the
+// clusters watched over EDS.
+func checkClusterConsistency(proxyID string, cdsClusters, edsClusters []string) ClusterConsistency {
+	cds := make(map[string]struct{}, len(cdsClusters))
+	for _, c := range cdsClusters {
+		cds[c] = struct{}{}
+	}
+	eds := make(map[string]struct{}, len(edsClusters))
+	for _, c := range edsClusters {
+		eds[c] = struct{}{}
+	}
+	out := ClusterConsistency{ProxyID: proxyID}
+	for c := range eds {
+		if _, f := cds[c]; !f {
+			out.EdsWithoutCds = append(out.EdsWithoutCds, c)
+		}
+	}
+	for c := range cds {
+		if _, f := eds[c]; !f {
+			out.CdsWithoutEds = append(out.CdsWithoutEds, c)
+		}
+	}
+	sort.Strings(out.EdsWithoutCds)
+	sort.Strings(out.CdsWithoutEds)
+	return out
+}
+
+// edsClusterNames returns the names of the EDS clusters, as watched over EDS.
+func edsClusterNames(clusters []*cluster.Cluster) []string {
+	out := make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		if c.GetType() != cluster.Cluster_EDS {
+			continue
+		}
+		name := c.GetEdsClusterConfig().GetServiceName()
+		if name == "" {
+			name = c.Name
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+// clusterConsistency checks the clusters the connection watches over EDS against the clusters CDS would
+// send it with the current push context.
+func (s *DiscoveryServer) clusterConsistency(con *Connection) ClusterConsistency {
+	cds := edsClusterNames(s.ConfigGenerator.BuildClusters(con.proxy, s.globalPushContext()))
+	return checkClusterConsistency(con.proxy.ID, cds, con.Clusters())
+}
+
+// clusterConsistencyz reports the mismatches between the CDS and EDS clusters of the proxy passed in the
+// proxyID query parameter, or of all the proxies watching endpoints with mismatches.
+func (s *DiscoveryServer) clusterConsistencyz(w http.ResponseWriter, req *http.Request) {
+	var out interface{}
+	if proxyID := req.URL.Query().Get("proxyID"); proxyID != "" {
+		con := s.getProxyConnection(proxyID)
+		if con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("Proxy not connected to this Pilot instance. It may be connected to another instance."))
+			return
+		}
+		out = s.clusterConsistency(con)
+	} else {
+		s.adsClientsMutex.RLock()
+		cons := make([]*Connection, 0, len(s.adsClients))
+		for _, con := range s.adsClients {
+			cons = append(cons, con)
+		}
+		s.adsClientsMutex.RUnlock()
+		all := make([]ClusterConsistency, 0)
+		for _, con := range cons {
+			if con.Watched(v3.EndpointType) == nil {
+				continue
+			}
+			if c := s.clusterConsistency(con); !c.Consistent() {
+				all = append(all, c)
+			}
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].ProxyID < all[j].ProxyID })
+		out = all
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(out, "", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
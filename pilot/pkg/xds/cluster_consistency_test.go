@@ -0,0 +1,135 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestCheckClusterConsistency(t *testing.T) {
+	cases := []struct {
+		name     string
+		cds      []string
+		eds      []string
+		expected ClusterConsistency
+	}{
+		{
+			name:     "consistent",
+			cds:      []string{"a", "b"},
+			eds:      []string{"b", "a"},
+			expected: ClusterConsistency{ProxyID: "proxy"},
+		},
+		{
+			name:     "eds without cds",
+			cds:      []string{"a"},
+			eds:      []string{"a", "c", "b"},
+			expected: ClusterConsistency{ProxyID: "proxy", EdsWithoutCds: []string{"b", "c"}},
+		},
+		{
+			name:     "cds without eds",
+			cds:      []string{"a", "b"},
+			eds:      []string{"a"},
+			expected: ClusterConsistency{ProxyID: "proxy", CdsWithoutEds: []string{"b"}},
+		},
+		{
+			name:     "both",
+			cds:      []string{"a", "b"},
+			eds:      []string{"a", "c"},
+			expected: ClusterConsistency{ProxyID: "proxy", EdsWithoutCds: []string{"c"}, CdsWithoutEds: []string{"b"}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkClusterConsistency("proxy", tt.cds, tt.eds)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, got)
+			}
+			if got.Consistent() != (tt.name == "consistent") {
+				t.Fatalf("unexpected consistency %v", got.Consistent())
+			}
+		})
+	}
+}
+
+func TestClusterConsistencyz(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("watched.example.com", "unwatched.example.com")
+	con, _ := newRecordingConnection(s, &model.Proxy{ID: "consistency.default"})
+	// Connections are looked up by the proxy ID their ID starts with.
+	con.ConID = connectionID(con.proxy.ID)
+	con.proxy.WatchedResources[v3.EndpointType] = &model.WatchedResource{
+		TypeUrl:       v3.EndpointType,
+		ResourceNames: []string{"outbound|80||watched.example.com", "outbound|80||removed.example.com"},
+	}
+	s.Discovery.addCon(con.ConID, con)
+	defer s.Discovery.removeCon(con.ConID)
+
+	get := func(url string, out interface{}) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		s.Discovery.clusterConsistencyz(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(got ClusterConsistency) {
+		t.Helper()
+		if got.ProxyID != con.proxy.ID {
+			t.Fatalf("expected the consistency of %s, got %s", con.proxy.ID, got.ProxyID)
+		}
+		if want := []string{"outbound|80||removed.example.com"}; !reflect.DeepEqual(got.EdsWithoutCds, want) {
+			t.Fatalf("expected EDS clusters without CDS %v, got %v", want, got.EdsWithoutCds)
+		}
+		found := false
+		for _, c := range got.CdsWithoutEds {
+			if c == "outbound|80||watched.example.com" {
+				t.Fatalf("expected the watched cluster to be consistent, got %v", got.CdsWithoutEds)
+			}
+			if c == "outbound|80||unwatched.example.com" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected the unwatched cluster in CDS clusters without EDS, got %v", got.CdsWithoutEds)
+		}
+	}
+
+	var single ClusterConsistency
+	get("/debug/cluster_consistencyz?proxyID="+con.proxy.ID, &single)
+	check(single)
+
+	var all []ClusterConsistency
+	get("/debug/cluster_consistencyz", &all)
+	if len(all) != 1 {
+		t.Fatalf("expected the single connection with mismatches, got %v", all)
+	}
+	check(all[0])
+
+	rr := httptest.NewRecorder()
+	s.Discovery.clusterConsistencyz(rr, httptest.NewRequest(http.MethodGet, "/debug/cluster_consistencyz?proxyID=unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected not found for an unknown proxy, got %d", rr.Code)
+	}
+}
@@ -156,6 +156,7 @@ func (s *DiscoveryServer) AddDebugHandlers(mux *http.ServeMux, enableProfiling b
 	mux.HandleFunc("/debug", s.Debug)
 
 	s.addDebugHandler(mux, "/debug/edsz", "Status and debug interface for EDS", s.Edsz)
+	s.addDebugHandler(mux, "/debug/edsstatsz", "Statistics of the EDS pushes of each connection, or of the passed in con", s.edsStatsz)
 	s.addDebugHandler(mux, "/debug/ndsz", "Status and debug interface for NDS", s.Ndsz)
 	s.addDebugHandler(mux, "/debug/adsz", "Status and debug interface for ADS", s.adsz)
 	s.addDebugHandler(mux, "/debug/adsz?push=true", "Initiates push of the current state to all connected endpoints", s.adsz)
@@ -170,12 +171,20 @@ func (s *DiscoveryServer) AddDebugHandlers(mux *http.ServeMux, enableProfiling b
 	s.addDebugHandler(mux, "/debug/configz", "Debug support for config", s.configz)
 	s.addDebugHandler(mux, "/debug/resourcesz", "Debug support for watched resources", s.resourcez)
 	s.addDebugHandler(mux, "/debug/instancesz", "Debug support for service instances", s.instancesz)
+	s.addDebugHandler(mux, "/debug/cluster_consistencyz", "Mismatches between the clusters sent over CDS and watched over EDS",
+		s.clusterConsistencyz)
+	s.addDebugHandler(mux, "/debug/destinationrulez", "DestinationRules selected for the clusters of the passed in proxyID", s.destinationRulez)
 
 	s.addDebugHandler(mux, "/debug/authorizationz", "Internal authorization policies", s.Authorizationz)
 	s.addDebugHandler(mux, "/debug/config_dump", "ConfigDump in the form of the Envoy admin config dump API for passed in proxyID", s.ConfigDump)
 	s.addDebugHandler(mux, "/debug/push_status", "Last PushContext Details", s.PushStatusHandler)
 
 	s.addDebugHandler(mux, "/debug/inject", "Active inject template", s.InjectTemplateHandler(webhook))
+
+	if features.EnableEndpointOverrides {
+		s.addDebugHandler(mux, "/debug/endpoint_overridez", "Endpoints sent to single proxies instead of the actual ones, for testing",
+			s.endpointOverridez)
+	}
 }
 
 func (s *DiscoveryServer) addDebugHandler(mux *http.ServeMux, path string, help string,
@@ -436,6 +445,51 @@ func (s *DiscoveryServer) Authorizationz(w http.ResponseWriter, req *http.Reques
 	}
 }
 
+// DestinationRuleDebug holds the DestinationRule selected for a cluster of a proxy.
+type DestinationRuleDebug struct {
+	Cluster   string `json:"cluster"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// destinationRulez reports which DestinationRule was selected for each cluster of a proxy.
+// A single cluster can be requested with the cluster query parameter, otherwise all EDS
+// clusters watched by the proxy are reported.
+func (s *DiscoveryServer) destinationRulez(w http.ResponseWriter, req *http.Request) {
+	proxyID := req.URL.Query().Get("proxyID")
+	if proxyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("You must provide a proxyID in the query string"))
+		return
+	}
+	con := s.getProxyConnection(proxyID)
+	if con == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("Proxy not connected to this Pilot instance. It may be connected to another instance."))
+		return
+	}
+
+	clusters := con.Clusters()
+	if cluster := req.URL.Query().Get("cluster"); cluster != "" {
+		clusters = []string{cluster}
+	}
+	push := s.globalPushContext()
+	out := make([]DestinationRuleDebug, 0, len(clusters))
+	for _, cluster := range clusters {
+		info := DestinationRuleDebug{Cluster: cluster}
+		if dr := NewEndpointBuilder(cluster, con.proxy, push).ResolvedDestinationRule(); dr != nil {
+			info.Name = dr.Name
+			info.Namespace = dr.Namespace
+		}
+		out = append(out, info)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(out, "", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
+
 // adsz implements a status and debug interface for ADS.
 // It is mapped to /debug/adsz
 func (s *DiscoveryServer) adsz(w http.ResponseWriter, req *http.Request) {
@@ -15,6 +15,9 @@
 package xds
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -23,6 +26,7 @@ import (
 	"github.com/google/uuid"
 	"go.uber.org/atomic"
 	"google.golang.org/grpc"
+	"k8s.io/utils/clock"
 
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
@@ -64,6 +68,10 @@ type debounceOptions struct {
 
 	// enableEDSDebounce indicates whether EDS pushes should be debounced.
 	enableEDSDebounce bool
+
+	// endpointStreamWindow is the interval in which snapshots sent to an
+	// endpoint update stream are merged into a single update.
+	endpointStreamWindow time.Duration
 }
 
 // DiscoveryServer is Pilot's gRPC implementation for Envoy's xds APIs
@@ -95,6 +103,18 @@ type DiscoveryServer struct {
 	// incremental updates. This is keyed by service and namespace
 	EndpointShardsByService map[string]map[string]*EndpointShards
 
+	// emptyServices tracks the services in EndpointShardsByService without any endpoints
+	// in all of their shards. Protected by mutex.
+	emptyServices map[ServiceRef]struct{}
+
+	// terminatingNamespaces are the namespaces being deleted in each cluster, for which the endpoint updates
+	// of the cluster not removing endpoints are suppressed. Protected by mutex.
+	terminatingNamespaces map[clusterNamespace]struct{}
+
+	// resyncingClusters are the clusters whose registry is being resynced, for which the endpoints missing
+	// from updates are kept serving until the resync is finished. Protected by mutex.
+	resyncingClusters map[string]struct{}
+
 	pushChannel chan *model.PushRequest
 
 	// mutex used for config update scheduling (former cache update mutex)
@@ -125,6 +145,40 @@ type DiscoveryServer struct {
 
 	// Cache for XDS resources
 	Cache model.XdsCache
+
+	// NonceStrategy generates the nonces of discovery responses. Defaults to random nonces.
+	NonceStrategy NonceStrategy
+
+	// EndpointAuditHook, if set, is called with the changes of the endpoint membership of services.
+	EndpointAuditHook EndpointAuditHook
+
+	// edsPushObservers are notified of the push requests triggered by EDS updates, protected by mutex.
+	edsPushObservers []func(*model.PushRequest)
+
+	// endpointFilters are applied to the endpoints of all clusters, in order, protected by mutex.
+	endpointFilters []EndpointFilter
+
+	// edsPause holds the EDS updates deferred while EDS pushes are paused.
+	edsPause edsPause
+
+	// endpointOverrides holds the endpoints sent to single proxies instead of the actual ones, for testing.
+	endpointOverrides endpointOverrides
+
+	// localityLoads holds the load last reported for each locality, for adaptive locality weights.
+	localityLoads localityLoads
+
+	// pushLoops tracks the rate of the pushes triggered by endpoint updates, to break push loops.
+	pushLoops pushLoops
+
+	// edsPreload runs the preloads of the endpoints in the EDS cache, one at a time.
+	edsPreload edsPreload
+
+	// clock is used to track readiness flips and propagation latency of endpoints.
+	clock clock.Clock
+
+	// pendingPropagation is the number of endpoints of all services whose propagation is tracked, so EDS
+	// pushes only look for them if there are any.
+	pendingPropagation atomic.Int64
 }
 
 // EndpointShards holds the set of endpoint shards of a service. Registries update
@@ -145,6 +199,47 @@ type EndpointShards struct {
 	// Due to the larger time, it is still possible that connection errors will occur while
 	// CDS is updated.
 	ServiceAccounts sets.Set
+
+	// LastUpdated holds the time each shard was last updated by its registry, keyed by shard. A shard not
+	// updated for long may belong to a registry which went silent. Updated along with the shard.
+	LastUpdated map[string]time.Time
+
+	// readinessFlips holds the times endpoints were added to or removed from the shards, keyed by
+	// cluster ID and address. It is only populated if PILOT_FLAKY_ENDPOINT_WINDOW is set.
+	readinessFlips map[string][]time.Time
+	clock          clock.Clock
+
+	// shardUpdates holds the sequence number of the last update of each shard, used to evict the least
+	// recently updated shards. It is only populated if PILOT_MAX_SHARDS_PER_SERVICE is set.
+	shardUpdates   map[string]uint64
+	shardUpdateSeq uint64
+
+	// pendingPropagation holds the time endpoints were first seen, keyed by cluster ID and address, until
+	// they are included in a sent EDS response. They are counted in pendingPropagationTotal, shared by the
+	// endpoint shards of all services.
+	pendingPropagation      map[string]time.Time
+	pendingPropagationTotal *atomic.Int64
+
+	// emptySince holds the time the shards retained during PILOT_ENDPOINT_SHARD_DELETION_GRACE_PERIOD
+	// became empty, keyed by shard.
+	emptySince map[string]time.Time
+
+	// stale holds the keys of the endpoints of the shards being resynced which are still served, but not
+	// yet confirmed by the resync, keyed by shard.
+	stale map[string]map[string]struct{}
+
+	// lastServiceAccountPush is the time of the last full push triggered by a change of ServiceAccounts, and
+	// serviceAccountPushPending is set while a coalesced one is scheduled. They are only used if
+	// PILOT_SERVICE_ACCOUNT_FULL_PUSH_WINDOW is set.
+	lastServiceAccountPush    time.Time
+	serviceAccountPushPending bool
+
+	// minShardsReached is set once PILOT_EDS_MIN_SHARDS shards had endpoints at once.
+	minShardsReached bool
+
+	// portNameFallbackLogged is set once endpoints without a service port name were matched to the only port
+	// of the service, so the warning is only logged once per service.
+	portNameFallbackLogged bool
 }
 
 // NewDiscoveryServer creates DiscoveryServer that sources data from Pilot's internal mesh data structures
@@ -153,6 +248,9 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 		Env:                     env,
 		Generators:              map[string]model.XdsResourceGenerator{},
 		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		emptyServices:           map[ServiceRef]struct{}{},
+		terminatingNamespaces:   map[clusterNamespace]struct{}{},
+		resyncingClusters:       map[string]struct{}{},
 		concurrentPushLimit:     make(chan struct{}, features.PushThrottle),
 		pushChannel:             make(chan *model.PushRequest, 10),
 		pushQueue:               NewPushQueue(),
@@ -160,11 +258,13 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 		adsClients:              map[string]*Connection{},
 		serverReady:             false,
 		debounceOptions: debounceOptions{
-			debounceAfter:     features.DebounceAfter,
-			debounceMax:       features.DebounceMax,
-			enableEDSDebounce: features.EnableEDSDebounce.Get(),
+			debounceAfter:        features.DebounceAfter,
+			debounceMax:          features.DebounceMax,
+			enableEDSDebounce:    features.EnableEDSDebounce.Get(),
+			endpointStreamWindow: features.EndpointStreamDebounce,
 		},
 		Cache: model.DisabledCache{},
+		clock: clock.RealClock{},
 	}
 
 	// Flush cached discovery responses when detecting jwt public key change.
@@ -174,6 +274,10 @@ func NewDiscoveryServer(env *model.Environment, plugins []string) *DiscoveryServ
 
 	out.initGenerators()
 
+	if features.EndpointAuditLog {
+		out.EndpointAuditHook = LogEndpointAudit
+	}
+
 	if features.EnableXDSCaching {
 		out.Cache = model.NewXdsCache()
 	}
@@ -206,6 +310,15 @@ func (s *DiscoveryServer) Start(stopCh <-chan struct{}) {
 	go s.handleUpdates(stopCh)
 	go s.periodicRefreshMetrics(stopCh)
 	go s.sendPushes(stopCh)
+	if features.TopServicesByEndpoints > 0 {
+		go s.periodicReportTopServices(stopCh)
+	}
+	if features.EndpointShardCompactionInterval > 0 {
+		go s.periodicCompactEndpointShards(stopCh)
+	}
+	if localityLoadFeedbackEnabled() {
+		go s.periodicExpireLocalityLoads(stopCh)
+	}
 }
 
 func (s *DiscoveryServer) getNonK8sRegistries() []serviceregistry.Instance {
@@ -252,6 +365,121 @@ func (s *DiscoveryServer) periodicRefreshMetrics(stopCh <-chan struct{}) {
 	}
 }
 
+// periodicReportTopServices periodically logs and records metrics for the services with the most endpoints.
+func (s *DiscoveryServer) periodicReportTopServices(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(features.TopServicesByEndpointsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			top := s.topServicesByEndpoints(features.TopServicesByEndpoints)
+			for i := 0; i < features.TopServicesByEndpoints; i++ {
+				// Reset ranks without a service, so they do not report stale counts.
+				endpoints := 0
+				if i < len(top) {
+					endpoints = top[i].Endpoints
+				}
+				recordTopServiceEndpoints(i+1, endpoints)
+			}
+			out, _ := json.Marshal(top)
+			adsLog.Infof("Top services by endpoints: %s", string(out))
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ServiceRef identifies a service by hostname and namespace.
+type ServiceRef struct {
+	Hostname  string `json:"hostname"`
+	Namespace string `json:"namespace"`
+}
+
+// EmptyServices returns the services which have endpoint shards, but no endpoints in any cluster.
+// Traffic to these services is blackholed.
+func (s *DiscoveryServer) EmptyServices() []ServiceRef {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	out := make([]ServiceRef, 0, len(s.emptyServices))
+	for svc := range s.emptyServices {
+		out = append(out, svc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		return out[i].Namespace < out[j].Namespace
+	})
+	return out
+}
+
+// updateEmptyService updates whether the service is tracked as empty. Must be called with the
+// mutex held, but not the mutex of the service's EndpointShards.
+func (s *DiscoveryServer) updateEmptyService(hostname, namespace string) {
+	svc := ServiceRef{Hostname: hostname, Namespace: namespace}
+	shards := s.EndpointShardsByService[hostname][namespace]
+	if shards == nil {
+		delete(s.emptyServices, svc)
+		return
+	}
+	shards.mutex.RLock()
+	empty := true
+	for _, eps := range shards.Shards {
+		if len(eps) > 0 {
+			empty = false
+			break
+		}
+	}
+	shards.mutex.RUnlock()
+	if !empty {
+		delete(s.emptyServices, svc)
+		return
+	}
+	if s.emptyServices == nil {
+		s.emptyServices = map[ServiceRef]struct{}{}
+	}
+	s.emptyServices[svc] = struct{}{}
+}
+
+// serviceEndpoints is the number of endpoints of a service, across all shards.
+type serviceEndpoints struct {
+	Hostname  string `json:"hostname"`
+	Namespace string `json:"namespace"`
+	Endpoints int    `json:"endpoints"`
+}
+
+// topServicesByEndpoints returns the n services with the most endpoints, ordered by decreasing endpoint count.
+func (s *DiscoveryServer) topServicesByEndpoints(n int) []serviceEndpoints {
+	var services []serviceEndpoints
+	s.mutex.RLock()
+	for hostname, byNamespace := range s.EndpointShardsByService {
+		for namespace, shards := range byNamespace {
+			count := 0
+			shards.mutex.RLock()
+			for _, endpoints := range shards.Shards {
+				count += len(endpoints)
+			}
+			shards.mutex.RUnlock()
+			services = append(services, serviceEndpoints{Hostname: hostname, Namespace: namespace, Endpoints: count})
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Endpoints != services[j].Endpoints {
+			return services[i].Endpoints > services[j].Endpoints
+		}
+		if services[i].Hostname != services[j].Hostname {
+			return services[i].Hostname < services[j].Hostname
+		}
+		return services[i].Namespace < services[j].Namespace
+	})
+	if len(services) > n {
+		services = services[:n]
+	}
+	return services
+}
+
 // Push is called to push changes on config updates using ADS. This is set in DiscoveryService.Push,
 // to avoid direct dependencies.
 func (s *DiscoveryServer) Push(req *model.PushRequest) {
@@ -285,12 +513,38 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 
 	req.Push = push
 	go s.AdsPushAll(versionLocal, req)
+	if edsPreloadEnabled() {
+		s.startPreloadEndpoints(push)
+	}
 }
 
+// NonceStrategy generates the nonce of a discovery response. The nonce must start with the given prefix,
+// which is used to track the distribution of config versions, and be unique.
+type NonceStrategy func(noncePrefix string) string
+
+// nonce is the default NonceStrategy, appending a random UUID to the prefix.
 func nonce(noncePrefix string) string {
 	return noncePrefix + uuid.New().String()
 }
 
+// MonotonicNonce returns a NonceStrategy appending an increasing counter to the prefix. The counter is
+// zero padded, so nonces with the same prefix are also ordered when compared as strings. This makes the
+// nonces deterministic, which is useful for tests.
+func MonotonicNonce() NonceStrategy {
+	counter := atomic.NewUint64(0)
+	return func(noncePrefix string) string {
+		return fmt.Sprintf("%s%020d", noncePrefix, counter.Inc())
+	}
+}
+
+// nextNonce returns a nonce for a discovery response, using the configured NonceStrategy.
+func (s *DiscoveryServer) nextNonce(noncePrefix string) string {
+	if s.NonceStrategy == nil {
+		return nonce(noncePrefix)
+	}
+	return s.NonceStrategy(noncePrefix)
+}
+
 func versionInfo() string {
 	versionMutex.RLock()
 	defer versionMutex.RUnlock()
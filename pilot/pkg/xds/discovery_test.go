@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -25,9 +26,12 @@ import (
 
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"google.golang.org/grpc"
+	clocktesting "k8s.io/utils/clock/testing"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/test/util/retry"
 )
 
@@ -475,3 +479,490 @@ func TestShouldRespond(t *testing.T) {
 		})
 	}
 }
+
+func TestTopServicesByEndpoints(t *testing.T) {
+	endpoints := func(n int) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, n)
+		for i := 0; i < n; i++ {
+			out = append(out, &model.IstioEndpoint{Address: fmt.Sprintf("10.0.0.%d", i)})
+		}
+		return out
+	}
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{
+			"a.example.com": {
+				"ns1": {Shards: map[string][]*model.IstioEndpoint{"cluster1": endpoints(3)}},
+				"ns2": {Shards: map[string][]*model.IstioEndpoint{"cluster1": endpoints(1)}},
+			},
+			"b.example.com": {
+				// Endpoints are counted across all shards.
+				"ns1": {Shards: map[string][]*model.IstioEndpoint{"cluster1": endpoints(2), "cluster2": endpoints(3)}},
+			},
+			"c.example.com": {
+				"ns1": {Shards: map[string][]*model.IstioEndpoint{"cluster1": endpoints(3)}},
+			},
+			"d.example.com": {
+				"ns1": {Shards: map[string][]*model.IstioEndpoint{}},
+			},
+		},
+	}
+
+	cases := []struct {
+		n        int
+		expected []serviceEndpoints
+	}{
+		{
+			n: 3,
+			expected: []serviceEndpoints{
+				{Hostname: "b.example.com", Namespace: "ns1", Endpoints: 5},
+				{Hostname: "a.example.com", Namespace: "ns1", Endpoints: 3},
+				{Hostname: "c.example.com", Namespace: "ns1", Endpoints: 3},
+			},
+		},
+		{
+			n: 10,
+			expected: []serviceEndpoints{
+				{Hostname: "b.example.com", Namespace: "ns1", Endpoints: 5},
+				{Hostname: "a.example.com", Namespace: "ns1", Endpoints: 3},
+				{Hostname: "c.example.com", Namespace: "ns1", Endpoints: 3},
+				{Hostname: "a.example.com", Namespace: "ns2", Endpoints: 1},
+				{Hostname: "d.example.com", Namespace: "ns1", Endpoints: 0},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			if got := s.topServicesByEndpoints(tt.n); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestEmptyServices(t *testing.T) {
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}}
+	endpoints := []*model.IstioEndpoint{{Address: "10.0.0.1"}}
+	expect := func(expected ...ServiceRef) {
+		t.Helper()
+		if got := s.EmptyServices(); !reflect.DeepEqual(got, append([]ServiceRef{}, expected...)) {
+			t.Fatalf("expected empty services %v, got %v", expected, got)
+		}
+	}
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster1", "b.example.com", "ns1", endpoints)
+	expect()
+
+	// A service is only empty once all of its shards are empty.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", nil)
+	expect()
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", nil)
+	expect(ServiceRef{Hostname: "a.example.com", Namespace: "ns1"})
+	s.edsCacheUpdate("cluster1", "b.example.com", "ns1", nil)
+	expect(ServiceRef{Hostname: "a.example.com", Namespace: "ns1"}, ServiceRef{Hostname: "b.example.com", Namespace: "ns1"})
+
+	// Endpoints becoming available again remove the service from the list.
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	expect(ServiceRef{Hostname: "b.example.com", Namespace: "ns1"})
+
+	// Deleted services are no longer tracked.
+	s.deleteService("cluster1", "b.example.com", "ns1")
+	expect()
+}
+
+func TestMaxShardsPerService(t *testing.T) {
+	setFeatureForTest(t, &features.MaxShardsPerService, 2)
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}}
+	endpoints := []*model.IstioEndpoint{{Address: "10.0.0.1"}}
+	expectShards := func(expected ...string) {
+		t.Helper()
+		var got []string
+		for shard := range s.EndpointShardsByService["a.example.com"]["ns1"].Shards {
+			got = append(got, shard)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("expected shards %v, got %v", expected, got)
+		}
+	}
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	expectShards("cluster1", "cluster2")
+
+	// The least recently updated shard is evicted.
+	s.edsCacheUpdate("cluster3", "a.example.com", "ns1", endpoints)
+	expectShards("cluster2", "cluster3")
+
+	// Updating a shard makes it the most recently updated one.
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster4", "a.example.com", "ns1", endpoints)
+	expectShards("cluster2", "cluster4")
+}
+
+func TestMinEndpointsPerService(t *testing.T) {
+	setFeatureForTest(t, &features.MinEndpointsPerService, map[string]int{"min.example.com": 2})
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}}
+	endpoints := func(addresses ...string) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, a := range addresses {
+			out = append(out, &model.IstioEndpoint{Address: a})
+		}
+		return out
+	}
+	count := func() int {
+		n := 0
+		for _, eps := range s.EndpointShardsByService["min.example.com"]["ns1"].Shards {
+			n += len(eps)
+		}
+		return n
+	}
+	rejected := func() float64 {
+		return sumValue(t, "pilot_eds_rejected_updates", "service", "min.example.com")
+	}
+
+	// Services below the minimum can still grow.
+	s.edsCacheUpdate("cluster1", "min.example.com", "ns1", endpoints("10.0.0.1"))
+	s.edsCacheUpdate("cluster1", "min.example.com", "ns1", endpoints("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	if got := count(); got != 3 {
+		t.Fatalf("expected 3 endpoints, got %d", got)
+	}
+
+	// Dropping to the minimum is accepted, dropping below it is rejected.
+	before := rejected()
+	s.edsCacheUpdate("cluster1", "min.example.com", "ns1", endpoints("10.0.0.1", "10.0.0.2"))
+	s.edsCacheUpdate("cluster1", "min.example.com", "ns1", endpoints("10.0.0.1"))
+	s.edsCacheUpdate("cluster1", "min.example.com", "ns1", nil)
+	if got := count(); got != 2 {
+		t.Fatalf("expected the previous 2 endpoints to be kept, got %d", got)
+	}
+	if got := rejected() - before; got != 2 {
+		t.Fatalf("expected 2 rejected updates, got %v", got)
+	}
+
+	// Deleting the service is not affected.
+	s.deleteService("cluster1", "min.example.com", "ns1")
+	if _, f := s.EndpointShardsByService["min.example.com"]; f {
+		t.Fatalf("expected the service to be deleted")
+	}
+}
+
+func TestEndpointShardDeletionGracePeriod(t *testing.T) {
+	setFeatureForTest(t, &features.EndpointShardDeletionGracePeriod, 10*time.Second)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}, clock: fakeClock}
+	endpoints := []*model.IstioEndpoint{{Address: "10.0.0.1"}}
+	shards := func() map[string]int {
+		out := map[string]int{}
+		for shard, eps := range s.EndpointShardsByService["a.example.com"]["ns1"].Shards {
+			out[shard] = len(eps)
+		}
+		return out
+	}
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+
+	// The shard is retained empty within the grace period, and reused when endpoints come back.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", nil)
+	if got, want := shards(), map[string]int{"cluster1": 0, "cluster2": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected shards %v, got %v", want, got)
+	}
+	fakeClock.Step(5 * time.Second)
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints)
+	if got, want := shards(), map[string]int{"cluster1": 1, "cluster2": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected shards %v, got %v", want, got)
+	}
+
+	// The grace period restarts once the shard is empty again, and the shard is deleted on the next update
+	// after it expired.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", nil)
+	fakeClock.Step(9 * time.Second)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	if got, want := shards(), map[string]int{"cluster1": 0, "cluster2": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected shards %v, got %v", want, got)
+	}
+	fakeClock.Step(time.Second)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	if got, want := shards(), map[string]int{"cluster2": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected shards %v, got %v", want, got)
+	}
+}
+
+func TestEndpointResync(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	endpoint := func(addr string) *model.IstioEndpoint {
+		return &model.IstioEndpoint{Address: addr, EndpointPort: 80, ServicePortName: "http"}
+	}
+	addresses := func(hostname, cluster string) []string {
+		out := []string{}
+		for _, ep := range s.EndpointShardsByService[hostname]["ns1"].Shards[cluster] {
+			out = append(out, ep.Address)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.0.1"), endpoint("10.0.0.2")})
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.1.1")})
+	s.edsCacheUpdate("cluster1", "b.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.2.1")})
+
+	s.StartEndpointResync("cluster1")
+	// Endpoints missing from the updates during the resync keep being served, while new ones are added.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.0.3")})
+	s.edsCacheUpdate("cluster1", "b.example.com", "ns1", nil)
+	if got, want := addresses("a.example.com", "cluster1"), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+	if got, want := addresses("b.example.com", "cluster1"), []string{"10.0.2.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+	// The resync confirms one of the endpoints; updates of other clusters are not affected.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.0.2"), endpoint("10.0.0.3")})
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", nil)
+	if got := addresses("a.example.com", "cluster2"); len(got) != 0 {
+		t.Fatalf("expected no endpoints in cluster2, got %v", got)
+	}
+
+	s.FinishEndpointResync("cluster1")
+	if got, want := addresses("a.example.com", "cluster1"), []string{"10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+	if got := addresses("b.example.com", "cluster1"); len(got) != 0 {
+		t.Fatalf("expected no endpoints, got %v", got)
+	}
+	select {
+	case req := <-s.pushChannel:
+		want := map[model.ConfigKey]struct{}{
+			{Kind: gvk.ServiceEntry, Name: "a.example.com", Namespace: "ns1"}: {},
+			{Kind: gvk.ServiceEntry, Name: "b.example.com", Namespace: "ns1"}: {},
+		}
+		if req.Full || !reflect.DeepEqual(req.ConfigsUpdated, want) {
+			t.Fatalf("expected an incremental push of %v, got %+v", want, req)
+		}
+	default:
+		t.Fatal("expected a push once the resync is finished")
+	}
+
+	// Once finished, updates replace the endpoints again.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{endpoint("10.0.0.3")})
+	if got, want := addresses("a.example.com", "cluster1"), []string{"10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+}
+
+func TestPauseEds(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	addresses := func(hostname string) []string {
+		out := []string{}
+		if ep := s.EndpointShardsByService[hostname]["ns1"]; ep != nil {
+			for _, e := range ep.Shards["cluster1"] {
+				out = append(out, e.Address)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	<-s.pushChannel
+
+	s.PauseEds()
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}})
+	s.EDSUpdate("cluster1", "b.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.1.1"}})
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}, {Address: "10.0.0.3"}})
+	if got := len(s.pushChannel); got != 0 {
+		t.Fatalf("expected no push while paused, got %d", got)
+	}
+	if got, want := addresses("a.example.com"), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v while paused, got %v", want, got)
+	}
+
+	s.ResumeEds()
+	if got := len(s.pushChannel); got != 1 {
+		t.Fatalf("expected a single push on resume, got %d", got)
+	}
+	req := <-s.pushChannel
+	want := map[model.ConfigKey]struct{}{
+		{Kind: gvk.ServiceEntry, Name: "a.example.com", Namespace: "ns1"}: {},
+		{Kind: gvk.ServiceEntry, Name: "b.example.com", Namespace: "ns1"}: {},
+	}
+	if !reflect.DeepEqual(req.ConfigsUpdated, want) {
+		t.Fatalf("expected a push of %v, got %v", want, req.ConfigsUpdated)
+	}
+	// b.example.com is a new service, which needs a full push.
+	if !req.Full {
+		t.Fatal("expected a full push")
+	}
+	if got, want := addresses("a.example.com"), []string{"10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the final endpoints %v, got %v", want, got)
+	}
+	if got, want := addresses("b.example.com"), []string{"10.0.1.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the final endpoints %v, got %v", want, got)
+	}
+
+	// Once resumed, updates are pushed right away.
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.4"}})
+	if got := len(s.pushChannel); got != 1 {
+		t.Fatalf("expected a push after resuming, got %d", got)
+	}
+}
+
+func TestPauseEdsShardWrites(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	addresses := func(hostname string) []string {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		ep := s.EndpointShardsByService[hostname]["ns1"]
+		if ep == nil {
+			return nil
+		}
+		out := []string{}
+		for _, e := range ep.Shards["cluster1"] {
+			out = append(out, e.Address)
+		}
+		sort.Strings(out)
+		return out
+	}
+	s.EDSUpdate("cluster1", "deleted.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	s.EDSUpdate("cluster1", "cached.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.1.1"}})
+	s.EDSUpdate("cluster1", "evicted.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.2.1"}})
+
+	s.PauseEds()
+	s.EDSUpdate("cluster1", "deleted.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}})
+	s.EDSUpdate("cluster1", "cached.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.1.2"}})
+	s.EDSUpdate("cluster1", "evicted.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.2.1"}, {Address: "10.0.2.2"}})
+	// Writes of the shards which are not deferred are newer than the deferred updates.
+	s.SvcUpdate("cluster1", "deleted.example.com", "ns1", model.EventDelete)
+	s.EDSCacheUpdate("cluster1", "cached.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.1.3"}})
+	s.EvictEndpoint("evicted.example.com", "ns1", "10.0.2.1")
+	s.ResumeEds()
+
+	if got := addresses("deleted.example.com"); got != nil {
+		t.Fatalf("expected the service deleted while paused to stay deleted, got endpoints %v", got)
+	}
+	if got, want := addresses("cached.example.com"), []string{"10.0.1.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the newer endpoints %v, got %v", want, got)
+	}
+	if got, want := addresses("evicted.example.com"), []string{"10.0.2.2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the evicted endpoint to stay evicted, got %v", got)
+	}
+
+	s.PauseEds()
+	s.EDSUpdate("cluster1", "cached.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.1.4"}})
+	s.ReplaceRegistryShards("cluster1", map[ServiceRef][]*model.IstioEndpoint{
+		{Hostname: "cached.example.com", Namespace: "ns1"}: {{Address: "10.0.1.5"}},
+	})
+	s.ResumeEds()
+	if got, want := addresses("cached.example.com"), []string{"10.0.1.5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the replaced endpoints %v, got %v", want, got)
+	}
+}
+
+func TestEndpointShardLastUpdated(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}, clock: fakeClock}
+	endpoints := []*model.IstioEndpoint{{Address: "10.0.0.1"}}
+	lastUpdated := func() map[string]time.Time {
+		out := map[string]time.Time{}
+		for shard, t := range s.EndpointShardsByService["a.example.com"]["ns1"].LastUpdated {
+			out[shard] = t
+		}
+		return out
+	}
+
+	start := fakeClock.Now()
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints)
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints)
+	fakeClock.Step(time.Minute)
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}})
+	if got, want := lastUpdated(), map[string]time.Time{"cluster1": start.Add(time.Minute), "cluster2": start}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected update times %v, got %v", want, got)
+	}
+
+	// Deleted shards are no longer tracked.
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", nil)
+	if got, want := lastUpdated(), map[string]time.Time{"cluster1": start.Add(time.Minute)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected update times %v, got %v", want, got)
+	}
+}
+
+func TestTerminatingNamespaceUpdates(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	d := s.Discovery
+	ep := func(addresses ...string) []*model.IstioEndpoint {
+		eps := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, a := range addresses {
+			eps = append(eps, &model.IstioEndpoint{Address: a, EndpointPort: 80, ServicePortName: "http"})
+		}
+		return eps
+	}
+	shard := func(clusterID, hostname, namespace string) []string {
+		d.mutex.RLock()
+		defer d.mutex.RUnlock()
+		shards := d.EndpointShardsByService[hostname][namespace]
+		if shards == nil {
+			return nil
+		}
+		shards.mutex.RLock()
+		defer shards.mutex.RUnlock()
+		var addresses []string
+		for _, e := range shards.Shards[clusterID] {
+			addresses = append(addresses, e.Address)
+		}
+		sort.Strings(addresses)
+		return addresses
+	}
+	const a = "a.terminating.svc.cluster.local"
+	d.EDSUpdate("cluster1", a, "terminating", ep("10.0.0.1", "10.0.0.2"))
+	d.NamespaceUpdate("cluster1", "terminating", true)
+
+	// Updates adding or changing endpoints are suppressed.
+	d.EDSUpdate("cluster1", a, "terminating", ep("10.0.0.1", "10.0.0.2", "10.0.0.3"))
+	d.EDSCacheUpdate("cluster1", "b.terminating.svc.cluster.local", "terminating", ep("10.0.0.4"))
+	if got := shard("cluster1", a, "terminating"); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("expected the update adding endpoints to be suppressed, got %v", got)
+	}
+	if got := shard("cluster1", "b.terminating.svc.cluster.local", "terminating"); got != nil {
+		t.Fatalf("expected the update of a new service to be suppressed, got %v", got)
+	}
+
+	// Updates removing endpoints, as the pods of the namespace are deleted, are applied.
+	d.EDSUpdate("cluster1", a, "terminating", ep("10.0.0.2"))
+	if got := shard("cluster1", a, "terminating"); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Fatalf("expected the update removing endpoints to be applied, got %v", got)
+	}
+	d.EDSCacheUpdate("cluster1", a, "terminating", nil)
+	if got := shard("cluster1", a, "terminating"); got != nil {
+		t.Fatalf("expected the update removing all endpoints to be applied, got %v", got)
+	}
+
+	// The namespace only terminates in cluster1: the updates of other clusters and namespaces proceed.
+	d.EDSUpdate("cluster2", a, "terminating", ep("10.0.1.1"))
+	d.EDSUpdate("cluster1", "a.default.svc.cluster.local", "default", ep("10.0.0.5"))
+	if shard("cluster2", a, "terminating") == nil || shard("cluster1", "a.default.svc.cluster.local", "default") == nil {
+		t.Fatalf("expected updates of other clusters and namespaces to proceed")
+	}
+	// Another cluster does not clear the terminating namespace of cluster1.
+	d.NamespaceUpdate("cluster2", "terminating", false)
+	d.EDSUpdate("cluster1", a, "terminating", ep("10.0.0.6"))
+	if got := shard("cluster1", a, "terminating"); got != nil {
+		t.Fatalf("expected updates to still be suppressed, got %v", got)
+	}
+
+	// Once the namespace is no longer terminating, e.g. recreated, updates proceed again.
+	d.NamespaceUpdate("cluster1", "terminating", false)
+	d.EDSUpdate("cluster1", a, "terminating", ep("10.0.0.6"))
+	if got := shard("cluster1", a, "terminating"); !reflect.DeepEqual(got, []string{"10.0.0.6"}) {
+		t.Fatalf("expected updates to proceed after the namespace stopped terminating, got %v", got)
+	}
+}
@@ -15,11 +15,17 @@
 package xds
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
 
 	networkingapi "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	networking "istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
@@ -38,6 +44,8 @@ import (
 // Note that aggregated list is expensive (for large numbers) - we want to replace
 // it with a model where DiscoveryServer keeps track of all endpoint registries
 // directly, and calls them one by one.
+// Registries do not report errors from InstancesByPort, so a lookup for one service can not abort
+// the reconciliation of the others: the shards of every service in every registry are updated.
 func (s *DiscoveryServer) UpdateServiceShards(push *model.PushContext) error {
 	registries := s.getNonK8sRegistries()
 	// Short circuit now to avoid the call to Services
@@ -64,6 +72,7 @@ func (s *DiscoveryServer) UpdateServiceShards(push *model.PushContext) error {
 				}
 			}
 
+			s.discardDeferredEdsUpdate(registry.Cluster(), string(svc.Hostname), svc.Attributes.Namespace)
 			s.edsCacheUpdate(registry.Cluster(), string(svc.Hostname), svc.Attributes.Namespace, endpoints)
 		}
 	}
@@ -74,15 +83,75 @@ func (s *DiscoveryServer) UpdateServiceShards(push *model.PushContext) error {
 // SvcUpdate is a callback from service discovery when service info changes.
 func (s *DiscoveryServer) SvcUpdate(cluster, hostname string, namespace string, event model.Event) {
 	// When a service deleted, we should cleanup the endpoint shards and also remove keys from EndpointShardsByService to
-	// prevent memory leaks.
+	// prevent memory leaks. Deletes are processed for terminating namespaces as well, as they are the cleanup.
 	if event == model.EventDelete {
 		inboundServiceDeletes.Increment()
 		s.deleteService(cluster, hostname, namespace)
-	} else {
+	} else if !s.namespaceTerminating(cluster, namespace) {
 		inboundServiceUpdates.Increment()
 	}
 }
 
+// clusterNamespace identifies a namespace of a cluster.
+type clusterNamespace struct {
+	clusterID string
+	namespace string
+}
+
+// NamespaceUpdate implements model.NamespaceUpdater. Endpoint updates of a namespace terminating in the
+// cluster are suppressed, as they are churn from the soon-to-be-deleted services, unless they remove
+// endpoints: the pods of the namespace are deleted before its services.
+func (s *DiscoveryServer) NamespaceUpdate(clusterID, namespace string, terminating bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := clusterNamespace{clusterID: clusterID, namespace: namespace}
+	if terminating {
+		s.terminatingNamespaces[key] = struct{}{}
+	} else {
+		delete(s.terminatingNamespaces, key)
+	}
+}
+
+// namespaceTerminating returns whether the namespace is being deleted in the cluster.
+func (s *DiscoveryServer) namespaceTerminating(clusterID, namespace string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, f := s.terminatingNamespaces[clusterNamespace{clusterID: clusterID, namespace: namespace}]
+	return f
+}
+
+// skipTerminatingUpdate returns whether the update of the endpoints of the service in the cluster can be
+// skipped, because the namespace is terminating in the cluster and the update does not remove endpoints.
+func (s *DiscoveryServer) skipTerminatingUpdate(clusterID, hostname, namespace string, istioEndpoints []*model.IstioEndpoint) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.skipTerminatingUpdateLocked(clusterID, hostname, namespace, istioEndpoints)
+}
+
+// skipTerminatingUpdateLocked is skipTerminatingUpdate, with the mutex held.
+func (s *DiscoveryServer) skipTerminatingUpdateLocked(clusterID, hostname, namespace string,
+	istioEndpoints []*model.IstioEndpoint) bool {
+	if _, f := s.terminatingNamespaces[clusterNamespace{clusterID: clusterID, namespace: namespace}]; !f {
+		return false
+	}
+	ep := s.EndpointShardsByService[hostname][namespace]
+	if ep == nil {
+		return true
+	}
+	updated := make(map[string]struct{}, len(istioEndpoints))
+	for _, e := range istioEndpoints {
+		updated[endpointKey(e)] = struct{}{}
+	}
+	ep.mutex.RLock()
+	defer ep.mutex.RUnlock()
+	for _, e := range ep.Shards[clusterID] {
+		if _, f := updated[endpointKey(e)]; !f {
+			return false
+		}
+	}
+	return true
+}
+
 // EDSUpdate computes destination address membership across all clusters and networks.
 // This is the main method implementing EDS.
 // It replaces InstancesByPort in model - instead of iterating over all endpoints it uses
@@ -90,11 +159,25 @@ func (s *DiscoveryServer) SvcUpdate(cluster, hostname string, namespace string,
 // on each step: instead the conversion happens once, when an endpoint is first discovered.
 func (s *DiscoveryServer) EDSUpdate(clusterID, serviceName string, namespace string,
 	istioEndpoints []*model.IstioEndpoint) {
+	if s.skipTerminatingUpdate(clusterID, serviceName, namespace, istioEndpoints) {
+		adsLog.Debugf("Skipping EDS update of service %s in terminating namespace %s", serviceName, namespace)
+		return
+	}
 	inboundEDSUpdates.Increment()
+	if s.deferEdsUpdate(clusterID, serviceName, namespace, istioEndpoints) {
+		edsDeferredUpdates.Increment()
+		return
+	}
 	// Update the endpoint shards
-	fp := s.edsCacheUpdate(clusterID, serviceName, namespace, istioEndpoints)
+	fp, rejected := s.edsCacheUpdate(clusterID, serviceName, namespace, istioEndpoints)
+	if !rejected {
+		recordEDSUpdateKind(fp)
+	}
+	if !s.edsPushAllowed(serviceName, namespace, fp) {
+		return
+	}
 	// Trigger a push
-	s.ConfigUpdate(&model.PushRequest{
+	req := &model.PushRequest{
 		Full: fp,
 		ConfigsUpdated: map[model.ConfigKey]struct{}{{
 			Kind:      gvk.ServiceEntry,
@@ -102,7 +185,122 @@ func (s *DiscoveryServer) EDSUpdate(clusterID, serviceName string, namespace str
 			Namespace: namespace,
 		}: {}},
 		Reason: []model.TriggerReason{model.EndpointUpdate},
+	}
+	s.notifyEdsPushObservers(req)
+	s.ConfigUpdate(req)
+}
+
+// OnEdsPushRequest registers an observer of the push requests triggered by EDS updates. Observers are
+// called asynchronously with a copy of the request, so they do not delay the push.
+func (s *DiscoveryServer) OnEdsPushRequest(observer func(*model.PushRequest)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.edsPushObservers = append(s.edsPushObservers, observer)
+}
+
+func (s *DiscoveryServer) notifyEdsPushObservers(req *model.PushRequest) {
+	s.mutex.RLock()
+	observers := s.edsPushObservers
+	s.mutex.RUnlock()
+	for _, observer := range observers {
+		// The request is owned by the debouncer once it is sent, so each observer gets its own copy.
+		observed := *req
+		go observer(&observed)
+	}
+}
+
+// EvictEndpoint removes the endpoints with the given address of the service from all shards and triggers
+// an incremental push. It returns whether any endpoint was removed. This allows to remove a known-bad
+// endpoint which the registry has not dropped yet; the eviction lasts until the next update of the shard
+// by its registry.
+func (s *DiscoveryServer) EvictEndpoint(hostname, namespace, address string) bool {
+	s.evictDeferredEndpoint(hostname, namespace, address)
+	s.mutex.RLock()
+	ep := s.EndpointShardsByService[hostname][namespace]
+	s.mutex.RUnlock()
+	if ep == nil {
+		return false
+	}
+
+	evicted := false
+	var audit []*EndpointAuditRecord
+	ep.mutex.Lock()
+	for clusterID, endpoints := range ep.Shards {
+		kept := make([]*model.IstioEndpoint, 0, len(endpoints))
+		for _, e := range endpoints {
+			if e.Address != address {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == len(endpoints) {
+			continue
+		}
+		adsLog.Infof("Evicting endpoint %s of service %s/%s in cluster %s", address, namespace, hostname, clusterID)
+		if flakyEndpointsEnabled() {
+			ep.recordReadinessFlips(clusterID, endpoints, kept)
+		}
+		ep.trackPropagation(clusterID, endpoints, kept)
+		if s.EndpointAuditHook != nil {
+			audit = append(audit, newEndpointAuditRecord(clusterID, hostname, namespace, endpoints, kept))
+		}
+		ep.Shards[clusterID] = kept
+		evicted = true
+	}
+	ep.mutex.Unlock()
+	if !evicted {
+		return false
+	}
+
+	s.mutex.Lock()
+	s.updateEmptyService(hostname, namespace)
+	s.mutex.Unlock()
+	s.auditEndpoints(audit)
+	s.ConfigUpdate(&model.PushRequest{
+		Full: false,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{{
+			Kind:      gvk.ServiceEntry,
+			Name:      hostname,
+			Namespace: namespace,
+		}: {}},
+		Reason: []model.TriggerReason{model.EndpointUpdate},
 	})
+	return true
+}
+
+// EndpointUpdateStream returns a channel accepting full endpoint snapshots of the service in the cluster,
+// for sources which change at a high rate. Snapshots are merged for the endpoint stream window and only
+// the latest one is applied, so at most one push is triggered per window. Closing the channel applies
+// the pending snapshot, if any, and stops the stream. The stream is also stopped, dropping the pending
+// snapshot, once stop is closed; senders should select on stop as well, as the channel is then no longer read.
+func (s *DiscoveryServer) EndpointUpdateStream(clusterID, hostname, namespace string,
+	stop <-chan struct{}) chan<- []*model.IstioEndpoint {
+	ch := make(chan []*model.IstioEndpoint)
+	go func() {
+		var pending []*model.IstioEndpoint
+		var hasPending bool
+		var window <-chan time.Time
+		for {
+			select {
+			case eps, ok := <-ch:
+				if !ok {
+					if hasPending {
+						s.EDSUpdate(clusterID, hostname, namespace, pending)
+					}
+					return
+				}
+				pending, hasPending = eps, true
+				if window == nil {
+					window = time.After(s.debounceOptions.endpointStreamWindow)
+				}
+			case <-window:
+				s.EDSUpdate(clusterID, hostname, namespace, pending)
+				pending, hasPending, window = nil, false, nil
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return ch
 }
 
 // EDSCacheUpdate computes destination address membership across all clusters and networks.
@@ -114,27 +312,47 @@ func (s *DiscoveryServer) EDSUpdate(clusterID, serviceName string, namespace str
 // Note: the difference with `EDSUpdate` is that it only update the cache rather than requesting a push
 func (s *DiscoveryServer) EDSCacheUpdate(clusterID, serviceName string, namespace string,
 	istioEndpoints []*model.IstioEndpoint) {
+	if s.skipTerminatingUpdate(clusterID, serviceName, namespace, istioEndpoints) {
+		adsLog.Debugf("Skipping EDS cache update of service %s in terminating namespace %s", serviceName, namespace)
+		return
+	}
 	inboundEDSUpdates.Increment()
+	s.discardDeferredEdsUpdate(clusterID, serviceName, namespace)
 	// Update the endpoint shards
-	s.edsCacheUpdate(clusterID, serviceName, namespace, istioEndpoints)
+	if fp, rejected := s.edsCacheUpdate(clusterID, serviceName, namespace, istioEndpoints); !rejected {
+		recordEDSUpdateKind(fp)
+	}
 }
 
 // edsCacheUpdate updates EndpointShards data by clusterID, hostname, IstioEndpoints.
-// It also tracks the changes to ServiceAccounts. It returns whether a full push
-// is needed or incremental push is sufficient.
+// It also tracks the changes to ServiceAccounts. It returns whether a full push is needed or incremental push
+// is sufficient, and whether the update was rejected by PILOT_MIN_ENDPOINTS_PER_SERVICE. The kind of the
+// update is recorded by the callers applying updates of registries, not by the reconciliation of the shards.
 func (s *DiscoveryServer) edsCacheUpdate(clusterID, hostname string, namespace string,
-	istioEndpoints []*model.IstioEndpoint) bool {
+	istioEndpoints []*model.IstioEndpoint) (fullPush bool, rejected bool) {
+	if s.endpointResyncing(clusterID) {
+		// Endpoints missing from the update are kept serving until the resync confirms they are gone.
+		istioEndpoints = s.retainStaleEndpoints(clusterID, hostname, namespace, istioEndpoints)
+	}
+	if s.belowMinEndpoints(clusterID, hostname, namespace, istioEndpoints) {
+		adsLog.Warnf("Rejecting update of service %s/%s in cluster %s: it would drop the endpoints below %d",
+			namespace, hostname, clusterID, features.MinEndpointsPerService[hostname])
+		recordRejectedEndpointUpdate(hostname)
+		return false, true
+	}
 	if len(istioEndpoints) == 0 {
 		// Should delete the service EndpointShards when endpoints become zero to prevent memory leak,
 		// but we should not do not delete the keys from EndpointShardsByService map - that will trigger
 		// unnecessary full push which can become a real problem if a pod is in crashloop and thus endpoints
-		// flip flopping between 1 and 0.
+		// flip flopping between 1 and 0. The shard itself is retained empty for
+		// PILOT_ENDPOINT_SHARD_DELETION_GRACE_PERIOD, if set, to be reused by a quick scale up.
 		s.deleteEndpointShards(clusterID, hostname, namespace)
 		adsLog.Infof("Incremental push, service %s has no endpoints", hostname)
-		return false
+		return false, false
 	}
 
-	fullPush := false
+	// Locality labels are parsed once here rather than on each build of the endpoints.
+	normalizeEndpointLocalities(hostname, istioEndpoints)
 
 	// Find endpoint shard for this service, if it is available - otherwise create a new one.
 	ep, created := s.getOrCreateEndpointShard(hostname, namespace)
@@ -144,6 +362,25 @@ func (s *DiscoveryServer) edsCacheUpdate(clusterID, hostname string, namespace s
 		fullPush = true
 	}
 
+	var audit []*EndpointAuditRecord
+	if s.updateEndpointShard(ep, created, clusterID, hostname, namespace, istioEndpoints, &audit) {
+		fullPush = true
+	}
+
+	s.mutex.Lock()
+	s.updateEmptyService(hostname, namespace)
+	s.mutex.Unlock()
+
+	s.auditEndpoints(audit)
+	return fullPush, false
+}
+
+// updateEndpointShard replaces the endpoints of the shard of the cluster, in the endpoint shards of the service,
+// which may have just been created. It returns whether the service accounts of an existing service changed,
+// requiring a full push. Audit records of the change are appended to audit.
+func (s *DiscoveryServer) updateEndpointShard(ep *EndpointShards, created bool, clusterID, hostname, namespace string,
+	istioEndpoints []*model.IstioEndpoint, audit *[]*EndpointAuditRecord) bool {
+	fullPush := false
 	// Check if ServiceAccounts have changed. We should do a full push if they have changed.
 	serviceAccounts := sets.Set{}
 	for _, e := range istioEndpoints {
@@ -154,23 +391,114 @@ func (s *DiscoveryServer) edsCacheUpdate(clusterID, hostname string, namespace s
 
 	ep.mutex.Lock()
 	// For existing endpoints, we need to do full push if service accounts change.
-	if !fullPush && !serviceAccounts.Equals(ep.ServiceAccounts) {
+	if !created && !serviceAccounts.Equals(ep.ServiceAccounts) {
 		adsLog.Debugf("Updating service accounts now, svc %v, before service account %v, after %v",
 			hostname, ep.ServiceAccounts, serviceAccounts)
-		adsLog.Infof("Full push, service accounts changed, %v", hostname)
-		fullPush = true
+		if s.serviceAccountPushAllowed(ep, hostname, namespace) {
+			adsLog.Infof("Full push, service accounts changed, %v", hostname)
+			fullPush = true
+		}
 	}
+	if flakyEndpointsEnabled() {
+		ep.recordReadinessFlips(clusterID, ep.Shards[clusterID], istioEndpoints)
+	}
+	ep.trackPropagation(clusterID, ep.Shards[clusterID], istioEndpoints)
+	if s.EndpointAuditHook != nil {
+		*audit = append(*audit, newEndpointAuditRecord(clusterID, hostname, namespace, ep.Shards[clusterID], istioEndpoints))
+	}
+	reuseEnvoyEndpoints(ep.Shards[clusterID], istioEndpoints)
 	ep.Shards[clusterID] = istioEndpoints
+	ep.shardUpdated(clusterID)
 	ep.ServiceAccounts = serviceAccounts
+	delete(ep.emptySince, clusterID)
+	ep.pruneEmptyShards()
+	if features.MaxShardsPerService > 0 {
+		for shard, evicted := range ep.evictOldestShards(clusterID, hostname, features.MaxShardsPerService) {
+			ep.trackPropagation(shard, evicted, nil)
+			if s.EndpointAuditHook != nil {
+				*audit = append(*audit, newEndpointAuditRecord(shard, hostname, namespace, evicted, nil))
+			}
+		}
+	}
 	ep.mutex.Unlock()
-
 	return fullPush
 }
 
+// serviceAccountPushAllowed returns whether a change of the service accounts of the service triggers a full
+// push now. With PILOT_SERVICE_ACCOUNT_FULL_PUSH_WINDOW set, only one such push is allowed per window: later
+// changes are coalesced into a single full push scheduled at the end of the window, so proxies still converge
+// on the latest service accounts. Must be called with the mutex of the endpoint shards held.
+func (s *DiscoveryServer) serviceAccountPushAllowed(ep *EndpointShards, hostname, namespace string) bool {
+	window := features.ServiceAccountFullPushWindow
+	if window <= 0 {
+		return true
+	}
+	now := s.clock.Now()
+	elapsed := now.Sub(ep.lastServiceAccountPush)
+	if elapsed >= window {
+		ep.lastServiceAccountPush = now
+		return true
+	}
+	edsServiceAccountPushesCoalesced.Increment()
+	if ep.serviceAccountPushPending {
+		return false
+	}
+	ep.serviceAccountPushPending = true
+	timer := s.clock.NewTimer(window - elapsed)
+	go func() {
+		<-timer.C()
+		ep.mutex.Lock()
+		ep.serviceAccountPushPending = false
+		ep.lastServiceAccountPush = s.clock.Now()
+		ep.mutex.Unlock()
+		adsLog.Infof("Full push, service accounts changed, %v (coalesced)", hostname)
+		req := &model.PushRequest{
+			Full: true,
+			ConfigsUpdated: map[model.ConfigKey]struct{}{{
+				Kind:      gvk.ServiceEntry,
+				Name:      hostname,
+				Namespace: namespace,
+			}: {}},
+			Reason: []model.TriggerReason{model.EndpointUpdate},
+		}
+		s.notifyEdsPushObservers(req)
+		s.ConfigUpdate(req)
+	}()
+	return false
+}
+
+// belowMinEndpoints returns whether updating the shard of the cluster with the endpoints would reduce the
+// endpoints of the service below its minimum set in PILOT_MIN_ENDPOINTS_PER_SERVICE.
+func (s *DiscoveryServer) belowMinEndpoints(clusterID, hostname, namespace string, istioEndpoints []*model.IstioEndpoint) bool {
+	min, f := features.MinEndpointsPerService[hostname]
+	if !f {
+		return false
+	}
+	s.mutex.RLock()
+	ep := s.EndpointShardsByService[hostname][namespace]
+	s.mutex.RUnlock()
+	if ep == nil {
+		return false
+	}
+	ep.mutex.RLock()
+	defer ep.mutex.RUnlock()
+	before := 0
+	for _, endpoints := range ep.Shards {
+		before += len(endpoints)
+	}
+	after := before - len(ep.Shards[clusterID]) + len(istioEndpoints)
+	// Services which have not reached the minimum yet can still grow.
+	return after < min && after < before
+}
+
 func (s *DiscoveryServer) getOrCreateEndpointShard(serviceName, namespace string) (*EndpointShards, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	return s.getOrCreateEndpointShardLocked(serviceName, namespace)
+}
 
+// getOrCreateEndpointShardLocked is getOrCreateEndpointShard, with the mutex held.
+func (s *DiscoveryServer) getOrCreateEndpointShardLocked(serviceName, namespace string) (*EndpointShards, bool) {
 	if _, exists := s.EndpointShardsByService[serviceName]; !exists {
 		s.EndpointShardsByService[serviceName] = map[string]*EndpointShards{}
 	}
@@ -181,6 +509,9 @@ func (s *DiscoveryServer) getOrCreateEndpointShard(serviceName, namespace string
 	ep := &EndpointShards{
 		Shards:          map[string][]*model.IstioEndpoint{},
 		ServiceAccounts: sets.Set{},
+		clock:           s.clock,
+
+		pendingPropagationTotal: &s.pendingPropagation,
 	}
 	s.EndpointShardsByService[serviceName][namespace] = ep
 
@@ -191,18 +522,142 @@ func (s *DiscoveryServer) getOrCreateEndpointShard(serviceName, namespace string
 // endpoints are deleted.
 func (s *DiscoveryServer) deleteEndpointShards(cluster, serviceName, namespace string) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	audit := s.deleteEndpointShardsLocked(cluster, serviceName, namespace)
+	s.mutex.Unlock()
+	s.auditEndpoints([]*EndpointAuditRecord{audit})
+}
+
+// deleteEndpointShardsLocked is deleteEndpointShards, with the mutex held. The audit record of the deletion,
+// if any, is returned.
+func (s *DiscoveryServer) deleteEndpointShardsLocked(cluster, serviceName, namespace string) *EndpointAuditRecord {
+	var audit *EndpointAuditRecord
 	if s.EndpointShardsByService[serviceName] != nil &&
 		s.EndpointShardsByService[serviceName][namespace] != nil {
-		s.EndpointShardsByService[serviceName][namespace].mutex.Lock()
-		delete(s.EndpointShardsByService[serviceName][namespace].Shards, cluster)
-		s.EndpointShardsByService[serviceName][namespace].mutex.Unlock()
+		ep := s.EndpointShardsByService[serviceName][namespace]
+		ep.mutex.Lock()
+		if flakyEndpointsEnabled() {
+			ep.recordReadinessFlips(cluster, ep.Shards[cluster], nil)
+		}
+		ep.trackPropagation(cluster, ep.Shards[cluster], nil)
+		if s.EndpointAuditHook != nil {
+			audit = newEndpointAuditRecord(cluster, serviceName, namespace, ep.Shards[cluster], nil)
+		}
+		if _, f := ep.Shards[cluster]; f && features.EndpointShardDeletionGracePeriod > 0 {
+			ep.retainEmptyShard(cluster)
+			ep.shardUpdated(cluster)
+		} else {
+			delete(ep.Shards, cluster)
+			delete(ep.shardUpdates, cluster)
+			delete(ep.LastUpdated, cluster)
+		}
+		ep.pruneEmptyShards()
+		ep.mutex.Unlock()
+		s.updateEmptyService(serviceName, namespace)
+	}
+	return audit
+}
+
+// reachedMinShards returns whether minShards shards had endpoints at once since the service was created, and
+// the number of shards with endpoints while it is not reached. Shards retained empty during
+// PILOT_ENDPOINT_SHARD_DELETION_GRACE_PERIOD do not count. Once reached, the minimum is no longer checked, so
+// endpoints keep being sent if clusters go away.
+func (e *EndpointShards) reachedMinShards(minShards int) (int, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.minShardsReached {
+		return 0, true
+	}
+	shards := 0
+	for cluster, endpoints := range e.Shards {
+		if _, retained := e.emptySince[cluster]; retained || len(endpoints) == 0 {
+			continue
+		}
+		shards++
+	}
+	e.minShardsReached = shards >= minShards
+	return shards, e.minShardsReached
+}
+
+// shardUpdated records the time of the update of the shard. Must be called with the mutex held.
+func (e *EndpointShards) shardUpdated(cluster string) {
+	if e.LastUpdated == nil {
+		e.LastUpdated = map[string]time.Time{}
+	}
+	e.LastUpdated[cluster] = e.now()
+}
+
+// retainEmptyShard empties the shard of the cluster, which is deleted once it has been empty for
+// PILOT_ENDPOINT_SHARD_DELETION_GRACE_PERIOD. Must be called with the mutex held.
+func (e *EndpointShards) retainEmptyShard(cluster string) {
+	e.Shards[cluster] = []*model.IstioEndpoint{}
+	if e.emptySince == nil {
+		e.emptySince = map[string]time.Time{}
+	}
+	if _, f := e.emptySince[cluster]; !f {
+		e.emptySince[cluster] = e.now()
+	}
+}
+
+// pruneEmptyShards deletes the retained empty shards whose grace period has expired. Shards are pruned
+// on updates of the service. Must be called with the mutex held.
+func (e *EndpointShards) pruneEmptyShards() {
+	if len(e.emptySince) == 0 {
+		return
+	}
+	now := e.now()
+	for cluster, since := range e.emptySince {
+		if now.Sub(since) >= features.EndpointShardDeletionGracePeriod {
+			delete(e.Shards, cluster)
+			delete(e.shardUpdates, cluster)
+			delete(e.emptySince, cluster)
+			delete(e.LastUpdated, cluster)
+		}
+	}
+}
+
+// evictOldestShards records the update of the shard, and evicts the least recently updated shards until at
+// most max shards remain. The updated shard is never evicted. The endpoints of the evicted shards are
+// returned, keyed by shard. Must be called with the mutex held.
+func (e *EndpointShards) evictOldestShards(updated, hostname string, max int) map[string][]*model.IstioEndpoint {
+	if e.shardUpdates == nil {
+		e.shardUpdates = map[string]uint64{}
+	}
+	e.shardUpdateSeq++
+	e.shardUpdates[updated] = e.shardUpdateSeq
+	var evicted map[string][]*model.IstioEndpoint
+	for len(e.Shards) > max {
+		oldest := ""
+		for shard := range e.Shards {
+			if shard == updated {
+				continue
+			}
+			// Shards updated before the limit was enabled have no sequence number, and are evicted first.
+			if oldest == "" || e.shardUpdates[shard] < e.shardUpdates[oldest] ||
+				(e.shardUpdates[shard] == e.shardUpdates[oldest] && shard < oldest) {
+				oldest = shard
+			}
+		}
+		if oldest == "" {
+			break
+		}
+		adsLog.Warnf("Evicting endpoint shard %s of service %s, exceeding the maximum of %d shards", oldest, hostname, max)
+		if evicted == nil {
+			evicted = map[string][]*model.IstioEndpoint{}
+		}
+		evicted[oldest] = e.Shards[oldest]
+		delete(e.Shards, oldest)
+		delete(e.shardUpdates, oldest)
+		delete(e.emptySince, oldest)
+		delete(e.LastUpdated, oldest)
 	}
+	return evicted
 }
 
 // deleteService deletes all service related references from EndpointShardsByService. This is called
 // when a service is deleted.
 func (s *DiscoveryServer) deleteService(cluster, serviceName, namespace string) {
+	// A deferred update must not recreate the shard of the deleted service.
+	s.discardDeferredEdsUpdate(cluster, serviceName, namespace)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -210,16 +665,22 @@ func (s *DiscoveryServer) deleteService(cluster, serviceName, namespace string)
 		s.EndpointShardsByService[serviceName][namespace] != nil {
 
 		s.EndpointShardsByService[serviceName][namespace].mutex.Lock()
+		s.EndpointShardsByService[serviceName][namespace].trackPropagation(cluster,
+			s.EndpointShardsByService[serviceName][namespace].Shards[cluster], nil)
 		delete(s.EndpointShardsByService[serviceName][namespace].Shards, cluster)
+		delete(s.EndpointShardsByService[serviceName][namespace].emptySince, cluster)
+		delete(s.EndpointShardsByService[serviceName][namespace].LastUpdated, cluster)
 		shards := len(s.EndpointShardsByService[serviceName][namespace].Shards)
 		s.EndpointShardsByService[serviceName][namespace].mutex.Unlock()
 
 		if shards == 0 {
 			delete(s.EndpointShardsByService[serviceName], namespace)
+			s.pushLoops.forget(ServiceRef{Hostname: serviceName, Namespace: namespace})
 		}
 		if len(s.EndpointShardsByService[serviceName]) == 0 {
 			delete(s.EndpointShardsByService, serviceName)
 		}
+		s.updateEmptyService(serviceName, namespace)
 	}
 }
 
@@ -242,6 +703,7 @@ func (s *DiscoveryServer) loadAssignmentsForCluster(b EndpointBuilder) *endpoint
 	// Gateways use EDS for Passthrough cluster. So we should allow Passthrough here.
 	if b.service.Resolution == model.DNSLB {
 		adsLog.Infof("cluster %s in eds cluster, but its resolution now is updated to %v, skipping it.", b.clusterName, b.service.Resolution)
+		traceEdsSkip(b.proxy.ID, []string{b.clusterName}, edsSkipDNSResolution)
 		return nil
 	}
 
@@ -254,6 +716,7 @@ func (s *DiscoveryServer) loadAssignmentsForCluster(b EndpointBuilder) *endpoint
 
 	s.mutex.RLock()
 	epShards, f := s.EndpointShardsByService[string(b.hostname)][b.service.Attributes.Namespace]
+	b.endpointFilters = s.endpointFilters
 	s.mutex.RUnlock()
 	if !f {
 		// Shouldn't happen here
@@ -261,6 +724,16 @@ func (s *DiscoveryServer) loadAssignmentsForCluster(b EndpointBuilder) *endpoint
 		return buildEmptyClusterLoadAssignment(b.clusterName)
 	}
 
+	// Until enough clusters reported, nothing is sent, so proxies keep the endpoints they have.
+	if minShards := features.EDSMinShards; minShards > 0 {
+		if shards, reached := epShards.reachedMinShards(minShards); !reached {
+			adsLog.Debugf("cluster %s has endpoints from %d clusters, waiting for %d", b.clusterName, shards, minShards)
+			traceEdsSkip(b.proxy.ID, []string{b.clusterName}, edsSkipMinShards)
+			return nil
+		}
+	}
+
+	b.localityLoads = s.localityLoads.current(s.clock.Now())
 	locEps := b.buildLocalityLbEndpointsFromShards(epShards, svcPort)
 
 	return &endpoint.ClusterLoadAssignment{
@@ -269,15 +742,64 @@ func (s *DiscoveryServer) loadAssignmentsForCluster(b EndpointBuilder) *endpoint
 	}
 }
 
+// PushEdsToConnection pushes the endpoints of all the clusters watched by a single connection, even if they
+// did not change since the last push, for example to remediate an Envoy suspected of having stale endpoints.
+// The push is handed to the connection like any other push, other connections are not pushed.
+func (s *DiscoveryServer) PushEdsToConnection(conID string) error {
+	s.adsClientsMutex.RLock()
+	con := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if con == nil {
+		return fmt.Errorf("connection %s not found", conID)
+	}
+	if con.Watched(v3.EndpointType) == nil {
+		return fmt.Errorf("connection %s does not watch endpoints", conID)
+	}
+
+	// A forced incremental push pushes all the watched clusters, and only EDS.
+	pushEv := &Event{
+		pushRequest: &model.PushRequest{
+			Push:     s.globalPushContext(),
+			Start:    time.Now(),
+			Reason:   []model.TriggerReason{model.DebugTrigger},
+			ForceEds: true,
+		},
+		done: func() {},
+	}
+	select {
+	case con.pushChannel <- pushEv:
+		return nil
+	case <-con.stream.Context().Done():
+		return fmt.Errorf("connection %s closed", conID)
+	}
+}
+
+// BuildEndpoints returns the ClusterLoadAssignments of the clusters for the proxy, as they would be pushed
+// over EDS, without going through a connection or the EDS cache. Clusters without endpoints to push are
+// omitted.
+func (s *DiscoveryServer) BuildEndpoints(proxy *model.Proxy, push *model.PushContext,
+	clusters []string) []*endpoint.ClusterLoadAssignment {
+	out := make([]*endpoint.ClusterLoadAssignment, 0, len(clusters))
+	for _, clusterName := range clusters {
+		if l := s.generateEndpoints(NewEndpointBuilder(clusterName, proxy, push)); l != nil {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
 func (s *DiscoveryServer) generateEndpoints(b EndpointBuilder) *endpoint.ClusterLoadAssignment {
+	if override := s.endpointOverride(b.proxy.ID, b.clusterName); override != nil {
+		return overriddenLoadAssignment(override)
+	}
 	l := s.loadAssignmentsForCluster(b)
 	if l == nil {
 		return nil
 	}
 
 	// If networks are set (by default they aren't) apply the Split Horizon
-	// EDS filter on the endpoints
-	if b.MultiNetworkConfigured() {
+	// EDS filter on the endpoints, unless the cluster opted out of it.
+	if b.MultiNetworkConfigured() && !b.networkFilterDisabled() {
 		l.Endpoints = b.EndpointsByNetworkFilter(l.Endpoints)
 	}
 
@@ -285,15 +807,73 @@ func (s *DiscoveryServer) generateEndpoints(b EndpointBuilder) *endpoint.Cluster
 	// Failover should only be enabled when there is an outlier detection, otherwise Envoy
 	// will never detect the hosts are unhealthy and redirect traffic.
 	enableFailover, lb := getOutlierDetectionAndLoadBalancerSettings(b.DestinationRule(), b.port, b.subsetName)
-	lbSetting := loadbalancer.GetLocalityLbSetting(b.push.Mesh.GetLocalityLbSetting(), lb.GetLocalityLbSetting())
-	if lbSetting != nil {
+	// Outlier detection is passive health checking. Clusters relying on it should not have any active
+	// health checks configured for their endpoints.
+	if enableFailover {
+		disableActiveHealthChecks(l)
+	}
+	lbSetting := b.localityLbSetting(lb)
+	// The percentages of each zone, when configured, replace the locality load balancing settings.
+	weights := b.zoneWeights()
+	// Endpoints prioritized by tier are not prioritized by locality.
+	if weights != nil && !endpointTiersEnabled() {
+		l = zoneWeightedLoadAssignment(weights, l)
+	} else if lbSetting != nil && !endpointTiersEnabled() {
 		// Make a shallow copy of the cla as we are mutating the endpoints with priorities/weights relative to the calling proxy
 		l = util.CloneClusterLoadAssignment(l)
 		loadbalancer.ApplyLocalityLBSetting(b.locality, l, lbSetting, enableFailover)
+		if enableFailover && lbSetting.GetDistribute() == nil {
+			recordLocalityFailover(configuredSubset(b.DestinationRule(), b.subsetName))
+		}
+	}
+	// Without locality failover or distribution, weights are precomputed for proxyless gRPC clients, which lack zone
+	// aware routing. Envoy ignores locality weights unless the cluster enables locality weighted load balancing.
+	if b.proxyless && weights == nil && !enableFailover && lbSetting.GetDistribute() == nil && !endpointTiersEnabled() &&
+		features.ZoneAwareEndpointWeights {
+		l = zoneAwareLoadAssignment(b.locality, l)
+	}
+	// Proxyless gRPC clients pick endpoints by weight, so the locality priorities are turned into weights.
+	if b.proxyless && features.GRPCFlattenLocalityPriorities {
+		l = flattenLocalityPriorities(l)
+	}
+	if shouldAddSelfEndpoint(b.clusterName) {
+		l = addSelfEndpoint(b, l)
+	}
+	if features.SortedEDSOutput {
+		l = sortLoadAssignment(l)
+	}
+	if shouldCaptureEndpoints(b.clusterName) {
+		s.captureEndpoints(b, l)
 	}
 	return l
 }
 
+// configuredSubset returns the subset name if it is defined by the DestinationRule, or an empty string
+// otherwise. Cluster names are provided by proxies, so this keeps metric cardinality bounded.
+func configuredSubset(dr *networkingapi.DestinationRule, subsetName string) string {
+	for _, subset := range dr.GetSubsets() {
+		if subset.Name == subsetName {
+			return subsetName
+		}
+	}
+	return ""
+}
+
+// disableActiveHealthChecks removes the active health check configuration from all endpoints of the cluster.
+// LbEndpoints are shared with the endpoint shards, so they are cloned before being modified.
+func disableActiveHealthChecks(l *endpoint.ClusterLoadAssignment) {
+	for _, locLbEps := range l.Endpoints {
+		for i, lbEp := range locLbEps.LbEndpoints {
+			if lbEp.GetEndpoint().GetHealthCheckConfig() == nil {
+				continue
+			}
+			clone := proto.Clone(lbEp).(*endpoint.LbEndpoint)
+			clone.GetEndpoint().HealthCheckConfig = nil
+			locLbEps.LbEndpoints[i] = clone
+		}
+	}
+}
+
 // Legacy v2 generator. Used only for gRPC
 type EdsV2Generator struct {
 	Generator *EdsGenerator
@@ -342,45 +922,87 @@ func edsNeedsPush(updates model.XdsUpdates) bool {
 
 func (eds *EdsGenerator) Generate(proxy *model.Proxy, push *model.PushContext, w *model.WatchedResource, req *model.PushRequest) model.Resources {
 	if !edsNeedsPush(req.ConfigsUpdated) {
+		traceEdsSkip(proxy.ID, w.ResourceNames, edsSkipNoEdsConfigUpdated)
 		return nil
 	}
+	updatedServices := model.ConfigNamesOfKind(req.ConfigsUpdated, gvk.ServiceEntry)
 	var edsUpdatedServices map[string]struct{}
-	if !req.Full {
-		edsUpdatedServices = model.ConfigNamesOfKind(req.ConfigsUpdated, gvk.ServiceEntry)
+	// Forced pushes send all the watched clusters, like full pushes.
+	if !req.Full && !req.ForceEds {
+		edsUpdatedServices = updatedServices
+		if len(req.ConfigsUpdated) > 0 && len(edsUpdatedServices) == 0 {
+			// None of the updated configs is a service, so there is nothing to recompute or send.
+			edsNoOpPushes.Increment()
+			traceEdsSkip(proxy.ID, w.ResourceNames, edsSkipNoServiceUpdated)
+			return nil
+		}
 	}
-	resources := make([]*any.Any, 0)
-	empty := 0
-
-	cached := 0
-	regenerated := 0
-	for _, clusterName := range w.ResourceNames {
+	clusters := make([]string, 0, len(w.ResourceNames))
+	for _, clusterName := range prioritizeUpdatedClusters(w.ResourceNames, updatedServices) {
 		if edsUpdatedServices != nil {
 			_, _, hostname, _ := model.ParseSubsetKey(clusterName)
 			if _, ok := edsUpdatedServices[string(hostname)]; !ok {
 				// Cluster was not updated, skip recomputing. This happens when we get an incremental update for a
-				// specific Hostname. On connect or for full push edsUpdatedServices will be empty.
+				// specific Hostname. On connect or for full push edsUpdatedServices will be nil.
+				traceEdsSkip(proxy.ID, []string{clusterName}, edsSkipServiceNotUpdated)
 				continue
 			}
 		}
-		builder := NewEndpointBuilder(clusterName, proxy, push)
-		if marshalledEndpoint, f := eds.Server.Cache.Get(builder); f {
-			resources = append(resources, marshalledEndpoint)
-			cached++
-		} else {
-			l := eds.Server.generateEndpoints(builder)
-			if l == nil {
-				continue
-			}
-			regenerated++
+		clusters = append(clusters, clusterName)
+	}
 
-			if len(l.Endpoints) == 0 {
-				empty++
-			}
-			resource := util.MessageToAny(l)
-			resources = append(resources, resource)
+	results := make([]edsClusterResult, len(clusters))
+	generate := func(i int) {
+		builder := NewEndpointBuilder(clusters[i], proxy, push)
+		builder.localityLoads = eds.Server.localityLoads.current(eds.Server.clock.Now())
+		// Overridden endpoints are specific to the proxy, so they are neither read from nor added to the cache.
+		overridden := eds.Server.endpointOverride(proxy.ID, clusters[i]) != nil
+		if marshalledEndpoint, f := eds.Server.Cache.Get(builder); f && !overridden {
+			results[i] = edsClusterResult{resource: marshalledEndpoint, cached: true}
+			return
+		}
+		l := eds.Server.generateEndpoints(builder)
+		if l == nil {
+			return
+		}
+		resource := util.MessageToAny(l)
+		results[i] = edsClusterResult{resource: resource, empty: len(l.Endpoints) == 0}
+		if !overridden {
 			eds.Server.Cache.Add(builder, resource)
 		}
 	}
+	if workers := features.EDSGenerationWorkers; workers > 1 && len(clusters) >= parallelEdsMinClusters {
+		generateInParallel(len(clusters), workers, generate)
+	} else {
+		for i := range clusters {
+			generate(i)
+		}
+	}
+
+	// Results are assembled in the order of the clusters, regardless of how they were generated.
+	resources := make([]*any.Any, 0, len(results))
+	empty := 0
+	cached := 0
+	regenerated := 0
+	for _, r := range results {
+		if r.resource == nil {
+			continue
+		}
+		resources = append(resources, r.resource)
+		if r.cached {
+			cached++
+			continue
+		}
+		regenerated++
+		if r.empty {
+			empty++
+		}
+	}
+	if edsUpdatedServices != nil && len(resources) == 0 {
+		// None of the updated services is watched by the proxy, so there is nothing to send.
+		edsNoOpPushes.Increment()
+		return nil
+	}
 	if len(edsUpdatedServices) == 0 {
 		adsLog.Infof("EDS: PUSH for node:%s resources:%d empty:%v cached:%v/%v",
 			proxy.ID, len(resources), empty, cached, cached+regenerated)
@@ -391,20 +1013,70 @@ func (eds *EdsGenerator) Generate(proxy *model.Proxy, push *model.PushContext, w
 	return resources
 }
 
+// parallelEdsMinClusters is the minimum number of clusters of a push for which the endpoints are generated
+// in parallel, below which the overhead of the workers is not worth it.
+const parallelEdsMinClusters = 100
+
+// edsClusterResult is the generated endpoints of a single cluster.
+type edsClusterResult struct {
+	resource *any.Any
+	cached   bool
+	empty    bool
+}
+
+// generateInParallel calls generate for all indexes in [0, n) using the given number of workers.
+func generateInParallel(n, workers int, generate func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	indexes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				generate(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// prioritizeUpdatedClusters orders the clusters so that the clusters of updated services are generated and
+// sent first, reducing the time to converge for the services that actually changed. The relative order of
+// the clusters is otherwise preserved.
+func prioritizeUpdatedClusters(clusters []string, updatedServices map[string]struct{}) []string {
+	if len(updatedServices) == 0 {
+		return clusters
+	}
+	ordered := make([]string, 0, len(clusters))
+	rest := make([]string, 0, len(clusters))
+	for _, clusterName := range clusters {
+		_, _, hostname, _ := model.ParseSubsetKey(clusterName)
+		if _, f := updatedServices[string(hostname)]; f {
+			ordered = append(ordered, clusterName)
+		} else {
+			rest = append(rest, clusterName)
+		}
+	}
+	return append(ordered, rest...)
+}
+
 func getOutlierDetectionAndLoadBalancerSettings(
 	destinationRule *networkingapi.DestinationRule,
 	portNumber int,
 	subsetName string) (bool, *networkingapi.LoadBalancerSettings) {
-	if destinationRule == nil {
-		return false, nil
-	}
 	var outlierDetectionEnabled = false
 	var lbSettings *networkingapi.LoadBalancerSettings
 
 	port := &model.Port{Port: portNumber}
-	policy := networking.MergeTrafficPolicy(nil, destinationRule.TrafficPolicy, port)
-
-	for _, subset := range destinationRule.Subsets {
+	policy := networking.MergeTrafficPolicy(nil, networking.DestinationRuleTrafficPolicy(destinationRule), port)
+	for _, subset := range destinationRule.GetSubsets() {
 		if subset.Name == subsetName {
 			policy = networking.MergeTrafficPolicy(policy, subset.TrafficPolicy, port)
 			break
@@ -421,7 +1093,8 @@ func getOutlierDetectionAndLoadBalancerSettings(
 	return outlierDetectionEnabled, lbSettings
 }
 
-func endpointDiscoveryResponse(loadAssignments []*any.Any, version, noncePrefix string) *discovery.DiscoveryResponse {
+func (s *DiscoveryServer) endpointDiscoveryResponse(loadAssignments []*any.Any, version,
+	noncePrefix string) *discovery.DiscoveryResponse {
 	out := &discovery.DiscoveryResponse{
 		TypeUrl: v3.EndpointType,
 		// Pilot does not really care for versioning. It always supplies what's currently
@@ -429,13 +1102,34 @@ func endpointDiscoveryResponse(loadAssignments []*any.Any, version, noncePrefix
 		// responses. Pilot believes in eventual consistency and that at some point, Envoy
 		// will begin seeing results it deems to be good.
 		VersionInfo: version,
-		Nonce:       nonce(noncePrefix),
+		Nonce:       s.nextNonce(noncePrefix),
 		Resources:   loadAssignments,
 	}
 
 	return out
 }
 
+// chunkResources splits the resources, in order, in chunks whose total size is at most maxBytes. A
+// resource larger than maxBytes is in a chunk of its own.
+func chunkResources(resources []*any.Any, maxBytes int) [][]*any.Any {
+	var chunks [][]*any.Any
+	var chunk []*any.Any
+	size := 0
+	for _, r := range resources {
+		sz := proto.Size(r)
+		if len(chunk) > 0 && size+sz > maxBytes {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, r)
+		size += sz
+	}
+	if len(chunk) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
 // cluster with no endpoints
 func buildEmptyClusterLoadAssignment(clusterName string) *endpoint.ClusterLoadAssignment {
 	return &endpoint.ClusterLoadAssignment{
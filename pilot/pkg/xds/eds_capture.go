@@ -0,0 +1,251 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/proto"
+
+	networkingapi "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/test"
+	"istio.io/istio/pkg/util/gogoprotomarshal"
+	"istio.io/istio/pkg/util/protomarshal"
+)
+
+// EndpointCapture holds the inputs used to generate the endpoints of a cluster for a proxy, together with
+// the generated ClusterLoadAssignment. Captures are written by pilot if PILOT_EDS_CAPTURE_DIR is set, and
+// can be replayed in tests to reproduce production EDS responses.
+type EndpointCapture struct {
+	Cluster string         `json:"cluster"`
+	Proxy   CapturedProxy  `json:"proxy"`
+	Service *model.Service `json:"service"`
+	// Shards holds the endpoints of the service, keyed by cluster ID.
+	Shards                map[string][]*model.IstioEndpoint `json:"shards"`
+	DestinationRule       *CapturedConfig                   `json:"destinationRule,omitempty"`
+	MeshLocalityLbSetting json.RawMessage                   `json:"meshLocalityLbSetting,omitempty"`
+	LoadAssignment        json.RawMessage                   `json:"loadAssignment"`
+}
+
+// CapturedProxy holds the proxy properties used to generate endpoints.
+type CapturedProxy struct {
+	ID              string              `json:"id"`
+	ConfigNamespace string              `json:"configNamespace"`
+	IPAddresses     []string            `json:"ipAddresses"`
+	Locality        string              `json:"locality,omitempty"`
+	Metadata        *model.NodeMetadata `json:"metadata,omitempty"`
+}
+
+// CapturedConfig holds a config with its spec in JSON.
+type CapturedConfig struct {
+	Name      string          `json:"name"`
+	Namespace string          `json:"namespace"`
+	Spec      json.RawMessage `json:"spec"`
+}
+
+// shouldCaptureEndpoints returns true if the endpoints of the cluster should be captured.
+func shouldCaptureEndpoints(clusterName string) bool {
+	if features.EDSCaptureDir == "" {
+		return false
+	}
+	for _, c := range features.EDSCaptureClusters {
+		if c == clusterName {
+			return true
+		}
+	}
+	return false
+}
+
+// captureEndpoints writes the inputs and result of the endpoint generation to PILOT_EDS_CAPTURE_DIR.
+// Each proxy and cluster is written to its own file, which is overwritten by later captures.
+func (s *DiscoveryServer) captureEndpoints(b EndpointBuilder, l *endpoint.ClusterLoadAssignment) {
+	capture, err := s.newEndpointCapture(b, l)
+	if err != nil {
+		adsLog.Warnf("failed to capture endpoints of %s for %s: %v", b.clusterName, b.proxy.ID, err)
+		return
+	}
+	out, err := json.MarshalIndent(capture, "", "  ")
+	if err != nil {
+		adsLog.Warnf("failed to capture endpoints of %s for %s: %v", b.clusterName, b.proxy.ID, err)
+		return
+	}
+	name := strings.NewReplacer("|", "_", "/", "_").Replace(b.proxy.ID + "_" + b.clusterName + ".json")
+	if err := ioutil.WriteFile(filepath.Join(features.EDSCaptureDir, name), out, 0644); err != nil {
+		adsLog.Warnf("failed to capture endpoints of %s for %s: %v", b.clusterName, b.proxy.ID, err)
+	}
+}
+
+func (s *DiscoveryServer) newEndpointCapture(b EndpointBuilder, l *endpoint.ClusterLoadAssignment) (*EndpointCapture, error) {
+	capture := &EndpointCapture{
+		Cluster: b.clusterName,
+		Proxy: CapturedProxy{
+			ID:              b.proxy.ID,
+			ConfigNamespace: b.proxy.ConfigNamespace,
+			IPAddresses:     b.proxy.IPAddresses,
+			Locality:        util.LocalityToString(b.proxy.Locality),
+			Metadata:        b.proxy.Metadata,
+		},
+		Service: b.service,
+		Shards:  map[string][]*model.IstioEndpoint{},
+	}
+
+	if b.service != nil {
+		s.mutex.RLock()
+		shards := s.EndpointShardsByService[string(b.hostname)][b.service.Attributes.Namespace]
+		s.mutex.RUnlock()
+		if shards != nil {
+			shards.mutex.RLock()
+			for clusterID, eps := range shards.Shards {
+				captured := make([]*model.IstioEndpoint, 0, len(eps))
+				for _, ep := range eps {
+					// The envoy endpoint is only a cache of the endpoint conversion.
+					c := *ep
+					c.EnvoyEndpoint = nil
+					captured = append(captured, &c)
+				}
+				capture.Shards[clusterID] = captured
+			}
+			shards.mutex.RUnlock()
+		}
+	}
+
+	if dr := b.destinationRule; dr != nil {
+		spec, err := gogoprotomarshal.ToJSON(b.DestinationRule())
+		if err != nil {
+			return nil, err
+		}
+		capture.DestinationRule = &CapturedConfig{Name: dr.Name, Namespace: dr.Namespace, Spec: json.RawMessage(spec)}
+	}
+	if lb := b.push.Mesh.GetLocalityLbSetting(); lb != nil {
+		setting, err := gogoprotomarshal.ToJSON(lb)
+		if err != nil {
+			return nil, err
+		}
+		capture.MeshLocalityLbSetting = json.RawMessage(setting)
+	}
+	if l != nil {
+		cla, err := protomarshal.ToJSON(l)
+		if err != nil {
+			return nil, err
+		}
+		capture.LoadAssignment = json.RawMessage(cla)
+	}
+	return capture, nil
+}
+
+// LoadEndpointCapture reads an EndpointCapture written by pilot.
+func LoadEndpointCapture(path string) (*EndpointCapture, error) {
+	by, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	capture := &EndpointCapture{}
+	if err := json.Unmarshal(by, capture); err != nil {
+		return nil, fmt.Errorf("invalid endpoint capture %s: %v", path, err)
+	}
+	return capture, nil
+}
+
+// Replay generates the endpoints from the captured inputs, and fails the test if the result is not
+// equal to the captured ClusterLoadAssignment. Localities and endpoints are compared regardless of order.
+func (c *EndpointCapture) Replay(t test.Failer) {
+	m := mesh.DefaultMeshConfig()
+	if len(c.MeshLocalityLbSetting) > 0 {
+		m.LocalityLbSetting = &networkingapi.LocalityLoadBalancerSetting{}
+		if err := gogoprotomarshal.ApplyJSON(string(c.MeshLocalityLbSetting), m.LocalityLbSetting); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var configs []config.Config
+	if c.DestinationRule != nil {
+		dr := &networkingapi.DestinationRule{}
+		if err := gogoprotomarshal.ApplyJSON(string(c.DestinationRule.Spec), dr); err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config.Config{
+			Meta: config.Meta{
+				GroupVersionKind: gvk.DestinationRule,
+				Name:             c.DestinationRule.Name,
+				Namespace:        c.DestinationRule.Namespace,
+			},
+			Spec: dr,
+		})
+	}
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{Configs: configs, MeshConfig: &m})
+	if c.Service != nil {
+		s.MemRegistry.AddService(c.Service.Hostname, c.Service)
+		s.refreshPushContext()
+		for clusterID, eps := range c.Shards {
+			s.Discovery.EDSCacheUpdate(clusterID, string(c.Service.Hostname), c.Service.Attributes.Namespace, eps)
+		}
+	}
+	proxy := &model.Proxy{
+		ID:              c.Proxy.ID,
+		ConfigNamespace: c.Proxy.ConfigNamespace,
+		IPAddresses:     c.Proxy.IPAddresses,
+		Metadata:        c.Proxy.Metadata,
+	}
+	if c.Proxy.Locality != "" {
+		proxy.Locality = util.ConvertLocality(c.Proxy.Locality)
+	}
+	proxy = s.SetupProxy(proxy)
+
+	got := s.Discovery.generateEndpoints(NewEndpointBuilder(c.Cluster, proxy, s.PushContext()))
+	var want *endpoint.ClusterLoadAssignment
+	if len(c.LoadAssignment) > 0 {
+		want = &endpoint.ClusterLoadAssignment{}
+		if err := protomarshal.ApplyJSON(string(c.LoadAssignment), want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !proto.Equal(normalizeLoadAssignment(got), normalizeLoadAssignment(want)) {
+		t.Fatalf("replayed endpoints of %s differ from the capture:\ngot:  %v\nwant: %v", c.Cluster, got, want)
+	}
+}
+
+// normalizeLoadAssignment returns a copy of the ClusterLoadAssignment with localities and endpoints sorted,
+// as their order depends on map iteration.
+func normalizeLoadAssignment(l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	if l == nil {
+		return nil
+	}
+	l = proto.Clone(l).(*endpoint.ClusterLoadAssignment)
+	for _, llb := range l.Endpoints {
+		sort.SliceStable(llb.LbEndpoints, func(i, j int) bool {
+			return llb.LbEndpoints[i].GetEndpoint().GetAddress().String() < llb.LbEndpoints[j].GetEndpoint().GetAddress().String()
+		})
+	}
+	sort.SliceStable(l.Endpoints, func(i, j int) bool {
+		a, b := l.Endpoints[i], l.Endpoints[j]
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return util.LocalityToString(a.Locality) < util.LocalityToString(b.Locality)
+	})
+	return l
+}
@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestEndpointCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eds_capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cluster := "outbound|80|v1|capture.example.com"
+	setFeatureForTest(t, &features.EDSCaptureDir, dir)
+	setFeatureForTest(t, &features.EDSCaptureClusters, []string{cluster})
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: capture
+  namespace: default
+spec:
+  host: capture.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutiveErrors: 5
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+`})
+	s.addHTTPServices("capture.example.com")
+	endpoint := func(address, version, locality string) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.Labels = map[string]string{"version": version}
+		ep.TLSMode = model.IstioMutualTLSModeLabel
+		return ep
+	}
+	s.Discovery.EDSCacheUpdate("cluster1", "capture.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "v1", "region1/zone1/subzone1"),
+		endpoint("10.0.0.2", "v2", "region1/zone1/subzone1"),
+		endpoint("10.0.0.3", "v1", "region2/zone1/subzone1"),
+	})
+	s.Discovery.EDSCacheUpdate("cluster2", "capture.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.1.1", "v1", "region1/zone2/subzone1"),
+	})
+	proxy := s.SetupProxy(&model.Proxy{
+		ID:       "capture.default",
+		Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"},
+	})
+	if cla := s.buildEndpoints(cluster, proxy); len(cla.Endpoints) != 3 {
+		t.Fatalf("expected endpoints in 3 localities, got %v", cla.Endpoints)
+	}
+	features.EDSCaptureDir = ""
+
+	capture, err := LoadEndpointCapture(filepath.Join(dir, "capture.default_outbound_80_v1_capture.example.com.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.Cluster != cluster || len(capture.Shards) != 2 || capture.DestinationRule == nil {
+		t.Fatalf("unexpected capture %+v", capture)
+	}
+	capture.Replay(t)
+}
@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// EdsConnStats is the statistics of the EDS pushes sent on a connection, for debugging.
+type EdsConnStats struct {
+	// Pushes is the number of EDS pushes sent on the connection.
+	Pushes int `json:"pushes"`
+	// LastPush is the time of the last EDS push sent on the connection.
+	LastPush time.Time `json:"lastPush,omitempty"`
+	// LastPushEndpoints is the number of endpoints in the last EDS push, across all its clusters.
+	LastPushEndpoints int `json:"lastPushEndpoints"`
+	// LastError is the last error pushing EDS on the connection, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// edsConnStats tracks the EDS pushes of a connection. It is updated from the main loop of the connection
+// and read from debug handlers.
+type edsConnStats struct {
+	mutex    sync.RWMutex
+	pushes   int
+	lastPush time.Time
+	// lastResources are the resources of the last push. They are shared with the EDS cache, and their
+	// endpoints are only counted when the stats are read, keeping pushes cheap.
+	lastResources []*any.Any
+	lastError     error
+}
+
+// recordPush records an EDS push of the resources sent successfully.
+func (e *edsConnStats) recordPush(resources []*any.Any, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.pushes++
+	e.lastPush = now
+	e.lastResources = resources
+}
+
+// recordError records a failure to push EDS.
+func (e *edsConnStats) recordError(err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastError = err
+}
+
+func (e *edsConnStats) stats() EdsConnStats {
+	e.mutex.RLock()
+	out := EdsConnStats{Pushes: e.pushes, LastPush: e.lastPush}
+	resources := e.lastResources
+	if e.lastError != nil {
+		out.LastError = e.lastError.Error()
+	}
+	e.mutex.RUnlock()
+	for _, r := range resources {
+		cla := &endpoint.ClusterLoadAssignment{}
+		if err := ptypes.UnmarshalAny(r, cla); err != nil {
+			continue
+		}
+		for _, llb := range cla.Endpoints {
+			out.LastPushEndpoints += len(llb.LbEndpoints)
+		}
+	}
+	return out
+}
+
+// EdsStatsForConnection returns the statistics of the EDS pushes sent on the connection, or empty
+// statistics if the connection is not found.
+func (s *DiscoveryServer) EdsStatsForConnection(conID string) EdsConnStats {
+	s.adsClientsMutex.RLock()
+	con := s.adsClients[conID]
+	s.adsClientsMutex.RUnlock()
+	if con == nil {
+		return EdsConnStats{}
+	}
+	return con.edsStats.stats()
+}
+
+// edsStatsz reports the statistics of the EDS pushes of the connection passed in the con query parameter,
+// or of all the connections keyed by connection ID.
+func (s *DiscoveryServer) edsStatsz(w http.ResponseWriter, req *http.Request) {
+	var out interface{}
+	if conID := req.URL.Query().Get("con"); conID != "" {
+		s.adsClientsMutex.RLock()
+		con := s.adsClients[conID]
+		s.adsClientsMutex.RUnlock()
+		if con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("Connection not found on this Pilot instance. It may be connected to another instance."))
+			return
+		}
+		out = con.edsStats.stats()
+	} else {
+		s.adsClientsMutex.RLock()
+		cons := make(map[string]*Connection, len(s.adsClients))
+		for conID, con := range s.adsClients {
+			cons[conID] = con
+		}
+		s.adsClientsMutex.RUnlock()
+		all := make(map[string]EdsConnStats, len(cons))
+		for conID, con := range cons {
+			all[conID] = con.edsStats.stats()
+		}
+		out = all
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(out, "", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestEdsStatsForConnection(t *testing.T) {
+	setFeatureForTest(t, &features.SkipUnchangedEDSPushes, false)
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("stats.example.com")
+	s.Discovery.SetEndpointShardsForTest("stats.example.com", "", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", ""),
+		testEndpoint("10.0.0.2", ""),
+	})
+
+	stream := &failingStream{}
+	con := newConnection("", stream)
+	con.ConID = "stats-con"
+	con.proxy = s.SetupProxy(nil)
+	con.proxy.WatchedResources = map[string]*model.WatchedResource{}
+	s.Discovery.addCon(con.ConID, con)
+	defer s.Discovery.removeCon(con.ConID)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||stats.example.com"}}
+	push := func() error {
+		return s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, &model.PushRequest{Full: true})
+	}
+
+	if got := s.Discovery.EdsStatsForConnection(con.ConID); got != (EdsConnStats{}) {
+		t.Fatalf("expected empty stats before any push, got %+v", got)
+	}
+	if got := s.Discovery.EdsStatsForConnection("unknown"); got != (EdsConnStats{}) {
+		t.Fatalf("expected empty stats for an unknown connection, got %+v", got)
+	}
+
+	if err := push(); err != nil {
+		t.Fatal(err)
+	}
+	got := s.Discovery.EdsStatsForConnection(con.ConID)
+	if got.Pushes != 1 || got.LastPush.IsZero() || got.LastPushEndpoints != 2 || got.LastError != "" {
+		t.Fatalf("unexpected stats after a push: %+v", got)
+	}
+	lastPush := got.LastPush
+
+	// Failed pushes are not counted, but record their error.
+	stream.fail = true
+	if err := push(); err == nil {
+		t.Fatal("expected the push to fail")
+	}
+	got = s.Discovery.EdsStatsForConnection(con.ConID)
+	if got.Pushes != 1 || got.LastPush != lastPush || got.LastError != "send failed" {
+		t.Fatalf("unexpected stats after a failed push: %+v", got)
+	}
+
+	stream.fail = false
+	if err := push(); err != nil {
+		t.Fatal(err)
+	}
+	if got = s.Discovery.EdsStatsForConnection(con.ConID); got.Pushes != 2 {
+		t.Fatalf("expected 2 pushes, got %+v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	s.Discovery.edsStatsz(rr, httptest.NewRequest(http.MethodGet, "/debug/edsstatsz?con="+con.ConID, nil))
+	var single EdsConnStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &single); err != nil {
+		t.Fatal(err)
+	}
+	if single.Pushes != 2 || single.LastPushEndpoints != 2 {
+		t.Fatalf("unexpected stats from the debug endpoint: %+v", single)
+	}
+	rr = httptest.NewRecorder()
+	s.Discovery.edsStatsz(rr, httptest.NewRequest(http.MethodGet, "/debug/edsstatsz", nil))
+	var all map[string]EdsConnStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &all); err != nil {
+		t.Fatal(err)
+	}
+	if all[con.ConID].Pushes != 2 {
+		t.Fatalf("expected the stats of %s from the debug endpoint, got %+v", con.ConID, all)
+	}
+	rr = httptest.NewRecorder()
+	s.Discovery.edsStatsz(rr, httptest.NewRequest(http.MethodGet, "/debug/edsstatsz?con=unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected not found for an unknown connection, got %d", rr.Code)
+	}
+}
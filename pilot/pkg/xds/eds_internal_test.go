@@ -0,0 +1,1004 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"go.opencensus.io/stats/view"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// recordingStream is a fakeStream which keeps track of all responses sent on it.
+type recordingStream struct {
+	fakeStream
+	mu        sync.Mutex
+	responses []*discovery.DiscoveryResponse
+}
+
+func (r *recordingStream) Send(resp *discovery.DiscoveryResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+func (r *recordingStream) sent() []*discovery.DiscoveryResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*discovery.DiscoveryResponse{}, r.responses...)
+}
+
+// newRecordingConnection creates a Connection for the proxy which records every response sent to it.
+func newRecordingConnection(s *FakeDiscoveryServer, p *model.Proxy) (*Connection, *recordingStream) {
+	stream := &recordingStream{}
+	con := newConnection("", stream)
+	con.ConID = "test-con"
+	con.proxy = s.SetupProxy(p)
+	con.proxy.WatchedResources = map[string]*model.WatchedResource{}
+	return con, stream
+}
+
+func TestEdsSkipEmptyIncrementalPush(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	con, stream := newRecordingConnection(s, nil)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||foo.com"}}
+
+	// An incremental push which updated configs, but no services, should not send anything.
+	req := &model.PushRequest{
+		Full: false,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{
+			{Kind: gvk.DestinationRule, Name: "foo", Namespace: "default"}: {},
+		},
+	}
+	if err := s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(stream.sent()); got != 0 {
+		t.Fatalf("expected no EDS response to be sent, got %d", got)
+	}
+
+	// Neither an incremental push without ConfigsUpdated, nor one for services the proxy does not watch.
+	for _, updated := range []map[model.ConfigKey]struct{}{
+		nil,
+		{{Kind: gvk.ServiceEntry, Name: "bar.com", Namespace: "default"}: {}},
+	} {
+		req.ConfigsUpdated = updated
+		if err := s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, req); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(stream.sent()); got != 0 {
+			t.Fatalf("expected no EDS response to be sent for updated configs %v, got %d", updated, got)
+		}
+	}
+
+	// An incremental push for a service still sends a response.
+	req.ConfigsUpdated = map[model.ConfigKey]struct{}{
+		{Kind: gvk.ServiceEntry, Name: "foo.com", Namespace: "default"}: {},
+	}
+	if err := s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(stream.sent()); got != 1 {
+		t.Fatalf("expected a single EDS response to be sent, got %d", got)
+	}
+}
+
+func TestEdsForcedIncrementalPush(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("forced.example.com")
+	s.MemRegistry.AddEndpoint("forced.example.com", "http-main", 80, "10.0.0.1", 80)
+	proxy := s.SetupProxy(nil)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||forced.example.com"}}
+	gen := &EdsGenerator{Server: s.Discovery}
+
+	// An incremental push without ConfigsUpdated does not tell which services changed, so nothing is pushed.
+	if got := gen.Generate(proxy, s.PushContext(), w, &model.PushRequest{Full: false}); got != nil {
+		t.Fatalf("expected no push, got %d clusters", len(got))
+	}
+	// A forced push pushes all the watched clusters.
+	if got := gen.Generate(proxy, s.PushContext(), w, &model.PushRequest{Full: false, ForceEds: true}); len(got) != 1 {
+		t.Fatalf("expected the watched cluster to be pushed, got %d", len(got))
+	}
+}
+
+func TestEdsChunkedPush(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	var hostnames, clusters []string
+	for i := 0; i < 50; i++ {
+		hostname := fmt.Sprintf("svc%d.example.com", i)
+		hostnames = append(hostnames, hostname)
+		clusters = append(clusters, fmt.Sprintf("outbound|80||%s", hostname))
+	}
+	s.addHTTPServices(hostnames...)
+	for i, hostname := range hostnames {
+		s.MemRegistry.SetEndpoints(hostname, "", []*model.IstioEndpoint{testEndpoint(fmt.Sprintf("10.0.0.%d", i), "")})
+	}
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: clusters}
+
+	setFeatureForTest(t, &features.EDSMaxResponseBytes, 1000)
+	con, stream := newRecordingConnection(s, nil)
+	if err := s.Discovery.pushXds(con, s.PushContext(), "v1", w, &model.PushRequest{Full: true}); err != nil {
+		t.Fatal(err)
+	}
+	responses := stream.sent()
+	if len(responses) < 2 {
+		t.Fatalf("expected the push to be split, got %d responses", len(responses))
+	}
+	nonces := map[string]struct{}{}
+	got := []string{}
+	for _, resp := range responses {
+		if resp.VersionInfo != "v1" {
+			t.Fatalf("expected all responses to have version v1, got %s", resp.VersionInfo)
+		}
+		nonces[resp.Nonce] = struct{}{}
+		size := 0
+		for _, r := range resp.Resources {
+			size += proto.Size(r)
+			cla := &endpoint.ClusterLoadAssignment{}
+			if err := ptypes.UnmarshalAny(r, cla); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, cla.ClusterName)
+		}
+		if size > 1000 && len(resp.Resources) > 1 {
+			t.Fatalf("expected responses of at most 1000 bytes, got %d", size)
+		}
+	}
+	if len(nonces) != len(responses) {
+		t.Fatalf("expected a nonce per response, got %d for %d responses", len(nonces), len(responses))
+	}
+	if !reflect.DeepEqual(got, clusters) {
+		t.Fatalf("expected all clusters in order %v, got %v", clusters, got)
+	}
+	if nonce := con.NonceSent(v3.EndpointType); nonce != responses[len(responses)-1].Nonce {
+		t.Fatalf("expected the nonce of the last response to be tracked, got %s", nonce)
+	}
+
+	// Without a limit, all resources are sent in a single response.
+	features.EDSMaxResponseBytes = 0
+	con, stream = newRecordingConnection(s, nil)
+	if err := s.Discovery.pushXds(con, s.PushContext(), "v1", w, &model.PushRequest{Full: true}); err != nil {
+		t.Fatal(err)
+	}
+	if responses := stream.sent(); len(responses) != 1 || len(responses[0].Resources) != len(clusters) {
+		t.Fatalf("expected a single response with all clusters, got %d responses", len(responses))
+	}
+}
+
+// failingStream is a fakeStream whose sends fail while fail is set.
+type failingStream struct {
+	fakeStream
+	fail     bool
+	attempts int
+}
+
+func (f *failingStream) Send(*discovery.DiscoveryResponse) error {
+	f.attempts++
+	if f.fail {
+		return errors.New("send failed")
+	}
+	return nil
+}
+
+// sumValue returns the current value of the sum metric for the given label value. Rows without the
+// label are matched by an empty value.
+func sumValue(t *testing.T, metric, label, value string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(metric)
+	if err != nil {
+		t.Fatalf("failed to retrieve %s: %v", metric, err)
+	}
+	for _, row := range rows {
+		rowValue := ""
+		for _, tag := range row.Tags {
+			if tag.Key.Name() == label {
+				rowValue = tag.Value
+			}
+		}
+		if rowValue == value {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
+func TestEDSUpdateKindMetrics(t *testing.T) {
+	setFeatureForTest(t, &features.MinEndpointsPerService, map[string]int{"kind.example.com": 1})
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	endpoints := func(addr, sa string) []*model.IstioEndpoint {
+		return []*model.IstioEndpoint{{Address: addr, ServiceAccount: sa, ServicePortName: "http", EndpointPort: 80}}
+	}
+	kinds := []string{"service", "endpoints", "deferred", "rejected"}
+	values := func() map[string]float64 {
+		out := map[string]float64{"eds": sumValue(t, "pilot_inbound_updates", "type", "eds")}
+		for _, kind := range kinds {
+			out[kind] = sumValue(t, "pilot_eds_update_kind", "kind", kind)
+		}
+		return out
+	}
+
+	cases := []struct {
+		name   string
+		update func()
+		// kinds are the expected increases of pilot_eds_update_kind, by kind.
+		kinds map[string]float64
+	}{
+		{"new service", func() {
+			s.Discovery.EDSUpdate("cluster1", "kind.example.com", "default", endpoints("10.0.0.1", "sa1"))
+		}, map[string]float64{"service": 1}},
+		{"endpoint change", func() {
+			s.Discovery.EDSUpdate("cluster1", "kind.example.com", "default", endpoints("10.0.0.2", "sa1"))
+		}, map[string]float64{"endpoints": 1}},
+		{"service account change", func() {
+			s.Discovery.EDSUpdate("cluster1", "kind.example.com", "default", endpoints("10.0.0.2", "sa2"))
+		}, map[string]float64{"service": 1}},
+		{"rejected", func() {
+			s.Discovery.EDSUpdate("cluster1", "kind.example.com", "default", nil)
+		}, map[string]float64{"rejected": 1}},
+		{"deferred", func() {
+			s.Discovery.PauseEds()
+			s.Discovery.EDSUpdate("cluster1", "kind.example.com", "default", endpoints("10.0.0.3", "sa2"))
+		}, map[string]float64{"deferred": 1}},
+		{"resumed", func() {
+			s.Discovery.ResumeEds()
+		}, map[string]float64{"endpoints": 1}},
+		{"endpoint removal", func() {
+			s.Discovery.EDSUpdate("cluster2", "kind.example.com", "default", nil)
+		}, map[string]float64{"endpoints": 1}},
+		// The periodic reconciliation of the shards is not an update.
+		{"reconcile", func() {
+			s.addHTTPServices("reconcile.example.com")
+			if err := s.Discovery.UpdateServiceShards(s.PushContext()); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			before := values()
+			tt.update()
+			after := values()
+			for _, kind := range kinds {
+				if got := after[kind] - before[kind]; got != tt.kinds[kind] {
+					t.Errorf("expected kind %s to increase by %v, got %v", kind, tt.kinds[kind], got)
+				}
+			}
+			// Each update is still counted once by pilot_inbound_updates.
+			if got, want := after["eds"]-before["eds"], 1.0; tt.name != "resumed" && tt.name != "reconcile" && got != want {
+				t.Errorf("expected %v inbound EDS updates, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestEdsPrioritizesUpdatedClusters(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	proxy := s.SetupProxy(nil)
+	gen := s.Discovery.Generators[v3.EndpointType]
+	w := &model.WatchedResource{
+		TypeUrl: v3.EndpointType,
+		ResourceNames: []string{
+			"outbound|80||a.example.com",
+			"outbound|80||b.example.com",
+			"outbound|80||c.example.com",
+			"outbound|90||c.example.com",
+		},
+	}
+	req := &model.PushRequest{
+		Full: true,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{
+			{Kind: gvk.ServiceEntry, Name: "c.example.com", Namespace: "default"}: {},
+		},
+	}
+	resources := gen.Generate(proxy, s.PushContext(), w, req)
+	got := make([]string, 0, len(resources))
+	for _, r := range resources {
+		cla := &endpoint.ClusterLoadAssignment{}
+		if err := ptypes.UnmarshalAny(r, cla); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, cla.ClusterName)
+	}
+	expected := []string{
+		"outbound|80||c.example.com",
+		"outbound|90||c.example.com",
+		"outbound|80||a.example.com",
+		"outbound|80||b.example.com",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected clusters in order %v, got %v", expected, got)
+	}
+}
+
+func TestEdsPassiveHealthCheckOnly(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: passive
+  namespace: default
+spec:
+  host: passive.example.com
+  trafficPolicy:
+    outlierDetection:
+      interval: 1s
+      baseEjectionTime: 3m
+`})
+	s.addHTTPServices("passive.example.com", "active.example.com")
+	proxy := s.SetupProxy(nil)
+
+	for _, tt := range []struct {
+		hostname    string
+		healthCheck bool
+	}{
+		{"passive.example.com", false},
+		{"active.example.com", true},
+	} {
+		t.Run(tt.hostname, func(t *testing.T) {
+			ep := testEndpoint("10.0.0.1", "")
+			// Simulate an endpoint carrying an active health check configuration.
+			ep.EnvoyEndpoint = buildEnvoyLbEndpoint(ep, false, false, false)
+			ep.EnvoyEndpoint.GetEndpoint().HealthCheckConfig = &endpoint.Endpoint_HealthCheckConfig{PortValue: 8080}
+			s.Discovery.EDSCacheUpdate("", tt.hostname, "", []*model.IstioEndpoint{ep})
+
+			cla := s.buildEndpoints("outbound|80||"+tt.hostname, proxy)
+			if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+				t.Fatalf("expected a single endpoint, got %v", cla.Endpoints)
+			}
+			got := cla.Endpoints[0].LbEndpoints[0].GetEndpoint().GetHealthCheckConfig() != nil
+			if got != tt.healthCheck {
+				t.Fatalf("expected active health check config: %v, got %v", tt.healthCheck, got)
+			}
+			// The shared endpoint must not be modified.
+			if ep.EnvoyEndpoint.GetEndpoint().GetHealthCheckConfig() == nil {
+				t.Fatalf("shared endpoint was modified")
+			}
+		})
+	}
+}
+
+func TestEdsSkipUnchangedPush(t *testing.T) {
+	setFeatureForTest(t, &features.SkipUnchangedEDSPushes, true)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("unchanged.example.com")
+	s.MemRegistry.AddEndpoint("unchanged.example.com", "http-main", 80, "10.0.0.1", 80)
+	con, stream := newRecordingConnection(s, nil)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||unchanged.example.com"}}
+	push := func(full bool) {
+		t.Helper()
+		req := &model.PushRequest{Full: full}
+		if !full {
+			req.ConfigsUpdated = map[model.ConfigKey]struct{}{
+				{Kind: gvk.ServiceEntry, Name: "unchanged.example.com", Namespace: "default"}: {},
+			}
+		}
+		if err := s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push(false)
+	if got := len(stream.sent()); got != 1 {
+		t.Fatalf("expected the first EDS response to be sent, got %d", got)
+	}
+
+	// A second incremental push with identical endpoints must be skipped.
+	push(false)
+	if got := len(stream.sent()); got != 1 {
+		t.Fatalf("expected the unchanged EDS response to be skipped, got %d responses", got)
+	}
+
+	// Full pushes are always sent, as the clusters may have been updated.
+	push(true)
+	if got := len(stream.sent()); got != 2 {
+		t.Fatalf("expected the full EDS response to be sent, got %d responses", got)
+	}
+
+	// Changed endpoints must be sent again.
+	s.Discovery.EDSCacheUpdate("", "unchanged.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.2", "")})
+	s.Discovery.Cache.ClearAll()
+	push(false)
+	if got := len(stream.sent()); got != 3 {
+		t.Fatalf("expected the changed EDS response to be sent, got %d responses", got)
+	}
+}
+
+func TestEdsLocalityFailoverSubsetMetric(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: failover
+  namespace: default
+spec:
+  host: failover.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutive5xxErrors: 5
+    loadBalancer:
+      localityLbSetting:
+        enabled: true
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+    trafficPolicy:
+      outlierDetection:
+        consecutive5xxErrors: 1
+`})
+	s.addHTTPServices("failover.example.com")
+	ep := testEndpoint("10.0.0.1", "region1/zone1/subzone1")
+	ep.Labels = map[string]string{"version": "v1"}
+	s.Discovery.EDSCacheUpdate("", "failover.example.com", "", []*model.IstioEndpoint{ep})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}})
+
+	cases := []struct {
+		cluster string
+		subset  string
+	}{
+		{"outbound|80|v1|failover.example.com", "v1"},
+		{"outbound|80||failover.example.com", ""},
+		// Subsets not defined in the DestinationRule must not create new label values.
+		{"outbound|80|unknown|failover.example.com", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			before := sumValue(t, "pilot_eds_locality_failover", "subset", tt.subset)
+			s.buildEndpoints(tt.cluster, proxy)
+			if got := sumValue(t, "pilot_eds_locality_failover", "subset", tt.subset) - before; got != 1 {
+				t.Fatalf("expected locality failover to be recorded for subset %q, got %v", tt.subset, got)
+			}
+		})
+	}
+}
+
+func TestEndpointUpdateStream(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 100),
+		debounceOptions:         debounceOptions{endpointStreamWindow: 100 * time.Millisecond},
+	}
+	snapshot := func(n int) []*model.IstioEndpoint {
+		eps := make([]*model.IstioEndpoint, 0, n)
+		for i := 0; i < n; i++ {
+			eps = append(eps, &model.IstioEndpoint{Address: fmt.Sprintf("10.0.0.%d", i+1), EndpointPort: 80})
+		}
+		return eps
+	}
+	endpoints := func() int {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		shards := s.EndpointShardsByService["stream.example.com"]["default"]
+		if shards == nil {
+			return 0
+		}
+		shards.mutex.RLock()
+		defer shards.mutex.RUnlock()
+		return len(shards.Shards["cluster1"])
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	stream := s.EndpointUpdateStream("cluster1", "stream.example.com", "default", stop)
+	for i := 1; i <= 20; i++ {
+		stream <- snapshot(i)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := len(s.pushChannel); got != 1 {
+		t.Fatalf("expected a single push for the rapid updates, got %d", got)
+	}
+	if got := endpoints(); got != 20 {
+		t.Fatalf("expected the latest snapshot with 20 endpoints to be applied, got %d", got)
+	}
+	<-s.pushChannel
+
+	// Closing the stream applies the pending snapshot without waiting for the window.
+	stream <- snapshot(3)
+	close(stream)
+	select {
+	case <-s.pushChannel:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("expected the pending snapshot to be pushed when the stream is closed")
+	}
+	if got := endpoints(); got != 3 {
+		t.Fatalf("expected the pending snapshot with 3 endpoints to be applied, got %d", got)
+	}
+
+	// Stopping the server stops the stream, dropping the pending snapshot.
+	stopped := make(chan struct{})
+	stream = s.EndpointUpdateStream("cluster1", "stream.example.com", "default", stopped)
+	stream <- snapshot(5)
+	close(stopped)
+	// Give the stream time to observe the stop, well within the window.
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case stream <- snapshot(6):
+		t.Fatal("expected the stream not to be read once stopped")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := len(s.pushChannel); got != 0 {
+		t.Fatalf("expected no push once the stream is stopped, got %d", got)
+	}
+	if got := endpoints(); got != 3 {
+		t.Fatalf("expected the pending snapshot to be dropped once the stream is stopped, got %d endpoints", got)
+	}
+}
+
+func TestMonotonicNonce(t *testing.T) {
+	setFeatureForTest(t, &features.SkipUnchangedEDSPushes, false)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.Discovery.NonceStrategy = MonotonicNonce()
+	con, stream := newRecordingConnection(s, nil)
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||foo.com"}}
+	for i := 0; i < 2; i++ {
+		if err := s.Discovery.pushXds(con, s.PushContext(), versionInfo(), w, &model.PushRequest{Full: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := stream.sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(sent))
+	}
+	first, second := sent[0].Nonce, sent[1].Nonce
+	if !strings.HasPrefix(first, s.PushContext().Version) || !strings.HasPrefix(second, s.PushContext().Version) {
+		t.Fatalf("expected nonces %q and %q to start with the push version %q", first, second, s.PushContext().Version)
+	}
+	if first >= second {
+		t.Fatalf("expected distinct, ordered nonces, got %q then %q", first, second)
+	}
+	if third := s.Discovery.endpointDiscoveryResponse(nil, versionInfo(), s.PushContext().Version).Nonce; second >= third {
+		t.Fatalf("expected the nonces of all responses to be ordered, got %q then %q", second, third)
+	}
+}
+
+func TestEdsGenerateParallel(t *testing.T) {
+	services := 2 * parallelEdsMinClusters
+	s := NewFakeDiscoveryServer(t, FakeOptions{Configs: createEndpoints(1, services)})
+	proxy := s.SetupProxy(nil)
+	push := s.Discovery.globalPushContext()
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType}
+	for svc := services - 1; svc >= 0; svc-- {
+		w.ResourceNames = append(w.ResourceNames, fmt.Sprintf("outbound|80||foo-%d.com", svc))
+	}
+	gen := s.Discovery.Generators[v3.EndpointType]
+	clusterNames := func(resources model.Resources) []string {
+		names := make([]string, 0, len(resources))
+		for _, r := range resources {
+			cla := &endpoint.ClusterLoadAssignment{}
+			if err := ptypes.UnmarshalAny(r, cla); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, cla.ClusterName)
+		}
+		return names
+	}
+
+	setFeatureForTest(t, &features.EDSGenerationWorkers, 1)
+	serial := clusterNames(gen.Generate(proxy, push, w, &model.PushRequest{Full: true}))
+	if !reflect.DeepEqual(serial, w.ResourceNames) {
+		t.Fatalf("serial generation returned %v, want %v", serial, w.ResourceNames)
+	}
+
+	s.Discovery.Cache.ClearAll()
+	features.EDSGenerationWorkers = 8
+	parallel := clusterNames(gen.Generate(proxy, push, w, &model.PushRequest{Full: true}))
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Fatalf("parallel generation returned %v, want %v", parallel, serial)
+	}
+}
+
+func TestEvictEndpoint(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	endpoints := func(addresses ...string) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, a := range addresses {
+			out = append(out, &model.IstioEndpoint{Address: a})
+		}
+		return out
+	}
+	addresses := func() []string {
+		var out []string
+		for _, eps := range s.EndpointShardsByService["a.example.com"]["ns1"].Shards {
+			for _, e := range eps {
+				out = append(out, e.Address)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints("10.0.0.1", "10.0.0.2"))
+	s.edsCacheUpdate("cluster2", "a.example.com", "ns1", endpoints("10.0.0.1", "10.0.0.3"))
+
+	if !s.EvictEndpoint("a.example.com", "ns1", "10.0.0.1") {
+		t.Fatalf("expected endpoint to be evicted")
+	}
+	if got, want := addresses(), []string{"10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+	select {
+	case req := <-s.pushChannel:
+		key := model.ConfigKey{Kind: gvk.ServiceEntry, Name: "a.example.com", Namespace: "ns1"}
+		if _, f := req.ConfigsUpdated[key]; req.Full || !f {
+			t.Fatalf("expected incremental push for the service, got %+v", req)
+		}
+	default:
+		t.Fatalf("expected a push")
+	}
+
+	// Nothing to evict: no push.
+	if s.EvictEndpoint("a.example.com", "ns1", "10.0.0.1") || s.EvictEndpoint("b.example.com", "ns1", "10.0.0.2") {
+		t.Fatalf("expected no endpoint to be evicted")
+	}
+	if len(s.pushChannel) != 0 {
+		t.Fatalf("expected no push")
+	}
+
+	// The next update of the shard by the registry re-adds the endpoint.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints("10.0.0.1", "10.0.0.2"))
+	if got, want := addresses(), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+}
+
+func TestOnEdsPushRequest(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	observed := make(chan *model.PushRequest, 1)
+	s.OnEdsPushRequest(func(req *model.PushRequest) {
+		observed <- req
+	})
+
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	select {
+	case req := <-observed:
+		key := model.ConfigKey{Kind: gvk.ServiceEntry, Name: "a.example.com", Namespace: "ns1"}
+		if _, f := req.ConfigsUpdated[key]; !f || len(req.ConfigsUpdated) != 1 {
+			t.Fatalf("expected the request to update the service, got %+v", req)
+		}
+		if !reflect.DeepEqual(req.Reason, []model.TriggerReason{model.EndpointUpdate}) {
+			t.Fatalf("expected an endpoint update, got %v", req.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the observer to be called")
+	}
+	if len(s.pushChannel) != 1 {
+		t.Fatalf("expected a push, got %d", len(s.pushChannel))
+	}
+}
+
+func TestServiceAccountFullPushWindow(t *testing.T) {
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 100),
+		clock:                   fakeClock,
+	}
+	update := func(serviceAccount string) {
+		s.EDSUpdate("cluster1", "sa.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1", ServiceAccount: serviceAccount}})
+	}
+	// pushes returns the number of full and incremental pushes requested since the last call.
+	pushes := func() (full, incremental int) {
+		for {
+			select {
+			case req := <-s.pushChannel:
+				if req.Full {
+					full++
+				} else {
+					incremental++
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	// Without a window, each change of the service accounts triggers a full push.
+	update("sa0")
+	for i := 1; i <= 3; i++ {
+		update(fmt.Sprintf("sa%d", i))
+	}
+	if full, incremental := pushes(); full != 4 || incremental != 0 {
+		t.Fatalf("expected 4 full pushes, got %d full and %d incremental", full, incremental)
+	}
+
+	setFeatureForTest(t, &features.ServiceAccountFullPushWindow, time.Minute)
+	coalescedBefore := sumValue(t, "pilot_eds_service_account_pushes_coalesced", "", "")
+	for i := 4; i <= 13; i++ {
+		update(fmt.Sprintf("sa%d", i))
+	}
+	// Only the first change triggers a full push, the others are coalesced into a later one.
+	if full, incremental := pushes(); full != 1 || incremental != 9 {
+		t.Fatalf("expected a single full push, got %d full and %d incremental", full, incremental)
+	}
+	if got := sumValue(t, "pilot_eds_service_account_pushes_coalesced", "", "") - coalescedBefore; got != 9 {
+		t.Fatalf("expected 9 coalesced pushes, got %v", got)
+	}
+
+	// The coalesced full push happens at the end of the window, so the proxies converge.
+	fakeClock.Step(time.Minute)
+	select {
+	case req := <-s.pushChannel:
+		key := model.ConfigKey{Kind: gvk.ServiceEntry, Name: "sa.example.com", Namespace: "ns1"}
+		if _, f := req.ConfigsUpdated[key]; !req.Full || !f {
+			t.Fatalf("expected a full push of the service, got %+v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the coalesced full push")
+	}
+	if full, incremental := pushes(); full != 0 || incremental != 0 {
+		t.Fatalf("expected a single coalesced push, got %d full and %d incremental", full, incremental)
+	}
+}
+
+func TestPushEdsToConnection(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("targeted.example.com")
+	s.MemRegistry.AddEndpoint("targeted.example.com", "http-main", 80, "10.0.0.1", 80)
+	watch := func(con *Connection) {
+		con.proxy.WatchedResources[v3.EndpointType] = &model.WatchedResource{
+			TypeUrl:       v3.EndpointType,
+			ResourceNames: []string{"outbound|80||targeted.example.com"},
+		}
+	}
+	target, targetStream := newRecordingConnection(s, &model.Proxy{ID: "target.default"})
+	target.ConID = "target-con"
+	watch(target)
+	other, _ := newRecordingConnection(s, &model.Proxy{ID: "other.default"})
+	other.ConID = "other-con"
+	watch(other)
+	s.Discovery.addCon(target.ConID, target)
+	s.Discovery.addCon(other.ConID, other)
+	defer s.Discovery.removeCon(target.ConID)
+	defer s.Discovery.removeCon(other.ConID)
+
+	// The target already has these endpoints, they must be resent anyway.
+	if err := s.Discovery.pushXds(target, s.PushContext(), versionInfo(),
+		target.Watched(v3.EndpointType), &model.PushRequest{Full: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Discovery.PushEdsToConnection(target.ConID) }()
+	select {
+	case pushEv := <-target.pushChannel:
+		if err := s.Discovery.pushConnection(target, pushEv); err != nil {
+			t.Fatal(err)
+		}
+		pushEv.done()
+	case <-other.pushChannel:
+		t.Fatal("expected no push for the other connection")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the push to the target connection")
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	sent := targetStream.sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected the endpoints to be pushed again, got %d responses", len(sent))
+	}
+	if got := sent[1].TypeUrl; got != v3.EndpointType {
+		t.Fatalf("expected an EDS response, got %s", got)
+	}
+	select {
+	case <-other.pushChannel:
+		t.Fatal("expected no push for the other connection")
+	default:
+	}
+
+	if err := s.Discovery.PushEdsToConnection("unknown-con"); err == nil {
+		t.Fatal("expected an error for an unknown connection")
+	}
+	delete(other.proxy.WatchedResources, v3.EndpointType)
+	if err := s.Discovery.PushEdsToConnection(other.ConID); err == nil {
+		t.Fatal("expected an error for a connection not watching endpoints")
+	}
+}
+
+func TestEdsMinShards(t *testing.T) {
+	setFeatureForTest(t, &features.EDSMinShards, 2)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("multi.example.com")
+	generate := func() *endpoint.ClusterLoadAssignment {
+		return s.buildEndpoints("outbound|80||multi.example.com", s.SetupProxy(nil))
+	}
+
+	s.Discovery.EDSCacheUpdate("cluster1", "multi.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")})
+	if l := generate(); l != nil {
+		t.Fatalf("expected no endpoints below the shard threshold, got %v", l)
+	}
+
+	s.Discovery.EDSCacheUpdate("cluster2", "multi.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.2", "")})
+	l := generate()
+	if l == nil {
+		t.Fatal("expected endpoints at the shard threshold")
+	}
+	if got := len(l.Endpoints[0].LbEndpoints); got != 2 {
+		t.Fatalf("expected endpoints of both clusters, got %d", got)
+	}
+
+	// Once reached, the threshold is no longer checked.
+	s.Discovery.EDSCacheUpdate("cluster2", "multi.example.com", "", nil)
+	if l := generate(); l == nil {
+		t.Fatal("expected endpoints once the shard threshold was reached")
+	}
+}
+
+func TestEdsMinShardsRetainedShards(t *testing.T) {
+	setFeatureForTest(t, &features.EDSMinShards, 2)
+	setFeatureForTest(t, &features.EndpointShardDeletionGracePeriod, time.Hour)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("multi.example.com")
+
+	s.Discovery.EDSCacheUpdate("cluster1", "multi.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")})
+	s.Discovery.EDSCacheUpdate("cluster2", "multi.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.2", "")})
+	// The shard of cluster2 is retained empty, it does not count.
+	s.Discovery.EDSCacheUpdate("cluster2", "multi.example.com", "", nil)
+	if l := s.buildEndpoints("outbound|80||multi.example.com", s.SetupProxy(nil)); l != nil {
+		t.Fatalf("expected no endpoints below the shard threshold, got %v", l)
+	}
+}
+
+func TestEdsPushLoopBackoff(t *testing.T) {
+	setFeatureForTest(t, &features.EDSPushLoopThreshold, 3)
+	setFeatureForTest(t, &features.EDSPushLoopWindow, time.Second)
+
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 100),
+		clock:                   fakeClock,
+	}
+	var mu sync.Mutex
+	updates := 0
+	// update counts the updates once done, so they are all done once counted.
+	update := func() {
+		mu.Lock()
+		address := fmt.Sprintf("10.0.0.%d", updates%2+1)
+		mu.Unlock()
+		s.EDSUpdate("cluster1", "loop.example.com", "ns1", []*model.IstioEndpoint{{Address: address}})
+		mu.Lock()
+		updates++
+		mu.Unlock()
+	}
+	// Each push triggers a new endpoint update of the service, like a misconfiguration would.
+	s.OnEdsPushRequest(func(*model.PushRequest) { update() })
+	waitForUpdates := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			got := updates
+			mu.Unlock()
+			if got == want {
+				// Give a runaway loop a chance to show up.
+				time.Sleep(50 * time.Millisecond)
+				mu.Lock()
+				got = updates
+				mu.Unlock()
+				if got != want {
+					t.Fatalf("expected the loop to stop after %d updates, got %d", want, got)
+				}
+				return
+			}
+			if got > want || time.Now().After(deadline) {
+				t.Fatalf("expected %d updates, got %d", want, got)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	backoffsBefore := sumValue(t, "pilot_eds_push_loop_backoffs", "", "")
+
+	// The first 3 updates are pushed, the 4th one exceeds the threshold and breaks the loop.
+	update()
+	waitForUpdates(4)
+	if got := len(s.pushChannel); got != 3 {
+		t.Fatalf("expected 3 pushes, got %d", got)
+	}
+	if got := sumValue(t, "pilot_eds_push_loop_backoffs", "", "") - backoffsBefore; got != 1 {
+		t.Fatalf("expected the backoff to engage once, got %v", got)
+	}
+
+	// A single push is sent at the end of the backoff, which resumes the loop until it is detected again.
+	fakeClock.Step(time.Second)
+	waitForUpdates(7)
+	if got := len(s.pushChannel); got != 6 {
+		t.Fatalf("expected 6 pushes, got %d", got)
+	}
+	if got := sumValue(t, "pilot_eds_push_loop_backoffs", "", "") - backoffsBefore; got != 2 {
+		t.Fatalf("expected the backoff to engage again, got %v", got)
+	}
+
+	// The backoff doubled while the loop persists.
+	fakeClock.Step(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if got := len(s.pushChannel); got != 6 {
+		t.Fatalf("expected no push before the end of the doubled backoff, got %d", got)
+	}
+	fakeClock.Step(time.Second)
+	waitForUpdates(10)
+	if got := len(s.pushChannel); got != 9 {
+		t.Fatalf("expected 9 pushes, got %d", got)
+	}
+}
+
+func TestEdsPushLoopForgetsServices(t *testing.T) {
+	setFeatureForTest(t, &features.EDSPushLoopThreshold, 3)
+	setFeatureForTest(t, &features.EDSPushLoopWindow, time.Second)
+
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		emptyServices:           map[ServiceRef]struct{}{},
+		pushChannel:             make(chan *model.PushRequest, 100),
+		clock:                   fakeClock,
+	}
+	tracked := func() []string {
+		s.pushLoops.mutex.Lock()
+		defer s.pushLoops.mutex.Unlock()
+		out := []string{}
+		for svc := range s.pushLoops.services {
+			out = append(out, svc.Hostname)
+		}
+		sort.Strings(out)
+		return out
+	}
+	for _, hostname := range []string{"deleted.example.com", "idle.example.com"} {
+		s.EDSUpdate("cluster1", hostname, "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	}
+	if got := tracked(); !reflect.DeepEqual(got, []string{"deleted.example.com", "idle.example.com"}) {
+		t.Fatalf("expected both services to be tracked, got %v", got)
+	}
+
+	s.deleteService("cluster1", "deleted.example.com", "ns1")
+	if got := tracked(); !reflect.DeepEqual(got, []string{"idle.example.com"}) {
+		t.Fatalf("expected the deleted service to be forgotten, got %v", got)
+	}
+
+	// Services idle for a window are swept by the next push.
+	fakeClock.Step(time.Second)
+	s.EDSUpdate("cluster1", "active.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	if got := tracked(); !reflect.DeepEqual(got, []string{"active.example.com"}) {
+		t.Fatalf("expected the idle service to be swept, got %v", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// EndpointOverride replaces the endpoints of a cluster sent to a single proxy, until it expires. Overrides
+// are only meant for testing failure scenarios, and are only available if PILOT_ENABLE_ENDPOINT_OVERRIDES
+// is set.
+type EndpointOverride struct {
+	ProxyID string `json:"proxyID"`
+	Cluster string `json:"cluster"`
+	// Endpoints holds the host:port addresses sent instead of the endpoints of the cluster.
+	Endpoints []string  `json:"endpoints"`
+	Expires   time.Time `json:"expires"`
+}
+
+// endpointOverrides holds the active EndpointOverrides, keyed by proxy ID and cluster.
+type endpointOverrides struct {
+	mutex     sync.RWMutex
+	overrides map[string]map[string]*EndpointOverride
+}
+
+// SetEndpointOverride makes the proxy receive the given host:port endpoints for the cluster instead of its
+// actual endpoints, for the given duration. It takes effect on the next EDS push to the proxy.
+func (s *DiscoveryServer) SetEndpointOverride(proxyID, cluster string, endpoints []string, ttl time.Duration) error {
+	if !features.EnableEndpointOverrides {
+		return fmt.Errorf("endpoint overrides are disabled, set PILOT_ENABLE_ENDPOINT_OVERRIDES to enable them")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("invalid endpoint override ttl %v", ttl)
+	}
+	for _, ep := range endpoints {
+		if _, _, err := splitEndpointAddress(ep); err != nil {
+			return err
+		}
+	}
+	o := &s.endpointOverrides
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.overrides == nil {
+		o.overrides = map[string]map[string]*EndpointOverride{}
+	}
+	if o.overrides[proxyID] == nil {
+		o.overrides[proxyID] = map[string]*EndpointOverride{}
+	}
+	o.overrides[proxyID][cluster] = &EndpointOverride{
+		ProxyID:   proxyID,
+		Cluster:   cluster,
+		Endpoints: endpoints,
+		Expires:   s.clock.Now().Add(ttl),
+	}
+	adsLog.Warnf("Overriding the endpoints of %s for %s with %v for %v", cluster, proxyID, endpoints, ttl)
+	return nil
+}
+
+// ClearEndpointOverrides removes all the EndpointOverrides.
+func (s *DiscoveryServer) ClearEndpointOverrides() {
+	o := &s.endpointOverrides
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.overrides = nil
+}
+
+// EndpointOverrides returns the EndpointOverrides which have not expired yet.
+func (s *DiscoveryServer) EndpointOverrides() []EndpointOverride {
+	o := &s.endpointOverrides
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	now := s.clock.Now()
+	out := make([]EndpointOverride, 0)
+	for _, clusters := range o.overrides {
+		for _, override := range clusters {
+			if now.Before(override.Expires) {
+				out = append(out, *override)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ProxyID != out[j].ProxyID {
+			return out[i].ProxyID < out[j].ProxyID
+		}
+		return out[i].Cluster < out[j].Cluster
+	})
+	return out
+}
+
+// endpointOverride returns the active override of the endpoints of the cluster for the proxy, if any.
+// Expired overrides are removed.
+func (s *DiscoveryServer) endpointOverride(proxyID, cluster string) *EndpointOverride {
+	if !features.EnableEndpointOverrides {
+		return nil
+	}
+	o := &s.endpointOverrides
+	o.mutex.RLock()
+	override := o.overrides[proxyID][cluster]
+	o.mutex.RUnlock()
+	if override == nil {
+		return nil
+	}
+	if !s.clock.Now().Before(override.Expires) {
+		o.mutex.Lock()
+		if o.overrides[proxyID][cluster] == override {
+			delete(o.overrides[proxyID], cluster)
+			if len(o.overrides[proxyID]) == 0 {
+				delete(o.overrides, proxyID)
+			}
+		}
+		o.mutex.Unlock()
+		return nil
+	}
+	return override
+}
+
+// overriddenLoadAssignment builds the ClusterLoadAssignment of an EndpointOverride.
+func overriddenLoadAssignment(override *EndpointOverride) *endpoint.ClusterLoadAssignment {
+	lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(override.Endpoints))
+	for _, ep := range override.Endpoints {
+		// Addresses were validated when the override was set.
+		host, port, _ := splitEndpointAddress(ep)
+		lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{Address: util.BuildAddress(host, port)},
+			},
+		})
+	}
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: override.Cluster,
+		Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+	}
+}
+
+func splitEndpointAddress(address string) (string, uint32, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid endpoint %q: %v", address, err)
+	}
+	port, err := strconv.ParseUint(p, 10, 32)
+	if err != nil || port == 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port of endpoint %q", address)
+	}
+	return host, uint32(port), nil
+}
+
+// endpointOverridez lists the active EndpointOverrides. A POST with the proxyID, cluster, endpoints
+// (comma separated host:port addresses) and ttl query parameters sets an override and pushes it to the
+// proxy, a DELETE clears all of them.
+func (s *DiscoveryServer) endpointOverridez(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		con := s.getProxyConnection(query.Get("proxyID"))
+		if query.Get("proxyID") == "" || con == nil {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("Proxy not connected to this Pilot instance. It may be connected to another instance."))
+			return
+		}
+		ttl, err := time.ParseDuration(query.Get("ttl"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "invalid ttl: %v", err)
+			return
+		}
+		var endpoints []string
+		for _, ep := range strings.Split(query.Get("endpoints"), ",") {
+			if ep = strings.TrimSpace(ep); ep != "" {
+				endpoints = append(endpoints, ep)
+			}
+		}
+		if err := s.SetEndpointOverride(con.proxy.ID, query.Get("cluster"), endpoints, ttl); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		s.pushQueue.Enqueue(con, &model.PushRequest{
+			Full:   true,
+			Push:   s.globalPushContext(),
+			Start:  time.Now(),
+			Reason: []model.TriggerReason{model.DebugTrigger},
+		})
+	case http.MethodDelete:
+		s.ClearEndpointOverrides()
+		AdsPushAll(s)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if b, err := json.MarshalIndent(s.EndpointOverrides(), "", "  "); err == nil {
+		_, _ = w.Write(b)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestEndpointOverride(t *testing.T) {
+	setFeatureForTest(t, &features.EnableEndpointOverrides, true)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s.Discovery.clock = fakeClock
+	s.addHTTPServices("override.example.com")
+	s.Discovery.EDSCacheUpdate("", "override.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")})
+	target := s.SetupProxy(&model.Proxy{ID: "target.default"})
+	other := s.SetupProxy(&model.Proxy{ID: "other.default"})
+
+	const cluster = "outbound|80||override.example.com"
+	addresses := func(proxy *model.Proxy) []string {
+		got := loadAssignmentAddresses(s.buildEndpoints(cluster, proxy))
+		sort.Strings(got)
+		return got
+	}
+
+	if err := s.Discovery.SetEndpointOverride(target.ID, cluster, []string{"10.1.0.1:8080", "10.1.0.2:8080"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addresses(target), []string{"10.1.0.1", "10.1.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the overridden endpoints %v for the targeted proxy, got %v", want, got)
+	}
+	if got, want := addresses(other), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the actual endpoints %v for other proxies, got %v", want, got)
+	}
+	if got := s.Discovery.EndpointOverrides(); len(got) != 1 || got[0].ProxyID != target.ID {
+		t.Fatalf("expected a single override for %s, got %v", target.ID, got)
+	}
+
+	// Overrides expire after their ttl.
+	fakeClock.Step(time.Minute)
+	if got, want := addresses(target), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the actual endpoints %v after the override expired, got %v", want, got)
+	}
+	if got := s.Discovery.EndpointOverrides(); len(got) != 0 {
+		t.Fatalf("expected no overrides after they expired, got %v", got)
+	}
+
+	if err := s.Discovery.SetEndpointOverride(target.ID, cluster, []string{"10.1.0.1:8080"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.Discovery.ClearEndpointOverrides()
+	if got, want := addresses(target), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the actual endpoints %v after the overrides were cleared, got %v", want, got)
+	}
+
+	if err := s.Discovery.SetEndpointOverride(target.ID, cluster, []string{"10.1.0.1"}, time.Minute); err == nil {
+		t.Fatal("expected an endpoint without port to be rejected")
+	}
+	features.EnableEndpointOverrides = false
+	if err := s.Discovery.SetEndpointOverride(target.ID, cluster, []string{"10.1.0.1:8080"}, time.Minute); err == nil {
+		t.Fatal("expected overrides to be rejected when they are disabled")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// edsPause holds the EDS updates received while EDS pushes are paused, for PauseEds and ResumeEds.
+type edsPause struct {
+	// mutex is held while the deferred updates are applied, so updates received meanwhile wait for them
+	// and are applied on top.
+	mutex  sync.Mutex
+	paused bool
+	// updates holds the latest endpoints of each updated shard, in the order the shards were first updated.
+	updates []deferredEdsUpdate
+	index   map[deferredEdsKey]int
+}
+
+type deferredEdsKey struct {
+	clusterID, hostname, namespace string
+}
+
+type deferredEdsUpdate struct {
+	deferredEdsKey
+	endpoints []*model.IstioEndpoint
+}
+
+// PauseEds pauses EDS pushes, for example while making bulk changes during a maintenance. EDS updates and
+// registry replacements received while paused are deferred, and applied in a single push by ResumeEds. The
+// other writes of the shards, such as cache updates and service deletions, are applied right away and
+// discard the deferred updates of the shards they write, which are older.
+func (s *DiscoveryServer) PauseEds() {
+	s.edsPause.mutex.Lock()
+	defer s.edsPause.mutex.Unlock()
+	if !s.edsPause.paused {
+		adsLog.Infof("Pausing EDS pushes")
+	}
+	s.edsPause.paused = true
+}
+
+// ResumeEds resumes EDS pushes paused by PauseEds. The latest endpoints received for each shard while
+// paused are applied, and a single push is triggered for all the updated services.
+func (s *DiscoveryServer) ResumeEds() {
+	p := &s.edsPause
+	p.mutex.Lock()
+	if !p.paused {
+		p.mutex.Unlock()
+		return
+	}
+	p.paused = false
+	updates := p.updates
+	p.updates, p.index = nil, nil
+	adsLog.Infof("Resuming EDS pushes, applying %d deferred updates", len(updates))
+	if len(updates) == 0 {
+		p.mutex.Unlock()
+		return
+	}
+
+	fullPush := false
+	updated := make(map[model.ConfigKey]struct{}, len(updates))
+	for _, u := range updates {
+		fp, rejected := s.edsCacheUpdate(u.clusterID, u.hostname, u.namespace, u.endpoints)
+		if !rejected {
+			recordEDSUpdateKind(fp)
+		}
+		if fp {
+			fullPush = true
+		}
+		updated[model.ConfigKey{Kind: gvk.ServiceEntry, Name: u.hostname, Namespace: u.namespace}] = struct{}{}
+	}
+	p.mutex.Unlock()
+
+	req := &model.PushRequest{
+		Full:           fullPush,
+		ConfigsUpdated: updated,
+		Reason:         []model.TriggerReason{model.EndpointUpdate},
+	}
+	s.notifyEdsPushObservers(req)
+	s.ConfigUpdate(req)
+}
+
+// deferEdsUpdate defers the EDS update if EDS pushes are paused, replacing any deferred update of the
+// same shard. It returns false if the update should be applied now.
+func (s *DiscoveryServer) deferEdsUpdate(clusterID, hostname, namespace string, endpoints []*model.IstioEndpoint) bool {
+	p := &s.edsPause
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.paused {
+		return false
+	}
+	if s.endpointResyncing(clusterID) {
+		// The deferred endpoints are the latest of the registry, they confirm the stale ones for the resync.
+		s.retainStaleEndpoints(clusterID, hostname, namespace, endpoints)
+	}
+	key := deferredEdsKey{clusterID: clusterID, hostname: hostname, namespace: namespace}
+	if i, f := p.index[key]; f {
+		p.updates[i].endpoints = endpoints
+		return true
+	}
+	if p.index == nil {
+		p.index = map[deferredEdsKey]int{}
+	}
+	p.index[key] = len(p.updates)
+	p.updates = append(p.updates, deferredEdsUpdate{deferredEdsKey: key, endpoints: endpoints})
+	return true
+}
+
+// discardDeferredEdsUpdates discards the deferred updates of the shards matching the filter, as the shards are
+// written by a newer update, which they must not overwrite when EDS pushes are resumed. It must not be called
+// with the mutex of the DiscoveryServer held, which ResumeEds acquires after the one of the deferred updates.
+func (s *DiscoveryServer) discardDeferredEdsUpdates(match func(deferredEdsKey) bool) {
+	p := &s.edsPause
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.updates) == 0 {
+		return
+	}
+	kept := p.updates[:0]
+	p.index = map[deferredEdsKey]int{}
+	for _, u := range p.updates {
+		if match(u.deferredEdsKey) {
+			continue
+		}
+		p.index[u.deferredEdsKey] = len(kept)
+		kept = append(kept, u)
+	}
+	p.updates = kept
+}
+
+// discardDeferredEdsUpdate discards the deferred update of the shard, if any.
+func (s *DiscoveryServer) discardDeferredEdsUpdate(clusterID, hostname, namespace string) {
+	key := deferredEdsKey{clusterID: clusterID, hostname: hostname, namespace: namespace}
+	s.discardDeferredEdsUpdates(func(k deferredEdsKey) bool { return k == key })
+}
+
+// evictDeferredEndpoint removes the endpoints with the address from the deferred updates of the service, so
+// the eviction is not undone when EDS pushes are resumed.
+func (s *DiscoveryServer) evictDeferredEndpoint(hostname, namespace, address string) {
+	p := &s.edsPause
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, u := range p.updates {
+		if u.hostname != hostname || u.namespace != namespace {
+			continue
+		}
+		kept := make([]*model.IstioEndpoint, 0, len(u.endpoints))
+		for _, e := range u.endpoints {
+			if e.Address != address {
+				kept = append(kept, e)
+			}
+		}
+		p.updates[i].endpoints = kept
+	}
+}
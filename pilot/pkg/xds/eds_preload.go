@@ -0,0 +1,177 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// edsPreloadEnabled returns whether endpoints are preloaded in the EDS cache, which must be enabled.
+func edsPreloadEnabled() bool {
+	return features.EDSPreload && features.EnableXDSCaching
+}
+
+// edsPreload runs a single preload of the endpoints at a time: a preload started by a push cancels the one
+// of the previous push, and waits for it to return.
+type edsPreload struct {
+	mutex sync.Mutex
+	// stop is closed to cancel the running preload, if any.
+	stop chan struct{}
+	// done is closed once the last started preload returned.
+	done chan struct{}
+}
+
+// startPreloadEndpoints preloads the endpoints of the push in the background, canceling the preload of the
+// previous push, if still running.
+func (s *DiscoveryServer) startPreloadEndpoints(push *model.PushContext) {
+	p := &s.edsPreload
+	p.mutex.Lock()
+	if p.stop != nil {
+		close(p.stop)
+	}
+	previous := p.done
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	p.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		s.preloadEndpoints(push, stop)
+	}()
+}
+
+// preloadEndpoints generates and caches the endpoints of the clusters of all the services visible to each
+// distinct profile of the connected proxies, so the first EDS push of new connections with the same profile is
+// served from the cache instead of computing everything from scratch. Clusters already cached are skipped. The
+// preload stops once stop is closed, or the push is no longer the current one, so endpoints of an outdated push
+// are not cached. It returns the number of load assignments preloaded.
+func (s *DiscoveryServer) preloadEndpoints(push *model.PushContext, stop <-chan struct{}) int {
+	t0 := time.Now()
+	profiles := s.preloadProfiles(push)
+	preloaded := 0
+	for _, proxy := range profiles {
+		for _, clusterName := range preloadClusters(push, proxy) {
+			if !s.preloadCurrent(push, stop) {
+				adsLog.Debugf("EDS: preload canceled after %d cluster load assignments, a newer push started", preloaded)
+				return preloaded
+			}
+			b := NewEndpointBuilder(clusterName, proxy, push)
+			b.localityLoads = s.localityLoads.current(s.clock.Now())
+			if !b.Cacheable() {
+				continue
+			}
+			if _, f := s.Cache.Get(b); f {
+				continue
+			}
+			l := s.generateEndpoints(b)
+			if l == nil || !s.preloadCurrent(push, stop) {
+				continue
+			}
+			s.Cache.Add(b, util.MessageToAny(l))
+			preloaded++
+		}
+	}
+	adsLog.Infof("EDS: preloaded %d cluster load assignments for %d proxy profiles in %v",
+		preloaded, len(profiles), time.Since(t0))
+	return preloaded
+}
+
+// preloadCurrent returns whether the preload of the push may go on: it is not canceled and the push is still
+// the current one.
+func (s *DiscoveryServer) preloadCurrent(push *model.PushContext, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	return s.globalPushContext() == push
+}
+
+// preloadProfiles returns a proxy for each distinct profile of the connected proxies watching endpoints. Proxies
+// with the same profile share the cached endpoints: they have the same attributes making up the cache key, the
+// same config namespace and sidecar scope. The returned proxies are copies, scoped to the push context.
+func (s *DiscoveryServer) preloadProfiles(push *model.PushContext) []*model.Proxy {
+	s.adsClientsMutex.RLock()
+	cons := make([]*Connection, 0, len(s.adsClients))
+	for _, con := range s.adsClients {
+		cons = append(cons, con)
+	}
+	s.adsClientsMutex.RUnlock()
+
+	profiles := map[string]*model.Proxy{}
+	for _, con := range cons {
+		if con.proxy == nil || con.Watched(v3.EndpointType) == nil {
+			continue
+		}
+		con.proxy.RLock()
+		proxy := &model.Proxy{
+			Type:            con.proxy.Type,
+			ID:              con.proxy.ID,
+			IPAddresses:     con.proxy.IPAddresses,
+			ConfigNamespace: con.proxy.ConfigNamespace,
+			Metadata:        con.proxy.Metadata,
+			Locality:        con.proxy.Locality,
+		}
+		con.proxy.RUnlock()
+		proxy.SetSidecarScope(push)
+		key := NewEndpointBuilder("", proxy, push).Key() + "~" + string(proxy.Type) + "~" + proxy.ConfigNamespace
+		if scope := proxy.SidecarScope.Config; scope != nil {
+			key += "~" + scope.Namespace + "/" + scope.Name
+		}
+		if _, f := profiles[key]; !f {
+			profiles[key] = proxy
+		}
+	}
+	keys := make([]string, 0, len(profiles))
+	for key := range profiles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*model.Proxy, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, profiles[key])
+	}
+	return out
+}
+
+// preloadClusters returns the names of the clusters of all the ports of the services visible to the proxy, without
+// subsets. Services resolved by DNS do not use EDS, so they are skipped.
+func preloadClusters(push *model.PushContext, proxy *model.Proxy) []string {
+	var out []string
+	seen := map[string]struct{}{}
+	for _, svc := range push.Services(proxy) {
+		if svc.Resolution == model.DNSLB {
+			continue
+		}
+		for _, port := range svc.Ports {
+			clusterName := model.BuildSubsetKey(model.TrafficDirectionOutbound, "", svc.Hostname, port.Port)
+			if _, f := seen[clusterName]; !f {
+				seen[clusterName] = struct{}{}
+				out = append(out, clusterName)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// newPreloadServer returns a server with 3 services, and two connections with the same profile watching
+// endpoints and one not watching them.
+func newPreloadServer(t *testing.T) *FakeDiscoveryServer {
+	s := NewFakeDiscoveryServer(t, FakeOptions{Configs: createEndpoints(2, 3)})
+	if s.Discovery.Cache == nil {
+		t.Skip("EDS preload requires the xDS cache")
+	}
+	for i, watchEds := range []bool{true, true, false} {
+		con, _ := newRecordingConnection(s, newPreloadProxy(fmt.Sprintf("app-%d", i)))
+		con.ConID = fmt.Sprintf("con-%d", i)
+		if watchEds {
+			con.proxy.WatchedResources[v3.EndpointType] = &model.WatchedResource{TypeUrl: v3.EndpointType}
+		}
+		s.Discovery.addCon(con.ConID, con)
+	}
+	return s
+}
+
+func newPreloadProxy(id string) *model.Proxy {
+	return &model.Proxy{
+		Type:            model.SidecarProxy,
+		IPAddresses:     []string{"10.3.3.3"},
+		ID:              id,
+		ConfigNamespace: "default",
+		Metadata:        &model.NodeMetadata{},
+	}
+}
+
+func TestPreloadEndpoints(t *testing.T) {
+	s := newPreloadServer(t)
+	push := s.PushContext()
+	if got := s.Discovery.preloadEndpoints(push, nil); got != 3 {
+		t.Fatalf("expected 3 load assignments preloaded, got %d", got)
+	}
+	// Everything is already cached.
+	if got := s.Discovery.preloadEndpoints(push, nil); got != 0 {
+		t.Fatalf("expected nothing preloaded again, got %d", got)
+	}
+
+	// A new connection with the same profile is served from the cache.
+	proxy := s.SetupProxy(newPreloadProxy("new"))
+	for svc := 0; svc < 3; svc++ {
+		b := NewEndpointBuilder(fmt.Sprintf("outbound|80||foo-%d.com", svc), proxy, push)
+		if _, f := s.Discovery.Cache.Get(b); !f {
+			t.Fatalf("expected %s to be preloaded", b.clusterName)
+		}
+	}
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{"outbound|80||foo-0.com"}}
+	resources := s.Discovery.Generators[v3.EndpointType].Generate(proxy, push, w, &model.PushRequest{Full: true})
+	if len(resources) != 1 {
+		t.Fatalf("expected 1 load assignment, got %d", len(resources))
+	}
+}
+
+func TestPreloadEndpointsCanceled(t *testing.T) {
+	s := newPreloadServer(t)
+	push := s.PushContext()
+	stop := make(chan struct{})
+	close(stop)
+	if got := s.Discovery.preloadEndpoints(push, stop); got != 0 {
+		t.Fatalf("expected nothing preloaded once canceled, got %d", got)
+	}
+
+	// The endpoints of an outdated push are not cached.
+	s.refreshPushContext()
+	if got := s.Discovery.preloadEndpoints(push, nil); got != 0 {
+		t.Fatalf("expected nothing preloaded for an outdated push, got %d", got)
+	}
+
+	// A new preload cancels the running one, and waits for it to return.
+	s.Discovery.startPreloadEndpoints(push)
+	s.Discovery.edsPreload.mutex.Lock()
+	first := s.Discovery.edsPreload.stop
+	s.Discovery.edsPreload.mutex.Unlock()
+	s.Discovery.startPreloadEndpoints(s.PushContext())
+	select {
+	case <-first:
+	default:
+		t.Fatal("expected the first preload to be canceled")
+	}
+	s.Discovery.edsPreload.mutex.Lock()
+	done := s.Discovery.edsPreload.done
+	s.Discovery.edsPreload.mutex.Unlock()
+	<-done
+}
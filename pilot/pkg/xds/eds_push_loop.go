@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// maxPushLoopBackoffWindows bounds the backoff of a service stuck in a push loop, in windows.
+const maxPushLoopBackoffWindows = 32
+
+// pushLoops detects services pushed by endpoint updates at an abnormally high sustained rate, typically
+// because of a push loop, where the pushes end up triggering new endpoint updates of the service. The
+// pushes of such services are held back, with an exponential backoff while the rate stays high.
+type pushLoops struct {
+	mutex    sync.Mutex
+	services map[ServiceRef]*servicePushRate
+	// lastSweep is the last time idle services were removed from services.
+	lastSweep time.Time
+}
+
+// servicePushRate tracks the rate of the pushes triggered by endpoint updates of a service.
+type servicePushRate struct {
+	windowStart time.Time
+	pushes      int
+	// backoff is the current backoff, doubled each time the loop is detected again, and reset once a window
+	// stays below the threshold.
+	backoff      time.Duration
+	backoffUntil time.Time
+	// pendingFull is set if a push held back by the backoff must be full.
+	pendingFull bool
+}
+
+// edsPushAllowed returns whether the push triggered by an endpoint update of the service is sent now. With
+// PILOT_EDS_PUSH_LOOP_THRESHOLD set, a service pushed more than that many times in a PILOT_EDS_PUSH_LOOP_WINDOW
+// is considered to be in a push loop: its pushes are held back for a backoff, and a single push is sent at
+// its end, full if any of the held back pushes was, so proxies still converge on the latest endpoints.
+func (s *DiscoveryServer) edsPushAllowed(hostname, namespace string, full bool) bool {
+	threshold, window := features.EDSPushLoopThreshold, features.EDSPushLoopWindow
+	if threshold <= 0 || window <= 0 {
+		return true
+	}
+	svc := ServiceRef{Hostname: hostname, Namespace: namespace}
+	now := s.clock.Now()
+
+	loops := &s.pushLoops
+	loops.mutex.Lock()
+	defer loops.mutex.Unlock()
+	if loops.services == nil {
+		loops.services = map[ServiceRef]*servicePushRate{}
+	}
+	if now.Sub(loops.lastSweep) >= window {
+		loops.sweep(now, threshold, window)
+	}
+	rate := loops.services[svc]
+	if rate == nil {
+		rate = &servicePushRate{windowStart: now}
+		loops.services[svc] = rate
+	}
+	if now.Before(rate.backoffUntil) {
+		// A push is already scheduled at the end of the backoff.
+		rate.pendingFull = rate.pendingFull || full
+		return false
+	}
+	if now.Sub(rate.windowStart) >= window {
+		if rate.pushes <= threshold {
+			rate.backoff = 0
+		}
+		rate.windowStart = now
+		rate.pushes = 0
+	}
+	rate.pushes++
+	if rate.pushes <= threshold {
+		return true
+	}
+
+	if rate.backoff == 0 {
+		rate.backoff = window
+	} else if rate.backoff < maxPushLoopBackoffWindows*window {
+		rate.backoff *= 2
+	}
+	rate.backoffUntil = now.Add(rate.backoff)
+	rate.pendingFull = full
+	adsLog.Warnf("Service %s/%s pushed more than %d times in %v, possibly in a push loop, backing off for %v",
+		namespace, hostname, threshold, window, rate.backoff)
+	recordPushLoopBackoff()
+	timer := s.clock.NewTimer(rate.backoff)
+	go func() {
+		<-timer.C()
+		loops.mutex.Lock()
+		full := rate.pendingFull
+		rate.pendingFull = false
+		// The push sent at the end of the backoff starts a new window.
+		rate.windowStart = s.clock.Now()
+		rate.pushes = 1
+		loops.mutex.Unlock()
+		req := &model.PushRequest{
+			Full: full,
+			ConfigsUpdated: map[model.ConfigKey]struct{}{{
+				Kind:      gvk.ServiceEntry,
+				Name:      hostname,
+				Namespace: namespace,
+			}: {}},
+			Reason: []model.TriggerReason{model.EndpointUpdate},
+		}
+		s.notifyEdsPushObservers(req)
+		s.ConfigUpdate(req)
+	}()
+	return false
+}
+
+// sweep removes the services which were not pushed at a high rate in their last window, and are not backed
+// off: they would start over on their next push anyway. Must be called with the mutex held.
+func (l *pushLoops) sweep(now time.Time, threshold int, window time.Duration) {
+	l.lastSweep = now
+	for svc, rate := range l.services {
+		if now.Sub(rate.windowStart) >= window && rate.pushes <= threshold && !now.Before(rate.backoffUntil) {
+			delete(l.services, svc)
+		}
+	}
+}
+
+// forget removes the service, once deleted.
+func (l *pushLoops) forget(svc ServiceRef) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.services, svc)
+}
@@ -0,0 +1,51 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"istio.io/istio/pilot/pkg/features"
+)
+
+// edsSkipReason is the reason why the endpoints of a cluster are not sent in an EDS push.
+type edsSkipReason string
+
+const (
+	// edsSkipNoEdsConfigUpdated is used when none of the configs updated by the push affects endpoints.
+	edsSkipNoEdsConfigUpdated edsSkipReason = "no config affecting endpoints updated"
+	// edsSkipNoServiceUpdated is used when an incremental push updated configs, but no services.
+	edsSkipNoServiceUpdated edsSkipReason = "no service updated"
+	// edsSkipServiceNotUpdated is used when an incremental push did not update the service of the cluster.
+	edsSkipServiceNotUpdated edsSkipReason = "service not updated"
+	// edsSkipDNSResolution is used when the service of the cluster is resolved by DNS, not EDS.
+	edsSkipDNSResolution edsSkipReason = "service resolved by DNS"
+	// edsSkipMinShards is used when fewer clusters than PILOT_EDS_MIN_SHARDS reported endpoints for the service.
+	edsSkipMinShards edsSkipReason = "too few clusters reported endpoints"
+)
+
+// logEdsSkip logs why the endpoints of a cluster are not sent to a proxy. It is a variable for tests.
+var logEdsSkip = func(proxyID, clusterName string, reason edsSkipReason) {
+	adsLog.Infof("EDS: skipping cluster %s for node:%s: %s", clusterName, proxyID, reason)
+}
+
+// traceEdsSkip logs why the endpoints of the clusters are not sent to the proxy, if PILOT_EDS_SKIP_TRACE
+// is enabled. This is verbose, so meant for debugging why a proxy does not get endpoints.
+func traceEdsSkip(proxyID string, clusterNames []string, reason edsSkipReason) {
+	if !features.EDSSkipTrace {
+		return
+	}
+	for _, clusterName := range clusterNames {
+		logEdsSkip(proxyID, clusterName, reason)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+const edsSkipTraceConfig = `
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: static
+  namespace: default
+spec:
+  hosts:
+  - static.example.com
+  ports:
+  - number: 80
+    name: http
+    protocol: HTTP
+  resolution: STATIC
+  endpoints:
+  - address: 10.0.0.1
+---
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: dns
+  namespace: default
+spec:
+  hosts:
+  - dns.example.com
+  ports:
+  - number: 80
+    name: http
+    protocol: HTTP
+  resolution: DNS
+`
+
+func TestTraceEdsSkip(t *testing.T) {
+	setFeatureForTest(t, &features.EDSSkipTrace, false)
+	setFeatureForTest(t, &features.EDSMinShards, 0)
+	defer func(old func(string, string, edsSkipReason)) { logEdsSkip = old }(logEdsSkip)
+	var logged map[string]edsSkipReason
+	logEdsSkip = func(_, clusterName string, reason edsSkipReason) {
+		logged[clusterName] = reason
+	}
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: edsSkipTraceConfig})
+	proxy := s.SetupProxy(nil)
+	static, dns := "outbound|80||static.example.com", "outbound|80||dns.example.com"
+	w := &model.WatchedResource{TypeUrl: v3.EndpointType, ResourceNames: []string{static, dns}}
+
+	cases := []struct {
+		name      string
+		trace     bool
+		minShards int
+		req       *model.PushRequest
+		want      map[string]edsSkipReason
+	}{
+		{
+			name:  "disabled",
+			trace: false,
+			req:   &model.PushRequest{Full: true},
+			want:  map[string]edsSkipReason{},
+		},
+		{
+			name:  "full push",
+			trace: true,
+			req:   &model.PushRequest{Full: true},
+			want:  map[string]edsSkipReason{dns: edsSkipDNSResolution},
+		},
+		{
+			name:  "no config affecting endpoints updated",
+			trace: true,
+			req: &model.PushRequest{ConfigsUpdated: map[model.ConfigKey]struct{}{
+				{Kind: gvk.VirtualService, Name: "vs", Namespace: "default"}: {},
+			}},
+			want: map[string]edsSkipReason{static: edsSkipNoEdsConfigUpdated, dns: edsSkipNoEdsConfigUpdated},
+		},
+		{
+			name:  "no service updated",
+			trace: true,
+			req: &model.PushRequest{ConfigsUpdated: map[model.ConfigKey]struct{}{
+				{Kind: gvk.DestinationRule, Name: "dr", Namespace: "default"}: {},
+			}},
+			want: map[string]edsSkipReason{static: edsSkipNoServiceUpdated, dns: edsSkipNoServiceUpdated},
+		},
+		{
+			name:  "service not updated",
+			trace: true,
+			req: &model.PushRequest{ConfigsUpdated: map[model.ConfigKey]struct{}{
+				{Kind: gvk.ServiceEntry, Name: "static.example.com", Namespace: "default"}: {},
+			}},
+			want: map[string]edsSkipReason{dns: edsSkipServiceNotUpdated},
+		},
+		{
+			name:      "too few shards",
+			trace:     true,
+			minShards: 2,
+			req:       &model.PushRequest{Full: true},
+			want:      map[string]edsSkipReason{static: edsSkipMinShards, dns: edsSkipDNSResolution},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			features.EDSSkipTrace = tt.trace
+			features.EDSMinShards = tt.minShards
+			s.Discovery.Cache.ClearAll()
+			logged = map[string]edsSkipReason{}
+			s.Discovery.Generators[v3.EndpointType].Generate(proxy, s.PushContext(), w, tt.req)
+			if !reflect.DeepEqual(logged, tt.want) {
+				t.Fatalf("expected skipped clusters %v, got %v", tt.want, logged)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +33,7 @@ import (
 	"time"
 
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/proto"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/xds"
@@ -66,7 +68,15 @@ func TestIncrementalPush(t *testing.T) {
 	})
 	t.Run("Incremental Push", func(t *testing.T) {
 		ads.WaitClear()
+		// Without ConfigsUpdated, no service is known to be updated, so nothing is sent.
 		s.Discovery.Push(&model.PushRequest{Full: false})
+		if _, err := ads.Wait(time.Second, v3.EndpointType); err == nil {
+			t.Fatal("expected no EDS update")
+		}
+	})
+	t.Run("Forced Incremental Push", func(t *testing.T) {
+		ads.WaitClear()
+		s.Discovery.Push(&model.PushRequest{Full: false, ForceEds: true})
 		if err := ads.WaitSingle(time.Second*5, v3.EndpointType, v3.ClusterType); err != nil {
 			t.Fatal(err)
 		}
@@ -234,6 +244,44 @@ func TestEdsWeightedServiceEntry(t *testing.T) {
 	}
 }
 
+func TestBuildEndpoints(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{ConfigString: mustReadFile(t, "tests/testdata/config/static-weighted-se.yaml")})
+	addEdsCluster(s, "build.svc.cluster.local", "http", "10.0.0.1", 8080)
+	adscConn := s.Connect(nil, nil, watchEds)
+	pushed := adscConn.GetEndpoints()
+	if len(pushed) == 0 {
+		t.Fatal("expected endpoints to be pushed")
+	}
+	clusters := make([]string, 0, len(pushed))
+	for c := range pushed {
+		clusters = append(clusters, c)
+	}
+	sort.Strings(clusters)
+
+	built := s.Discovery.BuildEndpoints(s.SetupProxy(nil), s.PushContext(), clusters)
+	if len(built) != len(clusters) {
+		t.Fatalf("expected %d assignments, got %d", len(clusters), len(built))
+	}
+	for i, cla := range built {
+		if cla.ClusterName != clusters[i] {
+			t.Fatalf("expected assignment of %s, got %s", clusters[i], cla.ClusterName)
+		}
+		// Localities are built from a map, so their order is not stable across generations.
+		sortLocalities(cla)
+		sortLocalities(pushed[cla.ClusterName])
+		if !proto.Equal(cla, pushed[cla.ClusterName]) {
+			t.Errorf("built endpoints of %s differ from the pushed ones:\ngot:  %v\nwant: %v",
+				cla.ClusterName, cla, pushed[cla.ClusterName])
+		}
+	}
+}
+
+func sortLocalities(cla *endpoint.ClusterLoadAssignment) {
+	sort.Slice(cla.Endpoints, func(i, j int) bool {
+		return cla.Endpoints[i].Locality.String() < cla.Endpoints[j].Locality.String()
+	})
+}
+
 var watchEds = []string{v3.ClusterType, v3.EndpointType}
 var watchAll = []string{v3.ClusterType, v3.EndpointType, v3.ListenerType, v3.RouteType}
 
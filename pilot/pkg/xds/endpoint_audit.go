@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	istiolog "istio.io/pkg/log"
+)
+
+var endpointAuditLog = istiolog.RegisterScope("endpointaudit", "endpoint membership audit records", 0)
+
+// EndpointAuditRecord describes a change of the endpoint membership of a service in a cluster. Only the
+// addresses of the endpoints are recorded, to limit the personal data shipped to audit sinks.
+type EndpointAuditRecord struct {
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster"`
+	Hostname  string    `json:"hostname"`
+	Namespace string    `json:"namespace"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+}
+
+// EndpointAuditHook is called with the record of each change of the endpoint membership of a service.
+// It is called synchronously from the endpoint updates, without any lock held, so it should not block.
+type EndpointAuditHook func(record EndpointAuditRecord)
+
+// LogEndpointAudit is an EndpointAuditHook writing the records as JSON to the endpointaudit log scope, to be
+// shipped to an audit sink by the log collection. It is used if PILOT_ENDPOINT_AUDIT_LOG is enabled.
+func LogEndpointAudit(record EndpointAuditRecord) {
+	out, err := json.Marshal(record)
+	if err != nil {
+		endpointAuditLog.Errorf("failed to marshal endpoint audit record: %v", err)
+		return
+	}
+	endpointAuditLog.Info(string(out))
+}
+
+// newEndpointAuditRecord returns the record of the change of the endpoints of the service in the cluster,
+// or nil if the addresses of the endpoints did not change.
+func newEndpointAuditRecord(cluster, hostname, namespace string, previous, current []*model.IstioEndpoint) *EndpointAuditRecord {
+	prev := endpointAddresses(previous)
+	cur := endpointAddresses(current)
+	record := &EndpointAuditRecord{
+		Time:      time.Now(),
+		Cluster:   cluster,
+		Hostname:  hostname,
+		Namespace: namespace,
+	}
+	for address := range cur {
+		if _, f := prev[address]; !f {
+			record.Added = append(record.Added, address)
+		}
+	}
+	for address := range prev {
+		if _, f := cur[address]; !f {
+			record.Removed = append(record.Removed, address)
+		}
+	}
+	if len(record.Added) == 0 && len(record.Removed) == 0 {
+		return nil
+	}
+	sort.Strings(record.Added)
+	sort.Strings(record.Removed)
+	return record
+}
+
+func endpointAddresses(endpoints []*model.IstioEndpoint) map[string]struct{} {
+	out := make(map[string]struct{}, len(endpoints))
+	for _, e := range endpoints {
+		out[e.Address] = struct{}{}
+	}
+	return out
+}
+
+// auditEndpoints passes the records to the EndpointAuditHook. Must be called without any lock held.
+func (s *DiscoveryServer) auditEndpoints(records []*EndpointAuditRecord) {
+	if s.EndpointAuditHook == nil {
+		return
+	}
+	for _, r := range records {
+		if r != nil {
+			s.EndpointAuditHook(*r)
+		}
+	}
+}
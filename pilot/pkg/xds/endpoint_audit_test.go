@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestEndpointAudit(t *testing.T) {
+	var records []EndpointAuditRecord
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+		EndpointAuditHook: func(record EndpointAuditRecord) {
+			records = append(records, record)
+		},
+	}
+	endpoints := func(addresses ...string) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, a := range addresses {
+			out = append(out, &model.IstioEndpoint{Address: a})
+		}
+		return out
+	}
+	expect := func(expected ...EndpointAuditRecord) {
+		t.Helper()
+		for i := range records {
+			if records[i].Time.IsZero() {
+				t.Fatalf("expected audit record %+v to have a time", records[i])
+			}
+			records[i].Time = time.Time{}
+		}
+		if !reflect.DeepEqual(records, append([]EndpointAuditRecord(nil), expected...)) {
+			t.Fatalf("expected audit records %+v, got %+v", expected, records)
+		}
+		records = nil
+	}
+	record := func(cluster string, added, removed []string) EndpointAuditRecord {
+		return EndpointAuditRecord{Cluster: cluster, Hostname: "a.example.com", Namespace: "ns1", Added: added, Removed: removed}
+	}
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints("10.0.0.2", "10.0.0.1"))
+	expect(record("cluster1", []string{"10.0.0.1", "10.0.0.2"}, nil))
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints("10.0.0.2", "10.0.0.3"))
+	expect(record("cluster1", []string{"10.0.0.3"}, []string{"10.0.0.1"}))
+
+	// Updates without a membership change, such as label changes, are not audited.
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", endpoints("10.0.0.3", "10.0.0.2"))
+	expect()
+
+	s.EvictEndpoint("a.example.com", "ns1", "10.0.0.2")
+	expect(record("cluster1", nil, []string{"10.0.0.2"}))
+
+	s.edsCacheUpdate("cluster1", "a.example.com", "ns1", nil)
+	expect(record("cluster1", nil, []string{"10.0.0.3"}))
+}
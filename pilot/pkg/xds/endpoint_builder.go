@@ -15,19 +15,30 @@
 package xds
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
 	"sort"
+	"strconv"
 	"strings"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
 
 	networkingapi "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/config/validation"
 )
 
 type EndpointBuilder struct {
@@ -39,12 +50,25 @@ type EndpointBuilder struct {
 	locality        *core.Locality
 	destinationRule *config.Config
 	service         *model.Service
+	// proxyless is set for proxyless gRPC clients, which are sent endpoint metadata in the gRPC shape.
+	proxyless bool
+	// mtlsUnsupported is set for proxies which cannot originate Istio mutual TLS, if endpoints are adjusted for them.
+	mtlsUnsupported bool
+	// addressFamily is the address family preferred by the proxy for the endpoints of dual-stack workloads.
+	addressFamily string
+	// localityLoads holds the recently reported loads of localities, keyed by locality, if load feedback is enabled.
+	localityLoads map[string]float64
+	// originalDst is set for the passthrough clusters of gateways, whose endpoints carry original destination metadata.
+	originalDst bool
+	// endpointFilters are the filters registered on the DiscoveryServer, applied to each endpoint.
+	endpointFilters []EndpointFilter
 
 	// These fields are provided for convenience only
 	subsetName string
 	hostname   host.Name
 	port       int
 	push       *model.PushContext
+	proxy      *model.Proxy
 }
 
 func NewEndpointBuilder(clusterName string, proxy *model.Proxy, push *model.PushContext) EndpointBuilder {
@@ -58,8 +82,13 @@ func NewEndpointBuilder(clusterName string, proxy *model.Proxy, push *model.Push
 		locality:        proxy.Locality,
 		service:         svc,
 		destinationRule: push.DestinationRule(proxy, svc),
+		proxyless:       isProxylessGrpc(proxy),
+		mtlsUnsupported: mtlsUnsupported(proxy),
+		addressFamily:   addressFamilyPreference(proxy),
+		originalDst:     originalDstPassthrough(clusterName, proxy),
 
 		push:       push,
+		proxy:      proxy,
 		subsetName: subsetName,
 		hostname:   hostname,
 		port:       port,
@@ -73,6 +102,12 @@ func (b EndpointBuilder) DestinationRule() *networkingapi.DestinationRule {
 	return b.destinationRule.Spec.(*networkingapi.DestinationRule)
 }
 
+// ResolvedDestinationRule returns the DestinationRule config, including its name and namespace,
+// selected for the cluster and proxy. This is mostly useful for debugging.
+func (b EndpointBuilder) ResolvedDestinationRule() *config.Config {
+	return b.destinationRule
+}
+
 // Key provides the eds cache key and should include any information that could change the way endpoints are generated.
 func (b EndpointBuilder) Key() string {
 	params := []string{b.clusterName, b.network, b.clusterID, util.LocalityToString(b.locality)}
@@ -90,6 +125,21 @@ func (b EndpointBuilder) Key() string {
 		sort.Strings(nv)
 		params = append(params, nv...)
 	}
+	if b.proxyless {
+		params = append(params, "grpc")
+	}
+	if b.mtlsUnsupported {
+		params = append(params, "nomtls")
+	}
+	if b.addressFamily != "" {
+		params = append(params, b.addressFamily)
+	}
+	if b.originalDst {
+		params = append(params, "origdst")
+	}
+	if features.ProxyEndpointOrdering && b.proxy != nil {
+		params = append(params, b.proxy.ID)
+	}
 	return strings.Join(params, "~")
 }
 
@@ -98,11 +148,25 @@ func (b *EndpointBuilder) MultiNetworkConfigured() bool {
 	return b.push.NetworkGateways() != nil
 }
 
+// networkFilterDisabled returns true if the endpoints of the cluster are not filtered by network, either
+// because the cluster is listed in PILOT_NETWORK_FILTER_EXEMPT_CLUSTERS or because its DestinationRule
+// is annotated with networking.istio.io/disableNetworkFilter.
+func (b *EndpointBuilder) networkFilterDisabled() bool {
+	if _, f := features.NetworkFilterExemptClusters[b.clusterName]; f {
+		return true
+	}
+	return b.destinationRule != nil && b.destinationRule.Annotations[model.DisableNetworkFilterAnnotation] == "true"
+}
+
 func (b EndpointBuilder) Cacheable() bool {
 	// If service is not defined, we cannot do any caching as we will not have a way to
 	// invalidate the results.
 	// Service being nil means the EDS will be empty anyways, so not much lost here.
-	return b.service != nil
+	// The synthetic self endpoint is specific to the proxy, so these clusters are not cached either.
+	// Flaky endpoints recover as their readiness flips age, without an update invalidating the cache.
+	// The weights of localities reporting their load change with every report, if the cluster uses them.
+	return b.service != nil && !shouldAddSelfEndpoint(b.clusterName) && !flakyEndpointsEnabled() &&
+		(len(b.localityLoads) == 0 || !b.localityWeightsHonored())
 }
 
 func (b EndpointBuilder) DependentConfigs() []model.ConfigKey {
@@ -123,67 +187,200 @@ func (b *EndpointBuilder) canViewNetwork(network string) bool {
 	return b.networkView[network]
 }
 
-// build LocalityLbEndpoints for a cluster from existing EndpointShards.
+// build LocalityLbEndpoints for a cluster from existing EndpointShards. The shards are read with their mutex
+// held, which registries also hold to write them, so a build never sees a shard in the middle of an update.
 func (b *EndpointBuilder) buildLocalityLbEndpointsFromShards(
 	shards *EndpointShards,
 	svcPort *model.Port,
 ) []*endpoint.LocalityLbEndpoints {
 	localityEpMap := make(map[string]*endpoint.LocalityLbEndpoints)
 
+	// A subset which is not defined has no labels, but must not select all the endpoints of the service.
+	if b.subsetName != "" && !subsetDefined(b.DestinationRule(), b.subsetName) {
+		adsLog.Debugf("Subset %s of cluster %s is not defined, no endpoints are selected", b.subsetName, b.clusterName)
+		b.push.AddMetric(model.ProxyStatusClusterUnknownSubset, b.clusterName, "", "")
+		return []*endpoint.LocalityLbEndpoints{}
+	}
+
 	// get the subset labels
 	epLabels := getSubSetLabels(b.DestinationRule(), b.subsetName)
+	if features.EmptySubsetMatchesNone && emptySubset(b.DestinationRule(), b.subsetName) {
+		adsLog.Debugf("Subset %s of cluster %s has no labels, no endpoints are selected", b.subsetName, b.clusterName)
+		return []*endpoint.LocalityLbEndpoints{}
+	}
 
 	// Determine whether or not the target service is considered local to the cluster
 	// and should, therefore, not be accessed from outside the cluster.
-	isClusterLocal := b.push.IsClusterLocal(b.service)
+	isClusterLocal := isClusterLocal(b.push, b.service)
+
+	// Without locality load balancing, localities only add to the size of the config, so all endpoints
+	// can be sent in a single group.
+	flat := features.FlatEndpointLocality && !b.localityLbEnabled() && !features.ZoneAwareEndpointWeights
+	tiered := endpointTiersEnabled()
+	// Endpoints of subsets with their own upstream SNI carry it, so transport socket matches can select them.
+	sni := subsetSni(b.DestinationRule(), b.port, b.subsetName)
 
+	// Registries may leave the port name of endpoints empty, which is unambiguous for services with a single port.
+	portNameFallback := features.EmptyServicePortNameFallback && len(b.service.Ports) == 1
+	unnamed := 0
+
+	excluded, clusterLocalFiltered := 0, 0
 	shards.mutex.Lock()
+	// Dual-stack workloads are only sent with their address in the family preferred by the proxy.
+	var preferredFamily map[string]struct{}
+	if b.addressFamily != "" {
+		preferredFamily = preferredFamilyWorkloads(shards, b.addressFamily)
+	}
 	// The shards are updated independently, now need to filter and merge
 	// for this cluster
 	for clusterID, endpoints := range shards.Shards {
 		// If the downstream service is configured as cluster-local, only include endpoints that
 		// reside in the same cluster.
 		if isClusterLocal && (clusterID != b.clusterID) {
+			for _, ep := range endpoints {
+				if svcPort.Name == ep.ServicePortName {
+					clusterLocalFiltered++
+				}
+			}
 			continue
 		}
 
 		for _, ep := range endpoints {
 			if svcPort.Name != ep.ServicePortName {
-				continue
+				if !portNameFallback || ep.ServicePortName != "" {
+					continue
+				}
+				unnamed++
 			}
 			// Port labels
 			if !epLabels.HasSubsetOf(ep.Labels) {
 				continue
 			}
+			// Endpoints selected as cluster-local are only visible within their cluster
+			if clusterID != b.clusterID && isClusterLocalEndpoint(ep) {
+				clusterLocalFiltered++
+				continue
+			}
+			// Addresses of dual-stack workloads in the family not preferred by the proxy
+			if preferredFamily != nil && otherFamilyDuplicate(ep, b.addressFamily, preferredFamily) {
+				continue
+			}
+			// Endpoints taken out of rotation
+			if ep.Labels[model.EndpointExcludeLabel] == "true" {
+				excluded++
+				continue
+			}
+			// Endpoints requiring Istio mutual TLS, which the proxy cannot originate
+			mtlsDowngrade := false
+			if b.mtlsUnsupported && ep.TLSMode == model.IstioMutualTLSModeLabel {
+				if features.EndpointTLSModeCompatibility == endpointTLSModeExclude {
+					excluded++
+					continue
+				}
+				mtlsDowngrade = true
+			}
+			// Endpoints excluded by the registered filters
+			if !b.filterEndpoint(ep) {
+				excluded++
+				continue
+			}
+
+			var tier uint32
+			if tiered {
+				t, ok := endpointTier(ep)
+				if !ok {
+					// Endpoints with an invalid tier cannot be prioritized
+					excluded++
+					continue
+				}
+				tier = t
+			}
 
-			locLbEps, found := localityEpMap[ep.Locality.Label]
+			locality := ep.Locality
+			if flat {
+				locality = model.Locality{}
+			}
+			key := localityKey(locality)
+			if tiered {
+				key = strconv.FormatUint(uint64(tier), 10) + "~" + key
+			}
+			locLbEps, found := localityEpMap[key]
 			if !found {
 				locLbEps = &endpoint.LocalityLbEndpoints{
-					Locality:    util.ConvertLocality(ep.Locality.Label),
+					Locality:    util.ConvertEndpointLocality(locality, features.LocalityLabelDelimiter),
 					LbEndpoints: make([]*endpoint.LbEndpoint, 0, len(endpoints)),
+					Priority:    tier,
 				}
-				localityEpMap[ep.Locality.Label] = locLbEps
+				localityEpMap[key] = locLbEps
+			}
+			// Flaky endpoints are built on each push, as they recover without an update of the shard. The load
+			// assignments are not cached either while flaky endpoints are tracked.
+			// Endpoints of proxyless gRPC clients, or downgraded to plaintext, are not cached on the endpoint
+			// either, as they are rare.
+			flaky := flakyEndpointsEnabled() && shards.isFlaky(clusterID, ep.Address)
+			var lbEp *endpoint.LbEndpoint
+			if flaky || b.proxyless || mtlsDowngrade {
+				lbEp = buildEnvoyLbEndpoint(ep, flaky, b.proxyless, mtlsDowngrade)
+			} else {
+				if ep.EnvoyEndpoint == nil {
+					ep.EnvoyEndpoint = buildEnvoyLbEndpoint(ep, false, false, false)
+				}
+				lbEp = ep.EnvoyEndpoint
+			}
+			// The cached endpoint is shared by all subsets, so the SNI of the subset is set on a copy.
+			if sni != "" && !b.proxyless {
+				lbEp = withSniMetadata(lbEp, sni)
 			}
-			if ep.EnvoyEndpoint == nil {
-				ep.EnvoyEndpoint = buildEnvoyLbEndpoint(ep)
+			if b.originalDst {
+				lbEp = withOriginalDstMetadata(lbEp, ep)
 			}
-			locLbEps.LbEndpoints = append(locLbEps.LbEndpoints, ep.EnvoyEndpoint)
+			locLbEps.LbEndpoints = append(locLbEps.LbEndpoints, lbEp)
 		}
 	}
+	logPortNameFallback := unnamed > 0 && !shards.portNameFallbackLogged
+	if logPortNameFallback {
+		shards.portNameFallbackLogged = true
+	}
 	shards.mutex.Unlock()
 
+	// The weights of localities are only adjusted for clusters which Envoy balances by locality weight.
+	weighted := b.localityWeightsHonored()
 	locEps := make([]*endpoint.LocalityLbEndpoints, 0, len(localityEpMap))
 	for _, locLbEps := range localityEpMap {
 		var weight uint32
 		for _, ep := range locLbEps.LbEndpoints {
 			weight += ep.LoadBalancingWeight.GetValue()
 		}
-		locLbEps.LoadBalancingWeight = &wrappers.UInt32Value{
-			Value: weight,
+		if weighted {
+			weight = preferredLocalityWeight(locLbEps.Locality, weight)
+			if load, f := b.localityLoads[util.LocalityToString(locLbEps.Locality)]; f {
+				weight = localityLoadWeight(weight, load)
+			}
+		}
+		locLbEps.LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		if features.ProxyEndpointOrdering && b.proxy != nil {
+			sortLbEndpointsForProxy(locLbEps.LbEndpoints, b.proxy.ID)
 		}
 		locEps = append(locEps, locLbEps)
 	}
+	if features.ProxyEndpointOrdering {
+		sort.Slice(locEps, func(i, j int) bool {
+			return util.LocalityToString(locEps[i].Locality) < util.LocalityToString(locEps[j].Locality)
+		})
+	}
+	if tiered {
+		compactTierPriorities(locEps)
+	}
 
+	if excluded > 0 {
+		b.push.AddMetric(model.ProxyStatusClusterExcludedEndpoints, b.clusterName, "", fmt.Sprintf("%d endpoints excluded", excluded))
+	}
+	recordPortNameFallbacks(unnamed)
+	if logPortNameFallback {
+		adsLog.Warnf("Endpoints of service %s have no service port name, matched to the only port %s of the service",
+			b.hostname, svcPort.Name)
+	}
+	recordClusterLocalFilteredEndpoints(isClusterLocal, clusterLocalFiltered)
 	if len(locEps) == 0 {
 		b.push.AddMetric(model.ProxyStatusClusterNoInstances, b.clusterName, "", "")
 	}
@@ -191,21 +388,151 @@ func (b *EndpointBuilder) buildLocalityLbEndpointsFromShards(
 	return locEps
 }
 
-// buildEnvoyLbEndpoint packs the endpoint based on istio info.
-func buildEnvoyLbEndpoint(e *model.IstioEndpoint) *endpoint.LbEndpoint {
-	addr := util.BuildAddress(e.Address, e.EndpointPort)
+// localityLbEnabled returns whether locality load balancing is enabled for the cluster, by the mesh config, its
+// namespace or its DestinationRule.
+func (b *EndpointBuilder) localityLbEnabled() bool {
+	_, lb := getOutlierDetectionAndLoadBalancerSettings(b.DestinationRule(), b.port, b.subsetName)
+	return b.localityLbSetting(lb) != nil
+}
+
+// localityLbSetting returns the locality load balancing setting of the cluster, if enabled. The setting of the
+// DestinationRule takes precedence over the one of the service's namespace, which takes precedence over the
+// one of the mesh config.
+func (b *EndpointBuilder) localityLbSetting(lb *networkingapi.LoadBalancerSettings) *networkingapi.LocalityLoadBalancerSetting {
+	var namespace string
+	if b.service != nil {
+		namespace = b.service.Attributes.Namespace
+	}
+	return loadbalancer.GetLocalityLbSetting(b.push.Mesh.GetLocalityLbSetting(), namespace, lb.GetLocalityLbSetting())
+}
+
+// localityWeightsHonored returns whether Envoy balances the cluster by locality weight, which CDS only enables
+// for clusters with outlier detection and locality load balancing, or with zone weights. Envoy ignores the
+// weights of localities of the other clusters.
+func (b *EndpointBuilder) localityWeightsHonored() bool {
+	if b.destinationRule != nil {
+		if _, f := b.destinationRule.Annotations[validation.ZoneWeightsAnnotation]; f {
+			return true
+		}
+	}
+	outlierDetection, lb := getOutlierDetectionAndLoadBalancerSettings(b.DestinationRule(), b.port, b.subsetName)
+	return outlierDetection && b.localityLbSetting(lb) != nil
+}
+
+// preferredLocalityWeight scales the weight of the locality by PILOT_PREFERRED_LOCALITY_WEIGHT_MULTIPLIER
+// if it is the preferred locality. The endpoints are shared between clusters, so the multiplier is applied
+// to the aggregate weight of the locality rather than to each endpoint, which has the same effect.
+func preferredLocalityWeight(locality *core.Locality, weight uint32) uint32 {
+	if weight == 0 || features.PreferredLocality == "" || features.PreferredLocalityWeightMultiplier == 1.0 ||
+		!util.LocalityMatch(locality, features.PreferredLocality) {
+		return weight
+	}
+	scaled := math.Round(float64(weight) * features.PreferredLocalityWeightMultiplier)
+	switch {
+	case scaled < 1:
+		// Envoy requires locality weights to be at least 1.
+		return 1
+	case scaled > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(scaled)
+}
+
+// sortLbEndpointsForProxy sorts the endpoints in an order seeded by the proxy ID, so a proxy sees the
+// endpoints in the same order on each push, while the order differs between proxies.
+func sortLbEndpointsForProxy(lbEndpoints []*endpoint.LbEndpoint, proxyID string) {
+	keys := make(map[*endpoint.LbEndpoint]uint64, len(lbEndpoints))
+	for _, ep := range lbEndpoints {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(proxyID))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(lbEndpointAddress(ep)))
+		keys[ep] = h.Sum64()
+	}
+	sort.SliceStable(lbEndpoints, func(i, j int) bool {
+		if keys[lbEndpoints[i]] != keys[lbEndpoints[j]] {
+			return keys[lbEndpoints[i]] < keys[lbEndpoints[j]]
+		}
+		return lbEndpointAddress(lbEndpoints[i]) < lbEndpointAddress(lbEndpoints[j])
+	})
+}
+
+// localityKey returns the key grouping the endpoints of the locality. Localities with structured fields
+// are keyed like the equivalent label, so they are grouped with the endpoints of the same locality label.
+func localityKey(locality model.Locality) string {
+	if locality.Region == "" && locality.Zone == "" && locality.SubZone == "" {
+		return locality.Label
+	}
+	key := locality.Region
+	if locality.Zone != "" || locality.SubZone != "" {
+		key += features.LocalityLabelDelimiter + locality.Zone
+	}
+	if locality.SubZone != "" {
+		key += features.LocalityLabelDelimiter + locality.SubZone
+	}
+	return key
+}
+
+// sortLoadAssignment returns a copy of the load assignment with the localities sorted by ascending priority,
+// then by locality, and the endpoints of each locality by descending weight. Endpoints of the same weight
+// keep their order, such as the one set by PILOT_PROXY_ENDPOINT_ORDERING.
+func sortLoadAssignment(l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	l = util.CloneClusterLoadAssignment(l)
+	for _, locLbEps := range l.Endpoints {
+		lbEndpoints := append([]*endpoint.LbEndpoint(nil), locLbEps.LbEndpoints...)
+		sort.SliceStable(lbEndpoints, func(i, j int) bool {
+			return lbEndpoints[i].GetLoadBalancingWeight().GetValue() > lbEndpoints[j].GetLoadBalancingWeight().GetValue()
+		})
+		locLbEps.LbEndpoints = lbEndpoints
+	}
+	sort.SliceStable(l.Endpoints, func(i, j int) bool {
+		if l.Endpoints[i].Priority != l.Endpoints[j].Priority {
+			return l.Endpoints[i].Priority < l.Endpoints[j].Priority
+		}
+		return util.LocalityToString(l.Endpoints[i].Locality) < util.LocalityToString(l.Endpoints[j].Locality)
+	})
+	return l
+}
+
+// lbEndpointAddress returns the address and port of the endpoint.
+func lbEndpointAddress(ep *endpoint.LbEndpoint) string {
+	addr := ep.GetEndpoint().GetAddress().GetSocketAddress()
+	return addr.GetAddress() + ":" + strconv.Itoa(int(addr.GetPortValue()))
+}
 
+// lbEndpointWeight returns the load balancing weight of the endpoint. The weight of flaky endpoints is
+// divided by PILOT_FLAKY_ENDPOINT_WEIGHT_FACTOR, down to 1.
+func lbEndpointWeight(e *model.IstioEndpoint, flaky bool) uint32 {
 	epWeight := e.LbWeight
 	if epWeight == 0 {
-		epWeight = 1
+		epWeight = features.DefaultEndpointWeight
 	}
+	if flaky && features.FlakyEndpointWeightFactor > 1 {
+		epWeight /= uint32(features.FlakyEndpointWeightFactor)
+		if epWeight == 0 {
+			epWeight = 1
+		}
+	}
+	return epWeight
+}
+
+// buildEnvoyLbEndpoint packs the endpoint based on istio info. For proxyless gRPC clients, the
+// metadata is built in the gRPC shape rather than for Envoy filters.
+func buildEnvoyLbEndpoint(e *model.IstioEndpoint, flaky bool, proxyless bool, mtlsDowngrade bool) *endpoint.LbEndpoint {
+	addr := util.BuildAddress(e.Address, e.EndpointPort)
+	tlsMode := e.TLSMode
+	if mtlsDowngrade && tlsMode == model.IstioMutualTLSModeLabel {
+		tlsMode = model.DisabledTLSModeLabel
+	}
+
 	ep := &endpoint.LbEndpoint{
 		LoadBalancingWeight: &wrappers.UInt32Value{
-			Value: epWeight,
+			Value: lbEndpointWeight(e, flaky),
 		},
 		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
 			Endpoint: &endpoint.Endpoint{
-				Address: addr,
+				Address:           addr,
+				HealthCheckConfig: buildHealthCheckConfig(e),
 			},
 		},
 	}
@@ -213,7 +540,174 @@ func buildEnvoyLbEndpoint(e *model.IstioEndpoint) *endpoint.LbEndpoint {
 	// Istio telemetry depends on the metadata value being set for endpoints in the mesh.
 	// Istio endpoint level tls transport socket configuration depends on this logic
 	// Do not removepilot/pkg/xds/fake.go
-	ep.Metadata = util.BuildLbEndpointMetadata(e.Network, e.TLSMode)
+	if proxyless {
+		ep.Metadata = util.BuildGrpcLbEndpointMetadata(e.Network, tlsMode)
+	} else {
+		ep.Metadata = util.BuildLbEndpointMetadata(e.Network, tlsMode)
+		addTransportSocketMatchMetadata(ep, e.Labels, features.EndpointTransportSocketMatchLabels)
+	}
+	ep.Metadata = util.AddLabelFilterMetadata(ep.Metadata, e.Labels, features.EndpointFilterMetadataLabelPrefixes)
+	if prefix := features.EndpointConnectionPoolLabelPrefix; prefix != "" {
+		ep.Metadata = util.AddLabelFilterMetadata(ep.Metadata, e.Labels,
+			map[string]string{prefix: util.ConnectionPoolMetadataKey})
+	}
+	if weight, ok := canaryWeight(e); ok {
+		ep.Metadata = util.AddCanaryWeightMetadata(ep.Metadata, weight)
+	}
+	if features.EndpointSpotInstanceLabel != "" {
+		ep.Metadata = util.AddSpotInstanceMetadata(ep.Metadata, onSpotInstance(e))
+	}
+	if outlierExempt(e) {
+		ep.Metadata = util.AddOutlierExemptMetadata(ep.Metadata)
+	}
+	if e.PendingEviction || onDrainingNode(e) {
+		ep.HealthStatus = core.HealthStatus_DRAINING
+	}
 
 	return ep
 }
+
+// canaryWeight returns the canary weight of the endpoint, set by its PILOT_ENDPOINT_CANARY_WEIGHT_LABEL label.
+// An invalid weight is ignored.
+func canaryWeight(e *model.IstioEndpoint) (float64, bool) {
+	if features.EndpointCanaryWeightLabel == "" {
+		return 0, false
+	}
+	value, f := e.Labels[features.EndpointCanaryWeightLabel]
+	if !f {
+		return 0, false
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(weight) || weight < 0 || weight > 100 {
+		adsLog.Warnf("Ignoring invalid canary weight %q of endpoint %s", value, e.Address)
+		return 0, false
+	}
+	return weight, true
+}
+
+// onDrainingNode returns whether the endpoint is on a node being drained, as signaled by the
+// PILOT_DRAINING_NODE_ENDPOINT_LABEL label.
+func onDrainingNode(e *model.IstioEndpoint) bool {
+	return features.DrainingNodeEndpointLabel != "" && e.Labels[features.DrainingNodeEndpointLabel] == "true"
+}
+
+// onSpotInstance returns whether the endpoint is on a spot or preemptible node, as signaled by the
+// PILOT_ENDPOINT_SPOT_INSTANCE_LABEL label.
+func onSpotInstance(e *model.IstioEndpoint) bool {
+	return features.EndpointSpotInstanceLabel != "" && e.Labels[features.EndpointSpotInstanceLabel] == "true"
+}
+
+// outlierExempt returns whether the endpoint must not be ejected by outlier detection, as signaled by the
+// PILOT_ENDPOINT_OUTLIER_EXEMPT_LABEL label.
+func outlierExempt(e *model.IstioEndpoint) bool {
+	return features.EndpointOutlierExemptLabel != "" && e.Labels[features.EndpointOutlierExemptLabel] == "true"
+}
+
+// buildHealthCheckConfig returns the health check config of the endpoint, if it sets an alternative health
+// check port. An invalid port is ignored, leaving health checks on the serving port.
+func buildHealthCheckConfig(e *model.IstioEndpoint) *endpoint.Endpoint_HealthCheckConfig {
+	value, f := e.Labels[model.EndpointHealthCheckPortLabel]
+	if !f {
+		return nil
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		adsLog.Warnf("Ignoring invalid health check port %q of endpoint %s", value, e.Address)
+		return nil
+	}
+	return &endpoint.Endpoint_HealthCheckConfig{PortValue: uint32(port)}
+}
+
+// sniTransportSocketMatchKey is the key of the subset SNI in the transport socket match metadata.
+const sniTransportSocketMatchKey = "sni"
+
+// withSniMetadata returns a copy of the endpoint with the SNI added to its transport socket match metadata.
+// The metadata is copied, everything else is shared with the given endpoint.
+func withSniMetadata(ep *endpoint.LbEndpoint, sni string) *endpoint.LbEndpoint {
+	metadata := &core.Metadata{FilterMetadata: map[string]*structpb.Struct{}}
+	if ep.Metadata != nil {
+		metadata = proto.Clone(ep.Metadata).(*core.Metadata)
+		if metadata.FilterMetadata == nil {
+			metadata.FilterMetadata = map[string]*structpb.Struct{}
+		}
+	}
+	tsm := metadata.FilterMetadata[util.EnvoyTransportSocketMetadataKey]
+	if tsm == nil {
+		tsm = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+		metadata.FilterMetadata[util.EnvoyTransportSocketMetadataKey] = tsm
+	}
+	tsm.Fields[sniTransportSocketMatchKey] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: sni}}
+	return &endpoint.LbEndpoint{
+		HostIdentifier:      ep.HostIdentifier,
+		HealthStatus:        ep.HealthStatus,
+		Metadata:            metadata,
+		LoadBalancingWeight: ep.LoadBalancingWeight,
+	}
+}
+
+// withOriginalDstMetadata returns a copy of the endpoint carrying its address in the original destination
+// metadata. Endpoints on unix domain sockets are returned unchanged.
+func withOriginalDstMetadata(ep *endpoint.LbEndpoint, e *model.IstioEndpoint) *endpoint.LbEndpoint {
+	if strings.HasPrefix(e.Address, model.UnixAddressPrefix) {
+		return ep
+	}
+	var metadata *core.Metadata
+	if ep.Metadata != nil {
+		metadata = proto.Clone(ep.Metadata).(*core.Metadata)
+	}
+	address := net.JoinHostPort(e.Address, strconv.Itoa(int(e.EndpointPort)))
+	return &endpoint.LbEndpoint{
+		HostIdentifier:      ep.HostIdentifier,
+		HealthStatus:        ep.HealthStatus,
+		Metadata:            util.AddOriginalDstMetadata(metadata, address),
+		LoadBalancingWeight: ep.LoadBalancingWeight,
+	}
+}
+
+// originalDstPassthrough returns true if the cluster is a passthrough cluster of a gateway, named in the
+// outbound_.<port>_.<subset>_.<hostname> form, and PILOT_EDS_ORIGINAL_DST_METADATA is enabled.
+func originalDstPassthrough(clusterName string, proxy *model.Proxy) bool {
+	return features.EDSOriginalDstMetadata && proxy.Type == model.Router &&
+		strings.HasPrefix(clusterName, string(model.TrafficDirectionOutbound)+"_.")
+}
+
+// isProxylessGrpc returns whether the proxy is a proxyless gRPC client, which uses the gRPC generator.
+func isProxylessGrpc(proxy *model.Proxy) bool {
+	return proxy.Metadata != nil && proxy.Metadata.Generator == "grpc"
+}
+
+const (
+	endpointTLSModeDowngrade = "downgrade"
+	endpointTLSModeExclude   = "exclude"
+)
+
+// mtlsUnsupported returns true if the proxy cannot originate Istio mutual TLS, and the endpoints sent to it
+// are adjusted for it by PILOT_ENDPOINT_TLS_MODE_COMPATIBILITY.
+func mtlsUnsupported(proxy *model.Proxy) bool {
+	switch features.EndpointTLSModeCompatibility {
+	case endpointTLSModeDowngrade, endpointTLSModeExclude:
+		return proxy.Metadata != nil && bool(proxy.Metadata.DisableMTLS)
+	}
+	return false
+}
+
+// addTransportSocketMatchMetadata adds the values of the given endpoint labels to the transport socket
+// match metadata of the endpoint, so custom transport socket matches can select endpoints by them.
+// The tlsMode set by Istio is never overridden.
+func addTransportSocketMatchMetadata(ep *endpoint.LbEndpoint, lbls labels.Instance, keys []string) {
+	for _, key := range keys {
+		value, f := lbls[key]
+		if !f || key == model.TLSModeLabelShortname {
+			continue
+		}
+		if ep.Metadata == nil {
+			ep.Metadata = &core.Metadata{FilterMetadata: map[string]*structpb.Struct{}}
+		}
+		tsm := ep.Metadata.FilterMetadata[util.EnvoyTransportSocketMetadataKey]
+		if tsm == nil {
+			tsm = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+			ep.Metadata.FilterMetadata[util.EnvoyTransportSocketMetadataKey] = tsm
+		}
+		tsm.Fields[key] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: value}}
+	}
+}
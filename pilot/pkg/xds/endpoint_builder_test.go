@@ -0,0 +1,1523 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func TestBuildEnvoyLbEndpointTransportSocketMatch(t *testing.T) {
+	defaultLabels := features.EndpointTransportSocketMatchLabels
+	features.EndpointTransportSocketMatchLabels = []string{"tls-profile", model.TLSModeLabelShortname, "missing"}
+	defer func() { features.EndpointTransportSocketMatchLabels = defaultLabels }()
+
+	str := func(s string) *structpb.Value {
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+	}
+	cases := []struct {
+		name     string
+		endpoint *model.IstioEndpoint
+		expected map[string]*structpb.Value
+	}{
+		{
+			name: "extra keys alongside tls mode",
+			endpoint: &model.IstioEndpoint{
+				Address:      "10.0.0.1",
+				EndpointPort: 80,
+				TLSMode:      model.IstioMutualTLSModeLabel,
+				Labels:       map[string]string{"tls-profile": "fips", model.TLSModeLabelShortname: "custom", "app": "foo"},
+			},
+			expected: map[string]*structpb.Value{
+				model.TLSModeLabelShortname: str(model.IstioMutualTLSModeLabel),
+				"tls-profile":               str("fips"),
+			},
+		},
+		{
+			name: "extra keys without tls mode",
+			endpoint: &model.IstioEndpoint{
+				Address:      "10.0.0.1",
+				EndpointPort: 80,
+				TLSMode:      model.DisabledTLSModeLabel,
+				Labels:       map[string]string{"tls-profile": "fips"},
+			},
+			expected: map[string]*structpb.Value{
+				"tls-profile": str("fips"),
+			},
+		},
+		{
+			name: "no matching labels",
+			endpoint: &model.IstioEndpoint{
+				Address:      "10.0.0.1",
+				EndpointPort: 80,
+				TLSMode:      model.IstioMutualTLSModeLabel,
+				Labels:       map[string]string{"app": "foo"},
+			},
+			expected: map[string]*structpb.Value{
+				model.TLSModeLabelShortname: str(model.IstioMutualTLSModeLabel),
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := buildEnvoyLbEndpoint(tt.endpoint, false, false, false)
+			got := ep.GetMetadata().GetFilterMetadata()[util.EnvoyTransportSocketMetadataKey].GetFields()
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected transport socket match metadata %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildEnvoyLbEndpointConnectionPoolMetadata(t *testing.T) {
+	defer func(old string) { features.EndpointConnectionPoolLabelPrefix = old }(features.EndpointConnectionPoolLabelPrefix)
+	lbls := labels.Instance{
+		"connectionpool.example.com/max_connections": "10",
+		"connectionpool.example.com/max_requests":    "100",
+		"app": "legacy",
+	}
+
+	features.EndpointConnectionPoolLabelPrefix = ""
+	ep := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.1", Labels: lbls}, false, false, false)
+	if got, f := ep.GetMetadata().GetFilterMetadata()[util.ConnectionPoolMetadataKey]; f {
+		t.Fatalf("expected no connection pool metadata by default, got %v", got)
+	}
+
+	features.EndpointConnectionPoolLabelPrefix = "connectionpool.example.com/"
+	ep = buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.1", Labels: lbls}, false, false, false)
+	got := ep.GetMetadata().GetFilterMetadata()[util.ConnectionPoolMetadataKey].GetFields()
+	want := map[string]*structpb.Value{
+		"max_connections": {Kind: &structpb.Value_StringValue{StringValue: "10"}},
+		"max_requests":    {Kind: &structpb.Value_StringValue{StringValue: "100"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected connection pool metadata %v, got %v", want, got)
+	}
+}
+
+func TestBuildEnvoyLbEndpointCanaryWeightMetadata(t *testing.T) {
+	defer func(old string) { features.EndpointCanaryWeightLabel = old }(features.EndpointCanaryWeightLabel)
+	canaryEndpoint := func(weight string) *model.IstioEndpoint {
+		return &model.IstioEndpoint{Address: "10.0.0.1", LbWeight: 7, Labels: labels.Instance{"rollout.example.com/canary-weight": weight}}
+	}
+
+	features.EndpointCanaryWeightLabel = ""
+	ep := buildEnvoyLbEndpoint(canaryEndpoint("20"), false, false, false)
+	if got, f := ep.GetMetadata().GetFilterMetadata()[util.CanaryMetadataKey]; f {
+		t.Fatalf("expected no canary metadata by default, got %v", got)
+	}
+
+	features.EndpointCanaryWeightLabel = "rollout.example.com/canary-weight"
+	cases := []struct {
+		value    string
+		valid    bool
+		expected float64
+	}{
+		{"20", true, 20},
+		{"12.5", true, 12.5},
+		{"0", true, 0},
+		// Invalid weights are ignored.
+		{"101", false, 0},
+		{"-1", false, 0},
+		{"half", false, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			ep := buildEnvoyLbEndpoint(canaryEndpoint(tt.value), false, false, false)
+			canary, f := ep.GetMetadata().GetFilterMetadata()[util.CanaryMetadataKey]
+			if !tt.valid {
+				if f {
+					t.Fatalf("expected no canary metadata, got %v", canary)
+				}
+				return
+			}
+			weight, ok := canary.GetFields()["weight"].GetKind().(*structpb.Value_NumberValue)
+			if !ok {
+				t.Fatalf("expected a numeric canary weight, got %v", canary)
+			}
+			if weight.NumberValue != tt.expected {
+				t.Fatalf("expected canary weight %v, got %v", tt.expected, weight.NumberValue)
+			}
+			// The canary weight is distinct from the load balancing weight.
+			if got := ep.GetLoadBalancingWeight().GetValue(); got != 7 {
+				t.Fatalf("expected the load balancing weight to be unchanged, got %d", got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsProxylessGrpc(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("grpc.example.com")
+	ep := testEndpoint("10.0.0.1", "")
+	ep.Network, ep.TLSMode = "network1", model.IstioMutualTLSModeLabel
+	s.Discovery.EDSCacheUpdate("", "grpc.example.com", "", []*model.IstioEndpoint{ep})
+	str := func(s string) *structpb.Value {
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: s}}
+	}
+	metadata := func(proxy *model.Proxy) *core.Metadata {
+		t.Helper()
+		cla := s.buildEndpoints("outbound|80||grpc.example.com", proxy)
+		if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+			t.Fatalf("expected a single endpoint, got %v", cla.Endpoints)
+		}
+		return cla.Endpoints[0].LbEndpoints[0].Metadata
+	}
+
+	expected := &core.Metadata{FilterMetadata: map[string]*structpb.Struct{
+		util.IstioMetadataKey: {Fields: map[string]*structpb.Value{
+			"network":                   str("network1"),
+			model.TLSModeLabelShortname: str(model.IstioMutualTLSModeLabel),
+		}},
+	}}
+	grpcProxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{Generator: "grpc"}})
+	if got := metadata(grpcProxy); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected gRPC metadata %v, got %v", expected, got)
+	}
+
+	// Envoy proxies keep the Envoy filter shape, and are not served the gRPC endpoints from the cache.
+	envoyProxy := s.SetupProxy(nil)
+	if got := metadata(envoyProxy); !reflect.DeepEqual(got, util.BuildLbEndpointMetadata("network1", model.IstioMutualTLSModeLabel)) {
+		t.Fatalf("expected Envoy metadata, got %v", got)
+	}
+	if NewEndpointBuilder("outbound|80||grpc.example.com", grpcProxy, s.PushContext()).Key() ==
+		NewEndpointBuilder("outbound|80||grpc.example.com", envoyProxy, s.PushContext()).Key() {
+		t.Fatalf("expected gRPC and Envoy proxies to have different cache keys")
+	}
+}
+
+func TestMeshDefaultTrafficPolicy(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("default.example.com")
+	s.Discovery.EDSCacheUpdate("", "default.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", "region1/zone1/subzone1"),
+		testEndpoint("10.0.0.2", "region2/zone1/subzone1"),
+	})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}})
+	priorities := func() map[string]uint32 {
+		t.Helper()
+		b := NewEndpointBuilder("outbound|80||default.example.com", proxy, s.PushContext())
+		if b.DestinationRule() != nil {
+			t.Fatalf("expected no DestinationRule")
+		}
+		out := map[string]uint32{}
+		for _, locLbEps := range s.Discovery.generateEndpoints(b).Endpoints {
+			out[locLbEps.Locality.Region] = locLbEps.Priority
+		}
+		return out
+	}
+
+	// Without a mesh default, the endpoints are not prioritized.
+	setFeatureForTest(t, &features.MeshDefaultTrafficPolicy, nil)
+	if got, want := priorities(), map[string]uint32{"region1": 0, "region2": 0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected priorities %v, got %v", want, got)
+	}
+
+	// With outlier detection in the mesh default, locality failover applies.
+	features.MeshDefaultTrafficPolicy = &networking.TrafficPolicy{
+		OutlierDetection: &networking.OutlierDetection{},
+		LoadBalancer: &networking.LoadBalancerSettings{
+			LocalityLbSetting: &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+		},
+	}
+	if got, want := priorities(), map[string]uint32{"region1": 0, "region2": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected priorities %v, got %v", want, got)
+	}
+}
+
+func TestBuildLocalityLbEndpointsClusterLocal(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	// Services of the kube-system namespace are cluster-local by default.
+	hostnames := []string{"local.kube-system.svc.cluster.local", "global.default.svc.cluster.local"}
+	s.addHTTPServices(hostnames...)
+	for _, hostname := range hostnames {
+		s.Discovery.SetEndpointShardsForTest(hostname, "", "cluster1", []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")})
+		s.Discovery.SetEndpointShardsForTest(hostname, "", "cluster2", []*model.IstioEndpoint{testEndpoint("10.0.0.2", "")})
+	}
+	proxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{ClusterID: "cluster1"}})
+	addresses := func(hostname string) []string {
+		out := loadAssignmentAddresses(s.buildEndpoints("outbound|80||"+hostname, proxy))
+		sort.Strings(out)
+		return out
+	}
+
+	if got, want := addresses("local.kube-system.svc.cluster.local"), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected only the endpoints of the proxy's cluster %v, got %v", want, got)
+	}
+	if got, want := addresses("global.default.svc.cluster.local"), []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the endpoints of all clusters %v, got %v", want, got)
+	}
+}
+
+func TestBuildLocalityLbEndpointsClusterLocalRules(t *testing.T) {
+	setFeatureForTest(t, &features.ClusterLocalNamespaces, map[string]struct{}{"infra": {}})
+	setFeatureForTest(t, &features.ClusterLocalLabels, map[string]string{"topology": "local"})
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	for _, svc := range []struct{ hostname, namespace string }{
+		{"dns.infra.svc.cluster.local", "infra"},
+		{"app.default.svc.cluster.local", "default"},
+	} {
+		s.MemRegistry.AddService(host.Name(svc.hostname), &model.Service{
+			Hostname:   host.Name(svc.hostname),
+			Address:    "10.10.0.1",
+			Ports:      model.PortList{{Name: "http-main", Port: 80, Protocol: protocol.HTTP}},
+			Attributes: model.ServiceAttributes{Namespace: svc.namespace},
+		})
+		s.Discovery.SetEndpointShardsForTest(svc.hostname, svc.namespace, "cluster1", []*model.IstioEndpoint{{
+			Address:         "10.0.0.1",
+			ServicePortName: "http-main",
+			EndpointPort:    80,
+			Labels:          labels.Instance{"topology": "local"},
+		}})
+		s.Discovery.SetEndpointShardsForTest(svc.hostname, svc.namespace, "cluster2", []*model.IstioEndpoint{
+			{
+				Address:         "10.0.0.2",
+				ServicePortName: "http-main",
+				EndpointPort:    80,
+				Labels:          labels.Instance{"topology": "local"},
+			},
+			{
+				Address:         "10.0.0.3",
+				ServicePortName: "http-main",
+				EndpointPort:    80,
+			},
+		})
+	}
+	s.refreshPushContext()
+	proxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{ClusterID: "cluster1"}})
+	addresses := func(hostname string) []string {
+		out := loadAssignmentAddresses(s.buildEndpoints("outbound|80||"+hostname, proxy))
+		sort.Strings(out)
+		return out
+	}
+
+	filtered := func(clusterLocal string) float64 {
+		return sumValue(t, "pilot_eds_cluster_local_filtered_endpoints", "cluster_local", clusterLocal)
+	}
+
+	t.Run("namespace", func(t *testing.T) {
+		before := filtered("true")
+		if got, want := addresses("dns.infra.svc.cluster.local"), []string{"10.0.0.1"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected only the endpoints of the proxy's cluster %v, got %v", want, got)
+		}
+		// Both endpoints of the other cluster are filtered.
+		if got := filtered("true") - before; got != 2 {
+			t.Fatalf("expected 2 filtered endpoints of the cluster-local service, got %v", got)
+		}
+	})
+	t.Run("labels", func(t *testing.T) {
+		before := filtered("false")
+		// The labeled endpoint of the other cluster is excluded, the unlabeled one is kept.
+		if got, want := addresses("app.default.svc.cluster.local"), []string{"10.0.0.1", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected the labeled endpoints of the proxy's cluster and the unlabeled ones %v, got %v", want, got)
+		}
+		if got := filtered("false") - before; got != 1 {
+			t.Fatalf("expected 1 filtered cluster-local endpoint, got %v", got)
+		}
+	})
+}
+
+func TestBuildEnvoyLbEndpointDefaultWeight(t *testing.T) {
+	setFeatureForTest(t, &features.DefaultEndpointWeight, uint32(10))
+
+	if got := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.1"}, false, false, false).LoadBalancingWeight.GetValue(); got != 10 {
+		t.Fatalf("expected the default weight 10, got %d", got)
+	}
+	if got := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.1", LbWeight: 3}, false, false, false).LoadBalancingWeight.GetValue(); got != 3 {
+		t.Fatalf("expected the explicit weight 3, got %d", got)
+	}
+}
+
+func TestBuildEnvoyLbEndpointHealthCheckPort(t *testing.T) {
+	cases := []struct {
+		name   string
+		labels labels.Instance
+		want   *endpoint.Endpoint_HealthCheckConfig
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:   "alt port",
+			labels: labels.Instance{model.EndpointHealthCheckPortLabel: "15021"},
+			want:   &endpoint.Endpoint_HealthCheckConfig{PortValue: 15021},
+		},
+		{
+			name:   "invalid port",
+			labels: labels.Instance{model.EndpointHealthCheckPortLabel: "health"},
+		},
+		{
+			name:   "out of range port",
+			labels: labels.Instance{model.EndpointHealthCheckPortLabel: "70000"},
+		},
+		{
+			name:   "zero port",
+			labels: labels.Instance{model.EndpointHealthCheckPortLabel: "0"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.1", EndpointPort: 8080, Labels: tt.labels}, false, false, false)
+			if got := ep.GetEndpoint().GetHealthCheckConfig(); !proto.Equal(got, tt.want) {
+				t.Fatalf("expected health check config %v, got %v", tt.want, got)
+			}
+			if got := ep.GetEndpoint().GetAddress().GetSocketAddress().GetPortValue(); got != 8080 {
+				t.Fatalf("expected the serving port to be unchanged, got %d", got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsFlat(t *testing.T) {
+	setFeatureForTest(t, &features.FlatEndpointLocality, true)
+
+	// Locality load balancing is enabled by default, disable it mesh-wide.
+	m := mesh.DefaultMeshConfig()
+	m.LocalityLbSetting = nil
+	s := NewFakeDiscoveryServer(t, FakeOptions{MeshConfig: &m})
+	s.addHTTPServices("flat.example.com")
+	var eps []*model.IstioEndpoint
+	for i, locality := range []string{"region1/zone1", "region1/zone2", "region2/zone1"} {
+		ep := testEndpoint(fmt.Sprintf("10.0.0.%d", i+1), locality)
+		ep.LbWeight = uint32(i + 1)
+		eps = append(eps, ep)
+	}
+	s.Discovery.SetEndpointShardsForTest("flat.example.com", "", "", eps)
+	proxy := s.SetupProxy(nil)
+	build := func() *endpoint.ClusterLoadAssignment {
+		return s.buildEndpoints("outbound|80||flat.example.com", proxy)
+	}
+
+	cla := build()
+	if len(cla.Endpoints) != 1 {
+		t.Fatalf("expected a single locality group, got %d", len(cla.Endpoints))
+	}
+	if got := cla.Endpoints[0]; !proto.Equal(got.Locality, &core.Locality{}) || len(got.LbEndpoints) != 3 ||
+		got.LoadBalancingWeight.GetValue() != 6 {
+		t.Fatalf("expected 3 endpoints with an empty locality and a total weight of 6, got %v", got)
+	}
+
+	// With locality load balancing enabled, the endpoints are grouped by locality.
+	setFeatureForTest(t, &features.MeshDefaultTrafficPolicy, &networking.TrafficPolicy{
+		LoadBalancer: &networking.LoadBalancerSettings{
+			LocalityLbSetting: &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+		},
+	})
+	if got := len(build().Endpoints); got != 3 {
+		t.Fatalf("expected 3 locality groups with locality load balancing, got %d", got)
+	}
+}
+
+func TestLocalityLbSettingPrecedence(t *testing.T) {
+	setting := func(from string, enabled bool) *networking.LocalityLoadBalancerSetting {
+		return &networking.LocalityLoadBalancerSetting{
+			Enabled:  &types.BoolValue{Value: enabled},
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: from, To: "other"}},
+		}
+	}
+	setFeatureForTest(t, &features.NamespaceLocalityLbSettings, map[string]*networking.LocalityLoadBalancerSetting{
+		"ns-enabled":  setting("namespace", true),
+		"ns-disabled": setting("namespace", false),
+	})
+	cases := []struct {
+		name      string
+		mesh      *networking.LocalityLoadBalancerSetting
+		namespace string
+		dr        *networking.LocalityLoadBalancerSetting
+		want      string
+	}{
+		{"mesh", setting("mesh", true), "default", nil, "mesh"},
+		{"namespace over mesh", setting("mesh", true), "ns-enabled", nil, "namespace"},
+		{"namespace disables mesh", setting("mesh", true), "ns-disabled", nil, ""},
+		{"namespace without mesh", nil, "ns-enabled", nil, "namespace"},
+		{"destination rule over namespace", setting("mesh", true), "ns-enabled", setting("dr", true), "dr"},
+		{"destination rule enables disabled namespace", nil, "ns-disabled", setting("dr", true), "dr"},
+		{"destination rule disables namespace", setting("mesh", true), "ns-enabled", setting("dr", false), ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &EndpointBuilder{
+				push:    &model.PushContext{Mesh: &meshconfig.MeshConfig{LocalityLbSetting: tt.mesh}},
+				service: &model.Service{Attributes: model.ServiceAttributes{Namespace: tt.namespace}},
+			}
+			got := ""
+			if lb := b.localityLbSetting(&networking.LoadBalancerSettings{LocalityLbSetting: tt.dr}); lb != nil {
+				got = lb.Failover[0].From
+			}
+			if got != tt.want {
+				t.Fatalf("expected the setting of %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsWeightOnlyUpdate(t *testing.T) {
+	endpoints := func(weights ...uint32) []*model.IstioEndpoint {
+		out := make([]*model.IstioEndpoint, 0, len(weights))
+		for i, w := range weights {
+			out = append(out, &model.IstioEndpoint{
+				Address:         fmt.Sprintf("10.0.0.%d", i+1),
+				ServicePortName: "http-main",
+				EndpointPort:    80,
+				LbWeight:        w,
+				TLSMode:         model.IstioMutualTLSModeLabel,
+				Labels:          labels.Instance{"app": "weights"},
+				Locality:        model.Locality{Label: fmt.Sprintf("region%d", i%2)},
+			})
+		}
+		return out
+	}
+	build := func(updates ...[]*model.IstioEndpoint) *endpoint.ClusterLoadAssignment {
+		s := NewFakeDiscoveryServer(t, FakeOptions{})
+		s.addHTTPServices("weights.example.com")
+		proxy := s.SetupProxy(nil)
+		var cla *endpoint.ClusterLoadAssignment
+		for _, eps := range updates {
+			s.Discovery.EDSCacheUpdate("", "weights.example.com", "", eps)
+			cla = s.buildEndpoints("outbound|80||weights.example.com", proxy)
+		}
+		sort.Slice(cla.Endpoints, func(i, j int) bool {
+			return cla.Endpoints[i].Locality.Region < cla.Endpoints[j].Locality.Region
+		})
+		return cla
+	}
+
+	previous, current := endpoints(1, 2, 3), endpoints(5, 2, 0)
+	patched := build(previous, current)
+	for i, ep := range current {
+		if ep.EnvoyEndpoint == nil || ep.EnvoyEndpoint.Metadata != previous[i].EnvoyEndpoint.Metadata {
+			t.Fatalf("expected the endpoint %s to be patched rather than rebuilt", ep.Address)
+		}
+	}
+	if rebuilt := build(endpoints(5, 2, 0)); !proto.Equal(patched, rebuilt) {
+		t.Fatalf("expected the patched endpoints to match a full rebuild\npatched: %v\nrebuilt: %v", patched, rebuilt)
+	}
+
+	// Other changes rebuild the endpoints.
+	previous, changed := endpoints(1, 2, 3), endpoints(5, 2, 0)
+	changed[0].TLSMode = model.DisabledTLSModeLabel
+	build(previous, changed)
+	if changed[1].EnvoyEndpoint.Metadata == previous[1].EnvoyEndpoint.Metadata {
+		t.Fatalf("expected the endpoints to be rebuilt")
+	}
+}
+
+func TestBuildLocalityLbEndpointsProxyOrdering(t *testing.T) {
+	setFeatureForTest(t, &features.ProxyEndpointOrdering, true)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("ordering.example.com")
+	setEndpoints := func(reverse bool) {
+		eps := make([]*model.IstioEndpoint, 0, 20)
+		for i := 0; i < 20; i++ {
+			eps = append(eps, testEndpoint(fmt.Sprintf("10.0.0.%d", i), ""))
+		}
+		if reverse {
+			for i, j := 0, len(eps)-1; i < j; i, j = i+1, j-1 {
+				eps[i], eps[j] = eps[j], eps[i]
+			}
+		}
+		s.Discovery.SetEndpointShardsForTest("ordering.example.com", "", "cluster1", eps)
+	}
+	order := func(proxy *model.Proxy) []string {
+		t.Helper()
+		cla := s.buildEndpoints("outbound|80||ordering.example.com", proxy)
+		if len(cla.Endpoints) != 1 {
+			t.Fatalf("expected a single locality, got %v", cla.Endpoints)
+		}
+		return loadAssignmentAddresses(cla)
+	}
+	proxyA := s.SetupProxy(&model.Proxy{ID: "a.default"})
+	proxyB := s.SetupProxy(&model.Proxy{ID: "b.default"})
+
+	setEndpoints(false)
+	a, b := order(proxyA), order(proxyB)
+	if reflect.DeepEqual(a, b) {
+		t.Fatalf("expected different proxies to see different orders, got %v", a)
+	}
+
+	// The order of a proxy does not depend on the order of the endpoints in the shard.
+	setEndpoints(true)
+	if got := order(proxyA); !reflect.DeepEqual(got, a) {
+		t.Fatalf("expected stable order %v, got %v", a, got)
+	}
+	if got := order(proxyB); !reflect.DeepEqual(got, b) {
+		t.Fatalf("expected stable order %v, got %v", b, got)
+	}
+}
+
+func TestLocalityFailoverRegionScope(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: failover
+  namespace: default
+spec:
+  host: failover.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutiveErrors: 5
+`})
+	s.addHTTPServices("failover.example.com")
+	var eps []*model.IstioEndpoint
+	for i, locality := range []string{
+		"region1/zone1/subzone1",
+		"region1/zone1/subzone2",
+		"region1/zone2/subzone1",
+		"region2/zone1/subzone1",
+	} {
+		eps = append(eps, testEndpoint(fmt.Sprintf("10.0.0.%d", i), locality))
+	}
+	s.Discovery.SetEndpointShardsForTest("failover.example.com", "", "cluster1", eps)
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}})
+	priorities := func() map[string]uint32 {
+		t.Helper()
+		cla := s.buildEndpoints("outbound|80||failover.example.com", proxy)
+		out := map[string]uint32{}
+		for _, locLbEps := range cla.Endpoints {
+			out[util.LocalityToString(locLbEps.Locality)] = locLbEps.Priority
+		}
+		return out
+	}
+
+	setFeatureForTest(t, &features.LocalityLBFailoverScope, "")
+	want := map[string]uint32{
+		"region1/zone1/subzone1": 0,
+		"region1/zone1/subzone2": 1,
+		"region1/zone2/subzone1": 2,
+		"region2/zone1/subzone1": 3,
+	}
+	if got := priorities(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected priorities %v, got %v", want, got)
+	}
+
+	// Confined to the region, failover still happens across subzones and zones.
+	features.LocalityLBFailoverScope = "region"
+	delete(want, "region2/zone1/subzone1")
+	if got := priorities(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected priorities %v, got %v", want, got)
+	}
+}
+
+func TestSortedEDSOutput(t *testing.T) {
+	setFeatureForTest(t, &features.SortedEDSOutput, true)
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: failover
+  namespace: default
+spec:
+  host: sorted.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutiveErrors: 5
+`})
+	s.addHTTPServices("sorted.example.com")
+	endpoint := func(address, locality string, weight uint32) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.LbWeight = weight
+		return ep
+	}
+	s.Discovery.SetEndpointShardsForTest("sorted.example.com", "", "cluster1", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "region1/zone2", 1),
+		endpoint("10.0.0.2", "region1/zone1", 1),
+		endpoint("10.0.0.3", "region1/zone1", 5),
+		endpoint("10.0.0.4", "region2/zone1", 2),
+		endpoint("10.0.0.5", "region2/zone1", 7),
+		endpoint("10.0.0.6", "region2/zone1", 3),
+	})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region2", Zone: "zone1"}})
+
+	cla := s.buildEndpoints("outbound|80||sorted.example.com", proxy)
+	got := []string{}
+	for _, locLbEps := range cla.Endpoints {
+		group := fmt.Sprintf("%s@%d:", util.LocalityToString(locLbEps.Locality), locLbEps.Priority)
+		for _, lbEp := range locLbEps.LbEndpoints {
+			group += " " + lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+		}
+		got = append(got, group)
+	}
+	want := []string{
+		"region2/zone1@0: 10.0.0.5 10.0.0.6 10.0.0.4",
+		"region1/zone1@1: 10.0.0.3 10.0.0.2",
+		"region1/zone2@1: 10.0.0.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected endpoints %v, got %v", want, got)
+	}
+}
+
+func TestBuildLocalityLbEndpointsStructuredLocality(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("label.example.com", "structured.example.com")
+	endpoint := func(address string, locality model.Locality) *model.IstioEndpoint {
+		ep := testEndpoint(address, "")
+		ep.Locality = locality
+		return ep
+	}
+	s.Discovery.SetEndpointShardsForTest("label.example.com", "", "cluster1", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", model.Locality{Label: "region1/zone1/subzone1"}),
+		endpoint("10.0.0.2", model.Locality{Label: "region1/zone2"}),
+	})
+	s.Discovery.SetEndpointShardsForTest("structured.example.com", "", "cluster1", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", model.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}),
+		endpoint("10.0.0.2", model.Locality{Region: "region1", Zone: "zone2"}),
+	})
+	s.Discovery.SetEndpointShardsForTest("structured.example.com", "", "cluster2", []*model.IstioEndpoint{
+		// Grouped with the endpoints of the same structured locality.
+		endpoint("10.0.0.3", model.Locality{Label: "region1/zone2"}),
+	})
+	proxy := s.SetupProxy(nil)
+	localities := func(cluster string) map[string][]string {
+		t.Helper()
+		cla := s.buildEndpoints(cluster, proxy)
+		out := map[string][]string{}
+		for _, locLbEps := range cla.Endpoints {
+			key := fmt.Sprintf("%s|%s|%s", locLbEps.Locality.Region, locLbEps.Locality.Zone, locLbEps.Locality.SubZone)
+			for _, lbEp := range locLbEps.LbEndpoints {
+				out[key] = append(out[key], lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+			}
+			sort.Strings(out[key])
+		}
+		return out
+	}
+
+	want := map[string][]string{
+		"region1|zone1|subzone1": {"10.0.0.1"},
+		"region1|zone2|":         {"10.0.0.2"},
+	}
+	if got := localities("outbound|80||label.example.com"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected localities %v, got %v", want, got)
+	}
+	want["region1|zone2|"] = []string{"10.0.0.2", "10.0.0.3"}
+	if got := localities("outbound|80||structured.example.com"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected localities %v, got %v", want, got)
+	}
+}
+
+func TestBuildLocalityLbEndpointsCustomDelimiter(t *testing.T) {
+	setFeatureForTest(t, &features.LocalityLabelDelimiter, ".")
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("locality.example.com")
+	s.Discovery.EDSCacheUpdate("", "locality.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", "region1.zone1.subzone1"),
+	})
+
+	cla := s.buildEndpoints("outbound|80||locality.example.com", s.SetupProxy(nil))
+	if len(cla.Endpoints) != 1 {
+		t.Fatalf("expected a single locality, got %v", cla.Endpoints)
+	}
+	expected := &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}
+	if got := cla.Endpoints[0].Locality; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected locality %v, got %v", expected, got)
+	}
+}
+
+func TestResolvedDestinationRule(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: dr
+  namespace: svc
+spec:
+  hosts:
+  - dr.example.com
+  ports:
+  - number: 80
+    name: http
+    protocol: HTTP
+  resolution: STATIC
+  endpoints:
+  - address: 10.0.0.1
+---
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: svc-rule
+  namespace: svc
+spec:
+  host: dr.example.com
+---
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: app-rule
+  namespace: app
+spec:
+  host: dr.example.com
+`})
+	cases := []struct {
+		namespace string
+		expected  string
+	}{
+		{"app", "app/app-rule"},
+		{"other", "svc/svc-rule"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.namespace, func(t *testing.T) {
+			proxy := s.SetupProxy(&model.Proxy{ConfigNamespace: tt.namespace})
+			dr := NewEndpointBuilder("outbound|80||dr.example.com", proxy, s.PushContext()).ResolvedDestinationRule()
+			if dr == nil {
+				t.Fatalf("expected DestinationRule %s, got none", tt.expected)
+			}
+			if got := dr.Namespace + "/" + dr.Name; got != tt.expected {
+				t.Fatalf("expected DestinationRule %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsSubsets(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: subsets
+  namespace: default
+spec:
+  host: subsets.example.com
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+  - name: v2
+    labels:
+      version: v2
+  - name: stable
+    labels:
+      track: stable
+  - name: not-v2
+    labels:
+      version: "!v2"
+  - name: stable-not-v1
+    labels:
+      track: stable
+      version: "!v1"
+`})
+	s.addHTTPServices("subsets.example.com")
+	endpoint := func(address string, labels map[string]string) *model.IstioEndpoint {
+		ep := testEndpoint(address, "")
+		ep.Labels = labels
+		return ep
+	}
+	s.Discovery.EDSCacheUpdate("", "subsets.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", map[string]string{"version": "v1", "track": "stable"}),
+		endpoint("10.0.0.2", map[string]string{"version": "v2", "track": "stable"}),
+		endpoint("10.0.0.3", map[string]string{"version": "v2", "track": "canary"}),
+		// Endpoints without the label match negated subset labels.
+		endpoint("10.0.0.4", map[string]string{"track": "stable"}),
+	})
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster  string
+		expected []string
+	}{
+		{"outbound|80|v1|subsets.example.com", []string{"10.0.0.1"}},
+		{"outbound|80|v2|subsets.example.com", []string{"10.0.0.2", "10.0.0.3"}},
+		{"outbound|80|stable|subsets.example.com", []string{"10.0.0.1", "10.0.0.2", "10.0.0.4"}},
+		{"outbound|80|not-v2|subsets.example.com", []string{"10.0.0.1", "10.0.0.4"}},
+		{"outbound|80|stable-not-v1|subsets.example.com", []string{"10.0.0.2", "10.0.0.4"}},
+		{"outbound|80||subsets.example.com", []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			got := loadAssignmentAddresses(s.buildEndpoints(tt.cluster, proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsSubsetSni(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: subsets
+  namespace: default
+spec:
+  host: sni.example.com
+  trafficPolicy:
+    tls:
+      mode: SIMPLE
+      sni: default.example.com
+  subsets:
+  - name: a
+    trafficPolicy:
+      tls:
+        mode: SIMPLE
+        sni: a.example.com
+  - name: b
+    trafficPolicy:
+      tls:
+        mode: SIMPLE
+        sni: b.example.com
+  - name: plain
+`})
+	s.addHTTPServices("sni.example.com")
+	ep := testEndpoint("10.0.0.1", "")
+	ep.TLSMode = model.IstioMutualTLSModeLabel
+	s.Discovery.EDSCacheUpdate("", "sni.example.com", "", []*model.IstioEndpoint{ep})
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster string
+		sni     string
+	}{
+		{"outbound|80|a|sni.example.com", "a.example.com"},
+		{"outbound|80|b|sni.example.com", "b.example.com"},
+		// The SNI of the top level traffic policy applies to all subsets, and is not propagated.
+		{"outbound|80|plain|sni.example.com", ""},
+		{"outbound|80||sni.example.com", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			cla := s.buildEndpoints(tt.cluster, proxy)
+			if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+				t.Fatalf("expected a single endpoint, got %v", cla.Endpoints)
+			}
+			fields := cla.Endpoints[0].LbEndpoints[0].GetMetadata().GetFilterMetadata()[util.EnvoyTransportSocketMetadataKey].GetFields()
+			if got := fields[sniTransportSocketMatchKey].GetStringValue(); got != tt.sni {
+				t.Fatalf("expected sni %q, got %q", tt.sni, got)
+			}
+			if got := fields[model.TLSModeLabelShortname].GetStringValue(); got != model.IstioMutualTLSModeLabel {
+				t.Fatalf("expected the tls mode to be retained, got %q", got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsOriginalDstMetadata(t *testing.T) {
+	setFeatureForTest(t, &features.EDSOriginalDstMetadata, true)
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("passthrough.example.com")
+	ep := testEndpoint("10.0.0.1", "")
+	ep.EndpointPort, ep.TLSMode = 8080, model.IstioMutualTLSModeLabel
+	s.Discovery.EDSCacheUpdate("", "passthrough.example.com", "", []*model.IstioEndpoint{ep})
+	gateway := s.SetupProxy(&model.Proxy{Type: model.Router})
+	sidecar := s.SetupProxy(nil)
+
+	cases := []struct {
+		name     string
+		cluster  string
+		proxy    *model.Proxy
+		expected string
+	}{
+		{"gateway passthrough", "outbound_.80_._.passthrough.example.com", gateway, "10.0.0.1:8080"},
+		{"gateway", "outbound|80||passthrough.example.com", gateway, ""},
+		{"sidecar", "outbound|80||passthrough.example.com", sidecar, ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := s.buildEndpoints(tt.cluster, tt.proxy)
+			if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+				t.Fatalf("expected a single endpoint, got %v", cla.Endpoints)
+			}
+			metadata := cla.Endpoints[0].LbEndpoints[0].GetMetadata().GetFilterMetadata()
+			if got := metadata[util.OriginalDstMetadataKey].GetFields()["local"].GetStringValue(); got != tt.expected {
+				t.Fatalf("expected original destination %q, got %q", tt.expected, got)
+			}
+			// The metadata set by Istio is retained.
+			tlsMode := metadata[util.EnvoyTransportSocketMetadataKey].GetFields()[model.TLSModeLabelShortname].GetStringValue()
+			if tlsMode != model.IstioMutualTLSModeLabel {
+				t.Fatalf("expected the tls mode to be retained, got %q", tlsMode)
+			}
+		})
+	}
+}
+
+// versionedEndpoints returns the endpoints 10.0.0.1 and 10.0.0.2, labeled with the versions v1 and v2.
+func versionedEndpoints() []*model.IstioEndpoint {
+	v1, v2 := testEndpoint("10.0.0.1", ""), testEndpoint("10.0.0.2", "")
+	v1.Labels, v2.Labels = map[string]string{"version": "v1"}, map[string]string{"version": "v2"}
+	return []*model.IstioEndpoint{v1, v2}
+}
+
+func TestBuildLocalityLbEndpointsEmptySubset(t *testing.T) {
+	setFeatureForTest(t, &features.EmptySubsetMatchesNone, false)
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: subsets
+  namespace: default
+spec:
+  host: subsets.example.com
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+  - name: empty
+`})
+	s.addHTTPServices("subsets.example.com")
+	s.Discovery.EDSCacheUpdate("", "subsets.example.com", "", versionedEndpoints())
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster   string
+		matchNone bool
+		expected  []string
+	}{
+		{"outbound|80|empty|subsets.example.com", false, []string{"10.0.0.1", "10.0.0.2"}},
+		{"outbound|80|empty|subsets.example.com", true, []string{}},
+		// Only subsets without labels are affected, not the service cluster or labeled subsets.
+		{"outbound|80||subsets.example.com", true, []string{"10.0.0.1", "10.0.0.2"}},
+		{"outbound|80|v1|subsets.example.com", true, []string{"10.0.0.1"}},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%s/%v", tt.cluster, tt.matchNone), func(t *testing.T) {
+			features.EmptySubsetMatchesNone = tt.matchNone
+			got := loadAssignmentAddresses(s.buildEndpoints(tt.cluster, proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsUnknownSubset(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: subsets
+  namespace: default
+spec:
+  host: subsets.example.com
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+`})
+	s.addHTTPServices("subsets.example.com", "norule.example.com")
+	for _, hostname := range []string{"subsets.example.com", "norule.example.com"} {
+		s.Discovery.EDSCacheUpdate("", hostname, "", versionedEndpoints())
+	}
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster  string
+		expected []string
+		unknown  bool
+	}{
+		{"outbound|80|v1|subsets.example.com", []string{"10.0.0.1"}, false},
+		{"outbound|80||subsets.example.com", []string{"10.0.0.1", "10.0.0.2"}, false},
+		// Subsets missing from the DestinationRule, or without any DestinationRule, select no endpoints.
+		{"outbound|80|v2|subsets.example.com", []string{}, true},
+		{"outbound|80|v1|norule.example.com", []string{}, true},
+		{"outbound|80||norule.example.com", []string{"10.0.0.1", "10.0.0.2"}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			push := s.PushContext()
+			got := loadAssignmentAddresses(s.buildEndpoints(tt.cluster, proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+			_, unknown := push.ProxyStatus[model.ProxyStatusClusterUnknownSubset.Name()][tt.cluster]
+			if unknown != tt.unknown {
+				t.Fatalf("expected unknown subset status %v, got %v", tt.unknown, unknown)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsTLSModeCompatibility(t *testing.T) {
+	setFeatureForTest(t, &features.EndpointTLSModeCompatibility, "")
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("tls.example.com")
+	mtlsEp, plaintextEp := testEndpoint("10.0.0.1", ""), testEndpoint("10.0.0.2", "")
+	mtlsEp.TLSMode, plaintextEp.TLSMode = model.IstioMutualTLSModeLabel, model.DisabledTLSModeLabel
+	s.Discovery.EDSCacheUpdate("", "tls.example.com", "", []*model.IstioEndpoint{mtlsEp, plaintextEp})
+	noMTLS := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{DisableMTLS: true}})
+	mtls := s.SetupProxy(nil)
+
+	cases := []struct {
+		mode     string
+		proxy    *model.Proxy
+		expected map[string]string
+	}{
+		// By default, the metadata is sent unchanged.
+		{"", noMTLS, map[string]string{"10.0.0.1": model.IstioMutualTLSModeLabel, "10.0.0.2": ""}},
+		// Like other plaintext endpoints, downgraded endpoints have no tlsMode metadata.
+		{"downgrade", noMTLS, map[string]string{"10.0.0.1": "", "10.0.0.2": ""}},
+		{"exclude", noMTLS, map[string]string{"10.0.0.2": ""}},
+		// Proxies able to originate mutual TLS are not affected.
+		{"downgrade", mtls, map[string]string{"10.0.0.1": model.IstioMutualTLSModeLabel, "10.0.0.2": ""}},
+		{"exclude", mtls, map[string]string{"10.0.0.1": model.IstioMutualTLSModeLabel, "10.0.0.2": ""}},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%s/%v", tt.mode, tt.proxy.Metadata.DisableMTLS), func(t *testing.T) {
+			features.EndpointTLSModeCompatibility = tt.mode
+			cla := s.buildEndpoints("outbound|80||tls.example.com", tt.proxy)
+			got := map[string]string{}
+			for _, llb := range cla.Endpoints {
+				for _, lb := range llb.LbEndpoints {
+					tlsMode := lb.GetMetadata().GetFilterMetadata()[util.EnvoyTransportSocketMetadataKey].GetFields()[model.TLSModeLabelShortname]
+					got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = tlsMode.GetStringValue()
+				}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoint tls modes %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// The endpoints cached for other proxies are not downgraded.
+	features.EndpointTLSModeCompatibility = "downgrade"
+	s.buildEndpoints("outbound|80||tls.example.com", noMTLS)
+	cla := s.buildEndpoints("outbound|80||tls.example.com", mtls)
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			if lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress() != "10.0.0.1" {
+				continue
+			}
+			tlsMode := lb.GetMetadata().GetFilterMetadata()[util.EnvoyTransportSocketMetadataKey].GetFields()[model.TLSModeLabelShortname]
+			if tlsMode.GetStringValue() != model.IstioMutualTLSModeLabel {
+				t.Fatalf("expected the cached endpoint to keep its tls mode, got %v", tlsMode)
+			}
+		}
+	}
+}
+
+func TestBuildLocalityLbEndpointsEmptyServicePortName(t *testing.T) {
+	setFeatureForTest(t, &features.EmptyServicePortNameFallback, false)
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.MemRegistry.AddService("multi.example.com", &model.Service{
+		Hostname: "multi.example.com",
+		Address:  "10.10.0.2",
+		Ports: model.PortList{
+			{Name: "http-main", Port: 80, Protocol: protocol.HTTP},
+			{Name: "http-admin", Port: 8080, Protocol: protocol.HTTP},
+		},
+	})
+	s.addHTTPServices("single.example.com")
+	for _, hostname := range []string{"single.example.com", "multi.example.com"} {
+		unnamed := testEndpoint("10.0.0.2", "")
+		unnamed.ServicePortName = ""
+		s.Discovery.EDSCacheUpdate("", hostname, "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", ""), unnamed})
+	}
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster   string
+		fallback  bool
+		expected  []string
+		fallbacks float64
+	}{
+		{"outbound|80||single.example.com", true, []string{"10.0.0.1", "10.0.0.2"}, 1},
+		{"outbound|80||single.example.com", false, []string{"10.0.0.1"}, 0},
+		// The port of endpoints without a name is ambiguous for services with several ports.
+		{"outbound|80||multi.example.com", true, []string{"10.0.0.1"}, 0},
+		{"outbound|8080||multi.example.com", true, []string{}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%s/%v", tt.cluster, tt.fallback), func(t *testing.T) {
+			features.EmptyServicePortNameFallback = tt.fallback
+			fallbacks := sumValue(t, "pilot_eds_port_name_fallbacks", "", "")
+			cla := s.buildEndpoints(tt.cluster, proxy)
+			if got := sumValue(t, "pilot_eds_port_name_fallbacks", "", "") - fallbacks; got != tt.fallbacks {
+				t.Fatalf("expected %v port name fallbacks, got %v", tt.fallbacks, got)
+			}
+			got := loadAssignmentAddresses(cla)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// The fallback is only logged for the service with a single port.
+	for hostname, logged := range map[string]bool{"single.example.com": true, "multi.example.com": false} {
+		shards, _ := s.Discovery.getOrCreateEndpointShard(hostname, "")
+		shards.mutex.RLock()
+		got := shards.portNameFallbackLogged
+		shards.mutex.RUnlock()
+		if got != logged {
+			t.Fatalf("expected the port name fallback of %s to be logged %v, got %v", hostname, logged, got)
+		}
+	}
+}
+
+func TestBuildLocalityLbEndpointsExcluded(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("partial.example.com", "all.example.com")
+	endpoint := func(address string, exclude bool) *model.IstioEndpoint {
+		ep := testEndpoint(address, "")
+		ep.Labels = map[string]string{}
+		if exclude {
+			ep.Labels[model.EndpointExcludeLabel] = "true"
+		}
+		return ep
+	}
+	s.Discovery.EDSCacheUpdate("", "partial.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", false),
+		endpoint("10.0.0.2", true),
+	})
+	s.Discovery.EDSCacheUpdate("", "all.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.3", true),
+	})
+	proxy := s.SetupProxy(nil)
+	push := s.PushContext()
+
+	cases := []struct {
+		cluster     string
+		expected    []string
+		noInstances bool
+	}{
+		{"outbound|80||partial.example.com", []string{"10.0.0.1"}, false},
+		{"outbound|80||all.example.com", []string{}, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			got := loadAssignmentAddresses(s.buildEndpoints(tt.cluster, proxy))
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+			if _, f := push.ProxyStatus[model.ProxyStatusClusterExcludedEndpoints.Name()][tt.cluster]; !f {
+				t.Fatalf("expected excluded endpoints to be recorded for %s", tt.cluster)
+			}
+			if _, f := push.ProxyStatus[model.ProxyStatusClusterNoInstances.Name()][tt.cluster]; f != tt.noInstances {
+				t.Fatalf("expected no instances recorded: %v, got %v", tt.noInstances, f)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsDrainingNode(t *testing.T) {
+	setFeatureForTest(t, &features.DrainingNodeEndpointLabel, "example.com/node-draining")
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("draining.example.com")
+	draining, notDraining := testEndpoint("10.0.0.2", ""), testEndpoint("10.0.0.3", "")
+	draining.Labels = labels.Instance{"example.com/node-draining": "true"}
+	notDraining.Labels = labels.Instance{"example.com/node-draining": "false"}
+	s.Discovery.EDSCacheUpdate("", "draining.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", ""), draining, notDraining,
+	})
+
+	cla := s.buildEndpoints("outbound|80||draining.example.com", s.SetupProxy(nil))
+	got := map[string]core.HealthStatus{}
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = lb.HealthStatus
+		}
+	}
+	want := map[string]core.HealthStatus{
+		"10.0.0.1": core.HealthStatus_UNKNOWN,
+		"10.0.0.2": core.HealthStatus_DRAINING,
+		"10.0.0.3": core.HealthStatus_UNKNOWN,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected health statuses %v, got %v", want, got)
+	}
+
+	features.DrainingNodeEndpointLabel = ""
+	ep := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.2", Labels: labels.Instance{"example.com/node-draining": "true"}}, false, false, false)
+	if ep.HealthStatus != core.HealthStatus_UNKNOWN {
+		t.Fatalf("expected no health status without the feature, got %v", ep.HealthStatus)
+	}
+}
+
+func TestBuildLocalityLbEndpointsPendingEviction(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("evicted.example.com")
+	evicted := testEndpoint("10.0.0.2", "")
+	evicted.PendingEviction = true
+	s.Discovery.EDSCacheUpdate("", "evicted.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", ""), evicted})
+
+	cla := s.buildEndpoints("outbound|80||evicted.example.com", s.SetupProxy(nil))
+	got := map[string]core.HealthStatus{}
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = lb.HealthStatus
+		}
+	}
+	want := map[string]core.HealthStatus{
+		"10.0.0.1": core.HealthStatus_UNKNOWN,
+		"10.0.0.2": core.HealthStatus_DRAINING,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected health statuses %v, got %v", want, got)
+	}
+
+	// The eviction being canceled undrains the endpoint.
+	s.Discovery.EDSCacheUpdate("", "evicted.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", ""), testEndpoint("10.0.0.2", ""),
+	})
+	cla = s.buildEndpoints("outbound|80||evicted.example.com", s.SetupProxy(nil))
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			if lb.HealthStatus != core.HealthStatus_UNKNOWN {
+				t.Fatalf("expected no draining endpoint, got %v", lb)
+			}
+		}
+	}
+}
+
+func TestBuildLocalityLbEndpointsOutlierExempt(t *testing.T) {
+	setFeatureForTest(t, &features.EndpointOutlierExemptLabel, "example.com/outlier-exempt")
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("exempt.example.com")
+	exempt, notExempt := testEndpoint("10.0.0.2", ""), testEndpoint("10.0.0.3", "")
+	exempt.Labels = labels.Instance{"example.com/outlier-exempt": "true"}
+	notExempt.Labels = labels.Instance{"example.com/outlier-exempt": "false"}
+	s.Discovery.EDSCacheUpdate("", "exempt.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", ""), exempt, notExempt,
+	})
+
+	cla := s.buildEndpoints("outbound|80||exempt.example.com", s.SetupProxy(nil))
+	got := map[string]bool{}
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			md, f := lb.GetMetadata().GetFilterMetadata()[util.OutlierDetectionMetadataKey]
+			if f && !md.GetFields()["exempt"].GetBoolValue() {
+				t.Fatalf("expected exempt to be true if set, got %v", md)
+			}
+			got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = f
+		}
+	}
+	if want := map[string]bool{"10.0.0.1": false, "10.0.0.2": true, "10.0.0.3": false}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected exempt endpoints %v, got %v", want, got)
+	}
+
+	features.EndpointOutlierExemptLabel = ""
+	ep := buildEnvoyLbEndpoint(&model.IstioEndpoint{Address: "10.0.0.2", Labels: labels.Instance{"example.com/outlier-exempt": "true"}}, false, false, false)
+	if _, f := ep.GetMetadata().GetFilterMetadata()[util.OutlierDetectionMetadataKey]; f {
+		t.Fatalf("expected no outlier detection metadata without the feature, got %v", ep.Metadata)
+	}
+}
+
+func TestBuildLocalityLbEndpointsPreferredLocality(t *testing.T) {
+	setFeatureForTest(t, &features.PreferredLocality, "region1/zone1")
+	setFeatureForTest(t, &features.PreferredLocalityWeightMultiplier, 1.0)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: preferred
+  namespace: default
+spec:
+  host: preferred.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutive5xxErrors: 3
+    loadBalancer:
+      localityLbSetting:
+        enabled: true
+`})
+	s.addHTTPServices("preferred.example.com", "unweighted.example.com")
+	for _, hostname := range []string{"preferred.example.com", "unweighted.example.com"} {
+		s.Discovery.EDSCacheUpdate("", hostname, "", []*model.IstioEndpoint{
+			testEndpoint("10.0.0.1", "region1/zone1/subzone1"),
+			testEndpoint("10.0.0.2", "region1/zone1/subzone1"),
+			testEndpoint("10.0.0.3", "region1/zone2/subzone1"),
+			testEndpoint("10.0.0.4", "region1/zone2/subzone1"),
+		})
+	}
+	proxy := s.SetupProxy(nil)
+
+	cases := []struct {
+		cluster    string
+		multiplier float64
+		expected   map[string]uint32
+	}{
+		{"preferred.example.com", 1.0, map[string]uint32{"region1/zone1/subzone1": 2, "region1/zone2/subzone1": 2}},
+		{"preferred.example.com", 3.0, map[string]uint32{"region1/zone1/subzone1": 6, "region1/zone2/subzone1": 2}},
+		{"preferred.example.com", 0.5, map[string]uint32{"region1/zone1/subzone1": 1, "region1/zone2/subzone1": 2}},
+		// Envoy ignores the weights of localities without outlier detection and locality load balancing.
+		{"unweighted.example.com", 3.0, map[string]uint32{"region1/zone1/subzone1": 2, "region1/zone2/subzone1": 2}},
+	}
+	for _, tt := range cases {
+		t.Run(fmt.Sprintf("%s/%v", tt.cluster, tt.multiplier), func(t *testing.T) {
+			features.PreferredLocalityWeightMultiplier = tt.multiplier
+			got := localityWeights(s.buildEndpoints("outbound|80||"+tt.cluster, proxy))
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected locality weights %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsFlakyEndpoints(t *testing.T) {
+	setFeatureForTest(t, &features.FlakyEndpointWindow, time.Minute)
+	setFeatureForTest(t, &features.FlakyEndpointFlips, 3)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s.Discovery.clock = fakeClock
+	s.addHTTPServices("flaky.example.com")
+	update := func(addresses ...string) {
+		eps := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, address := range addresses {
+			ep := testEndpoint(address, "")
+			ep.LbWeight = 20
+			eps = append(eps, ep)
+		}
+		s.Discovery.EDSCacheUpdate("", "flaky.example.com", "", eps)
+		fakeClock.Step(time.Second)
+	}
+	proxy := s.SetupProxy(nil)
+	if NewEndpointBuilder("outbound|80||flaky.example.com", proxy, s.PushContext()).Cacheable() {
+		t.Fatal("expected the load assignments not to be cached while flaky endpoints are tracked")
+	}
+	weights := func() map[string]uint32 {
+		cla := s.buildEndpoints("outbound|80||flaky.example.com", proxy)
+		got := map[string]uint32{}
+		for _, llb := range cla.Endpoints {
+			for _, lb := range llb.LbEndpoints {
+				got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = lb.GetLoadBalancingWeight().GetValue()
+			}
+		}
+		return got
+	}
+
+	// 10.0.0.2 becomes ready, not ready and ready again.
+	update("10.0.0.1", "10.0.0.2")
+	update("10.0.0.1")
+	if got, expected := weights(), map[string]uint32{"10.0.0.1": 20}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected weights %v, got %v", expected, got)
+	}
+	update("10.0.0.1", "10.0.0.2")
+	if got, expected := weights(), map[string]uint32{"10.0.0.1": 20, "10.0.0.2": 2}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected reduced weight for the flaky endpoint, got %v", got)
+	}
+
+	// Once the flips are outside of the window, the endpoint is no longer flaky.
+	fakeClock.Step(time.Minute)
+	if got, expected := weights(), map[string]uint32{"10.0.0.1": 20, "10.0.0.2": 20}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected the endpoint to recover its weight, got %v", got)
+	}
+}
+
+func TestBuildLocalityLbEndpointsSubsetWeights(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: weights
+  namespace: default
+spec:
+  host: weights.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutiveErrors: 5
+  subsets:
+  - name: v1
+    labels:
+      version: v1
+`})
+	s.addHTTPServices("weights.example.com")
+	endpoint := func(address, version, locality string, weight uint32) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.Labels, ep.LbWeight = map[string]string{"version": version}, weight
+		return ep
+	}
+	s.Discovery.EDSCacheUpdate("", "weights.example.com", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "v1", "region1/zone1/subzone1", 2),
+		endpoint("10.0.0.2", "v2", "region1/zone1/subzone1", 5),
+		endpoint("10.0.0.3", "v1", "region1/zone2/subzone1", 3),
+		endpoint("10.0.0.4", "v2", "region1/zone2/subzone1", 7),
+	})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}})
+
+	cases := []struct {
+		cluster  string
+		expected map[string]uint32
+	}{
+		{"outbound|80|v1|weights.example.com", map[string]uint32{"region1/zone1/subzone1": 2, "region1/zone2/subzone1": 3}},
+		{"outbound|80||weights.example.com", map[string]uint32{"region1/zone1/subzone1": 7, "region1/zone2/subzone1": 10}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			got := localityWeights(s.buildEndpoints(tt.cluster, proxy))
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected locality weights %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBuildLocalityLbEndpointsAddressFamily(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("dualstack.example.com")
+	endpoint := func(address, uid string) *model.IstioEndpoint {
+		ep := testEndpoint(address, "")
+		ep.UID = uid
+		return ep
+	}
+	s.Discovery.EDSCacheUpdate("", "dualstack.example.com", "", []*model.IstioEndpoint{
+		// A dual-stack workload
+		endpoint("10.0.0.1", "kubernetes://a.default"),
+		endpoint("fd00::1", "kubernetes://a.default"),
+		// Workloads with addresses in a single family
+		endpoint("10.0.0.2", "kubernetes://b.default"),
+		endpoint("fd00::3", "kubernetes://c.default"),
+	})
+
+	cases := []struct {
+		preference string
+		want       []string
+	}{
+		{"", []string{"10.0.0.1", "10.0.0.2", "fd00::1", "fd00::3"}},
+		{"IPv4", []string{"10.0.0.1", "10.0.0.2", "fd00::3"}},
+		{"IPv6", []string{"10.0.0.2", "fd00::1", "fd00::3"}},
+		{"ipv6", []string{"10.0.0.2", "fd00::1", "fd00::3"}},
+		{"invalid", []string{"10.0.0.1", "10.0.0.2", "fd00::1", "fd00::3"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.preference, func(t *testing.T) {
+			proxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{IPFamilyPreference: tt.preference}})
+			got := loadAssignmentAddresses(s.buildEndpoints("outbound|80||dualstack.example.com", proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected endpoints %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// EndpointFilter returns whether the endpoint is included in the cluster being built, allowing integrators to
+// implement arbitrary inclusion logic, such as geo-fencing. The built endpoints are cached by the key of the
+// builder, so filters must only depend on the endpoint and on the cluster, locality and service of the builder.
+// Filters are called with the lock of the endpoint shards held, so they must not block.
+type EndpointFilter func(ep *model.IstioEndpoint, b *EndpointBuilder) bool
+
+// AddEndpointFilter registers a filter applied to the endpoints of all clusters, after the built-in filtering
+// and before their grouping by locality. Filters are applied in the order they are registered, and an endpoint
+// is only included if all of them include it. The EDS cache is cleared, as it holds unfiltered endpoints.
+func (s *DiscoveryServer) AddEndpointFilter(filter EndpointFilter) {
+	s.mutex.Lock()
+	s.endpointFilters = append(s.endpointFilters, filter)
+	s.mutex.Unlock()
+	s.Cache.ClearAll()
+}
+
+// filterEndpoint returns whether the endpoint is included by all the registered filters.
+func (b *EndpointBuilder) filterEndpoint(ep *model.IstioEndpoint) bool {
+	for _, filter := range b.endpointFilters {
+		if !filter(ep, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterName returns the name of the cluster being built.
+func (b *EndpointBuilder) ClusterName() string {
+	return b.clusterName
+}
+
+// Locality returns the locality of the proxy the cluster is built for.
+func (b *EndpointBuilder) Locality() *core.Locality {
+	return b.locality
+}
+
+// Service returns the service of the cluster being built.
+func (b *EndpointBuilder) Service() *model.Service {
+	return b.service
+}
@@ -0,0 +1,88 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestEndpointFilter(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("geo.example.com", "restricted.example.com")
+	s.Discovery.EDSCacheUpdate("", "geo.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", "eu/zone1"),
+		testEndpoint("10.0.0.2", "us/zone1"),
+		testEndpoint("10.0.0.3", "eu/zone2"),
+	})
+	s.Discovery.EDSCacheUpdate("", "restricted.example.com", "", []*model.IstioEndpoint{testEndpoint("10.0.1.1", "us/zone1")})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "eu", Zone: "zone1"}})
+
+	// Geo-fencing: proxies only see the endpoints of their own region.
+	var calls []string
+	s.Discovery.AddEndpointFilter(func(ep *model.IstioEndpoint, b *EndpointBuilder) bool {
+		calls = append(calls, "region")
+		return strings.HasPrefix(ep.Locality.Label, b.Locality().GetRegion()+"/")
+	})
+	// Compliance: the zone2 endpoints of geo.example.com are not available.
+	s.Discovery.AddEndpointFilter(func(ep *model.IstioEndpoint, b *EndpointBuilder) bool {
+		calls = append(calls, "compliance")
+		return b.Service().Hostname != "geo.example.com" || !strings.HasSuffix(ep.Locality.Label, "/zone2")
+	})
+
+	cases := []struct {
+		cluster     string
+		expected    []string
+		calls       []string
+		noInstances bool
+	}{
+		{
+			cluster:  "outbound|80||geo.example.com",
+			expected: []string{"10.0.0.1"},
+			// The later filters are skipped for the endpoints excluded by earlier ones.
+			calls: []string{"compliance", "compliance", "region", "region", "region"},
+		},
+		{
+			cluster:     "outbound|80||restricted.example.com",
+			expected:    []string{},
+			calls:       []string{"region"},
+			noInstances: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.cluster, func(t *testing.T) {
+			calls = nil
+			push := s.PushContext()
+			got := loadAssignmentAddresses(s.buildEndpoints(tt.cluster, proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+			sort.Strings(calls)
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Fatalf("expected filter calls %v, got %v", tt.calls, calls)
+			}
+			if _, f := push.ProxyStatus[model.ProxyStatusClusterNoInstances.Name()][tt.cluster]; f != tt.noInstances {
+				t.Fatalf("expected no instances status %v, got %v", tt.noInstances, f)
+			}
+		})
+	}
+}
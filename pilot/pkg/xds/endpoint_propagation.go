@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// trackPropagation starts tracking the propagation of each endpoint added to the shard of the cluster,
+// and stops tracking endpoints removed before they were sent to any proxy. Must be called with the
+// mutex held.
+func (e *EndpointShards) trackPropagation(clusterID string, previous, current []*model.IstioEndpoint) {
+	before := make(map[string]struct{}, len(previous))
+	for _, ep := range previous {
+		before[ep.Address] = struct{}{}
+	}
+	after := make(map[string]struct{}, len(current))
+	for _, ep := range current {
+		after[ep.Address] = struct{}{}
+		if _, f := before[ep.Address]; !f {
+			if e.pendingPropagation == nil {
+				e.pendingPropagation = map[string]time.Time{}
+			}
+			key := readinessFlipKey(clusterID, ep.Address)
+			if _, f := e.pendingPropagation[key]; !f {
+				e.pendingPropagation[key] = e.now()
+				e.pendingPropagationTotal.Inc()
+			}
+		}
+	}
+	if len(e.pendingPropagation) == 0 {
+		return
+	}
+	for address := range before {
+		if _, f := after[address]; f {
+			continue
+		}
+		key := readinessFlipKey(clusterID, address)
+		if _, f := e.pendingPropagation[key]; f {
+			delete(e.pendingPropagation, key)
+			e.pendingPropagationTotal.Dec()
+		}
+	}
+}
+
+// recordEndpointPropagation records the propagation time of the pending endpoints of the services
+// included in an EDS response sent to the proxy. Only the first response including an endpoint is
+// recorded.
+func (s *DiscoveryServer) recordEndpointPropagation(proxy *model.Proxy, push *model.PushContext,
+	w *model.WatchedResource, req *model.PushRequest) {
+	if s.pendingPropagation.Load() == 0 {
+		return
+	}
+	var updatedServices map[string]struct{}
+	if req != nil && !req.Full && len(req.ConfigsUpdated) > 0 {
+		// Only the clusters of the updated services were sent, see EdsGenerator.Generate.
+		updatedServices = model.ConfigNamesOfKind(req.ConfigsUpdated, gvk.ServiceEntry)
+	}
+	hostnames := map[host.Name]struct{}{}
+	for _, clusterName := range w.ResourceNames {
+		_, _, hostname, _ := model.ParseSubsetKey(clusterName)
+		if updatedServices != nil {
+			if _, f := updatedServices[string(hostname)]; !f {
+				continue
+			}
+		}
+		hostnames[hostname] = struct{}{}
+	}
+
+	for hostname := range hostnames {
+		svc := push.ServiceForHostname(proxy, hostname)
+		if svc == nil {
+			continue
+		}
+		s.mutex.RLock()
+		ep := s.EndpointShardsByService[string(hostname)][svc.Attributes.Namespace]
+		s.mutex.RUnlock()
+		if ep == nil {
+			continue
+		}
+		ep.mutex.RLock()
+		pending := len(ep.pendingPropagation)
+		ep.mutex.RUnlock()
+		if pending == 0 {
+			continue
+		}
+		ep.mutex.Lock()
+		propagated := ep.propagated()
+		ep.mutex.Unlock()
+		for _, d := range propagated {
+			edsEndpointPropagationTime.Record(d.Seconds())
+		}
+	}
+}
+
+// propagated stops tracking the pending endpoints and returns their propagation times. Must be called
+// with the mutex held.
+func (e *EndpointShards) propagated() []time.Duration {
+	now := e.now()
+	out := make([]time.Duration, 0, len(e.pendingPropagation))
+	for key, seen := range e.pendingPropagation {
+		out = append(out, now.Sub(seen))
+		delete(e.pendingPropagation, key)
+	}
+	e.pendingPropagationTotal.Sub(int64(len(out)))
+	return out
+}
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestEndpointPropagationTime(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s.Discovery.clock = fakeClock
+	s.addHTTPServices("propagation.example.com")
+	proxy := s.SetupProxy(nil)
+	update := func(addresses ...string) {
+		eps := make([]*model.IstioEndpoint, 0, len(addresses))
+		for _, address := range addresses {
+			eps = append(eps, testEndpoint(address, ""))
+		}
+		s.Discovery.EDSCacheUpdate("", "propagation.example.com", "", eps)
+	}
+	w := &model.WatchedResource{
+		TypeUrl:       v3.EndpointType,
+		ResourceNames: []string{"outbound|80||propagation.example.com"},
+	}
+	// The server counts the pending endpoints of all services, so pushes return early if there are none.
+	base := s.Discovery.pendingPropagation.Load()
+	assertPending := func(want int64) {
+		t.Helper()
+		if got := s.Discovery.pendingPropagation.Load() - base; got != want {
+			t.Fatalf("expected %d pending endpoints counted by the server, got %d", want, got)
+		}
+	}
+
+	// 10.0.0.2 is removed before any push, so only 10.0.0.1 is recorded.
+	update("10.0.0.1", "10.0.0.2")
+	assertPending(2)
+	shards := s.Discovery.EndpointShardsByService["propagation.example.com"][""]
+	fakeClock.Step(2 * time.Second)
+	update("10.0.0.1")
+	assertPending(1)
+	fakeClock.Step(time.Second)
+	shards.mutex.Lock()
+	got := shards.propagated()
+	shards.mutex.Unlock()
+	if want := []time.Duration{3 * time.Second}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected propagation times %v, got %v", want, got)
+	}
+	assertPending(0)
+
+	// Endpoints are recorded only on the first response including them.
+	update("10.0.0.1", "10.0.0.3")
+	assertPending(1)
+	s.Discovery.recordEndpointPropagation(proxy, s.PushContext(), w, &model.PushRequest{Full: true})
+	assertPending(0)
+	shards.mutex.Lock()
+	pending := len(shards.pendingPropagation)
+	shards.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("expected no pending endpoints after the push, got %d", pending)
+	}
+	update("10.0.0.1", "10.0.0.3")
+	if pending := len(shards.pendingPropagation); pending != 0 {
+		t.Fatalf("expected already sent endpoints not to be tracked again, got %d", pending)
+	}
+}
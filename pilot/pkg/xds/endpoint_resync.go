@@ -0,0 +1,166 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// StartEndpointResync marks the endpoints of the cluster as stale, before its registry is resynced. Stale
+// endpoints keep being served, even if they are missing from the updates received during the resync, so
+// traffic is not blackholed while the endpoints are rebuilt. An endpoint is no longer stale once an update
+// confirms it; the endpoints still stale are removed by FinishEndpointResync.
+func (s *DiscoveryServer) StartEndpointResync(clusterID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.resyncingClusters == nil {
+		s.resyncingClusters = map[string]struct{}{}
+	}
+	s.resyncingClusters[clusterID] = struct{}{}
+	for _, byNamespace := range s.EndpointShardsByService {
+		for _, ep := range byNamespace {
+			ep.mutex.Lock()
+			ep.markStale(clusterID)
+			ep.mutex.Unlock()
+		}
+	}
+}
+
+// FinishEndpointResync removes the endpoints of the cluster which were not confirmed by the resync started
+// with StartEndpointResync, and pushes the services they belong to. Updates deferred while EDS pushes are
+// paused are kept, as they are newer than the endpoints of the shards.
+func (s *DiscoveryServer) FinishEndpointResync(clusterID string) {
+	type staleShard struct {
+		hostname, namespace string
+		kept                []*model.IstioEndpoint
+	}
+	var shards []staleShard
+	s.mutex.Lock()
+	delete(s.resyncingClusters, clusterID)
+	for hostname, byNamespace := range s.EndpointShardsByService {
+		for namespace, ep := range byNamespace {
+			ep.mutex.Lock()
+			if kept, f := ep.dropStale(clusterID); f {
+				shards = append(shards, staleShard{hostname: hostname, namespace: namespace, kept: kept})
+			}
+			ep.mutex.Unlock()
+		}
+	}
+	s.mutex.Unlock()
+	if len(shards) == 0 {
+		return
+	}
+
+	fullPush := false
+	updated := make(map[model.ConfigKey]struct{}, len(shards))
+	for _, shard := range shards {
+		adsLog.Infof("Removing the endpoints of service %s/%s in cluster %s not confirmed by the resync",
+			shard.namespace, shard.hostname, clusterID)
+		fp, rejected := s.edsCacheUpdate(clusterID, shard.hostname, shard.namespace, shard.kept)
+		if !rejected {
+			recordEDSUpdateKind(fp)
+		}
+		if fp {
+			fullPush = true
+		}
+		updated[model.ConfigKey{Kind: gvk.ServiceEntry, Name: shard.hostname, Namespace: shard.namespace}] = struct{}{}
+	}
+	s.ConfigUpdate(&model.PushRequest{
+		Full:           fullPush,
+		ConfigsUpdated: updated,
+		Reason:         []model.TriggerReason{model.EndpointUpdate},
+	})
+}
+
+// endpointResyncing returns whether the registry of the cluster is being resynced.
+func (s *DiscoveryServer) endpointResyncing(clusterID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, f := s.resyncingClusters[clusterID]
+	return f
+}
+
+// retainStaleEndpoints returns the endpoints of the update, along with the stale endpoints of the shard
+// missing from it. The endpoints of the update are no longer stale.
+func (s *DiscoveryServer) retainStaleEndpoints(clusterID, hostname, namespace string,
+	istioEndpoints []*model.IstioEndpoint) []*model.IstioEndpoint {
+	s.mutex.RLock()
+	ep := s.EndpointShardsByService[hostname][namespace]
+	s.mutex.RUnlock()
+	if ep == nil {
+		return istioEndpoints
+	}
+
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	stale := ep.stale[clusterID]
+	if len(stale) == 0 {
+		return istioEndpoints
+	}
+	for _, e := range istioEndpoints {
+		delete(stale, endpointKey(e))
+	}
+	retained := istioEndpoints
+	for _, e := range ep.Shards[clusterID] {
+		if _, f := stale[endpointKey(e)]; f {
+			if len(retained) == len(istioEndpoints) {
+				retained = append(make([]*model.IstioEndpoint, 0, len(istioEndpoints)+len(stale)), istioEndpoints...)
+			}
+			retained = append(retained, e)
+		}
+	}
+	if len(stale) == 0 {
+		delete(ep.stale, clusterID)
+	}
+	return retained
+}
+
+// markStale marks all the endpoints of the shard of the cluster as stale. Must be called with the mutex held.
+func (e *EndpointShards) markStale(clusterID string) {
+	endpoints := e.Shards[clusterID]
+	if len(endpoints) == 0 {
+		return
+	}
+	stale := make(map[string]struct{}, len(endpoints))
+	for _, ep := range endpoints {
+		stale[endpointKey(ep)] = struct{}{}
+	}
+	if e.stale == nil {
+		e.stale = map[string]map[string]struct{}{}
+	}
+	e.stale[clusterID] = stale
+}
+
+// dropStale clears the stale endpoints of the shard of the cluster, returning the endpoints to keep and
+// whether there were any stale endpoints. Must be called with the mutex held.
+func (e *EndpointShards) dropStale(clusterID string) ([]*model.IstioEndpoint, bool) {
+	stale := e.stale[clusterID]
+	delete(e.stale, clusterID)
+	if len(stale) == 0 {
+		return nil, false
+	}
+	endpoints, f := e.Shards[clusterID]
+	if !f {
+		return nil, false
+	}
+	kept := make([]*model.IstioEndpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if _, f := stale[endpointKey(ep)]; !f {
+			kept = append(kept, ep)
+		}
+	}
+	return kept, true
+}
@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pkg/config/host"
+)
+
+// periodicCompactEndpointShards compacts the endpoint shards every PILOT_ENDPOINT_SHARD_COMPACTION_INTERVAL.
+func (s *DiscoveryServer) periodicCompactEndpointShards(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(features.EndpointShardCompactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if removed := s.compactEndpointShards(); removed > 0 {
+				adsLog.Infof("Compacted the endpoint shards of %d services", removed)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// compactEndpointShards removes the entries of EndpointShardsByService left behind by churn, and returns
+// the number of removed entries. The expired empty shards are pruned first, then the services without any
+// shard left are removed if they no longer exist, along with the hostnames left without any namespace.
+// Services which still exist are kept even without shards, as recreating their entry on their next update
+// triggers a full push.
+func (s *DiscoveryServer) compactEndpointShards() int {
+	push := s.globalPushContext()
+	removed := 0
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hostname, byNamespace := range s.EndpointShardsByService {
+		for namespace, ep := range byNamespace {
+			if ep == nil {
+				delete(byNamespace, namespace)
+				removed++
+				continue
+			}
+			ep.mutex.Lock()
+			ep.pruneEmptyShards()
+			empty := len(ep.Shards) == 0
+			ep.mutex.Unlock()
+			if !empty {
+				continue
+			}
+			if _, f := push.ServiceIndex.HostnameAndNamespace[host.Name(hostname)][namespace]; f {
+				continue
+			}
+			delete(byNamespace, namespace)
+			s.updateEmptyService(hostname, namespace)
+			removed++
+		}
+		if len(byNamespace) == 0 {
+			delete(s.EndpointShardsByService, hostname)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,59 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestCompactEndpointShards(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("known.example.com")
+	endpoints := []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")}
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		s.Discovery.EDSCacheUpdate("cluster1", fmt.Sprintf("svc%d.example.com", i), "ns", endpoints)
+	}
+	s.Discovery.EDSCacheUpdate("cluster1", "known.example.com", "", endpoints)
+	s.Discovery.EDSCacheUpdate("cluster1", "live.example.com", "ns", endpoints)
+	for i := 0; i < count; i++ {
+		s.Discovery.EDSCacheUpdate("cluster1", fmt.Sprintf("svc%d.example.com", i), "ns", nil)
+	}
+	s.Discovery.EDSCacheUpdate("cluster1", "known.example.com", "", nil)
+	// The entries of deleted services are kept empty, to avoid full pushes on endpoint flip flops.
+	if got := len(s.Discovery.EndpointShardsByService); got != count+2 {
+		t.Fatalf("expected %d services before compaction, got %d", count+2, got)
+	}
+
+	if removed := s.Discovery.compactEndpointShards(); removed != count {
+		t.Fatalf("expected %d services to be compacted, got %d", count, removed)
+	}
+	if got := len(s.Discovery.EndpointShardsByService); got != 2 {
+		t.Fatalf("expected 2 services after compaction, got %d: %v", got, s.Discovery.EndpointShardsByService)
+	}
+	// Services with endpoints are kept, as are the services still known to the registry.
+	for _, hostname := range []string{"known.example.com", "live.example.com"} {
+		if _, f := s.Discovery.EndpointShardsByService[hostname]; !f {
+			t.Errorf("expected %s to be kept", hostname)
+		}
+	}
+	if removed := s.Discovery.compactEndpointShards(); removed != 0 {
+		t.Fatalf("expected nothing to compact, got %d", removed)
+	}
+}
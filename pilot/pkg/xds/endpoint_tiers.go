@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// endpointTiersEnabled returns true if endpoints are prioritized by the tier label, or by whether they are on
+// spot instances, instead of their locality.
+func endpointTiersEnabled() bool {
+	return features.EndpointTierLabel != "" || spotEndpointsDeprioritized()
+}
+
+// spotEndpointsDeprioritized returns true if the endpoints on spot instances are given a lower priority.
+func spotEndpointsDeprioritized() bool {
+	return features.DeprioritizeSpotEndpoints && features.EndpointSpotInstanceLabel != ""
+}
+
+// endpointTier returns the tier of the endpoint from its tier label, which is a non-negative integer. Endpoints
+// without the label are in tier 0. If spot endpoints are deprioritized, each tier is split in two, the endpoints
+// on spot instances coming after the others. It returns false if the label value is not a valid tier.
+func endpointTier(ep *model.IstioEndpoint) (uint32, bool) {
+	var tier uint32
+	if v, f := ep.Labels[features.EndpointTierLabel]; f && features.EndpointTierLabel != "" {
+		t, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		tier = uint32(t)
+	}
+	if spotEndpointsDeprioritized() {
+		if tier > math.MaxUint32/2 {
+			return 0, false
+		}
+		tier *= 2
+		if onSpotInstance(ep) {
+			tier++
+		}
+	}
+	return tier, true
+}
+
+// compactTierPriorities maps the tiers set as priorities of the locality groups to consecutive priorities
+// starting at 0, as required by Envoy, and orders the groups by priority.
+func compactTierPriorities(locEps []*endpoint.LocalityLbEndpoints) {
+	tiers := make([]uint32, 0, len(locEps))
+	seen := map[uint32]struct{}{}
+	for _, locLbEps := range locEps {
+		if _, f := seen[locLbEps.Priority]; !f {
+			seen[locLbEps.Priority] = struct{}{}
+			tiers = append(tiers, locLbEps.Priority)
+		}
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i] < tiers[j] })
+	priorities := make(map[uint32]uint32, len(tiers))
+	for i, tier := range tiers {
+		priorities[tier] = uint32(i)
+	}
+	for _, locLbEps := range locEps {
+		locLbEps.Priority = priorities[locLbEps.Priority]
+	}
+	sort.SliceStable(locEps, func(i, j int) bool {
+		if locEps[i].Priority != locEps[j].Priority {
+			return locEps[i].Priority < locEps[j].Priority
+		}
+		return util.LocalityToString(locEps[i].Locality) < util.LocalityToString(locEps[j].Locality)
+	})
+}
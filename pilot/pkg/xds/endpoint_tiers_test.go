@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestBuildLocalityLbEndpointsTiers(t *testing.T) {
+	setFeatureForTest(t, &features.EndpointTierLabel, "istio.io/tier")
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("tiers.example.com")
+	endpoint := func(address, locality string, labels map[string]string) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.Labels = labels
+		return ep
+	}
+	s.Discovery.SetEndpointShardsForTest("tiers.example.com", "", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "region1/zone1", map[string]string{"istio.io/tier": "0"}),
+		endpoint("10.0.0.2", "region1/zone1", map[string]string{"istio.io/tier": "2"}),
+		endpoint("10.0.0.3", "region2/zone1", map[string]string{"istio.io/tier": "2"}),
+		// Endpoints without a tier are in tier 0.
+		endpoint("10.0.0.4", "region2/zone1", nil),
+		// Endpoints with an invalid tier are excluded.
+		endpoint("10.0.0.5", "region1/zone1", map[string]string{"istio.io/tier": "-1"}),
+		endpoint("10.0.0.6", "region1/zone1", map[string]string{"istio.io/tier": "primary"}),
+	})
+	// The proxy is in region2, which would get the highest priority with locality load balancing.
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region2"}})
+
+	cla := s.buildEndpoints("outbound|80||tiers.example.com", proxy)
+	got := map[string]uint32{}
+	for _, llb := range cla.Endpoints {
+		for _, lb := range llb.LbEndpoints {
+			got[lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = llb.Priority
+		}
+	}
+	// Tier 2 is the second tier, so it gets priority 1.
+	want := map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 1, "10.0.0.3": 1, "10.0.0.4": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected priorities %v, got %v", want, got)
+	}
+	for i := 1; i < len(cla.Endpoints); i++ {
+		if cla.Endpoints[i-1].Priority > cla.Endpoints[i].Priority {
+			t.Fatalf("expected locality groups ordered by priority, got %v", cla.Endpoints)
+		}
+	}
+}
+
+func TestBuildLocalityLbEndpointsSpotInstances(t *testing.T) {
+	setFeatureForTest(t, &features.EndpointSpotInstanceLabel, "node.example.com/spot")
+	setFeatureForTest(t, &features.DeprioritizeSpotEndpoints, false)
+	setFeatureForTest(t, &features.EndpointTierLabel, "")
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("spot.example.com")
+	endpoint := func(address, locality string, labels map[string]string) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.Labels = labels
+		return ep
+	}
+	s.Discovery.SetEndpointShardsForTest("spot.example.com", "", "", []*model.IstioEndpoint{
+		endpoint("10.0.0.1", "region1/zone1", nil),
+		endpoint("10.0.0.2", "region1/zone1", map[string]string{"node.example.com/spot": "true"}),
+		endpoint("10.0.0.3", "region2/zone1", map[string]string{"istio.io/tier": "1"}),
+		endpoint("10.0.0.4", "region2/zone1", map[string]string{"istio.io/tier": "1", "node.example.com/spot": "true"}),
+	})
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region2"}})
+	build := func() (map[string]uint32, map[string]string) {
+		t.Helper()
+		cla := s.buildEndpoints("outbound|80||spot.example.com", proxy)
+		priorities, metadata := map[string]uint32{}, map[string]string{}
+		for _, llb := range cla.Endpoints {
+			for _, lb := range llb.LbEndpoints {
+				address := lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+				priorities[address] = llb.Priority
+				metadata[address] = lb.GetMetadata().GetFilterMetadata()[util.EnvoyLbMetadataKey].GetFields()["spot"].GetStringValue()
+			}
+		}
+		return priorities, metadata
+	}
+
+	// The label is propagated to the metadata of all endpoints, without changing their priority.
+	priorities, metadata := build()
+	if want := map[string]string{"10.0.0.1": "false", "10.0.0.2": "true", "10.0.0.3": "false", "10.0.0.4": "true"}; !reflect.DeepEqual(metadata, want) {
+		t.Fatalf("expected spot metadata %v, got %v", want, metadata)
+	}
+	if want := map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 0, "10.0.0.3": 0, "10.0.0.4": 0}; !reflect.DeepEqual(priorities, want) {
+		t.Fatalf("expected priorities %v, got %v", want, priorities)
+	}
+
+	// Spot endpoints come after the stable endpoints.
+	features.DeprioritizeSpotEndpoints = true
+	if priorities, _ = build(); !reflect.DeepEqual(priorities, map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 1, "10.0.0.3": 0, "10.0.0.4": 1}) {
+		t.Fatalf("expected spot endpoints to be deprioritized, got %v", priorities)
+	}
+
+	// With tiers, spot endpoints come after the stable endpoints of their tier.
+	features.EndpointTierLabel = "istio.io/tier"
+	if priorities, _ = build(); !reflect.DeepEqual(priorities, map[string]uint32{"10.0.0.1": 0, "10.0.0.2": 1, "10.0.0.3": 2, "10.0.0.4": 3}) {
+		t.Fatalf("expected spot endpoints to be deprioritized within their tier, got %v", priorities)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"strconv"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// reuseEnvoyEndpoints carries the Envoy endpoints built for the previous endpoints of a shard over to the
+// current ones, if the update changes nothing but endpoint weights. Only the weights are patched, so the
+// endpoints, and their metadata in particular, are not rebuilt on the next push. Must be called with the
+// mutex of the shards held.
+func reuseEnvoyEndpoints(previous, current []*model.IstioEndpoint) {
+	if len(previous) == 0 || len(previous) != len(current) {
+		return
+	}
+	byKey := make(map[string]*model.IstioEndpoint, len(previous))
+	for _, ep := range previous {
+		byKey[endpointKey(ep)] = ep
+	}
+	reused := make([]*endpoint.LbEndpoint, len(current))
+	for i, ep := range current {
+		prev, f := byKey[endpointKey(ep)]
+		if !f || !sameEndpointExceptWeight(prev, ep) {
+			return
+		}
+		if prev.EnvoyEndpoint == nil {
+			continue
+		}
+		reused[i] = withLbWeight(prev.EnvoyEndpoint, lbEndpointWeight(ep, false))
+	}
+	for i, ep := range current {
+		if ep.EnvoyEndpoint == nil {
+			ep.EnvoyEndpoint = reused[i]
+		}
+	}
+}
+
+func endpointKey(ep *model.IstioEndpoint) string {
+	return ep.Address + ":" + strconv.Itoa(int(ep.EndpointPort)) + "/" + ep.ServicePortName
+}
+
+// sameEndpointExceptWeight returns true if the endpoints only differ in their weights.
+func sameEndpointExceptWeight(a, b *model.IstioEndpoint) bool {
+	return a.Address == b.Address &&
+		a.EndpointPort == b.EndpointPort &&
+		a.ServicePortName == b.ServicePortName &&
+		a.UID == b.UID &&
+		a.ServiceAccount == b.ServiceAccount &&
+		a.Network == b.Network &&
+		a.Locality == b.Locality &&
+		a.TLSMode == b.TLSMode &&
+		a.PendingEviction == b.PendingEviction &&
+		a.Labels.Equals(b.Labels)
+}
+
+// withLbWeight returns the endpoint with the weight, sharing everything else with the given endpoint.
+func withLbWeight(ep *endpoint.LbEndpoint, weight uint32) *endpoint.LbEndpoint {
+	if ep.GetLoadBalancingWeight().GetValue() == weight {
+		return ep
+	}
+	return &endpoint.LbEndpoint{
+		HostIdentifier:      ep.HostIdentifier,
+		HealthStatus:        ep.HealthStatus,
+		Metadata:            ep.Metadata,
+		LoadBalancingWeight: &wrappers.UInt32Value{Value: weight},
+	}
+}
@@ -43,6 +43,8 @@ func (b *EndpointBuilder) EndpointsByNetworkFilter(endpoints []*endpoint.Localit
 	// A new array of endpoints to be returned that will have both local and
 	// remote gateways (if any)
 	filtered := make([]*endpoint.LocalityLbEndpoints, 0)
+	// Number of endpoints sent directly and replaced by gateways, for metrics.
+	localEps, gatewayEps := 0, 0
 
 	// Go through all cluster endpoints and add those with the same network as the sidecar
 	// to the result. Also count the number of endpoints per each remote network while
@@ -65,6 +67,7 @@ func (b *EndpointBuilder) EndpointsByNetworkFilter(endpoints []*endpoint.Localit
 					Value: uint32(multiples),
 				}
 				lbEndpoints = append(lbEndpoints, clonedLbEp)
+				localEps++
 			} else {
 				if !b.canViewNetwork(epNetwork) {
 					continue
@@ -77,6 +80,7 @@ func (b *EndpointBuilder) EndpointsByNetworkFilter(endpoints []*endpoint.Localit
 				// Remote network endpoint which can not be accessed directly from local network.
 				// Increase the weight counter
 				remoteEps[epNetwork]++
+				gatewayEps++
 			}
 		}
 
@@ -117,12 +121,20 @@ func (b *EndpointBuilder) EndpointsByNetworkFilter(endpoints []*endpoint.Localit
 			}
 		}
 
+		// Skip localities without any endpoint reachable from the local network. Otherwise they would
+		// take up a priority once locality failover is applied, instead of failing over to another
+		// locality that can be reached directly or through a network gateway.
+		if len(lbEndpoints) == 0 {
+			continue
+		}
+
 		// Found endpoint(s) that can be accessed from local network
 		// and then build a new LocalityLbEndpoints with them.
 		newEp := createLocalityLbEndpoints(ep, lbEndpoints)
 		filtered = append(filtered, newEp)
 	}
 
+	recordNetworkFilterEndpoints(b.network, localEps, gatewayEps)
 	return filtered
 }
 
@@ -15,6 +15,7 @@
 package xds
 
 import (
+	"fmt"
 	"reflect"
 	"sort"
 	"testing"
@@ -23,13 +24,17 @@ import (
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	"go.opencensus.io/stats/view"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	memregistry "istio.io/istio/pilot/pkg/serviceregistry/memory"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/collections"
 )
 
@@ -563,6 +568,195 @@ func TestEndpointsByNetworkFilter_SkipLBWithHostname(t *testing.T) {
 	}
 }
 
+func TestEndpointsByNetworkFilter_LocalityFailover(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{
+		ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: failover
+  namespace: default
+spec:
+  host: failover.cluster.local
+  trafficPolicy:
+    outlierDetection:
+      interval: 1s
+      baseEjectionTime: 3m
+      maxEjectionPercent: 100
+`,
+		NetworksWatcher: mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+			Networks: map[string]*meshconfig.Network{
+				"network2": {
+					Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+						Gw:   &meshconfig.Network_IstioNetworkGateway_Address{Address: "2.2.2.2"},
+						Port: 15443,
+					}},
+				},
+			},
+		}),
+	})
+	s.MemRegistry.AddHTTPService("failover.cluster.local", "10.10.0.1", 80)
+	for _, ep := range []*model.IstioEndpoint{
+		{Address: "10.0.0.1", Network: "network1", Locality: model.Locality{Label: "region1/zone1/subzone1"}},
+		{Address: "20.0.0.1", Network: "network2", Locality: model.Locality{Label: "region2/zone2/subzone2"}},
+		// Plaintext endpoints can not be reached through the network2 gateway.
+		{Address: "20.0.0.2", Network: "network2", Locality: model.Locality{Label: "region3/zone3/subzone3"},
+			TLSMode: model.DisabledTLSModeLabel},
+	} {
+		ep.ServicePortName = "http-main"
+		ep.EndpointPort = 80
+		if ep.TLSMode == "" {
+			ep.TLSMode = model.IstioMutualTLSModeLabel
+		}
+		s.MemRegistry.AddInstance("failover.cluster.local", &model.ServiceInstance{
+			Endpoint:    ep,
+			ServicePort: &model.Port{Name: "http-main", Port: 80, Protocol: protocol.HTTP},
+		})
+	}
+	s.refreshPushContext()
+
+	proxy := s.SetupProxy(&model.Proxy{
+		Metadata: &model.NodeMetadata{Network: "network1"},
+		Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"},
+	})
+	cla := s.buildEndpoints("outbound|80||failover.cluster.local", proxy)
+
+	if len(cla.Endpoints) != 2 {
+		t.Fatalf("expected the unreachable locality to be dropped, got %d localities", len(cla.Endpoints))
+	}
+	got := map[string]uint32{}
+	for _, llb := range cla.Endpoints {
+		for _, lbEp := range llb.LbEndpoints {
+			got[lbEp.GetEndpoint().Address.GetSocketAddress().Address] = llb.Priority
+		}
+	}
+	expected := map[string]uint32{
+		// the local endpoint is preferred
+		"10.0.0.1": 0,
+		// on failure we fail over to the other region through the network2 gateway
+		"2.2.2.2": 1,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected endpoint priorities %v, got %v", expected, got)
+	}
+}
+
+func TestEndpointsByNetworkFilter_OptOut(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{
+		ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: anycast
+  namespace: default
+  annotations:
+    networking.istio.io/disableNetworkFilter: "true"
+spec:
+  host: anycast.cluster.local
+`,
+		NetworksWatcher: mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+			Networks: map[string]*meshconfig.Network{
+				"network2": {
+					Gateways: []*meshconfig.Network_IstioNetworkGateway{{
+						Gw:   &meshconfig.Network_IstioNetworkGateway_Address{Address: "2.2.2.2"},
+						Port: 15443,
+					}},
+				},
+			},
+		}),
+	})
+	for i, hostname := range []string{"filtered.cluster.local", "anycast.cluster.local", "exempt.cluster.local"} {
+		s.MemRegistry.AddHTTPService(hostname, fmt.Sprintf("10.10.0.%d", i+1), 80)
+		for _, ep := range []*model.IstioEndpoint{
+			{Address: "10.0.0.1", Network: "network1"},
+			{Address: "20.0.0.1", Network: "network2"},
+		} {
+			ep.ServicePortName = "http-main"
+			ep.EndpointPort = 80
+			ep.TLSMode = model.IstioMutualTLSModeLabel
+			s.MemRegistry.AddInstance(host.Name(hostname), &model.ServiceInstance{
+				Endpoint:    ep,
+				ServicePort: &model.Port{Name: "http-main", Port: 80, Protocol: protocol.HTTP},
+			})
+		}
+	}
+	s.refreshPushContext()
+
+	setFeatureForTest(t, &features.NetworkFilterExemptClusters, map[string]struct{}{"outbound|80||exempt.cluster.local": {}})
+
+	proxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{Network: "network1"}})
+	cases := []struct {
+		hostname string
+		expected []string
+	}{
+		// The endpoint of network2 is replaced by the gateway of network2.
+		{"filtered.cluster.local", []string{"10.0.0.1", "2.2.2.2"}},
+		// Clusters opted out of network filtering see all the endpoints.
+		{"anycast.cluster.local", []string{"10.0.0.1", "20.0.0.1"}},
+		{"exempt.cluster.local", []string{"10.0.0.1", "20.0.0.1"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got := loadAssignmentAddresses(s.buildEndpoints("outbound|80||"+tt.hostname, proxy))
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected endpoints %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsByNetworkFilterMetrics(t *testing.T) {
+	// Environment defines gateways for network1, network2 and network3, but not for network4.
+	// Test endpoints are 2 in network1, 1 in network2 and 1 in network4.
+	env := environment()
+	cases := []struct {
+		network string
+		local   float64
+		gateway float64
+	}{
+		// network1 and network4 endpoints are sent directly, the network2 endpoint is replaced by its gateway.
+		{"network1", 3, 1},
+		// network2 and network4 endpoints are sent directly, the network1 endpoints are replaced by its gateway.
+		{"network2", 2, 2},
+	}
+	for _, tt := range cases {
+		t.Run(tt.network, func(t *testing.T) {
+			localBefore := networkFilterEndpointsValue(t, tt.network, "local")
+			gatewayBefore := networkFilterEndpointsValue(t, tt.network, "gateway")
+			push := model.NewPushContext()
+			_ = push.InitContext(env, nil, nil)
+			b := NewEndpointBuilder("", xdsConnection(tt.network).proxy, push)
+			b.EndpointsByNetworkFilter(testEndpoints())
+			if got := networkFilterEndpointsValue(t, tt.network, "local") - localBefore; got != tt.local {
+				t.Errorf("expected %v local endpoints, got %v", tt.local, got)
+			}
+			if got := networkFilterEndpointsValue(t, tt.network, "gateway") - gatewayBefore; got != tt.gateway {
+				t.Errorf("expected %v endpoints replaced by gateways, got %v", tt.gateway, got)
+			}
+		})
+	}
+}
+
+// networkFilterEndpointsValue returns the current value of the pilot_eds_network_filter_endpoints metric.
+func networkFilterEndpointsValue(t *testing.T, network, typ string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData("pilot_eds_network_filter_endpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		tags := map[string]string{}
+		for _, tag := range row.Tags {
+			tags[tag.Key.Name()] = tag.Value
+		}
+		if tags["network"] == network && tags["type"] == typ {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
 func xdsConnection(network string) *Connection {
 	return &Connection{
 		proxy: &model.Proxy{
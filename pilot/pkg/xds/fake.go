@@ -17,6 +17,7 @@ package xds
 import (
 	"context"
 	"net"
+	"reflect"
 	"strings"
 	"time"
 
@@ -32,6 +33,7 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/plugin"
+	"istio.io/istio/pilot/pkg/networking/util"
 	kubesecrets "istio.io/istio/pilot/pkg/secrets/kube"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	kube "istio.io/istio/pilot/pkg/serviceregistry/kube/controller"
@@ -276,6 +278,16 @@ func (f *FakeDiscoveryServer) Endpoints(p *model.Proxy) []*endpoint.ClusterLoadA
 	return loadAssignments
 }
 
+// SetEndpointShardsForTest sets the endpoints of a shard of the service, creating the shard if needed. Unlike
+// EDSUpdate, the shard is set as is, including to an empty list, without any push, cache invalidation or
+// tracking of the service accounts, so tests can set up precise shard states. Only meant for tests.
+func (s *DiscoveryServer) SetEndpointShardsForTest(hostname, namespace, clusterID string, eps []*model.IstioEndpoint) {
+	ep, _ := s.getOrCreateEndpointShard(hostname, namespace)
+	ep.mutex.Lock()
+	defer ep.mutex.Unlock()
+	ep.Shards[clusterID] = eps
+}
+
 func (f *FakeDiscoveryServer) refreshPushContext() {
 	_, err := f.Discovery.initPushContext(&model.PushRequest{
 		Full:   true,
@@ -286,6 +298,65 @@ func (f *FakeDiscoveryServer) refreshPushContext() {
 	}
 }
 
+// addHTTPServices adds an HTTP service, with the http-main port 80 and no VIP, for each hostname, and refreshes
+// the push context so the endpoints of their clusters can be built.
+func (f *FakeDiscoveryServer) addHTTPServices(hostnames ...string) {
+	for _, hostname := range hostnames {
+		f.MemRegistry.AddHTTPService(hostname, "", 80)
+	}
+	f.refreshPushContext()
+}
+
+// buildEndpoints builds the load assignment of the cluster for the proxy with the current push context.
+func (f *FakeDiscoveryServer) buildEndpoints(clusterName string, proxy *model.Proxy) *endpoint.ClusterLoadAssignment {
+	return f.Discovery.generateEndpoints(NewEndpointBuilder(clusterName, proxy, f.PushContext()))
+}
+
+// testEndpoint returns an endpoint of the http-main port of the services added by addHTTPServices, in the
+// locality, in region/zone/subzone form.
+func testEndpoint(address, locality string) *model.IstioEndpoint {
+	return &model.IstioEndpoint{
+		Address:         address,
+		ServicePortName: "http-main",
+		EndpointPort:    80,
+		Locality:        model.Locality{Label: locality},
+	}
+}
+
+// localityWeights returns the weight of each locality of the load assignment, keyed by locality.
+func localityWeights(cla *endpoint.ClusterLoadAssignment) map[string]uint32 {
+	weights := map[string]uint32{}
+	for _, llb := range cla.GetEndpoints() {
+		weights[util.LocalityToString(llb.Locality)] = llb.GetLoadBalancingWeight().GetValue()
+	}
+	return weights
+}
+
+// loadAssignmentAddresses returns the addresses of the endpoints of the load assignment, in order.
+func loadAssignmentAddresses(cla *endpoint.ClusterLoadAssignment) []string {
+	addresses := []string{}
+	for _, llb := range cla.GetEndpoints() {
+		for _, lb := range llb.LbEndpoints {
+			addresses = append(addresses, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+		}
+	}
+	return addresses
+}
+
+// setFeatureForTest sets the feature, a pointer to one of the variables of the features package, to the value
+// for the duration of the test. A nil value sets the zero value of the feature.
+func setFeatureForTest(t test.Failer, feature interface{}, value interface{}) {
+	v := reflect.ValueOf(feature).Elem()
+	old := reflect.New(v.Type()).Elem()
+	old.Set(v)
+	t.Cleanup(func() { v.Set(old) })
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	v.Set(reflect.ValueOf(value))
+}
+
 func getKubernetesObjects(t test.Failer, opts FakeOptions) []runtime.Object {
 	if len(opts.KubernetesObjects) > 0 {
 		return opts.KubernetesObjects
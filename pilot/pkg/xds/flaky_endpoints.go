@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"time"
+
+	"k8s.io/utils/clock"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// flakyEndpointsEnabled returns true if endpoints with frequent readiness flips are deprioritized.
+func flakyEndpointsEnabled() bool {
+	return features.FlakyEndpointWindow > 0
+}
+
+func readinessFlipKey(clusterID, address string) string {
+	return clusterID + "/" + address
+}
+
+// recordReadinessFlips records a readiness flip for each endpoint added to or removed from the shard of
+// the cluster. Registries only report ready endpoints, so this tracks endpoints becoming ready or not
+// ready. Flips older than PILOT_FLAKY_ENDPOINT_WINDOW are dropped. Must be called with the mutex held.
+func (e *EndpointShards) recordReadinessFlips(clusterID string, previous, current []*model.IstioEndpoint) {
+	now := e.now()
+	if e.readinessFlips == nil {
+		e.readinessFlips = map[string][]time.Time{}
+	}
+	before := make(map[string]struct{}, len(previous))
+	for _, ep := range previous {
+		before[ep.Address] = struct{}{}
+	}
+	after := make(map[string]struct{}, len(current))
+	for _, ep := range current {
+		after[ep.Address] = struct{}{}
+		if _, f := before[ep.Address]; !f {
+			key := readinessFlipKey(clusterID, ep.Address)
+			e.readinessFlips[key] = append(e.readinessFlips[key], now)
+		}
+	}
+	for address := range before {
+		if _, f := after[address]; !f {
+			key := readinessFlipKey(clusterID, address)
+			e.readinessFlips[key] = append(e.readinessFlips[key], now)
+		}
+	}
+
+	cutoff := now.Add(-features.FlakyEndpointWindow)
+	for key, flips := range e.readinessFlips {
+		i := 0
+		for i < len(flips) && flips[i].Before(cutoff) {
+			i++
+		}
+		if i == len(flips) {
+			delete(e.readinessFlips, key)
+		} else {
+			e.readinessFlips[key] = flips[i:]
+		}
+	}
+}
+
+// isFlaky returns true if the endpoint flipped readiness at least PILOT_FLAKY_ENDPOINT_FLIPS times
+// within PILOT_FLAKY_ENDPOINT_WINDOW. Must be called with the mutex held.
+func (e *EndpointShards) isFlaky(clusterID, address string) bool {
+	flips := e.readinessFlips[readinessFlipKey(clusterID, address)]
+	if len(flips) < features.FlakyEndpointFlips {
+		return false
+	}
+	cutoff := e.now().Add(-features.FlakyEndpointWindow)
+	recent := 0
+	for _, flip := range flips {
+		if !flip.Before(cutoff) {
+			recent++
+		}
+	}
+	return recent >= features.FlakyEndpointFlips
+}
+
+func (e *EndpointShards) now() time.Time {
+	if e.clock == nil {
+		return clock.RealClock{}.Now()
+	}
+	return e.clock.Now()
+}
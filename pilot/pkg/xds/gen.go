@@ -16,11 +16,14 @@ package xds
 
 import (
 	"encoding/json"
+	"hash/fnv"
 	"time"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/ptypes/any"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/pkg/env"
@@ -108,19 +111,53 @@ func (s *DiscoveryServer) pushXds(con *Connection, push *model.PushContext,
 		}
 		return nil // No push needed.
 	}
+
+	var edsHash uint64
+	if w.TypeUrl == v3.EndpointType && features.SkipUnchangedEDSPushes {
+		edsHash = hashResources(cl)
+		// Full pushes may have updated clusters, which Envoy only finishes warming once it receives their endpoints.
+		if edsHash == con.edsHash && !req.Full {
+			// The proxy already has exactly these endpoints, avoid churning its config.
+			edsUnchangedPushes.Increment()
+			if s.StatusReporter != nil {
+				s.StatusReporter.RegisterEvent(con.ConID, w.TypeUrl, push.Version)
+			}
+			return nil
+		}
+	}
 	defer func() { recordPushTime(w.TypeUrl, time.Since(t0)) }()
 
-	resp := &discovery.DiscoveryResponse{
-		TypeUrl:     w.TypeUrl,
-		VersionInfo: currentVersion,
-		Nonce:       nonce(push.Version),
-		Resources:   cl,
+	chunks := [][]*any.Any{cl}
+	if w.TypeUrl == v3.EndpointType && features.EDSMaxResponseBytes > 0 {
+		// Unlike for CDS and LDS, EDS resources missing from a response are not removed by Envoy, so
+		// they can be sent in several responses. Each one has its own nonce: the proxy is in sync once it
+		// acks the last one.
+		chunks = chunkResources(cl, features.EDSMaxResponseBytes)
 	}
+	for _, chunk := range chunks {
+		resp := &discovery.DiscoveryResponse{
+			TypeUrl:     w.TypeUrl,
+			VersionInfo: currentVersion,
+			Nonce:       s.nextNonce(push.Version),
+			Resources:   chunk,
+		}
 
-	err := con.send(resp)
-	if err != nil {
-		recordSendError(w.TypeUrl, con.ConID, err)
-		return err
+		err := con.send(resp)
+		if err != nil {
+			recordSendError(w.TypeUrl, con.ConID, err)
+			if w.TypeUrl == v3.EndpointType {
+				con.edsStats.recordError(err)
+			}
+			return err
+		}
+	}
+	if len(chunks) > 1 {
+		adsLog.Debugf("EDS: PUSH for node:%s split in %d responses", con.proxy.ID, len(chunks))
+	}
+	if w.TypeUrl == v3.EndpointType {
+		con.edsHash = edsHash
+		con.edsStats.recordPush(cl, time.Now())
+		s.recordEndpointPropagation(con.proxy, push, w, req)
 	}
 
 	// Some types handle logs inside Generate, skip them here
@@ -129,3 +166,13 @@ func (s *DiscoveryServer) pushXds(con *Connection, push *model.PushContext,
 	}
 	return nil
 }
+
+// hashResources returns a content hash of the generated resources, in order.
+func hashResources(resources []*any.Any) uint64 {
+	h := fnv.New64a()
+	for _, r := range resources {
+		_, _ = h.Write([]byte(r.TypeUrl))
+		_, _ = h.Write(r.Value)
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,122 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"math"
+	"sort"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+const (
+	// flattenedPriorityRatio is the ratio of the traffic of a priority to the traffic of the priority below, once
+	// the priorities are flattened into weights.
+	flattenedPriorityRatio = 100
+	// flattenedWeightScale is the total weight of the endpoints once the priorities are flattened into weights,
+	// large enough for several priorities to keep a share of the traffic.
+	flattenedWeightScale = 1000000
+)
+
+// flattenLocalityPriorities turns the locality priorities of the load assignment into weights, for clients picking
+// endpoints at random by weight rather than by priority. All localities are moved to priority 0, and each priority
+// receives 1/flattenedPriorityRatio of the traffic of the priority above. Within a priority, the traffic is split by
+// locality weight, then by endpoint weight. The weight of each locality is the sum of the weights of its endpoints,
+// so the endpoint weights alone give the same distribution. Localities without endpoints are removed. The load
+// assignment is returned unchanged if all localities have the same priority.
+func flattenLocalityPriorities(l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	localities := make([]*endpoint.LocalityLbEndpoints, 0, len(l.Endpoints))
+	levels := map[uint32]float64{}
+	for _, locLbEps := range l.Endpoints {
+		if len(locLbEps.LbEndpoints) == 0 {
+			continue
+		}
+		localities = append(localities, locLbEps)
+		levels[locLbEps.Priority] += float64(localityWeight(locLbEps))
+	}
+	if len(levels) < 2 {
+		return l
+	}
+
+	// The share of the traffic of each priority, by rank of the priority.
+	priorities := make([]uint32, 0, len(levels))
+	for p := range levels {
+		priorities = append(priorities, p)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	shares := make(map[uint32]float64, len(priorities))
+	var total float64
+	for rank, p := range priorities {
+		shares[p] = math.Pow(flattenedPriorityRatio, -float64(rank))
+		total += shares[p]
+	}
+
+	out := &endpoint.ClusterLoadAssignment{
+		ClusterName: l.ClusterName,
+		Endpoints:   make([]*endpoint.LocalityLbEndpoints, 0, len(localities)),
+		Policy:      l.Policy,
+	}
+	for _, locLbEps := range localities {
+		share := shares[locLbEps.Priority] / total * float64(localityWeight(locLbEps)) / levels[locLbEps.Priority]
+		var epTotal float64
+		for _, lbEp := range locLbEps.LbEndpoints {
+			epTotal += float64(lbEndpointWeightOrDefault(lbEp))
+		}
+		flattened := &endpoint.LocalityLbEndpoints{
+			Locality:    locLbEps.Locality,
+			LbEndpoints: make([]*endpoint.LbEndpoint, 0, len(locLbEps.LbEndpoints)),
+		}
+		var sum uint32
+		for _, lbEp := range locLbEps.LbEndpoints {
+			weight := math.Round(share * float64(lbEndpointWeightOrDefault(lbEp)) / epTotal * flattenedWeightScale)
+			if weight < 1 {
+				// Weights must be at least 1.
+				weight = 1
+			}
+			// LbEndpoints may be shared with the cache, so the weight is set on a copy.
+			flattened.LbEndpoints = append(flattened.LbEndpoints, &endpoint.LbEndpoint{
+				HostIdentifier:      lbEp.HostIdentifier,
+				HealthStatus:        lbEp.HealthStatus,
+				Metadata:            lbEp.Metadata,
+				LoadBalancingWeight: &wrappers.UInt32Value{Value: uint32(weight)},
+			})
+			sum += uint32(weight)
+		}
+		flattened.LoadBalancingWeight = &wrappers.UInt32Value{Value: sum}
+		out.Endpoints = append(out.Endpoints, flattened)
+	}
+	return out
+}
+
+// localityWeight returns the weight of the locality, or the sum of the weights of its endpoints if it has none.
+func localityWeight(locLbEps *endpoint.LocalityLbEndpoints) uint32 {
+	if w := locLbEps.GetLoadBalancingWeight().GetValue(); w > 0 {
+		return w
+	}
+	var sum uint32
+	for _, lbEp := range locLbEps.LbEndpoints {
+		sum += lbEndpointWeightOrDefault(lbEp)
+	}
+	return sum
+}
+
+// lbEndpointWeightOrDefault returns the weight of the endpoint, 1 if it has none.
+func lbEndpointWeightOrDefault(lbEp *endpoint.LbEndpoint) uint32 {
+	if w := lbEp.GetLoadBalancingWeight().GetValue(); w > 0 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestFlattenLocalityPriorities(t *testing.T) {
+	lbEp := func(address string, weight uint32) *endpoint.LbEndpoint {
+		return &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{Address: util.BuildAddress(address, 80)},
+			},
+			LoadBalancingWeight: &wrappers.UInt32Value{Value: weight},
+		}
+	}
+	locality := func(zone string, priority, weight uint32, eps ...*endpoint.LbEndpoint) *endpoint.LocalityLbEndpoints {
+		return &endpoint.LocalityLbEndpoints{
+			Locality:            &core.Locality{Region: "region1", Zone: zone},
+			LbEndpoints:         eps,
+			LoadBalancingWeight: &wrappers.UInt32Value{Value: weight},
+			Priority:            priority,
+		}
+	}
+	weights := func(l *endpoint.ClusterLoadAssignment) map[string]uint32 {
+		got := map[string]uint32{}
+		for _, locLbEps := range l.Endpoints {
+			if locLbEps.Priority != 0 {
+				t.Fatalf("expected all localities at priority 0, got %d", locLbEps.Priority)
+			}
+			var sum uint32
+			for _, lbEp := range locLbEps.LbEndpoints {
+				got[lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] = lbEp.GetLoadBalancingWeight().GetValue()
+				sum += lbEp.GetLoadBalancingWeight().GetValue()
+			}
+			if locLbEps.GetLoadBalancingWeight().GetValue() != sum {
+				t.Fatalf("expected the locality weight to be the sum %d of its endpoint weights, got %d",
+					sum, locLbEps.GetLoadBalancingWeight().GetValue())
+			}
+		}
+		return got
+	}
+
+	shared := lbEp("10.0.0.1", 3)
+	l := &endpoint.ClusterLoadAssignment{
+		ClusterName: "outbound|80||grpc.example.com",
+		Endpoints: []*endpoint.LocalityLbEndpoints{
+			// Priority 0 receives 100/101 of the traffic, split 3:1 across localities, then by endpoint weight.
+			locality("zone1", 0, 30, shared, lbEp("10.0.0.2", 1)),
+			locality("zone2", 0, 10, lbEp("10.0.1.1", 1)),
+			// Priority 2 is the second priority, and receives 1/101 of the traffic.
+			locality("zone3", 2, 5, lbEp("10.0.2.1", 1)),
+			// Localities without endpoints are removed.
+			locality("zone4", 1, 5),
+		},
+	}
+	expected := map[string]uint32{
+		"10.0.0.1": 556931,
+		"10.0.0.2": 185644,
+		"10.0.1.1": 247525,
+		"10.0.2.1": 9901,
+	}
+	out := flattenLocalityPriorities(l)
+	if got := weights(out); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected weights %v, got %v", expected, got)
+	}
+	if len(out.Endpoints) != 3 {
+		t.Fatalf("expected the empty locality to be removed, got %d localities", len(out.Endpoints))
+	}
+	if shared.GetLoadBalancingWeight().GetValue() != 3 || l.Endpoints[2].Priority != 2 {
+		t.Fatalf("expected the original load assignment to be unchanged")
+	}
+
+	// Without several priorities there is nothing to flatten.
+	single := &endpoint.ClusterLoadAssignment{Endpoints: []*endpoint.LocalityLbEndpoints{
+		locality("zone1", 0, 1, lbEp("10.0.0.1", 1)),
+		locality("zone2", 0, 1, lbEp("10.0.1.1", 1)),
+	}}
+	if got := flattenLocalityPriorities(single); got != single {
+		t.Fatalf("expected the load assignment to be unchanged, got %v", got)
+	}
+}
+
+func TestGenerateEndpointsFlattenedPrioritiesGrpc(t *testing.T) {
+	setFeatureForTest(t, &features.GRPCFlattenLocalityPriorities, true)
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: failover
+  namespace: default
+spec:
+  host: grpc.example.com
+  trafficPolicy:
+    outlierDetection:
+      interval: 1s
+      baseEjectionTime: 3m
+      maxEjectionPercent: 100
+`})
+	s.addHTTPServices("grpc.example.com")
+	s.Discovery.EDSCacheUpdate("", "grpc.example.com", "", []*model.IstioEndpoint{
+		testEndpoint("10.0.0.1", "region1/zone1"),
+		testEndpoint("10.0.1.1", "region1/zone2"),
+		testEndpoint("10.0.2.1", "region2/zone1"),
+	})
+	locality := &core.Locality{Region: "region1", Zone: "zone1"}
+	weights := func(proxy *model.Proxy) (map[string]uint32, map[string]uint32) {
+		t.Helper()
+		cla := s.buildEndpoints("outbound|80||grpc.example.com", proxy)
+		weights, priorities := map[string]uint32{}, map[string]uint32{}
+		for _, locLbEps := range cla.Endpoints {
+			for _, lbEp := range locLbEps.LbEndpoints {
+				address := lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+				weights[address] = lbEp.GetLoadBalancingWeight().GetValue()
+				priorities[address] = locLbEps.Priority
+			}
+		}
+		return weights, priorities
+	}
+
+	// The local zone is preferred to the local region, itself preferred to other regions.
+	grpcProxy := s.SetupProxy(&model.Proxy{Metadata: &model.NodeMetadata{Generator: "grpc"}, Locality: locality})
+	gotWeights, gotPriorities := weights(grpcProxy)
+	expectedWeights := map[string]uint32{"10.0.0.1": 990001, "10.0.1.1": 9900, "10.0.2.1": 99}
+	if !reflect.DeepEqual(gotWeights, expectedWeights) {
+		t.Fatalf("expected gRPC weights %v, got %v", expectedWeights, gotWeights)
+	}
+	if expected := map[string]uint32{"10.0.0.1": 0, "10.0.1.1": 0, "10.0.2.1": 0}; !reflect.DeepEqual(gotPriorities, expected) {
+		t.Fatalf("expected gRPC priorities %v, got %v", expected, gotPriorities)
+	}
+
+	// Envoy proxies keep the priorities.
+	_, gotPriorities = weights(s.SetupProxy(&model.Proxy{Locality: locality}))
+	if expected := map[string]uint32{"10.0.0.1": 0, "10.0.1.1": 1, "10.0.2.1": 2}; !reflect.DeepEqual(gotPriorities, expected) {
+		t.Fatalf("expected Envoy priorities %v, got %v", expected, gotPriorities)
+	}
+}
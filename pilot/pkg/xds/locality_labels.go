@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"strings"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// normalizeEndpointLocalities parses the locality label of the endpoints into their region, zone and subzone,
+// which are then used as is when building the endpoints. Whitespace around the segments and trailing
+// delimiters are dropped from the label. Malformed labels, with more than three segments or an empty segment followed by a
+// non-empty one, are parsed as before, so the endpoints are not moved to another locality, but are counted
+// and logged so they can be fixed at the source. Endpoints with a region, zone or subzone already set are
+// left unchanged.
+func normalizeEndpointLocalities(hostname string, endpoints []*model.IstioEndpoint) {
+	malformed := 0
+	for _, ep := range endpoints {
+		l := &ep.Locality
+		if l.Label == "" || l.Region != "" || l.Zone != "" || l.SubZone != "" {
+			continue
+		}
+		segments := strings.Split(l.Label, features.LocalityLabelDelimiter)
+		for i := range segments {
+			segments[i] = strings.TrimSpace(segments[i])
+		}
+		for len(segments) > 0 && segments[len(segments)-1] == "" {
+			segments = segments[:len(segments)-1]
+		}
+		l.Label = strings.Join(segments, features.LocalityLabelDelimiter)
+		if !validLocalitySegments(segments) {
+			malformed++
+			adsLog.Debugf("Endpoint %s of service %s has a malformed locality label %q", ep.Address, hostname, l.Label)
+		}
+		for len(segments) < 3 {
+			segments = append(segments, "")
+		}
+		l.Region, l.Zone, l.SubZone = segments[0], segments[1], segments[2]
+	}
+	if malformed > 0 {
+		adsLog.Warnf("%d endpoints of service %s have a malformed locality label", malformed, hostname)
+	}
+	recordMalformedLocalities(malformed)
+}
+
+// validLocalitySegments returns true if there are at most three segments and none of them but the last
+// ones is empty.
+func validLocalitySegments(segments []string) bool {
+	if len(segments) > 3 {
+		return false
+	}
+	for _, s := range segments {
+		// Trailing empty segments were dropped, so any empty segment is followed by a non-empty one.
+		if s == "" {
+			return false
+		}
+	}
+	return true
+}
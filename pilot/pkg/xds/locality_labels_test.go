@@ -0,0 +1,67 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestNormalizeEndpointLocalities(t *testing.T) {
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("localities.example.com")
+
+	cases := []struct {
+		label     string
+		expected  model.Locality
+		malformed bool
+	}{
+		{"", model.Locality{}, false},
+		{"region1", model.Locality{Label: "region1", Region: "region1"}, false},
+		{"region1/zone1/subzone1", model.Locality{Label: "region1/zone1/subzone1", Region: "region1", Zone: "zone1", SubZone: "subzone1"}, false},
+		// Whitespace and trailing delimiters are corrected.
+		{" region1 / zone1 ", model.Locality{Label: "region1/zone1", Region: "region1", Zone: "zone1"}, false},
+		{"region1/zone1/", model.Locality{Label: "region1/zone1", Region: "region1", Zone: "zone1"}, false},
+		{"  ", model.Locality{}, false},
+		// Malformed labels are flagged, and parsed as before.
+		{"region1/zone1/subzone1/extra", model.Locality{
+			Label: "region1/zone1/subzone1/extra", Region: "region1", Zone: "zone1", SubZone: "subzone1"}, true},
+		{"region1//subzone1", model.Locality{Label: "region1//subzone1", Region: "region1", SubZone: "subzone1"}, true},
+		{"/zone1", model.Locality{Label: "/zone1", Zone: "zone1"}, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.label, func(t *testing.T) {
+			before := sumValue(t, "pilot_eds_malformed_locality_labels", "", "")
+			ep := testEndpoint("10.0.0.1", tt.label)
+			s.Discovery.EDSUpdate("", "localities.example.com", "", []*model.IstioEndpoint{ep})
+			if ep.Locality != tt.expected {
+				t.Fatalf("expected locality %+v, got %+v", tt.expected, ep.Locality)
+			}
+			malformed := sumValue(t, "pilot_eds_malformed_locality_labels", "", "") - before
+			if malformed != 0 != tt.malformed {
+				t.Fatalf("expected malformed %v, got %v malformed labels", tt.malformed, malformed)
+			}
+		})
+	}
+
+	// Localities provided as separate fields are used as is.
+	ep := testEndpoint("10.0.0.1", "ignored")
+	ep.Locality.Region, ep.Locality.Zone = "region1", "zone/1"
+	s.Discovery.EDSUpdate("", "localities.example.com", "", []*model.IstioEndpoint{ep})
+	if expected := (model.Locality{Label: "ignored", Region: "region1", Zone: "zone/1"}); ep.Locality != expected {
+		t.Fatalf("expected locality %+v, got %+v", expected, ep.Locality)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// localityLoadReport is the load last reported for a locality.
+type localityLoadReport struct {
+	load     float64
+	reported time.Time
+}
+
+// localityLoads holds the load last reported for each locality, keyed by locality in region/zone/subzone form.
+type localityLoads struct {
+	mutex   sync.RWMutex
+	reports map[string]localityLoadReport
+}
+
+func localityLoadFeedbackEnabled() bool {
+	return features.LocalityLoadFeedbackTTL > 0
+}
+
+// ReportLocalityLoad records the load of the locality, in region/zone/subzone form, and triggers an EDS push
+// so the weight of the locality is scaled inversely to it. The load is relative, 1 being the nominal load of
+// a locality: the weight of a locality reporting a load of 2 is halved, and localities without a recent
+// report keep their weight. Reports are only used if PILOT_LOCALITY_LOAD_FEEDBACK_TTL is set, and another
+// push is triggered once they expire.
+// Envoy only honors the weights of localities of clusters with locality weighted load balancing, which CDS
+// enables for clusters with outlier detection and locality load balancing, or with zone weights. The weights
+// of the other clusters are not scaled, and their load assignments stay cached, but each report still
+// triggers a push of all clusters. The load assignments of the scaled clusters are not cached while there
+// are recent reports.
+func (s *DiscoveryServer) ReportLocalityLoad(locality string, load float64) error {
+	if !localityLoadFeedbackEnabled() {
+		return fmt.Errorf("locality load feedback is disabled, set PILOT_LOCALITY_LOAD_FEEDBACK_TTL to enable it")
+	}
+	if load <= 0 || math.IsInf(load, 0) || math.IsNaN(load) {
+		return fmt.Errorf("invalid load %v for locality %q", load, locality)
+	}
+	l := &s.localityLoads
+	l.mutex.Lock()
+	if l.reports == nil {
+		l.reports = map[string]localityLoadReport{}
+	}
+	l.reports[locality] = localityLoadReport{load: load, reported: s.clock.Now()}
+	l.mutex.Unlock()
+
+	// A forced incremental push without ConfigsUpdated clears the EDS cache and pushes all clusters.
+	s.ConfigUpdate(&model.PushRequest{
+		Full:     false,
+		Reason:   []model.TriggerReason{model.EndpointUpdate},
+		ForceEds: true,
+	})
+	return nil
+}
+
+// current returns the loads reported within PILOT_LOCALITY_LOAD_FEEDBACK_TTL, keyed by locality, or nil if
+// there are none.
+func (l *localityLoads) current(now time.Time) map[string]float64 {
+	if !localityLoadFeedbackEnabled() {
+		return nil
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	var loads map[string]float64
+	for locality, report := range l.reports {
+		if now.Sub(report.reported) >= features.LocalityLoadFeedbackTTL {
+			continue
+		}
+		if loads == nil {
+			loads = map[string]float64{}
+		}
+		loads[locality] = report.load
+	}
+	return loads
+}
+
+// expire removes the reports older than PILOT_LOCALITY_LOAD_FEEDBACK_TTL, and returns whether there were any.
+func (l *localityLoads) expire(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	expired := false
+	for locality, report := range l.reports {
+		if now.Sub(report.reported) >= features.LocalityLoadFeedbackTTL {
+			delete(l.reports, locality)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// expireLocalityLoads removes the expired load reports, and triggers a push so the weights of their
+// localities are no longer scaled. It returns whether any report expired.
+func (s *DiscoveryServer) expireLocalityLoads() bool {
+	if !s.localityLoads.expire(s.clock.Now()) {
+		return false
+	}
+	s.ConfigUpdate(&model.PushRequest{
+		Full:     false,
+		Reason:   []model.TriggerReason{model.EndpointUpdate},
+		ForceEds: true,
+	})
+	return true
+}
+
+// periodicExpireLocalityLoads expires the load reports, checking them four times per ttl.
+func (s *DiscoveryServer) periodicExpireLocalityLoads(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(features.LocalityLoadFeedbackTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.expireLocalityLoads()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// localityLoadWeight scales the weight of a locality inversely to its reported load.
+func localityLoadWeight(weight uint32, load float64) uint32 {
+	if weight == 0 || load <= 0 || load == 1 {
+		return weight
+	}
+	scaled := math.Round(float64(weight) / load)
+	switch {
+	case scaled < 1:
+		// Envoy requires locality weights to be at least 1.
+		return 1
+	case scaled > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(scaled)
+}
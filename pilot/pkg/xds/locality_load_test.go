@@ -0,0 +1,164 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestLocalityLoadFeedback(t *testing.T) {
+	// Envoy only honors the weights of localities with outlier detection and locality load balancing.
+	s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: load
+  namespace: default
+spec:
+  host: load.example.com
+  trafficPolicy:
+    outlierDetection:
+      consecutive5xxErrors: 3
+    loadBalancer:
+      localityLbSetting:
+        enabled: true
+`})
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	s.Discovery.clock = fakeClock
+	s.addHTTPServices("load.example.com", "unweighted.example.com")
+	endpoint := func(address, locality string) *model.IstioEndpoint {
+		ep := testEndpoint(address, locality)
+		ep.LbWeight = 10
+		return ep
+	}
+	for _, hostname := range []string{"load.example.com", "unweighted.example.com"} {
+		s.Discovery.SetEndpointShardsForTest(hostname, "", "", []*model.IstioEndpoint{
+			endpoint("10.0.0.1", "region1/zone1"),
+			endpoint("10.0.0.2", "region1/zone1"),
+			endpoint("10.0.0.3", "region2/zone1"),
+			endpoint("10.0.0.4", "region2/zone1"),
+			endpoint("10.0.0.5", "region3/zone1"),
+		})
+	}
+	proxy := s.SetupProxy(nil)
+	clusterWeights := func(clusterName string) map[string]uint32 {
+		t.Helper()
+		return localityWeights(s.buildEndpoints(clusterName, proxy))
+	}
+	weights := func() map[string]uint32 {
+		t.Helper()
+		return clusterWeights("outbound|80||load.example.com")
+	}
+
+	// Load feedback is disabled by default.
+	if err := s.Discovery.ReportLocalityLoad("region1/zone1", 2); err == nil {
+		t.Fatal("expected load reports to be rejected while load feedback is disabled")
+	}
+
+	setFeatureForTest(t, &features.LocalityLoadFeedbackTTL, time.Minute)
+
+	unscaled := map[string]uint32{"region1/zone1": 20, "region2/zone1": 20, "region3/zone1": 10}
+	if got := weights(); !reflect.DeepEqual(got, unscaled) {
+		t.Fatalf("expected weights %v without load reports, got %v", unscaled, got)
+	}
+
+	for _, load := range []float64{0, -1} {
+		if err := s.Discovery.ReportLocalityLoad("region1/zone1", load); err == nil {
+			t.Fatalf("expected the invalid load %v to be rejected", load)
+		}
+	}
+	if err := s.Discovery.ReportLocalityLoad("region1/zone1", 2); err != nil {
+		t.Fatal(err)
+	}
+	fakeClock.Step(30 * time.Second)
+	if err := s.Discovery.ReportLocalityLoad("region2/zone1", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	// The weights of the reporting localities are scaled inversely to their load, other localities are unchanged.
+	want := map[string]uint32{"region1/zone1": 10, "region2/zone1": 40, "region3/zone1": 10}
+	if got := weights(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected weights %v after load reports, got %v", want, got)
+	}
+
+	// A new report replaces the previous one.
+	if err := s.Discovery.ReportLocalityLoad("region2/zone1", 4); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]uint32{"region1/zone1": 10, "region2/zone1": 5, "region3/zone1": 10}
+	if got := weights(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected weights %v after a new load report, got %v", want, got)
+	}
+
+	cacheable := func(clusterName string) bool {
+		b := NewEndpointBuilder(clusterName, proxy, s.PushContext())
+		b.localityLoads = s.Discovery.localityLoads.current(fakeClock.Now())
+		return b.Cacheable()
+	}
+	if cacheable("outbound|80||load.example.com") {
+		t.Fatal("expected the load assignments not to be cached while there are load reports")
+	}
+
+	// The weights of clusters without locality weighted load balancing are left alone, and stay cached.
+	if got := clusterWeights("outbound|80||unweighted.example.com"); !reflect.DeepEqual(got, unscaled) {
+		t.Fatalf("expected weights %v for a cluster without locality weights, got %v", unscaled, got)
+	}
+	if !cacheable("outbound|80||unweighted.example.com") {
+		t.Fatal("expected the load assignments of a cluster without locality weights to be cached")
+	}
+
+	// Reports older than the ttl are ignored, and trigger a push once expired.
+	fakeClock.Step(30 * time.Second)
+	want = map[string]uint32{"region1/zone1": 20, "region2/zone1": 5, "region3/zone1": 10}
+	if got := weights(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected weights %v after a load report expired, got %v", want, got)
+	}
+	if !s.Discovery.expireLocalityLoads() {
+		t.Fatal("expected the expired load report to trigger a push")
+	}
+	if s.Discovery.expireLocalityLoads() {
+		t.Fatal("expected no push without newly expired load reports")
+	}
+	fakeClock.Step(30 * time.Second)
+	if !s.Discovery.expireLocalityLoads() || !cacheable("outbound|80||load.example.com") {
+		t.Fatal("expected the load assignments to be cached again once all the load reports expired")
+	}
+}
+
+func TestLocalityLoadWeight(t *testing.T) {
+	cases := []struct {
+		weight uint32
+		load   float64
+		want   uint32
+	}{
+		{weight: 10, load: 1, want: 10},
+		{weight: 10, load: 2, want: 5},
+		{weight: 10, load: 0.25, want: 40},
+		// Weights are at least 1.
+		{weight: 1, load: 100, want: 1},
+		{weight: 0, load: 2, want: 0},
+	}
+	for _, tt := range cases {
+		if got := localityLoadWeight(tt.weight, tt.load); got != tt.want {
+			t.Errorf("localityLoadWeight(%d, %v): expected %d, got %d", tt.weight, tt.load, tt.want, got)
+		}
+	}
+}
@@ -14,6 +14,7 @@
 package xds
 
 import (
+	"strconv"
 	"sync"
 	"time"
 
@@ -30,6 +31,13 @@ var (
 	nodeTag    = monitoring.MustCreateLabel("node")
 	typeTag    = monitoring.MustCreateLabel("type")
 	versionTag = monitoring.MustCreateLabel("version")
+	rankTag    = monitoring.MustCreateLabel("rank")
+	subsetTag  = monitoring.MustCreateLabel("subset")
+	networkTag = monitoring.MustCreateLabel("network")
+	serviceTag = monitoring.MustCreateLabel("service")
+	kindTag    = monitoring.MustCreateLabel("kind")
+
+	clusterLocalTag = monitoring.MustCreateLabel("cluster_local")
 
 	cdsReject = monitoring.NewGauge(
 		"pilot_xds_cds_reject",
@@ -111,6 +119,51 @@ var (
 		[]float64{.1, 1, 3, 5, 10, 20, 30},
 	)
 
+	// only supported dimension is millis, unfortunately. default to unitdimensionless.
+	edsEndpointPropagationTime = monitoring.NewDistribution(
+		"pilot_eds_endpoint_propagation_time",
+		"Time in seconds between an endpoint first being seen and it being sent in an EDS response.",
+		[]float64{.01, .1, .5, 1, 3, 5, 10, 20, 30},
+	)
+
+	edsRejectedUpdates = monitoring.NewSum(
+		"pilot_eds_rejected_updates",
+		"Number of endpoint updates rejected as they would drop the endpoints of the service below its minimum.",
+		monitoring.WithLabels(serviceTag),
+	)
+
+	// EDS updates are split by whether they only changed endpoints, or also changed service level metadata
+	// (new service, service accounts) which requires a full push. Updates deferred while EDS pushes are paused
+	// are counted when deferred, and again with their kind once applied.
+	edsUpdateKinds = monitoring.NewSum(
+		"pilot_eds_update_kind",
+		"Total number of endpoint shard updates, labeled by kind: service, endpoints, deferred or rejected.",
+		monitoring.WithLabels(kindTag),
+	)
+
+	edsServiceUpdates      = edsUpdateKinds.With(kindTag.Value("service"))
+	edsEndpointOnlyUpdates = edsUpdateKinds.With(kindTag.Value("endpoints"))
+	edsDeferredUpdates     = edsUpdateKinds.With(kindTag.Value("deferred"))
+	edsRejectedKindUpdates = edsUpdateKinds.With(kindTag.Value("rejected"))
+
+	edsPushLoopBackoffs = monitoring.NewSum(
+		"pilot_eds_push_loop_backoffs",
+		"Number of times the pushes triggered by endpoint updates of a service were backed off, as the service "+
+			"was pushed at an abnormally high rate, possibly in a push loop.",
+	)
+
+	edsPortNameFallbacks = monitoring.NewSum(
+		"pilot_eds_port_name_fallbacks",
+		"Number of endpoints without a service port name matched to the only port of their service, while "+
+			"building the endpoints of clusters.",
+	)
+
+	edsMalformedLocalities = monitoring.NewSum(
+		"pilot_eds_malformed_locality_labels",
+		"Number of endpoints received with a malformed locality label, such as one with more than three "+
+			"segments or an empty region or zone followed by a zone or subzone.",
+	)
+
 	pushTriggers = monitoring.NewSum(
 		"pilot_push_triggers",
 		"Total number of times a push was triggered, labeled by reason for the push.",
@@ -134,6 +187,47 @@ var (
 		"Total number of internal XDS errors in pilot.",
 	)
 
+	edsNoOpPushes = monitoring.NewSum(
+		"pilot_eds_no_op_pushes_avoided",
+		"Total number of incremental EDS pushes skipped because no watched services were updated.",
+	)
+
+	edsUnchangedPushes = monitoring.NewSum(
+		"pilot_eds_unchanged_pushes_skipped",
+		"Total number of EDS pushes skipped because the generated endpoints were identical to the last ones sent.",
+	)
+
+	edsServiceAccountPushesCoalesced = monitoring.NewSum(
+		"pilot_eds_service_account_pushes_coalesced",
+		"Total number of full pushes triggered by service account changes which were coalesced into a later one.",
+	)
+
+	edsLocalityFailover = monitoring.NewSum(
+		"pilot_eds_locality_failover",
+		"Total number of EDS cluster load assignments generated with locality failover priorities, by subset.",
+		monitoring.WithLabels(subsetTag),
+	)
+
+	edsNetworkFilterEndpoints = monitoring.NewSum(
+		"pilot_eds_network_filter_endpoints",
+		"Total number of endpoints sent directly (type=local) or replaced by network gateways (type=gateway) "+
+			"by split horizon EDS, by network of the proxy.",
+		monitoring.WithLabels(networkTag, typeTag),
+	)
+
+	edsClusterLocalFilteredEndpoints = monitoring.NewSum(
+		"pilot_eds_cluster_local_filtered_endpoints",
+		"Total number of endpoints of other clusters left out of EDS because they are cluster-local, "+
+			"by whether the whole service (cluster_local=true) or only the endpoint is cluster-local.",
+		monitoring.WithLabels(clusterLocalTag),
+	)
+
+	topServiceEndpoints = monitoring.NewGauge(
+		"pilot_top_service_endpoints",
+		"Number of endpoints of the services with the most endpoints, by rank.",
+		monitoring.WithLabels(rankTag),
+	)
+
 	inboundUpdates = monitoring.NewSum(
 		"pilot_inbound_updates",
 		"Total number of updates received by pilot.",
@@ -153,6 +247,59 @@ func recordXDSClients(version string, delta float64) {
 	xdsClients.With(versionTag.Value(version)).Record(xdsClientTracker[version])
 }
 
+// recordEDSUpdateKind records whether an EDS update changed only endpoints, or the service metadata as well.
+func recordEDSUpdateKind(fullPush bool) {
+	if fullPush {
+		edsServiceUpdates.Increment()
+	} else {
+		edsEndpointOnlyUpdates.Increment()
+	}
+}
+
+func recordLocalityFailover(subset string) {
+	edsLocalityFailover.With(subsetTag.Value(subset)).Increment()
+}
+
+func recordRejectedEndpointUpdate(service string) {
+	edsRejectedKindUpdates.Increment()
+	edsRejectedUpdates.With(serviceTag.Value(service)).Increment()
+}
+
+func recordPushLoopBackoff() {
+	edsPushLoopBackoffs.Increment()
+}
+
+func recordPortNameFallbacks(endpoints int) {
+	if endpoints > 0 {
+		edsPortNameFallbacks.Record(float64(endpoints))
+	}
+}
+
+func recordMalformedLocalities(malformed int) {
+	if malformed > 0 {
+		edsMalformedLocalities.Record(float64(malformed))
+	}
+}
+
+func recordNetworkFilterEndpoints(network string, local, gateway int) {
+	if local > 0 {
+		edsNetworkFilterEndpoints.With(networkTag.Value(network), typeTag.Value("local")).Record(float64(local))
+	}
+	if gateway > 0 {
+		edsNetworkFilterEndpoints.With(networkTag.Value(network), typeTag.Value("gateway")).Record(float64(gateway))
+	}
+}
+
+func recordClusterLocalFilteredEndpoints(clusterLocal bool, filtered int) {
+	if filtered > 0 {
+		edsClusterLocalFilteredEndpoints.With(clusterLocalTag.Value(strconv.FormatBool(clusterLocal))).Record(float64(filtered))
+	}
+}
+
+func recordTopServiceEndpoints(rank int, endpoints int) {
+	topServiceEndpoints.With(rankTag.Value(strconv.Itoa(rank))).Record(float64(endpoints))
+}
+
 func recordPushTriggers(reasons ...model.TriggerReason) {
 	for _, r := range reasons {
 		pushTriggers.With(typeTag.Value(string(r))).Increment()
@@ -215,8 +362,21 @@ func init() {
 		pushTime,
 		proxiesConvergeDelay,
 		proxiesQueueTime,
+		edsEndpointPropagationTime,
 		pushContextErrors,
 		totalXDSInternalErrors,
+		edsNoOpPushes,
+		edsUnchangedPushes,
+		edsServiceAccountPushesCoalesced,
+		topServiceEndpoints,
+		edsLocalityFailover,
+		edsNetworkFilterEndpoints,
+		edsClusterLocalFilteredEndpoints,
+		edsRejectedUpdates,
+		edsUpdateKinds,
+		edsPushLoopBackoffs,
+		edsPortNameFallbacks,
+		edsMalformedLocalities,
 		inboundUpdates,
 		pushTriggers,
 	)
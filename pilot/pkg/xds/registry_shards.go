@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// ReplaceRegistryShards replaces all the endpoint shards of the cluster with the endpoints of a full resync of
+// its registry, in a single operation, so the endpoints are never built from the shards of some services
+// updated and others not. Services missing from the resync have the shard of the cluster removed. A single
+// push is then triggered for all the services, full if a service is new or its service accounts changed.
+// The update of each service goes through the same checks as in EDSUpdate: updates of services in terminating
+// namespaces not removing endpoints are skipped, updates are deferred while EDS pushes are paused, stale
+// endpoints are retained during a resync, updates dropping the endpoints below their minimum are rejected,
+// and services in a push loop are not pushed until their backoff ends.
+func (s *DiscoveryServer) ReplaceRegistryShards(clusterID string, endpointsByService map[ServiceRef][]*model.IstioEndpoint) {
+	inboundEDSUpdates.Increment()
+	// The replacement is newer than the updates of the cluster deferred while EDS pushes are paused.
+	s.discardDeferredEdsUpdates(func(k deferredEdsKey) bool { return k.clusterID == clusterID })
+
+	updates := make(map[ServiceRef][]*model.IstioEndpoint, len(endpointsByService))
+	for svc, istioEndpoints := range endpointsByService {
+		updates[svc] = istioEndpoints
+	}
+	s.mutex.RLock()
+	for hostname, byNamespace := range s.EndpointShardsByService {
+		for namespace, ep := range byNamespace {
+			svc := ServiceRef{Hostname: hostname, Namespace: namespace}
+			if _, f := updates[svc]; f {
+				continue
+			}
+			ep.mutex.RLock()
+			_, f := ep.Shards[clusterID]
+			ep.mutex.RUnlock()
+			if f {
+				updates[svc] = nil
+			}
+		}
+	}
+	s.mutex.RUnlock()
+
+	resyncing := s.endpointResyncing(clusterID)
+	for svc, istioEndpoints := range updates {
+		if s.skipTerminatingUpdate(clusterID, svc.Hostname, svc.Namespace, istioEndpoints) {
+			adsLog.Debugf("Skipping EDS update of service %s in terminating namespace %s", svc.Hostname, svc.Namespace)
+			delete(updates, svc)
+			continue
+		}
+		if s.deferEdsUpdate(clusterID, svc.Hostname, svc.Namespace, istioEndpoints) {
+			edsDeferredUpdates.Increment()
+			delete(updates, svc)
+			continue
+		}
+		if resyncing {
+			// Endpoints missing from the update are kept serving until the resync confirms they are gone.
+			istioEndpoints = s.retainStaleEndpoints(clusterID, svc.Hostname, svc.Namespace, istioEndpoints)
+			updates[svc] = istioEndpoints
+		}
+		if s.belowMinEndpoints(clusterID, svc.Hostname, svc.Namespace, istioEndpoints) {
+			adsLog.Warnf("Rejecting update of service %s/%s in cluster %s: it would drop the endpoints below %d",
+				svc.Namespace, svc.Hostname, clusterID, features.MinEndpointsPerService[svc.Hostname])
+			recordRejectedEndpointUpdate(svc.Hostname)
+			delete(updates, svc)
+		}
+	}
+
+	// full holds whether the update of each service needs a full push.
+	full := make(map[ServiceRef]bool, len(updates))
+	var audit []*EndpointAuditRecord
+	s.mutex.Lock()
+	for svc, istioEndpoints := range updates {
+		if len(istioEndpoints) == 0 {
+			audit = append(audit, s.deleteEndpointShardsLocked(clusterID, svc.Hostname, svc.Namespace))
+			recordEDSUpdateKind(false)
+			full[svc] = false
+			continue
+		}
+		normalizeEndpointLocalities(svc.Hostname, istioEndpoints)
+		ep, created := s.getOrCreateEndpointShardLocked(svc.Hostname, svc.Namespace)
+		if created {
+			adsLog.Infof("Full push, new service %s", svc.Hostname)
+		}
+		serviceUpdated := s.updateEndpointShard(ep, created, clusterID, svc.Hostname, svc.Namespace, istioEndpoints, &audit)
+		recordEDSUpdateKind(created || serviceUpdated)
+		full[svc] = created || serviceUpdated
+		s.updateEmptyService(svc.Hostname, svc.Namespace)
+	}
+	s.mutex.Unlock()
+
+	s.auditEndpoints(audit)
+	if len(full) > 0 {
+		adsLog.Infof("Replaced the endpoint shards of %d services of cluster %s", len(full), clusterID)
+	}
+	fullPush := false
+	updated := map[model.ConfigKey]struct{}{}
+	for svc, fp := range full {
+		if !s.edsPushAllowed(svc.Hostname, svc.Namespace, fp) {
+			continue
+		}
+		updated[model.ConfigKey{Kind: gvk.ServiceEntry, Name: svc.Hostname, Namespace: svc.Namespace}] = struct{}{}
+		fullPush = fullPush || fp
+	}
+	if len(updated) == 0 {
+		return
+	}
+	req := &model.PushRequest{
+		Full:           fullPush,
+		ConfigsUpdated: updated,
+		Reason:         []model.TriggerReason{model.EndpointUpdate},
+	}
+	s.notifyEdsPushObservers(req)
+	s.ConfigUpdate(req)
+}
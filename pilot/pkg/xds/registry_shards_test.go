@@ -0,0 +1,188 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+func shardAddresses(s *DiscoveryServer, hostname, namespace, clusterID string) []string {
+	ep := s.EndpointShardsByService[hostname][namespace]
+	if ep == nil {
+		return nil
+	}
+	ep.mutex.RLock()
+	defer ep.mutex.RUnlock()
+	eps, f := ep.Shards[clusterID]
+	if !f {
+		return nil
+	}
+	addresses := []string{}
+	for _, e := range eps {
+		addresses = append(addresses, e.Address)
+	}
+	return addresses
+}
+
+func TestReplaceRegistryShards(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	s.EDSUpdate("cluster1", "b.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}})
+	s.EDSUpdate("cluster2", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.1.0.1"}})
+	for len(s.pushChannel) > 0 {
+		<-s.pushChannel
+	}
+
+	s.ReplaceRegistryShards("cluster1", map[ServiceRef][]*model.IstioEndpoint{
+		{Hostname: "a.example.com", Namespace: "ns1"}: {{Address: "10.0.0.3"}},
+		{Hostname: "c.example.com", Namespace: "ns1"}: {{Address: "10.0.0.4"}},
+	})
+
+	cases := []struct {
+		hostname, clusterID string
+		want                []string
+	}{
+		{"a.example.com", "cluster1", []string{"10.0.0.3"}},
+		{"a.example.com", "cluster2", []string{"10.1.0.1"}},
+		{"b.example.com", "cluster1", nil},
+		{"c.example.com", "cluster1", []string{"10.0.0.4"}},
+	}
+	for _, tt := range cases {
+		if got := shardAddresses(s, tt.hostname, "ns1", tt.clusterID); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("expected shard %s of %s to have endpoints %v, got %v", tt.clusterID, tt.hostname, tt.want, got)
+		}
+	}
+
+	if len(s.pushChannel) != 1 {
+		t.Fatalf("expected a single push, got %d", len(s.pushChannel))
+	}
+	req := <-s.pushChannel
+	if !req.Full {
+		t.Errorf("expected a full push for the new service")
+	}
+	for _, hostname := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		if _, f := req.ConfigsUpdated[model.ConfigKey{Kind: gvk.ServiceEntry, Name: hostname, Namespace: "ns1"}]; !f {
+			t.Errorf("expected the push to update %s, got %v", hostname, req.ConfigsUpdated)
+		}
+	}
+}
+
+func TestReplaceRegistryShardsChecks(t *testing.T) {
+	setFeatureForTest(t, &features.MinEndpointsPerService, map[string]int{"min.example.com": 1})
+
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	s.EDSUpdate("cluster1", "a.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	s.EDSUpdate("cluster1", "min.example.com", "ns1", []*model.IstioEndpoint{{Address: "10.0.0.2"}})
+	for len(s.pushChannel) > 0 {
+		<-s.pushChannel
+	}
+
+	// While EDS pushes are paused, the replacement is deferred, including the removal of missing services.
+	s.PauseEds()
+	s.ReplaceRegistryShards("cluster1", map[ServiceRef][]*model.IstioEndpoint{
+		{Hostname: "b.example.com", Namespace: "ns1"}: {{Address: "10.0.0.3"}},
+	})
+	if len(s.pushChannel) != 0 {
+		t.Fatalf("expected no push while EDS pushes are paused, got %d", len(s.pushChannel))
+	}
+	if got := shardAddresses(s, "a.example.com", "ns1", "cluster1"); fmt.Sprint(got) != "[10.0.0.1]" {
+		t.Fatalf("expected the shard of a.example.com to be kept while paused, got %v", got)
+	}
+	s.ResumeEds()
+
+	cases := []struct {
+		hostname string
+		want     []string
+	}{
+		{"a.example.com", nil},
+		{"b.example.com", []string{"10.0.0.3"}},
+		// The removal would drop the endpoints below the minimum of the service.
+		{"min.example.com", []string{"10.0.0.2"}},
+	}
+	for _, tt := range cases {
+		if got := shardAddresses(s, tt.hostname, "ns1", "cluster1"); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("expected shard of %s to have endpoints %v, got %v", tt.hostname, tt.want, got)
+		}
+	}
+	if len(s.pushChannel) != 1 {
+		t.Fatalf("expected a single push on resume, got %d", len(s.pushChannel))
+	}
+	<-s.pushChannel
+
+	s.ReplaceRegistryShards("cluster1", nil)
+	if got := shardAddresses(s, "min.example.com", "ns1", "cluster1"); fmt.Sprint(got) != "[10.0.0.2]" {
+		t.Fatalf("expected the shard of min.example.com to be kept, got %v", got)
+	}
+	if got := shardAddresses(s, "b.example.com", "ns1", "cluster1"); got != nil {
+		t.Fatalf("expected the shard of b.example.com to be removed, got %v", got)
+	}
+}
+
+func TestReplaceRegistryShardsAtomic(t *testing.T) {
+	s := &DiscoveryServer{
+		EndpointShardsByService: map[string]map[string]*EndpointShards{},
+		pushChannel:             make(chan *model.PushRequest, 10),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-s.pushChannel:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	generation := func(i int) map[ServiceRef][]*model.IstioEndpoint {
+		return map[ServiceRef][]*model.IstioEndpoint{
+			{Hostname: "a.example.com", Namespace: "ns1"}: {{Address: fmt.Sprintf("10.0.%d.1", i)}},
+			{Hostname: "b.example.com", Namespace: "ns1"}: {{Address: fmt.Sprintf("10.0.%d.2", i)}},
+		}
+	}
+	s.ReplaceRegistryShards("cluster1", generation(0))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			s.ReplaceRegistryShards("cluster1", generation(i%2))
+		}
+	}()
+	// Readers holding the lock never see the services from different resyncs.
+	for i := 0; i < 1000; i++ {
+		s.mutex.RLock()
+		a := shardAddresses(s, "a.example.com", "ns1", "cluster1")
+		b := shardAddresses(s, "b.example.com", "ns1", "cluster1")
+		s.mutex.RUnlock()
+		if len(a) != 1 || len(b) != 1 || a[0][:7] != b[0][:7] {
+			t.Fatalf("expected endpoints of the same resync, got %v and %v", a, b)
+		}
+	}
+	wg.Wait()
+}
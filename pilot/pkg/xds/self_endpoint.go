@@ -0,0 +1,83 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	pstruct "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+const (
+	// selfEndpointMetadataKey is the field of the istio filter metadata marking the synthetic endpoint.
+	selfEndpointMetadataKey = "synthetic"
+	// selfEndpointMetadataValue is the value of selfEndpointMetadataKey for the proxy's own endpoint.
+	selfEndpointMetadataValue = "self"
+	// selfEndpointFallbackAddress is used if the proxy has no IP address.
+	selfEndpointFallbackAddress = "127.0.0.1"
+)
+
+// shouldAddSelfEndpoint returns whether a synthetic endpoint of the proxy itself is added to the cluster.
+func shouldAddSelfEndpoint(clusterName string) bool {
+	_, f := features.SelfEndpointClusters[clusterName]
+	return f
+}
+
+// addSelfEndpoint adds a synthetic endpoint pointing at the proxy itself to the cluster, in the locality of
+// the proxy. The port is the one of the proxy's own instance of the service, if any, or the service port.
+// The cluster load assignment is returned, cloned as it is specific to the proxy.
+func addSelfEndpoint(b EndpointBuilder, l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	if b.proxy == nil {
+		return l
+	}
+	address := selfEndpointFallbackAddress
+	if len(b.proxy.IPAddresses) > 0 {
+		address = b.proxy.IPAddresses[0]
+	}
+	port := uint32(b.port)
+	for _, si := range b.proxy.ServiceInstances {
+		if si.Service.Hostname == b.hostname && si.ServicePort.Port == b.port {
+			port = si.Endpoint.EndpointPort
+			break
+		}
+	}
+
+	ep := &endpoint.LbEndpoint{
+		LoadBalancingWeight: &wrappers.UInt32Value{Value: 1},
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: util.BuildAddress(address, port),
+			},
+		},
+		Metadata: util.BuildLbEndpointMetadata(b.network, ""),
+	}
+	istio := ep.Metadata.FilterMetadata[util.IstioMetadataKey]
+	if istio == nil {
+		istio = &pstruct.Struct{Fields: map[string]*pstruct.Value{}}
+		ep.Metadata.FilterMetadata[util.IstioMetadataKey] = istio
+	}
+	istio.Fields[selfEndpointMetadataKey] = &pstruct.Value{Kind: &pstruct.Value_StringValue{StringValue: selfEndpointMetadataValue}}
+
+	l = util.CloneClusterLoadAssignment(l)
+	l.Endpoints = append(l.Endpoints, &endpoint.LocalityLbEndpoints{
+		Locality:            b.locality,
+		LbEndpoints:         []*endpoint.LbEndpoint{ep},
+		LoadBalancingWeight: &wrappers.UInt32Value{Value: 1},
+	})
+	return l
+}
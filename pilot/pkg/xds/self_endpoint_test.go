@@ -0,0 +1,78 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestSelfEndpoint(t *testing.T) {
+	selfCluster := "outbound|80||self.example.com"
+	otherCluster := "outbound|80||other.example.com"
+	setFeatureForTest(t, &features.SelfEndpointClusters, map[string]struct{}{selfCluster: {}})
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("self.example.com", "other.example.com")
+	for _, hostname := range []string{"self.example.com", "other.example.com"} {
+		s.Discovery.EDSCacheUpdate("cluster1", hostname, "", []*model.IstioEndpoint{testEndpoint("10.0.0.1", "")})
+	}
+	proxy := s.SetupProxy(&model.Proxy{
+		IPAddresses: []string{"10.0.0.9"},
+		Locality:    &core.Locality{Region: "region1"},
+	})
+
+	selfEndpoints := func(cla *endpoint.ClusterLoadAssignment) []*endpoint.LbEndpoint {
+		var out []*endpoint.LbEndpoint
+		for _, locLbEps := range cla.Endpoints {
+			for _, lbEp := range locLbEps.LbEndpoints {
+				istio := lbEp.GetMetadata().GetFilterMetadata()[util.IstioMetadataKey]
+				if istio.GetFields()[selfEndpointMetadataKey].GetStringValue() == selfEndpointMetadataValue {
+					out = append(out, lbEp)
+				}
+			}
+		}
+		return out
+	}
+
+	b := NewEndpointBuilder(selfCluster, proxy, s.PushContext())
+	if b.Cacheable() {
+		t.Fatalf("expected clusters with a self endpoint not to be cacheable")
+	}
+	cla := s.Discovery.generateEndpoints(b)
+	self := selfEndpoints(cla)
+	if len(self) != 1 {
+		t.Fatalf("expected 1 self endpoint, got %v", cla.Endpoints)
+	}
+	if addr := self[0].GetEndpoint().GetAddress().GetSocketAddress(); addr.GetAddress() != "10.0.0.9" || addr.GetPortValue() != 80 {
+		t.Fatalf("expected self endpoint at 10.0.0.9:80, got %v", addr)
+	}
+	if got := cla.Endpoints[len(cla.Endpoints)-1].Locality.GetRegion(); got != "region1" {
+		t.Fatalf("expected self endpoint in the locality of the proxy, got %q", got)
+	}
+	if len(cla.Endpoints) != 2 || len(cla.Endpoints[0].LbEndpoints) != 1 {
+		t.Fatalf("expected the endpoints of the service to be kept, got %v", cla.Endpoints)
+	}
+
+	if cla := s.buildEndpoints(otherCluster, proxy); len(selfEndpoints(cla)) != 0 {
+		t.Fatalf("expected no self endpoint for unconfigured cluster, got %v", cla.Endpoints)
+	}
+}
@@ -16,6 +16,9 @@ package xds
 
 import (
 	networkingapi "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	networking "istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pkg/config/labels"
 )
 
@@ -41,3 +44,57 @@ func getSubSetLabels(dr *networkingapi.DestinationRule, subsetName string) label
 
 	return nil
 }
+
+// emptySubset returns true if the subset of the destination rule exists and has no labels.
+func emptySubset(dr *networkingapi.DestinationRule, subsetName string) bool {
+	if subsetName == "" || dr == nil {
+		return false
+	}
+	for _, subset := range dr.Subsets {
+		if subset.Name == subsetName {
+			return len(subset.Labels) == 0
+		}
+	}
+	return false
+}
+
+// subsetDefined returns true if the subset is defined by the destination rule.
+func subsetDefined(dr *networkingapi.DestinationRule, subsetName string) bool {
+	for _, subset := range dr.GetSubsets() {
+		if subset.Name == subsetName {
+			return true
+		}
+	}
+	return false
+}
+
+// subsetSni returns the upstream SNI set by the TLS settings of the subset for the port, if any. The SNI
+// of the top level traffic policy is not returned, as it applies to all the subsets alike.
+func subsetSni(dr *networkingapi.DestinationRule, port int, subsetName string) string {
+	if subsetName == "" || dr == nil {
+		return ""
+	}
+	for _, subset := range dr.Subsets {
+		if subset.Name == subsetName {
+			return networking.MergeTrafficPolicy(nil, subset.TrafficPolicy, &model.Port{Port: port}).GetTls().GetSni()
+		}
+	}
+	return ""
+}
+
+// isClusterLocal returns whether the endpoints of the service are only accessible to clients within the
+// same cluster, either because its host is cluster-local in the mesh config, or because its namespace is
+// listed in PILOT_CLUSTER_LOCAL_NAMESPACES.
+func isClusterLocal(push *model.PushContext, svc *model.Service) bool {
+	if push.IsClusterLocal(svc) {
+		return true
+	}
+	_, f := features.ClusterLocalNamespaces[svc.Attributes.Namespace]
+	return f
+}
+
+// isClusterLocalEndpoint returns whether the endpoint is only accessible to clients within the same cluster,
+// because its labels are selected by PILOT_CLUSTER_LOCAL_LABELS.
+func isClusterLocalEndpoint(ep *model.IstioEndpoint) bool {
+	return len(features.ClusterLocalLabels) > 0 && labels.Instance(features.ClusterLocalLabels).SubsetOf(ep.Labels)
+}
@@ -0,0 +1,98 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"math"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// zoneAwareWeightScale is the total weight of the localities receiving traffic with precomputed zone aware
+// weights, so the share of each locality is kept with a precision of 0.01%, like Envoy does.
+const zoneAwareWeightScale = 10000
+
+// zoneAwareLoadAssignment precomputes the locality weights of the zone aware routing of Envoy for a proxy in
+// the given locality. Pilot does not know where the clients of the service are, so they are assumed to be
+// evenly spread across the zones of the endpoints. If the zone of the proxy has at least its share of the
+// endpoint weight, all the traffic is kept in the zone. Otherwise the zone receives as much traffic as it
+// can, and the rest is spread across the zones with more than their share, by their excess weight. Zones
+// receiving no traffic are only used for failover, with a lower priority. The load assignment is returned
+// unchanged if the proxy has no zone or if there are no endpoints in its zone.
+func zoneAwareLoadAssignment(proxyLocality *core.Locality, l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	if proxyLocality.GetZone() == "" {
+		return l
+	}
+	localZone := zoneKey(proxyLocality)
+	zoneWeights := map[string]float64{}
+	var total float64
+	for _, locLbEps := range l.Endpoints {
+		w := float64(locLbEps.GetLoadBalancingWeight().GetValue())
+		zoneWeights[zoneKey(locLbEps.Locality)] += w
+		total += w
+	}
+	if len(zoneWeights) < 2 || zoneWeights[localZone] == 0 {
+		return l
+	}
+
+	fairShare := 1 / float64(len(zoneWeights))
+	localShare := zoneWeights[localZone] / total
+	// zoneTraffic holds the share of the traffic of the proxy sent to each zone.
+	zoneTraffic := map[string]float64{}
+	if localShare >= fairShare {
+		zoneTraffic[localZone] = 1
+	} else {
+		zoneTraffic[localZone] = localShare / fairShare
+		var excess float64
+		for _, w := range zoneWeights {
+			if share := w / total; share > fairShare {
+				excess += share - fairShare
+			}
+		}
+		for zone, w := range zoneWeights {
+			if share := w / total; share > fairShare {
+				zoneTraffic[zone] = (1 - zoneTraffic[localZone]) * (share - fairShare) / excess
+			}
+		}
+	}
+
+	// Make a shallow copy of the cla as we are mutating the endpoints with weights relative to the calling proxy
+	out := util.CloneClusterLoadAssignment(l)
+	for _, locLbEps := range out.Endpoints {
+		zone := zoneKey(locLbEps.Locality)
+		traffic := zoneTraffic[zone]
+		if traffic == 0 {
+			locLbEps.Priority = 1
+			continue
+		}
+		share := float64(locLbEps.GetLoadBalancingWeight().GetValue()) / zoneWeights[zone]
+		weight := math.Round(traffic * share * zoneAwareWeightScale)
+		if weight < 1 {
+			// Envoy requires locality weights to be at least 1.
+			weight = 1
+		}
+		locLbEps.LoadBalancingWeight = &wrappers.UInt32Value{Value: uint32(weight)}
+	}
+	return out
+}
+
+// zoneKey returns the region and zone of the locality, ignoring the subzone.
+func zoneKey(locality *core.Locality) string {
+	return locality.GetRegion() + "/" + locality.GetZone()
+}
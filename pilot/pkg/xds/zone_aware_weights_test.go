@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
+	"istio.io/istio/pilot/pkg/features"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestZoneAwareEndpointWeights(t *testing.T) {
+	setFeatureForTest(t, &features.ZoneAwareEndpointWeights, true)
+
+	s := NewFakeDiscoveryServer(t, FakeOptions{})
+	s.addHTTPServices("zones.example.com")
+	var eps []*model.IstioEndpoint
+	// zone1 has 1/6 of the endpoints, zone2 2/6 split in two subzones and zone3 3/6.
+	for i, locality := range []string{
+		"region1/zone1/subzone1",
+		"region1/zone2/subzone1", "region1/zone2/subzone2",
+		"region1/zone3/subzone1", "region1/zone3/subzone1", "region1/zone3/subzone1",
+	} {
+		ep := testEndpoint(fmt.Sprintf("10.0.0.%d", i+1), locality)
+		ep.LbWeight = 1
+		eps = append(eps, ep)
+	}
+	s.Discovery.SetEndpointShardsForTest("zones.example.com", "", "", eps)
+
+	type weight struct {
+		priority uint32
+		weight   uint32
+	}
+	cases := []struct {
+		name     string
+		locality *core.Locality
+		expected map[string]weight
+	}{
+		{
+			// zone1 is short of its 1/3 share, so it only keeps half of the traffic. The other half goes to
+			// zone3, the only zone with more than its share.
+			name:     "zone short of endpoints",
+			locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"},
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {0, 5000},
+				"region1/zone2/subzone1": {1, 1},
+				"region1/zone2/subzone2": {1, 1},
+				"region1/zone3/subzone1": {0, 5000},
+			},
+		},
+		{
+			// zone2 has exactly its share, so all the traffic is kept in the zone, split between its subzones.
+			name:     "zone with its share of endpoints",
+			locality: &core.Locality{Region: "region1", Zone: "zone2", SubZone: "subzone2"},
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {1, 1},
+				"region1/zone2/subzone1": {0, 5000},
+				"region1/zone2/subzone2": {0, 5000},
+				"region1/zone3/subzone1": {1, 3},
+			},
+		},
+		{
+			name:     "zone with more than its share of endpoints",
+			locality: &core.Locality{Region: "region1", Zone: "zone3"},
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {1, 1},
+				"region1/zone2/subzone1": {1, 1},
+				"region1/zone2/subzone2": {1, 1},
+				"region1/zone3/subzone1": {0, 10000},
+			},
+		},
+		{
+			// Without endpoints in the zone of the proxy, the weights are not changed.
+			name:     "zone without endpoints",
+			locality: &core.Locality{Region: "region2", Zone: "zone1"},
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {0, 1},
+				"region1/zone2/subzone1": {0, 1},
+				"region1/zone2/subzone2": {0, 1},
+				"region1/zone3/subzone1": {0, 3},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := s.SetupProxy(&model.Proxy{Locality: tt.locality, Metadata: &model.NodeMetadata{Generator: "grpc"}})
+			cla := s.buildEndpoints("outbound|80||zones.example.com", proxy)
+			got := map[string]weight{}
+			for _, llb := range cla.Endpoints {
+				got[util.LocalityToString(llb.Locality)] = weight{llb.Priority, llb.GetLoadBalancingWeight().GetValue()}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected locality weights %v, got %v", tt.expected, got)
+			}
+		})
+	}
+
+	// Envoy does its own zone aware routing, so the weights of sidecars are not changed.
+	proxy := s.SetupProxy(&model.Proxy{Locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"}})
+	cla := s.buildEndpoints("outbound|80||zones.example.com", proxy)
+	for _, llb := range cla.Endpoints {
+		if llb.Priority != 0 || llb.GetLoadBalancingWeight().GetValue() > 3 {
+			t.Fatalf("expected unchanged locality weights for a sidecar, got %v", cla.Endpoints)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"math"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+	"istio.io/istio/pkg/config/validation"
+)
+
+// zoneWeights returns the percentages of the traffic sent to each zone, configured on the DestinationRule of
+// the cluster, if any. Invalid percentages are rejected by validation, those which bypassed it are ignored.
+func (b *EndpointBuilder) zoneWeights() map[string]uint32 {
+	if b.destinationRule == nil {
+		return nil
+	}
+	value, f := b.destinationRule.Annotations[validation.ZoneWeightsAnnotation]
+	if !f {
+		return nil
+	}
+	weights, err := validation.ParseZoneWeights(value)
+	if err != nil {
+		adsLog.Warnf("Ignoring zone weights of DestinationRule %s/%s: %v",
+			b.destinationRule.Namespace, b.destinationRule.Name, err)
+		return nil
+	}
+	return weights
+}
+
+// zoneWeightedLoadAssignment sets the locality weights so each zone receives its configured percentage of
+// the traffic, regardless of its number of endpoints. The traffic of a zone is split across its localities
+// by their weight. Localities in zones without a percentage get no traffic, they are only used for failover,
+// with a lower priority. Zones without endpoints do not get their percentage, the other zones keep their
+// relative weights.
+func zoneWeightedLoadAssignment(weights map[string]uint32, l *endpoint.ClusterLoadAssignment) *endpoint.ClusterLoadAssignment {
+	zoneTotals := map[string]float64{}
+	for _, locLbEps := range l.Endpoints {
+		zoneTotals[zoneKey(locLbEps.Locality)] += float64(locLbEps.GetLoadBalancingWeight().GetValue())
+	}
+
+	// Make a shallow copy of the cla as we are mutating the endpoints with weights
+	out := util.CloneClusterLoadAssignment(l)
+	for _, locLbEps := range out.Endpoints {
+		zone := zoneKey(locLbEps.Locality)
+		percentage, f := weights[zone]
+		if !f || zoneTotals[zone] == 0 {
+			locLbEps.Priority = 1
+			continue
+		}
+		share := float64(locLbEps.GetLoadBalancingWeight().GetValue()) / zoneTotals[zone]
+		weight := math.Round(float64(percentage) / 100 * share * zoneAwareWeightScale)
+		if weight < 1 {
+			// Envoy requires locality weights to be at least 1.
+			weight = 1
+		}
+		locLbEps.LoadBalancingWeight = &wrappers.UInt32Value{Value: uint32(weight)}
+	}
+	return out
+}
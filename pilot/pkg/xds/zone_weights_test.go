@@ -0,0 +1,105 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xds
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestZoneWeightedEndpoints(t *testing.T) {
+	drConfig := `
+apiVersion: networking.istio.io/v1alpha3
+kind: DestinationRule
+metadata:
+  name: zones
+  namespace: default
+  annotations:
+    networking.istio.io/zoneWeights: %s
+spec:
+  host: zones.example.com
+%s
+`
+	// zone1 has 1 endpoint, zone2 2 split in two subzones, zone3 3 and zone4 1.
+	var eps []*model.IstioEndpoint
+	for i, locality := range []string{
+		"region1/zone1/subzone1",
+		"region1/zone2/subzone1", "region1/zone2/subzone2",
+		"region1/zone3/subzone1", "region1/zone3/subzone1", "region1/zone3/subzone1",
+		"region1/zone4/subzone1",
+	} {
+		ep := testEndpoint(fmt.Sprintf("10.0.0.%d", i+1), locality)
+		ep.LbWeight = 1
+		eps = append(eps, ep)
+	}
+
+	type weight struct {
+		priority uint32
+		weight   uint32
+	}
+	cases := []struct {
+		name     string
+		weights  string
+		policy   string
+		expected map[string]weight
+	}{
+		{
+			// zone4 has no percentage, so it is only used for failover.
+			name:    "percentages",
+			weights: "region1/zone1=50,region1/zone2=30,region1/zone3=20",
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {0, 5000},
+				"region1/zone2/subzone1": {0, 1500},
+				"region1/zone2/subzone2": {0, 1500},
+				"region1/zone3/subzone1": {0, 2000},
+				"region1/zone4/subzone1": {1, 1},
+			},
+		},
+		{
+			// The percentages replace the locality failover.
+			name:    "percentages with outlier detection",
+			weights: "region1/zone1=50,region1/zone2=30,region1/zone3=20",
+			policy:  "  trafficPolicy:\n    outlierDetection:\n      consecutive5xxErrors: 3",
+			expected: map[string]weight{
+				"region1/zone1/subzone1": {0, 5000},
+				"region1/zone2/subzone1": {0, 1500},
+				"region1/zone2/subzone2": {0, 1500},
+				"region1/zone3/subzone1": {0, 2000},
+				"region1/zone4/subzone1": {1, 1},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFakeDiscoveryServer(t, FakeOptions{ConfigString: fmt.Sprintf(drConfig, tt.weights, tt.policy)})
+			s.addHTTPServices("zones.example.com")
+			s.Discovery.SetEndpointShardsForTest("zones.example.com", "", "", eps)
+
+			proxy := s.SetupProxy(&model.Proxy{Locality: util.ConvertLocality("region1/zone1/subzone1")})
+			cla := s.buildEndpoints("outbound|80||zones.example.com", proxy)
+			got := map[string]weight{}
+			for _, locLbEps := range cla.Endpoints {
+				got[util.LocalityToString(locLbEps.Locality)] = weight{locLbEps.Priority, locLbEps.GetLoadBalancingWeight().GetValue()}
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("expected locality weights %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
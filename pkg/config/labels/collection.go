@@ -19,17 +19,14 @@ package labels
 type Collection []Instance
 
 // HasSubsetOf returns true if the input labels are a super set of one labels in a
-// collection or if the tag collection is empty
+// collection or if the tag collection is empty. Label values prefixed with NegationPrefix
+// match all the values but the negated one, including a missing label.
 func (c Collection) HasSubsetOf(that Instance) bool {
 	if len(c) == 0 {
 		return true
 	}
-	// prevent panic when that is nil
-	if len(that) == 0 {
-		return false
-	}
 	for _, this := range c {
-		if this.SubsetOf(that) {
+		if this.selects(that) {
 			return true
 		}
 	}
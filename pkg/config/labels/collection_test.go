@@ -58,4 +58,26 @@ func TestCollection(t *testing.T) {
 	if ab.HasSubsetOf(nilInstance) {
 		t.Errorf("%v.HasSubsetOf(%v) => Got true", ab, nilInstance)
 	}
+
+	notA := labels.Collection{{"app": "!a"}}
+	notAProd := labels.Collection{{"app": "!a", "prod": "env"}}
+	negated := []struct {
+		tag        labels.Instance
+		collection labels.Collection
+		match      bool
+	}{
+		{a, notA, false},
+		{b, notA, true},
+		{labels.Instance{"prod": "env"}, notA, true},
+		{nilInstance, notA, true},
+		{a1, notAProd, false},
+		{labels.Instance{"app": "b", "prod": "env"}, notAProd, true},
+		{b, notAProd, false},
+		{nilInstance, notAProd, false},
+	}
+	for _, tt := range negated {
+		if got := tt.collection.HasSubsetOf(tt.tag); got != tt.match {
+			t.Errorf("%v.HasSubsetOf(%v) => Got %v", tt.collection, tt.tag, got)
+		}
+	}
 }
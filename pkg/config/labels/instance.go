@@ -19,11 +19,16 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 )
 
 const (
+	// NegationPrefix prefixes the value of a subset label which the selected labels must not have, e.g. "!v3".
+	// It is supported by Collection.HasSubsetOf, which matches the instances of subsets.
+	NegationPrefix = "!"
+
 	DNS1123LabelMaxLength = 63 // Public for testing only.
 	dns1123LabelFmt       = "[a-zA-Z0-9](?:[-a-zA-Z0-9]*[a-zA-Z0-9])?"
 	// a wild-card prefix is an '*', a normal DNS1123 label with a leading '*' or '*-', or a normal DNS1123 label
@@ -64,6 +69,25 @@ func (i Instance) SubsetOf(that Instance) bool {
 	return true
 }
 
+// selects is true if that has identical values for the keys, except for the values prefixed with
+// NegationPrefix, which that must not have. Empty labels are only selected if all the values are negated.
+func (i Instance) selects(that Instance) bool {
+	positive := false
+	for k, v := range i {
+		if negated := strings.TrimPrefix(v, NegationPrefix); negated != v {
+			if value, f := that[k]; f && value == negated {
+				return false
+			}
+			continue
+		}
+		positive = true
+		if that[k] != v {
+			return false
+		}
+	}
+	return len(that) > 0 || (!positive && len(i) > 0)
+}
+
 // Equals returns true if the labels are identical
 func (i Instance) Equals(that Instance) bool {
 	if i == nil {
@@ -31,7 +31,6 @@ import (
 	"istio.io/istio/pkg/config/validation"
 	"istio.io/istio/pkg/util/gogoprotomarshal"
 	"istio.io/pkg/filewatcher"
-	"istio.io/pkg/log"
 )
 
 // DefaultProxyConfig for individual proxies
@@ -227,19 +226,22 @@ func ReadMeshConfig(filename string) (*meshconfig.MeshConfig, error) {
 
 // ResolveHostsInNetworksConfig will go through the Gateways addresses for all
 // networks in the config and if it's not an IP address it will try to lookup
-// that hostname and replace it with the IP address in the config
-func ResolveHostsInNetworksConfig(config *meshconfig.MeshNetworks) {
+// that hostname and replace it with the IP address in the config.
+// Hostnames which can not be resolved are kept, and returned as an error, as
+// no endpoints can be built for these gateways.
+func ResolveHostsInNetworksConfig(config *meshconfig.MeshNetworks) error {
 	if config == nil {
-		return
+		return nil
 	}
-	for _, n := range config.Networks {
+	var errs error
+	for name, n := range config.Networks {
 		for _, gw := range n.Gateways {
 			gwAddr := gw.GetAddress()
 			gwIP := net.ParseIP(gwAddr)
 			if gwIP == nil && len(gwAddr) != 0 {
 				addrs, err := net.LookupHost(gwAddr)
 				if err != nil {
-					log.Warnf("error resolving host %#v: %v", gw.GetAddress(), err)
+					errs = multierror.Append(errs, fmt.Errorf("network %v: error resolving gateway host %q: %v", name, gwAddr, err))
 				} else {
 					gw.Gw = &meshconfig.Network_IstioNetworkGateway_Address{
 						Address: addrs[0],
@@ -248,6 +250,7 @@ func ResolveHostsInNetworksConfig(config *meshconfig.MeshNetworks) {
 			}
 		}
 	}
+	return errs
 }
 
 // Add to the FileWatcher the provided file and execute the provided function
@@ -183,21 +183,31 @@ func TestResolveHostsInNetworksConfig(t *testing.T) {
 		name     string
 		address  string
 		modified bool
+		wantErr  bool
 	}{
 		{
 			"Gateway with IP address",
 			"9.142.3.1",
 			false,
+			false,
 		},
 		{
 			"Gateway with localhost address",
 			"localhost",
 			true,
+			false,
 		},
 		{
 			"Gateway with empty address",
 			"",
 			false,
+			false,
+		},
+		{
+			"Gateway with unresolvable address",
+			"gateway.invalid",
+			false,
+			true,
 		},
 	}
 	for _, tt := range tests {
@@ -215,7 +225,9 @@ func TestResolveHostsInNetworksConfig(t *testing.T) {
 					},
 				},
 			}
-			mesh.ResolveHostsInNetworksConfig(config)
+			if err := mesh.ResolveHostsInNetworksConfig(config); (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
 			addrAfter := config.Networks["network"].Gateways[0].GetAddress()
 			if addrAfter == tt.address && tt.modified {
 				t.Fatalf("Expected network address to be modified but it's the same as before calling the function")
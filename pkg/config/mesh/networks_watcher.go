@@ -63,7 +63,9 @@ func NewNetworksWatcher(fileWatcher filewatcher.FileWatcher, filename string) (N
 		return nil, fmt.Errorf("failed to read mesh networks configuration from %q: %v", filename, err)
 	}
 
-	ResolveHostsInNetworksConfig(meshNetworks)
+	if err := ResolveHostsInNetworksConfig(meshNetworks); err != nil {
+		log.Errorf("invalid gateways in mesh networks configuration from %q: %v", filename, err)
+	}
 	networksdump, _ := gogoprotomarshal.ToJSONWithIndent(meshNetworks, "   ")
 	log.Infof("mesh networks configuration: %s", networksdump)
 
@@ -95,7 +97,9 @@ func (w *networksWatcher) SetNetworks(meshNetworks *meshconfig.MeshNetworks) {
 
 	w.mutex.Lock()
 	if !reflect.DeepEqual(meshNetworks, w.networks) {
-		ResolveHostsInNetworksConfig(meshNetworks)
+		if err := ResolveHostsInNetworksConfig(meshNetworks); err != nil {
+			log.Errorf("invalid gateways in mesh networks configuration: %v", err)
+		}
 		networksdump, _ := gogoprotomarshal.ToJSONWithIndent(meshNetworks, "    ")
 		log.Infof("mesh networks configuration updated to: %s", networksdump)
 
@@ -433,10 +433,52 @@ var ValidateDestinationRule = registerValidateFunc("ValidateDestinationRule",
 			errs = appendErrors(errs, validateSubset(subset))
 		}
 
+		if value, f := cfg.Annotations[ZoneWeightsAnnotation]; f {
+			if _, err := ParseZoneWeights(value); err != nil {
+				errs = appendErrors(errs, fmt.Errorf("invalid %s annotation: %v", ZoneWeightsAnnotation, err))
+			}
+		}
+
 		errs = appendErrors(errs, validateExportTo(cfg.Namespace, rule.ExportTo, false))
 		return
 	})
 
+// ZoneWeightsAnnotation is the name of the annotation which, when set on a DestinationRule, sets the
+// percentage of the traffic sent to each zone of its host, regardless of their number of endpoints, e.g.
+// "region1/zone1=50,region1/zone2=30,region1/zone3=20". The percentages must sum to 100.
+const ZoneWeightsAnnotation = "networking.istio.io/zoneWeights"
+
+// ParseZoneWeights parses the percentages of the traffic sent to each zone, as set by the
+// ZoneWeightsAnnotation, e.g. "region1/zone1=50,region1/zone2=30,region1/zone3=20".
+// The percentages must be integers, summing to 100.
+func ParseZoneWeights(value string) (map[string]uint32, error) {
+	weights := map[string]uint32{}
+	var total uint32
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid zone weight %q, expected region/zone=percentage", item)
+		}
+		zone := strings.TrimSpace(parts[0])
+		if levels := strings.Split(zone, "/"); len(levels) != 2 || levels[0] == "" || levels[1] == "" {
+			return nil, fmt.Errorf("invalid zone %q, expected region/zone", zone)
+		}
+		if _, f := weights[zone]; f {
+			return nil, fmt.Errorf("duplicate zone %q", zone)
+		}
+		percentage, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+		if err != nil || percentage == 0 || percentage > 100 {
+			return nil, fmt.Errorf("invalid percentage %q of zone %q, expected an integer in 1..100", parts[1], zone)
+		}
+		weights[zone] = uint32(percentage)
+		total += uint32(percentage)
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("zone percentages sum to %d, expected 100", total)
+	}
+	return weights, nil
+}
+
 func validateExportTo(namespace string, exportTo []string, isServiceEntry bool) (errs error) {
 	if len(exportTo) > 0 {
 		// Make sure there are no duplicates
@@ -991,10 +1033,22 @@ func validateTLS(settings *networking.ClientTLSSettings) (errs error) {
 
 func validateSubset(subset *networking.Subset) error {
 	return appendErrors(validateSubsetName(subset.Name),
-		labels.Instance(subset.Labels).Validate(),
+		validateSubsetLabels(subset.Labels),
 		validateTrafficPolicy(subset.TrafficPolicy))
 }
 
+// validateSubsetLabels validates the labels of a subset, whose values may be negated by labels.NegationPrefix.
+func validateSubsetLabels(subsetLabels map[string]string) error {
+	if subsetLabels == nil {
+		return nil
+	}
+	lbls := make(labels.Instance, len(subsetLabels))
+	for k, v := range subsetLabels {
+		lbls[k] = strings.TrimPrefix(v, labels.NegationPrefix)
+	}
+	return lbls.Validate()
+}
+
 func validatePortTrafficPolicies(pls []*networking.TrafficPolicy_PortTrafficPolicy) (errs error) {
 	for _, t := range pls {
 		if t == nil {
@@ -2337,10 +2391,6 @@ func validateLocalityLbSetting(lb *networking.LocalityLoadBalancerSetting) error
 		return nil
 	}
 
-	if len(lb.GetDistribute()) > 0 && len(lb.GetFailover()) > 0 {
-		return fmt.Errorf("can not simultaneously specify 'distribute' and 'failover'")
-	}
-
 	srcLocalities := make([]string, 0)
 	for _, locality := range lb.GetDistribute() {
 		srcLocalities = append(srcLocalities, locality.From)
@@ -2449,6 +2499,18 @@ func ValidateMeshNetworks(meshnetworks *meshconfig.MeshNetworks) (errs error) {
 	return
 }
 
+// validateNetworkGatewayAddress checks that a network gateway address is an IP address or a hostname. Hostnames
+// are resolved to IP addresses when the mesh networks are loaded.
+func validateNetworkGatewayAddress(addr string) error {
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	if err := ValidateFQDN(addr); err != nil {
+		return fmt.Errorf("invalid gateway address %q: must be an IP address or a hostname", addr)
+	}
+	return nil
+}
+
 func validateNetwork(network *meshconfig.Network) (errs error) {
 	for _, n := range network.Endpoints {
 		switch e := n.Ne.(type) {
@@ -2470,7 +2532,7 @@ func validateNetwork(network *meshconfig.Network) (errs error) {
 				errs = multierror.Append(errs, err)
 			}
 		case *meshconfig.Network_IstioNetworkGateway_Address:
-			if err := ValidateIPAddress(g.Address); err != nil {
+			if err := validateNetworkGatewayAddress(g.Address); err != nil {
 				errs = multierror.Append(errs, err)
 			}
 		}
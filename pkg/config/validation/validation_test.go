@@ -15,6 +15,7 @@
 package validation
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -2224,6 +2225,71 @@ func TestValidateVirtualService(t *testing.T) {
 	}
 }
 
+func TestParseZoneWeights(t *testing.T) {
+	cases := []struct {
+		value string
+		want  map[string]uint32
+		err   string
+	}{
+		{
+			value: "region1/zone1=50, region1/zone2=30,region1/zone3 = 20",
+			want:  map[string]uint32{"region1/zone1": 50, "region1/zone2": 30, "region1/zone3": 20},
+		},
+		{value: "region1/zone1=100", want: map[string]uint32{"region1/zone1": 100}},
+		{value: "region1/zone1=50,region1/zone2=30", err: "sum to 80"},
+		{value: "region1/zone1=70,region1/zone2=40", err: "sum to 110"},
+		{value: "region1/zone1=100,region1/zone2=0", err: "invalid percentage"},
+		{value: "region1/zone1=50.5,region1/zone2=49.5", err: "invalid percentage"},
+		{value: "region1/zone1=50,region1/zone1=50", err: "duplicate zone"},
+		{value: "zone1=100", err: "invalid zone"},
+		{value: "region1/zone1/subzone1=100", err: "invalid zone"},
+		{value: "region1/zone1", err: "invalid zone weight"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseZoneWeights(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected weights %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateDestinationRuleZoneWeights(t *testing.T) {
+	cases := []struct {
+		value string
+		valid bool
+	}{
+		{value: "region1/zone1=50,region1/zone2=50", valid: true},
+		{value: "region1/zone1=50,region1/zone2=30", valid: false},
+		{value: "zone1=100", valid: false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := ValidateDestinationRule(config.Config{
+				Meta: config.Meta{
+					Name:        "zones",
+					Namespace:   "default",
+					Annotations: map[string]string{ZoneWeightsAnnotation: tt.value},
+				},
+				Spec: &networking.DestinationRule{Host: "reviews"},
+			})
+			if (err == nil) != tt.valid {
+				t.Fatalf("expected valid=%v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
 func TestValidateDestinationRule(t *testing.T) {
 	cases := []struct {
 		name  string
@@ -2238,6 +2304,20 @@ func TestValidateDestinationRule(t *testing.T) {
 			},
 		}, valid: true},
 
+		{name: "negated subset label", in: &networking.DestinationRule{
+			Host: "reviews",
+			Subsets: []*networking.Subset{
+				{Name: "not-v3", Labels: map[string]string{"version": "!v3"}},
+			},
+		}, valid: true},
+
+		{name: "invalid negated subset label", in: &networking.DestinationRule{
+			Host: "reviews",
+			Subsets: []*networking.Subset{
+				{Name: "not-v3", Labels: map[string]string{"version": "!!v3"}},
+			},
+		}, valid: false},
+
 		{name: "missing destination name", in: &networking.DestinationRule{
 			Host: "",
 			Subsets: []*networking.Subset{
@@ -4552,7 +4632,7 @@ func TestValidateLocalityLbSetting(t *testing.T) {
 			valid: false,
 		},
 		{
-			name: "invalid LocalityLoadBalancerSetting specify both distribute and failover",
+			name: "valid LocalityLoadBalancerSetting specify both distribute and failover",
 			in: &networking.LocalityLoadBalancerSetting{
 				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
 					{
@@ -4570,7 +4650,7 @@ func TestValidateLocalityLbSetting(t *testing.T) {
 					},
 				},
 			},
-			valid: false,
+			valid: true,
 		},
 
 		{
@@ -5149,6 +5229,60 @@ func TestValidateMeshNetworks(t *testing.T) {
 			},
 			valid: true,
 		},
+		{
+			name: "Valid gateway addresses",
+			mn: &meshconfig.MeshNetworks{
+				Networks: map[string]*meshconfig.Network{
+					"n1": {
+						Gateways: []*meshconfig.Network_IstioNetworkGateway{
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "1.1.1.1"}, Port: 15443},
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "2001:db8::1"}, Port: 15443},
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "gateway.example.com"}, Port: 15443},
+						},
+					},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "Invalid gateway address",
+			mn: &meshconfig.MeshNetworks{
+				Networks: map[string]*meshconfig.Network{
+					"n1": {
+						Gateways: []*meshconfig.Network_IstioNetworkGateway{
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "gateway_1:15443"}, Port: 15443},
+						},
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "Empty gateway address",
+			mn: &meshconfig.MeshNetworks{
+				Networks: map[string]*meshconfig.Network{
+					"n1": {
+						Gateways: []*meshconfig.Network_IstioNetworkGateway{
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: ""}, Port: 15443},
+						},
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "Invalid gateway port",
+			mn: &meshconfig.MeshNetworks{
+				Networks: map[string]*meshconfig.Network{
+					"n1": {
+						Gateways: []*meshconfig.Network_IstioNetworkGateway{
+							{Gw: &meshconfig.Network_IstioNetworkGateway_Address{Address: "1.1.1.1"}, Port: 0},
+						},
+					},
+				},
+			},
+			valid: false,
+		},
 		{
 			name: "Invalid registry name",
 			mn: &meshconfig.MeshNetworks{
@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/validation"
+)
+
+// validateEndpointAddresses checks that the endpoint addresses of ServiceEntries and WorkloadEntries are
+// IPv4 or IPv6 addresses, CIDR blocks or hostnames.
+func validateEndpointAddresses(cfg config.Config) error {
+	var errs error
+	switch spec := cfg.Spec.(type) {
+	case *networking.ServiceEntry:
+		for i, ep := range spec.Endpoints {
+			if err := validateEndpointAddress(ep.Address); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("spec.endpoints[%d].address: %v", i, err))
+			}
+		}
+	case *networking.WorkloadEntry:
+		if err := validateEndpointAddress(spec.Address); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("spec.address: %v", err))
+		}
+	}
+	return errs
+}
+
+// validateEndpointAddress checks that the address is an IPv4 or IPv6 address, a CIDR block or a hostname.
+// IPv6 addresses may carry a zone ID, such as fe80::1%eth0. Empty and unix domain socket addresses
+// are left to the type specific validation.
+func validateEndpointAddress(addr string) error {
+	if addr == "" || strings.HasPrefix(addr, validation.UnixAddressPrefix) {
+		return nil
+	}
+	if strings.Contains(addr, "/") {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return fmt.Errorf("%q is not a valid CIDR block", addr)
+		}
+		return nil
+	}
+	if strings.Contains(addr, ":") {
+		ip := addr
+		if i := strings.IndexByte(addr, '%'); i >= 0 {
+			if i == len(addr)-1 {
+				return fmt.Errorf("%q has an empty IPv6 zone ID", addr)
+			}
+			ip = addr[:i]
+		}
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+			return fmt.Errorf("%q is not a valid IPv6 address", addr)
+		}
+		return nil
+	}
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	// A numeric top level label can only be meant as an IPv4 address, so don't accept it as a hostname.
+	labels := strings.Split(addr, ".")
+	if isNumeric(labels[len(labels)-1]) {
+		return fmt.Errorf("%q is not a valid IPv4 address", addr)
+	}
+	if err := validation.ValidateFQDN(addr); err != nil {
+		return fmt.Errorf("%q is not a valid IPv4 address, IPv6 address, CIDR block or hostname", addr)
+	}
+	return nil
+}
+
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
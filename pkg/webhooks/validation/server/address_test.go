@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pkg/config/schema/collections"
+	"istio.io/istio/pkg/kube"
+)
+
+func TestValidateEndpointAddress(t *testing.T) {
+	cases := []struct {
+		addr  string
+		valid bool
+	}{
+		{"10.0.0.1", true},
+		{"2001:db8::1", true},
+		{"fe80::1%eth0", true},
+		{"10.0.0.0/24", true},
+		{"2001:db8::/64", true},
+		{"reviews.default.svc.cluster.local", true},
+		{"unix:///var/run/app.sock", true},
+		{"10.0.0.256", false},
+		{"10.0.0", false},
+		{"2001:db8:::1", false},
+		{"fe80::1%", false},
+		{"::ffff:10.0.0.1%eth0", false},
+		{"10.0.0.0/33", false},
+		{"2001:db8::/129", false},
+		{"under_score.example.com", false},
+		{"-leading.example.com", false},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			err := validateEndpointAddress(c.addr)
+			if c.valid && err != nil {
+				t.Fatalf("expected %q to be valid, got %v", c.addr, err)
+			}
+			if !c.valid && err == nil {
+				t.Fatalf("expected %q to be invalid", c.addr)
+			}
+		})
+	}
+}
+
+func TestAdmitPilotEndpointAddresses(t *testing.T) {
+	wh := &Webhook{schemas: collections.Pilot, domainSuffix: testDomainSuffix}
+	workloadEntry := func(addr string) []byte {
+		return []byte(fmt.Sprintf(`{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "WorkloadEntry",
+  "metadata": {"name": "vm", "namespace": "default"},
+  "spec": {"address": %q}
+}`, addr))
+	}
+
+	cases := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"fe80::1%eth0", true},
+		{"vm.example.com", true},
+		{"10.0.0.256", false},
+		{"fe80:::1", false},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			got := wh.admitPilot(&kube.AdmissionRequest{
+				Kind:      kubeApisMeta.GroupVersionKind{Kind: collections.IstioNetworkingV1Alpha3Workloadentries.Resource().Kind()},
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: workloadEntry(c.addr)},
+				Operation: kube.Create,
+			})
+			if got.Allowed != c.allowed {
+				t.Fatalf("expected allowed %v, got %v: %v", c.allowed, got.Allowed, got.Result)
+			}
+			if !c.allowed && !strings.Contains(got.Result.Message, "spec.address") {
+				t.Fatalf("expected a field error for spec.address, got %q", got.Result.Message)
+			}
+		})
+	}
+}
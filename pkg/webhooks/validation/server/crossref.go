@@ -0,0 +1,107 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/schema/gvk"
+)
+
+// ConfigLister provides read-only access to the existing configuration, used for cross-reference validation.
+type ConfigLister interface {
+	// List returns all configs of the given type in the namespace. An empty namespace lists all namespaces.
+	List(typ config.GroupVersionKind, namespace string) ([]config.Config, error)
+}
+
+// crossReferenceWarnings checks the references of the config to other configs and returns a warning for
+// each reference which does not exist.
+func crossReferenceWarnings(lister ConfigLister, cfg config.Config) []string {
+	if cfg.GroupVersionKind != gvk.VirtualService {
+		return nil
+	}
+	vs, ok := cfg.Spec.(*networking.VirtualService)
+	if !ok {
+		return nil
+	}
+
+	destinationRules, err := lister.List(gvk.DestinationRule, model.NamespaceAll)
+	if err != nil {
+		scope.Warnf("cannot list destination rules for cross-reference validation: %v", err)
+		return nil
+	}
+
+	var warnings []string
+	seen := map[string]struct{}{}
+	for _, d := range virtualServiceDestinations(vs) {
+		if d.Subset == "" {
+			continue
+		}
+		hostname := model.ResolveShortnameToFQDN(d.Host, cfg.Meta)
+		key := string(hostname) + "/" + d.Subset
+		if _, f := seen[key]; f {
+			continue
+		}
+		seen[key] = struct{}{}
+		if !subsetDefined(destinationRules, hostname, d.Subset) {
+			warnings = append(warnings, fmt.Sprintf("subset %q of host %q is not defined by any DestinationRule", d.Subset, hostname))
+		}
+	}
+	return warnings
+}
+
+// subsetDefined returns true if any of the DestinationRules for the host defines the subset.
+func subsetDefined(destinationRules []config.Config, hostname host.Name, subset string) bool {
+	for _, cfg := range destinationRules {
+		dr, ok := cfg.Spec.(*networking.DestinationRule)
+		if !ok || !model.ResolveShortnameToFQDN(dr.Host, cfg.Meta).Matches(hostname) {
+			continue
+		}
+		for _, s := range dr.Subsets {
+			if s.Name == subset {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// virtualServiceDestinations returns all destinations of the routes of the VirtualService.
+func virtualServiceDestinations(vs *networking.VirtualService) []*networking.Destination {
+	var out []*networking.Destination
+	for _, h := range vs.Http {
+		for _, r := range h.Route {
+			out = append(out, r.Destination)
+		}
+		if h.Mirror != nil {
+			out = append(out, h.Mirror)
+		}
+	}
+	for _, t := range vs.Tcp {
+		for _, r := range t.Route {
+			out = append(out, r.Destination)
+		}
+	}
+	for _, t := range vs.Tls {
+		for _, r := range t.Route {
+			out = append(out, r.Destination)
+		}
+	}
+	return out
+}
@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/schema/collections"
+	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/kube"
+)
+
+func TestAdmitPilotCrossReference(t *testing.T) {
+	store := memory.Make(collections.Pilot)
+	if _, err := store.Create(config.Config{
+		Meta: config.Meta{
+			GroupVersionKind: gvk.DestinationRule,
+			Name:             "reviews",
+			Namespace:        "default",
+			Domain:           testDomainSuffix,
+		},
+		Spec: &networking.DestinationRule{
+			Host:    "reviews",
+			Subsets: []*networking.Subset{{Name: "v1", Labels: map[string]string{"version": "v1"}}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	virtualService := func(subset string) []byte {
+		return []byte(fmt.Sprintf(`{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "VirtualService",
+  "metadata": {"name": "reviews", "namespace": "default"},
+  "spec": {
+    "hosts": ["reviews"],
+    "http": [{"route": [{"destination": {"host": "reviews", "subset": %q}}]}]
+  }
+}`, subset))
+	}
+
+	cases := []struct {
+		name     string
+		lister   ConfigLister
+		subset   string
+		warnings []string
+	}{
+		{
+			name:   "valid reference",
+			lister: store,
+			subset: "v1",
+		},
+		{
+			name:     "dangling reference",
+			lister:   store,
+			subset:   "v2",
+			warnings: []string{`subset "v2" of host "reviews.default.svc.local.cluster" is not defined by any DestinationRule`},
+		},
+		{
+			name:   "dangling reference without lister",
+			subset: "v2",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wh := &Webhook{schemas: collections.Pilot, domainSuffix: testDomainSuffix, configLister: c.lister}
+			got := wh.admitPilot(&kube.AdmissionRequest{
+				Kind:      kubeApisMeta.GroupVersionKind{Kind: collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Kind()},
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: virtualService(c.subset)},
+				Operation: kube.Create,
+			})
+			if !got.Allowed {
+				t.Fatalf("expected the request to be allowed, got %v", got.Result)
+			}
+			if !reflect.DeepEqual(got.Warnings, c.warnings) {
+				t.Fatalf("expected warnings %v, got %v", c.warnings, got.Warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DeprecatedField is a field of a kind of resources which is deprecated. Resources using it are warned
+// about, or denied if deprecated fields are denied.
+type DeprecatedField struct {
+	// Kind of the resources, e.g. VirtualService.
+	Kind string
+
+	// Path of the field in the resource, with dot separated field names, e.g. spec.http.mirrorPercent.
+	// Lists along the path are traversed, so the field is used if it is set in any of their elements.
+	Path string
+
+	// Replacement is the field to use instead, if any, e.g. spec.http.mirrorPercentage.
+	Replacement string
+}
+
+func (f DeprecatedField) message() string {
+	if f.Replacement == "" {
+		return fmt.Sprintf("field %s is deprecated", f.Path)
+	}
+	return fmt.Sprintf("field %s is deprecated, use %s instead", f.Path, f.Replacement)
+}
+
+// checkDeprecatedFields checks the raw JSON resource of the kind against the deprecated fields. It returns
+// a warning for each deprecated field used, or, if deny is set, an error naming the first one.
+func checkDeprecatedFields(fields []DeprecatedField, kind string, raw []byte, deny bool) ([]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	var object map[string]interface{}
+	decoded := false
+	var warnings []string
+	for _, field := range fields {
+		if field.Kind != kind {
+			continue
+		}
+		if !decoded {
+			if err := json.Unmarshal(raw, &object); err != nil {
+				return nil, fmt.Errorf("cannot decode configuration: %v", err)
+			}
+			decoded = true
+		}
+		if !fieldSet(object, strings.Split(field.Path, ".")) {
+			continue
+		}
+		if deny {
+			return nil, errors.New(field.message())
+		}
+		warnings = append(warnings, field.message())
+	}
+	return warnings, nil
+}
+
+// fieldSet returns whether the field at the path is set in the decoded JSON value.
+func fieldSet(value interface{}, path []string) bool {
+	if len(path) == 0 {
+		return value != nil
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return fieldSet(v[path[0]], path[1:])
+	case []interface{}:
+		for _, item := range v {
+			if fieldSet(item, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pkg/config/schema/collections"
+	"istio.io/istio/pkg/kube"
+)
+
+func TestAdmitPilotDeprecatedFields(t *testing.T) {
+	deprecated := []DeprecatedField{
+		{Kind: "VirtualService", Path: "spec.http.mirrorPercent", Replacement: "spec.http.mirrorPercentage"},
+		{Kind: "VirtualService", Path: "spec.exportTo"},
+		// Fields of other kinds are ignored.
+		{Kind: "DestinationRule", Path: "spec.host"},
+	}
+	const withDeprecated = `{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "VirtualService",
+  "metadata": {"name": "c", "namespace": "default"},
+  "spec": {
+    "hosts": ["c"],
+    "http": [
+      {"route": [{"destination": {"host": "c"}}]},
+      {"route": [{"destination": {"host": "c"}}], "mirror": {"host": "d"}, "mirrorPercent": 50}
+    ]
+  }
+}`
+	const withoutDeprecated = `{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "VirtualService",
+  "metadata": {"name": "c", "namespace": "default"},
+  "spec": {
+    "hosts": ["c"],
+    "http": [{"route": [{"destination": {"host": "c"}}], "mirror": {"host": "d"}, "mirrorPercentage": {"value": 50}}]
+  }
+}`
+
+	cases := []struct {
+		name     string
+		object   string
+		deny     bool
+		warnings []string
+		denial   string
+	}{
+		{
+			name:     "warning",
+			object:   withDeprecated,
+			warnings: []string{"field spec.http.mirrorPercent is deprecated, use spec.http.mirrorPercentage instead"},
+		},
+		{
+			name:   "denial",
+			object: withDeprecated,
+			deny:   true,
+			denial: "field spec.http.mirrorPercent is deprecated, use spec.http.mirrorPercentage instead",
+		},
+		{
+			name:   "no deprecated fields",
+			object: withoutDeprecated,
+			deny:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wh := &Webhook{
+				schemas:              collections.Pilot,
+				domainSuffix:         testDomainSuffix,
+				deprecatedFields:     deprecated,
+				denyDeprecatedFields: c.deny,
+			}
+			got := wh.admitPilot(&kube.AdmissionRequest{
+				Kind:      kubeApisMeta.GroupVersionKind{Kind: collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Kind()},
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: []byte(c.object)},
+				Operation: kube.Create,
+			})
+			if c.denial != "" {
+				if got.Allowed || got.Result.Message != c.denial {
+					t.Fatalf("expected the request to be denied with %q, got %v", c.denial, got.Result)
+				}
+				return
+			}
+			if !got.Allowed {
+				t.Fatalf("expected the request to be allowed, got %v", got.Result)
+			}
+			if !reflect.DeepEqual(got.Warnings, c.warnings) {
+				t.Fatalf("expected warnings %v, got %v", c.warnings, got.Warnings)
+			}
+		})
+	}
+}
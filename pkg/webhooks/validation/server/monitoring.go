@@ -16,6 +16,7 @@ package server
 
 import (
 	"strconv"
+	"time"
 
 	"istio.io/istio/pkg/kube"
 	"istio.io/pkg/monitoring"
@@ -27,6 +28,8 @@ const (
 	resourceTag = "resource"
 	reason      = "reason"
 	status      = "status"
+	kind        = "kind"
+	outcome     = "outcome"
 )
 
 var (
@@ -44,6 +47,12 @@ var (
 
 	// StatusTag holds the error code for the context.
 	StatusTag = monitoring.MustCreateLabel(status)
+
+	// KindTag holds the kind of the admitted resource for the context.
+	KindTag = monitoring.MustCreateLabel(kind)
+
+	// OutcomeTag holds whether the admission request was allowed or denied for the context.
+	OutcomeTag = monitoring.MustCreateLabel(outcome)
 )
 
 var (
@@ -62,6 +71,12 @@ var (
 		"Resource validation http serve errors",
 		monitoring.WithLabels(StatusTag),
 	)
+	metricValidationLatency = monitoring.NewDistribution(
+		"galley/validation/latency",
+		"Time in seconds to decode and validate an admission request",
+		[]float64{.001, .005, .01, .05, .1, .5, 1, 5},
+		monitoring.WithLabels(KindTag, OutcomeTag),
+	)
 )
 
 func init() {
@@ -69,6 +84,7 @@ func init() {
 		metricValidationPassed,
 		metricValidationFailed,
 		metricValidationHTTPError,
+		metricValidationLatency,
 	)
 }
 
@@ -95,10 +111,24 @@ func reportValidationHTTPError(status int) {
 		Increment()
 }
 
+func reportValidationLatency(kind string, allowed bool, duration time.Duration) {
+	outcome := "denied"
+	if allowed {
+		outcome = "allowed"
+	}
+	metricValidationLatency.
+		With(KindTag.Value(kind)).
+		With(OutcomeTag.Value(outcome)).
+		Record(duration.Seconds())
+}
+
 const (
 	reasonUnsupportedOperation = "unsupported_operation"
 	reasonYamlDecodeError      = "yaml_decode_error"
 	reasonUnknownType          = "unknown_type"
 	reasonCRDConversionError   = "crd_conversion_error"
 	reasonInvalidConfig        = "invalid_resource"
+	reasonPolicyViolation      = "policy_violation"
+	reasonQuotaExceeded        = "quota_exceeded"
+	reasonDeprecatedField      = "deprecated_field"
 )
@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+// PolicyRule is an organization specific policy, such as "all VirtualServices must set a timeout",
+// which admitted resources must satisfy on top of their schema validation.
+type PolicyRule struct {
+	// Name identifies the rule in the messages returned for failing resources.
+	Name string
+
+	// Expression is evaluated against the admitted resource. By default, it is a CEL expression with the
+	// resource bound to object, for example `object.spec.http.all(r, has(r.timeout))`.
+	// The resource passes the rule if the expression evaluates to true.
+	Expression string
+
+	// WarnOnly returns a warning for failing resources instead of denying them.
+	WarnOnly bool
+}
+
+// PolicyProgram is a compiled PolicyRule expression.
+type PolicyProgram interface {
+	// Eval evaluates the expression against the resource, decoded from its JSON representation.
+	// It returns whether the resource passes the rule.
+	Eval(object map[string]interface{}) (bool, error)
+}
+
+// PolicyCompiler compiles the expressions of PolicyRules. This allows expression languages
+// other than CEL to be used.
+type PolicyCompiler func(expression string) (PolicyProgram, error)
+
+// celObject is the variable the admitted resource is bound to in CEL expressions.
+const celObject = "object"
+
+// celProgram is a PolicyProgram evaluating a CEL expression.
+type celProgram struct {
+	program cel.Program
+}
+
+func (p celProgram) Eval(object map[string]interface{}) (bool, error) {
+	out, _, err := p.program.Eval(map[string]interface{}{celObject: object})
+	if err != nil {
+		return false, err
+	}
+	passed, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %v, not a bool", out.Value())
+	}
+	return passed, nil
+}
+
+// CompileCELPolicy is the default PolicyCompiler, compiling CEL expressions with the admitted resource
+// bound to object. Expressions must evaluate to a bool.
+func CompileCELPolicy(expression string) (PolicyProgram, error) {
+	env, err := cel.NewEnv(cel.Declarations(decls.NewIdent(celObject, decls.NewMapType(decls.String, decls.Dyn), nil)))
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if !proto.Equal(ast.ResultType(), decls.Bool) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+		return nil, errors.New("expression does not evaluate to a bool")
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return celProgram{program: program}, nil
+}
+
+type compiledPolicyRule struct {
+	PolicyRule
+	program PolicyProgram
+}
+
+// compilePolicyRules compiles all rules, with CEL unless another compiler is set, returning an error naming
+// the first rule which does not compile.
+func compilePolicyRules(rules []PolicyRule, compiler PolicyCompiler) ([]compiledPolicyRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if compiler == nil {
+		compiler = CompileCELPolicy
+	}
+	out := make([]compiledPolicyRule, 0, len(rules))
+	for _, rule := range rules {
+		program, err := compiler(rule.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %q does not compile: %v", rule.Name, err)
+		}
+		out = append(out, compiledPolicyRule{PolicyRule: rule, program: program})
+	}
+	return out, nil
+}
+
+// evaluatePolicyRules evaluates the rules against the raw JSON resource. It returns warnings for the
+// failing WarnOnly rules, and an error naming the first failing rule which denies the resource.
+func evaluatePolicyRules(rules []compiledPolicyRule, raw []byte) ([]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, fmt.Errorf("cannot decode configuration: %v", err)
+	}
+	var warnings []string
+	for _, rule := range rules {
+		passed, err := rule.program.Eval(object)
+		if err == nil && passed {
+			continue
+		}
+		msg := fmt.Sprintf("policy rule %q failed", rule.Name)
+		if err != nil {
+			msg = fmt.Sprintf("policy rule %q failed: %v", rule.Name, err)
+		}
+		if !rule.WarnOnly {
+			return warnings, errors.New(msg)
+		}
+		warnings = append(warnings, msg)
+	}
+	return warnings, nil
+}
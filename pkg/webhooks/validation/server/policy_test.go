@@ -0,0 +1,172 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pkg/config/schema/collections"
+	"istio.io/istio/pkg/kube"
+)
+
+// programFunc is a PolicyProgram evaluating a function.
+type programFunc func(object map[string]interface{}) (bool, error)
+
+func (f programFunc) Eval(object map[string]interface{}) (bool, error) {
+	return f(object)
+}
+
+func TestAdmitPilotPolicyRules(t *testing.T) {
+	virtualService := func(timeout string) []byte {
+		route := `{"route": [{"destination": {"host": "reviews"}}]}`
+		if timeout != "" {
+			route = fmt.Sprintf(`{"route": [{"destination": {"host": "reviews"}}], "timeout": %q}`, timeout)
+		}
+		return []byte(fmt.Sprintf(`{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "VirtualService",
+  "metadata": {"name": "reviews", "namespace": "default"},
+  "spec": {"hosts": ["reviews"], "http": [%s]}
+}`, route))
+	}
+	timeoutRule := PolicyRule{Name: "timeout-required", Expression: "object.spec.http.all(r, has(r.timeout))"}
+
+	cases := []struct {
+		name     string
+		warnOnly bool
+		timeout  string
+		allowed  bool
+		message  string
+		warnings []string
+	}{
+		{name: "passing rule", timeout: "5s", allowed: true},
+		{name: "failing rule", allowed: false, message: `policy rule "timeout-required" failed`},
+		{name: "failing warn only rule", warnOnly: true, allowed: true, warnings: []string{`policy rule "timeout-required" failed`}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rule := timeoutRule
+			rule.WarnOnly = c.warnOnly
+			wh, err := New(Options{
+				Schemas:     collections.Pilot,
+				Mux:         http.NewServeMux(),
+				PolicyRules: []PolicyRule{rule},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := wh.admitPilot(&kube.AdmissionRequest{
+				Kind:      kubeApisMeta.GroupVersionKind{Kind: collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Kind()},
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: virtualService(c.timeout)},
+				Operation: kube.Create,
+			})
+			if got.Allowed != c.allowed {
+				t.Fatalf("expected allowed %v, got %v: %v", c.allowed, got.Allowed, got.Result)
+			}
+			if !c.allowed && !strings.Contains(got.Result.Message, c.message) {
+				t.Fatalf("expected message %q, got %q", c.message, got.Result.Message)
+			}
+			if !reflect.DeepEqual(got.Warnings, c.warnings) {
+				t.Fatalf("expected warnings %v, got %v", c.warnings, got.Warnings)
+			}
+		})
+	}
+}
+
+func TestNewPolicyRulesCompileError(t *testing.T) {
+	cases := []struct {
+		name       string
+		expression string
+	}{
+		{"syntax error", "object.spec.http.all(r,"},
+		{"undeclared variable", "spec.hosts.size() > 0"},
+		{"not a bool", "object.spec.hosts.size() > 0 ? 1 : 0"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := New(Options{
+				Mux:         http.NewServeMux(),
+				PolicyRules: []PolicyRule{{Name: "invalid", Expression: c.expression}},
+			})
+			if err == nil || !strings.Contains(err.Error(), `policy rule "invalid" does not compile`) {
+				t.Fatalf("expected a compile error naming the rule, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEvaluatePolicyRules(t *testing.T) {
+	compile := func(expression string) PolicyRule {
+		return PolicyRule{Name: "rule", Expression: expression}
+	}
+	cases := []struct {
+		name    string
+		rule    PolicyRule
+		object  string
+		message string
+	}{
+		{"passing", compile(`object.metadata.name.startsWith("reviews")`), `{"metadata": {"name": "reviews-v1"}}`, ""},
+		{"failing", compile(`object.metadata.name.startsWith("reviews")`), `{"metadata": {"name": "ratings"}}`,
+			`policy rule "rule" failed`},
+		{"missing field", compile(`object.spec.hosts.size() > 0`), `{"metadata": {"name": "reviews"}}`,
+			`policy rule "rule" failed: no such key: spec`},
+		{"not a bool", compile(`object.spec.enabled`), `{"spec": {"enabled": "yes"}}`,
+			`policy rule "rule" failed: expression evaluated to yes, not a bool`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rules, err := compilePolicyRules([]PolicyRule{c.rule}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = evaluatePolicyRules(rules, []byte(c.object))
+			if c.message == "" && err != nil {
+				t.Fatalf("expected the rule to pass, got %v", err)
+			}
+			if c.message != "" && (err == nil || err.Error() != c.message) {
+				t.Fatalf("expected error %q, got %v", c.message, err)
+			}
+		})
+	}
+}
+
+func TestNewPolicyRulesCustomCompiler(t *testing.T) {
+	compiled := []string{}
+	wh, err := New(Options{
+		Mux:         http.NewServeMux(),
+		PolicyRules: []PolicyRule{{Name: "custom", Expression: "always fails"}},
+		PolicyCompiler: func(expression string) (PolicyProgram, error) {
+			compiled = append(compiled, expression)
+			return programFunc(func(map[string]interface{}) (bool, error) { return false, nil }), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(compiled, []string{"always fails"}) {
+		t.Fatalf("expected the expression to be compiled by the custom compiler, got %v", compiled)
+	}
+	if _, err := evaluatePolicyRules(wh.policyRules, []byte("{}")); err == nil {
+		t.Fatal("expected the custom rule to fail")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"istio.io/istio/pkg/config"
+)
+
+// checkNamespaceQuota returns an error if creating the config would exceed the quota of its kind in its
+// namespace. The existing configs are counted with the lister; if they cannot be listed, the config is
+// allowed.
+func checkNamespaceQuota(lister ConfigLister, quotas map[string]int, cfg config.Config) error {
+	limit, f := quotas[cfg.GroupVersionKind.Kind]
+	if !f {
+		return nil
+	}
+	existing, err := lister.List(cfg.GroupVersionKind, cfg.Namespace)
+	if err != nil {
+		scope.Warnf("cannot list %s resources for quota validation: %v", cfg.GroupVersionKind.Kind, err)
+		return nil
+	}
+	if len(existing) >= limit {
+		return fmt.Errorf("namespace %s has %d %s resources, creating %s would exceed the quota of %d",
+			cfg.Namespace, len(existing), cfg.GroupVersionKind.Kind, cfg.Name, limit)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/config/memory"
+	"istio.io/istio/pkg/config"
+	"istio.io/istio/pkg/config/schema/collections"
+	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/kube"
+)
+
+func TestAdmitPilotNamespaceQuota(t *testing.T) {
+	store := memory.Make(collections.Pilot)
+	for _, name := range []string{"a", "b"} {
+		if _, err := store.Create(config.Config{
+			Meta: config.Meta{
+				GroupVersionKind: gvk.VirtualService,
+				Name:             name,
+				Namespace:        "default",
+				Domain:           testDomainSuffix,
+			},
+			Spec: &networking.VirtualService{
+				Hosts: []string{name},
+				Http:  []*networking.HTTPRoute{{Route: []*networking.HTTPRouteDestination{{Destination: &networking.Destination{Host: name}}}}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	virtualService := func(namespace string) []byte {
+		return []byte(fmt.Sprintf(`{
+  "apiVersion": "networking.istio.io/v1alpha3",
+  "kind": "VirtualService",
+  "metadata": {"name": "c", "namespace": %q},
+  "spec": {
+    "hosts": ["c"],
+    "http": [{"route": [{"destination": {"host": "c"}}]}]
+  }
+}`, namespace))
+	}
+
+	cases := []struct {
+		name      string
+		quota     int
+		namespace string
+		operation string
+		denial    string
+	}{
+		{
+			name:      "under quota",
+			quota:     3,
+			namespace: "default",
+			operation: kube.Create,
+		},
+		{
+			name:      "over quota",
+			quota:     2,
+			namespace: "default",
+			operation: kube.Create,
+			denial:    "namespace default has 2 VirtualService resources, creating c would exceed the quota of 2",
+		},
+		{
+			name:      "other namespace",
+			quota:     2,
+			namespace: "other",
+			operation: kube.Create,
+		},
+		{
+			name:      "update",
+			quota:     2,
+			namespace: "default",
+			operation: kube.Update,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wh := &Webhook{
+				schemas:      collections.Pilot,
+				domainSuffix: testDomainSuffix,
+				configLister: store,
+				quotas:       map[string]int{"VirtualService": c.quota},
+			}
+			got := wh.admitPilot(&kube.AdmissionRequest{
+				Kind:      kubeApisMeta.GroupVersionKind{Kind: collections.IstioNetworkingV1Alpha3Virtualservices.Resource().Kind()},
+				Namespace: c.namespace,
+				Object:    runtime.RawExtension{Raw: virtualService(c.namespace)},
+				Operation: c.operation,
+			})
+			if c.denial == "" {
+				if !got.Allowed {
+					t.Fatalf("expected the request to be allowed, got %v", got.Result)
+				}
+				return
+			}
+			if got.Allowed || got.Result.Message != c.denial {
+				t.Fatalf("expected the request to be denied with %q, got %v", c.denial, got.Result)
+			}
+		})
+	}
+}
+
+func TestNewNamespaceQuotaRequiresLister(t *testing.T) {
+	if _, err := New(Options{Mux: http.NewServeMux(), NamespaceQuotas: map[string]int{"VirtualService": 1}}); err == nil {
+		t.Fatalf("expected an error for namespace quotas without a config lister")
+	}
+}
@@ -16,11 +16,15 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
 	kubeApiAdmissionv1 "k8s.io/api/admission/v1"
@@ -77,6 +81,45 @@ type Options struct {
 
 	// Use an existing mux instead of creating our own.
 	Mux *http.ServeMux
+
+	// ConfigLister provides read-only access to the existing configuration. If set, resources are also
+	// validated against it, for example VirtualServices referencing subsets which are not defined by any
+	// DestinationRule. Dangling references are returned as warnings, never as denials.
+	// Istiod does not set it, so cross references are only checked by programs embedding the webhook.
+	ConfigLister ConfigLister
+
+	// PolicyRules are organization specific policies which resources must satisfy. They are compiled
+	// once, as CEL expressions unless a PolicyCompiler is set.
+	// Istiod does not configure any rules; they are only enforced by programs embedding the webhook.
+	PolicyRules    []PolicyRule
+	PolicyCompiler PolicyCompiler
+
+	// NamespaceQuotas limits the number of resources of a kind, e.g. VirtualService, per namespace. Creates
+	// exceeding the quota are denied. The existing resources are counted with the ConfigLister, which is
+	// required if any quotas are set.
+	// Not set by Istiod.
+	NamespaceQuotas map[string]int
+
+	// DeprecatedFields are the deprecated fields resources are checked against. Resources using them are
+	// allowed with a warning naming the field and its replacement, or denied if DenyDeprecatedFields is set.
+	// Not set by Istiod.
+	DeprecatedFields     []DeprecatedField
+	DenyDeprecatedFields bool
+
+	// TLSMinVersion is the minimum TLS version accepted by the server serving the webhook, one of 1.0, 1.1,
+	// 1.2 or 1.3. The Go default is used if empty.
+	TLSMinVersion string
+
+	// TLSCipherSuites are the names of the cipher suites allowed for TLS versions up to 1.2, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the suites without known security issues are supported.
+	// The Go defaults are used if empty.
+	TLSCipherSuites []string
+
+	// ClientCABundle is the PEM encoded bundle of the CAs client certificates are verified against, typically
+	// the one of the Kubernetes API server. If set, validation requests without a valid client certificate are
+	// rejected. The other handlers of the server do not require client certificates.
+	// Client certificates are not requested by default.
+	ClientCABundle []byte
 }
 
 // String produces a stringified version of the arguments for debugging.
@@ -85,6 +128,8 @@ func (o Options) String() string {
 
 	_, _ = fmt.Fprintf(buf, "DomainSuffix: %s\n", o.DomainSuffix)
 	_, _ = fmt.Fprintf(buf, "Port: %d\n", o.Port)
+	_, _ = fmt.Fprintf(buf, "TLSMinVersion: %s\n", o.TLSMinVersion)
+	_, _ = fmt.Fprintf(buf, "TLSCipherSuites: %s\n", strings.Join(o.TLSCipherSuites, ","))
 
 	return buf.String()
 }
@@ -101,6 +146,15 @@ type Webhook struct {
 	// pilot
 	schemas      collection.Schemas
 	domainSuffix string
+	configLister ConfigLister
+	policyRules  []compiledPolicyRule
+	quotas       map[string]int
+
+	deprecatedFields     []DeprecatedField
+	denyDeprecatedFields bool
+
+	// clientCAs verify the client certificates of validation requests, if set.
+	clientCAs *x509.CertPool
 }
 
 // New creates a new instance of the admission webhook server.
@@ -109,8 +163,26 @@ func New(p Options) (*Webhook, error) {
 		scope.Error("mux not set correctly")
 		return nil, errors.New("expected mux to be passed, but was not passed")
 	}
+	policyRules, err := compilePolicyRules(p.PolicyRules, p.PolicyCompiler)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.NamespaceQuotas) > 0 && p.ConfigLister == nil {
+		return nil, errors.New("namespace quotas require a config lister")
+	}
+	clientCAs, err := parseClientCABundle(p.ClientCABundle)
+	if err != nil {
+		return nil, err
+	}
 	wh := &Webhook{
-		schemas: p.Schemas,
+		schemas:      p.Schemas,
+		configLister: p.ConfigLister,
+		policyRules:  policyRules,
+		quotas:       p.NamespaceQuotas,
+
+		deprecatedFields:     p.DeprecatedFields,
+		denyDeprecatedFields: p.DenyDeprecatedFields,
+		clientCAs:            clientCAs,
 	}
 
 	p.Mux.HandleFunc("/validate", wh.serveValidate)
@@ -165,6 +237,8 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 		return
 	}
 
+	// The latency covers decoding and validating the request, once it has been received.
+	start := time.Now()
 	var reviewResponse *kube.AdmissionResponse
 	var obj runtime.Object
 	var ar *kube.AdmissionReview
@@ -178,6 +252,11 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 			reviewResponse = admit(ar.Request)
 		}
 	}
+	var requestKind string
+	if ar != nil && ar.Request != nil {
+		requestKind = ar.Request.Kind.Kind
+	}
+	reportValidationLatency(requestKind, reviewResponse != nil && reviewResponse.Allowed, time.Since(start))
 
 	response := kube.AdmissionReview{}
 	response.Response = reviewResponse
@@ -206,13 +285,51 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 }
 
 func (wh *Webhook) serveAdmitPilot(w http.ResponseWriter, r *http.Request) {
+	if !wh.authorizeClient(w, r) {
+		return
+	}
 	serve(w, r, wh.admitPilot)
 }
 
 func (wh *Webhook) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if !wh.authorizeClient(w, r) {
+		return
+	}
 	serve(w, r, wh.validate)
 }
 
+// authorizeClient verifies the client certificate of the request against the client CAs, if any, and
+// rejects the request if it is missing or invalid. The certificate is requested, but not verified, by the
+// TLS handshake, as the server is shared with other webhooks.
+func (wh *Webhook) authorizeClient(w http.ResponseWriter, r *http.Request) bool {
+	if wh.clientCAs == nil {
+		return true
+	}
+	if err := verifyClientCert(r.TLS, wh.clientCAs); err != nil {
+		scope.Debugf("rejected validation request from %s: %v", r.RemoteAddr, err)
+		reportValidationHTTPError(http.StatusUnauthorized)
+		http.Error(w, "invalid client certificate", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func verifyClientCert(state *tls.ConnectionState, roots *x509.CertPool) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
 func (wh *Webhook) validate(request *kube.AdmissionRequest) *kube.AdmissionResponse {
 	switch request.Kind.Kind {
 	default:
@@ -257,6 +374,12 @@ func (wh *Webhook) admitPilot(request *kube.AdmissionRequest) *kube.AdmissionRes
 		return toAdmissionResponse(fmt.Errorf("error decoding configuration: %v", err))
 	}
 
+	if err := validateEndpointAddresses(*out); err != nil {
+		scope.Infof("configuration is invalid: %v", err)
+		reportValidationFailed(request, reasonInvalidConfig)
+		return toAdmissionResponse(fmt.Errorf("configuration is invalid: %v", err))
+	}
+
 	// TODO expose warnings
 	if _, err := s.Resource().ValidateConfig(*out); err != nil {
 		scope.Infof("configuration is invalid: %v", err)
@@ -269,8 +392,35 @@ func (wh *Webhook) admitPilot(request *kube.AdmissionRequest) *kube.AdmissionRes
 		return toAdmissionResponse(err)
 	}
 
+	warnings, err := evaluatePolicyRules(wh.policyRules, request.Object.Raw)
+	if err != nil {
+		scope.Infof("configuration violates policy: %v", err)
+		reportValidationFailed(request, reasonPolicyViolation)
+		return toAdmissionResponse(err)
+	}
+
+	deprecated, err := checkDeprecatedFields(wh.deprecatedFields, obj.Kind, request.Object.Raw, wh.denyDeprecatedFields)
+	if err != nil {
+		scope.Infof("configuration uses deprecated fields: %v", err)
+		reportValidationFailed(request, reasonDeprecatedField)
+		return toAdmissionResponse(err)
+	}
+	warnings = append(warnings, deprecated...)
+
+	if request.Operation == kube.Create && len(wh.quotas) > 0 {
+		if err := checkNamespaceQuota(wh.configLister, wh.quotas, *out); err != nil {
+			scope.Infof("configuration exceeds quota: %v", err)
+			reportValidationFailed(request, reasonQuotaExceeded)
+			return toAdmissionResponse(err)
+		}
+	}
+
 	reportValidationPass(request)
-	return &kube.AdmissionResponse{Allowed: true}
+	resp := &kube.AdmissionResponse{Allowed: true, Warnings: warnings}
+	if wh.configLister != nil {
+		resp.Warnings = append(resp.Warnings, crossReferenceWarnings(wh.configLister, *out)...)
+	}
+	return resp
 }
 
 func checkFields(raw []byte, kind string, namespace string, name string) (string, error) {
@@ -300,11 +450,102 @@ func validatePort(port int) error {
 	return fmt.Errorf("port number %d must be in the range 1..65535", port)
 }
 
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSMinVersion returns the TLS version with the given name, or 0 if empty.
+func parseTLSMinVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	version, f := tlsVersions[name]
+	if !f {
+		return 0, fmt.Errorf("unsupported TLS min version %q, must be one of 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// parseTLSCipherSuites returns the IDs of the cipher suites with the given names, or nil if empty.
+func parseTLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	supported := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+	var errs *multierror.Error
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, f := supported[strings.TrimSpace(name)]
+		if !f {
+			errs = multierror.Append(errs, fmt.Errorf("unsupported TLS cipher suite %q", name))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, errs.ErrorOrNil()
+}
+
+// parseClientCABundle returns the pool of the CAs of the bundle, or nil if empty.
+func parseClientCABundle(bundle []byte) (*x509.CertPool, error) {
+	if len(bundle) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("client CA bundle contains no valid PEM encoded certificate")
+	}
+	return pool, nil
+}
+
+// ApplyTLSConfig restricts the TLS config of the server serving the webhook to the configured min version
+// and cipher suites, and requests client certificates if there are client CAs. The certificates are verified
+// by the webhook, so the other handlers of the server are not affected. The config is left untouched if the
+// settings are invalid.
+func (o Options) ApplyTLSConfig(config *tls.Config) error {
+	minVersion, err := parseTLSMinVersion(o.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	cipherSuites, err := parseTLSCipherSuites(o.TLSCipherSuites)
+	if err != nil {
+		return err
+	}
+	clientCAs, err := parseClientCABundle(o.ClientCABundle)
+	if err != nil {
+		return err
+	}
+	if minVersion != 0 {
+		config.MinVersion = minVersion
+	}
+	if cipherSuites != nil {
+		config.CipherSuites = cipherSuites
+	}
+	if clientCAs != nil && config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return nil
+}
+
 // Validate tests if the Options has valid params.
 func (o Options) Validate() error {
 	var errs *multierror.Error
 	if err := validatePort(int(o.Port)); err != nil {
 		errs = multierror.Append(errs, err)
 	}
+	if _, err := parseTLSMinVersion(o.TLSMinVersion); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if _, err := parseTLSCipherSuites(o.TLSCipherSuites); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if _, err := parseClientCABundle(o.ClientCABundle); err != nil {
+		errs = multierror.Append(errs, err)
+	}
 	return errs.ErrorOrNil()
 }
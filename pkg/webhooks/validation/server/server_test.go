@@ -16,6 +16,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,11 +24,13 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"go.opencensus.io/stats/view"
 	kubeApiAdmission "k8s.io/api/admission/v1beta1"
 	kubeApisMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -38,6 +41,7 @@ import (
 	"istio.io/istio/pkg/kube"
 	"istio.io/istio/pkg/test/config"
 	"istio.io/istio/pkg/testcerts"
+	pkiutil "istio.io/istio/security/pkg/pki/util"
 )
 
 const (
@@ -382,6 +386,42 @@ func TestServe(t *testing.T) {
 	}
 }
 
+func TestServeLatency(t *testing.T) {
+	count := func(want string) int64 {
+		t.Helper()
+		rows, err := view.RetrieveData("galley/validation/latency")
+		if err != nil {
+			t.Fatalf("failed to retrieve the latency metric: %v", err)
+		}
+		for _, row := range rows {
+			labels := map[string]string{}
+			for _, tag := range row.Tags {
+				labels[tag.Key.Name()] = tag.Value
+			}
+			if labels[kind] == "AdmissionRequest" && labels[outcome] == want {
+				return row.Data.(*view.DistributionData).Count
+			}
+		}
+		return 0
+	}
+
+	for _, allowed := range []bool{true, false} {
+		want := "denied"
+		if allowed {
+			want = "allowed"
+		}
+		before := count(want)
+		req := httptest.NewRequest("POST", "http://validator", bytes.NewReader(makeTestReview(t, true, "v1beta1")))
+		req.Header.Add("Content-Type", "application/json")
+		serve(httptest.NewRecorder(), req, func(*kube.AdmissionRequest) *kube.AdmissionResponse {
+			return &kube.AdmissionResponse{Allowed: allowed}
+		})
+		if got := count(want) - before; got != 1 {
+			t.Fatalf("expected one %s request to be observed, got %d", want, got)
+		}
+	}
+}
+
 // scenario is a common struct used by many tests in this context.
 type scenario struct {
 	wrapFunc      func(*Options)
@@ -398,6 +438,23 @@ func TestValidate(t *testing.T) {
 			wrapFunc:      func(args *Options) { args.Port = 100000 },
 			expectedError: "port number 100000 must be in the range 1..65535",
 		},
+		"valid TLS settings": {
+			wrapFunc: func(args *Options) {
+				args.TLSMinVersion = "1.2"
+				args.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+			},
+			expectedError: "",
+		},
+		"invalid TLS min version": {
+			wrapFunc:      func(args *Options) { args.TLSMinVersion = "1.4" },
+			expectedError: `unsupported TLS min version "1.4"`,
+		},
+		"invalid TLS cipher suites": {
+			wrapFunc: func(args *Options) {
+				args.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}
+			},
+			expectedError: `unsupported TLS cipher suite "TLS_RSA_WITH_RC4_128_SHA"`,
+		},
 	}
 
 	for name, scenario := range scenarios {
@@ -407,6 +464,150 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestApplyTLSConfig(t *testing.T) {
+	args := DefaultArgs()
+	args.TLSMinVersion = "1.2"
+	args.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	config := &tls.Config{}
+	if err := args.ApplyTLSConfig(config); err != nil {
+		t.Fatalf("ApplyTLSConfig() failed: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected min version %x, got %x", tls.VersionTLS12, config.MinVersion)
+	}
+	if !reflect.DeepEqual(config.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("unexpected cipher suites %v", config.CipherSuites)
+	}
+
+	// Invalid settings leave the config untouched.
+	args.TLSMinVersion = "1.3"
+	args.TLSCipherSuites = []string{"not-a-cipher"}
+	if err := args.ApplyTLSConfig(config); err == nil {
+		t.Fatal("expected invalid cipher suites to be rejected")
+	}
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected min version to be unchanged, got %x", config.MinVersion)
+	}
+
+	// Nothing is applied by default.
+	config = &tls.Config{}
+	if err := DefaultArgs().ApplyTLSConfig(config); err != nil {
+		t.Fatalf("ApplyTLSConfig() failed: %v", err)
+	}
+	if config.MinVersion != 0 || config.CipherSuites != nil {
+		t.Errorf("expected default TLS config, got min version %x and cipher suites %v", config.MinVersion, config.CipherSuites)
+	}
+}
+
+// genClientCert returns a CA, and a client certificate signed by it.
+func genClientCert(t *testing.T) ([]byte, tls.Certificate) {
+	t.Helper()
+	caCertPem, caKeyPem, err := pkiutil.GenCertKeyFromOptions(pkiutil.CertOptions{
+		Host:         "client-ca",
+		TTL:          time.Hour,
+		Org:          "istio",
+		IsCA:         true,
+		IsSelfSigned: true,
+		RSAKeySize:   2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := pkiutil.ParsePemEncodedCertificate(caCertPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := pkiutil.ParsePemEncodedKey(caKeyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem, keyPem, err := pkiutil.GenCertKeyFromOptions(pkiutil.CertOptions{
+		Host:       "kube-apiserver",
+		TTL:        time.Hour,
+		SignerCert: caCert,
+		SignerPriv: caKey,
+		IsClient:   true,
+		RSAKeySize: 2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caCertPem, cert
+}
+
+func TestClientCertVerification(t *testing.T) {
+	clientCA, clientCert := genClientCert(t)
+	_, otherClientCert := genClientCert(t)
+
+	serverCert, err := tls.X509KeyPair(testcerts.ServerCert, testcerts.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	// Another handler sharing the server, which must not require client certificates.
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	args := DefaultArgs()
+	args.Mux = mux
+	args.ClientCABundle = clientCA
+	if _, err := New(args); err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	if err := args.ApplyTLSConfig(srv.TLS); err != nil {
+		t.Fatalf("ApplyTLSConfig() failed: %v", err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(path string, certs ...tls.Certificate) int {
+		t.Helper()
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{Certificates: certs, InsecureSkipVerify: true}, // nolint: gosec
+			},
+		}
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Authorized requests without a body are rejected as bad requests, past the client verification.
+	if got := get("/validate", clientCert); got != http.StatusBadRequest {
+		t.Errorf("expected a valid client cert to be accepted, got status %d", got)
+	}
+	if got := get("/validate"); got != http.StatusUnauthorized {
+		t.Errorf("expected a request without client cert to be rejected, got status %d", got)
+	}
+	if got := get("/validate", otherClientCert); got != http.StatusUnauthorized {
+		t.Errorf("expected a client cert signed by another CA to be rejected, got status %d", got)
+	}
+	if got := get("/admitpilot"); got != http.StatusUnauthorized {
+		t.Errorf("expected the legacy handler to require a client cert, got status %d", got)
+	}
+	if got := get("/ready"); got != http.StatusOK {
+		t.Errorf("expected other handlers not to require a client cert, got status %d", got)
+	}
+
+	args.ClientCABundle = []byte("not a certificate")
+	if err := args.Validate(); err == nil || !strings.Contains(err.Error(), "client CA bundle") {
+		t.Errorf("expected an invalid client CA bundle to be rejected, got %v", err)
+	}
+	args.Mux = http.NewServeMux()
+	if _, err := New(args); err == nil {
+		t.Error("expected New() to reject an invalid client CA bundle")
+	}
+}
+
 func runTestCode(name string, t *testing.T, test scenario) {
 	args := DefaultArgs()
 